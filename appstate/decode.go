@@ -8,6 +8,7 @@ package appstate
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
@@ -116,10 +117,10 @@ type patchOutput struct {
 	Mutations   []Mutation
 }
 
-func (proc *Processor) decodeMutations(mutations []*waProto.SyncdMutation, out *patchOutput, validateMACs bool) error {
+func (proc *Processor) decodeMutations(ctx context.Context, mutations []*waProto.SyncdMutation, out *patchOutput, validateMACs bool) error {
 	for i, mutation := range mutations {
 		keyID := mutation.GetRecord().GetKeyId().GetId()
-		keys, err := proc.getAppStateKey(keyID)
+		keys, err := proc.getAppStateKey(ctx, keyID)
 		if err != nil {
 			return fmt.Errorf("failed to get key %X to decode mutation: %w", keyID, err)
 		}
@@ -172,23 +173,23 @@ func (proc *Processor) decodeMutations(mutations []*waProto.SyncdMutation, out *
 	return nil
 }
 
-func (proc *Processor) storeMACs(name WAPatchName, currentState HashState, out *patchOutput) {
-	err := proc.Store.AppState.PutAppStateVersion(string(name), currentState.Version, currentState.Hash)
+func (proc *Processor) storeMACs(ctx context.Context, name WAPatchName, currentState HashState, out *patchOutput) {
+	err := proc.Store.AppState.PutAppStateVersionContext(ctx, string(name), currentState.Version, currentState.Hash)
 	if err != nil {
 		proc.Log.Errorf("Failed to update app state version in the database: %v", err)
 	}
-	err = proc.Store.AppState.DeleteAppStateMutationMACs(string(name), out.RemovedMACs)
+	err = proc.Store.AppState.DeleteAppStateMutationMACsContext(ctx, string(name), out.RemovedMACs)
 	if err != nil {
 		proc.Log.Errorf("Failed to remove deleted mutation MACs from the database: %v", err)
 	}
-	err = proc.Store.AppState.PutAppStateMutationMACs(string(name), currentState.Version, out.AddedMACs)
+	err = proc.Store.AppState.PutAppStateMutationMACsContext(ctx, string(name), currentState.Version, out.AddedMACs)
 	if err != nil {
 		proc.Log.Errorf("Failed to insert added mutation MACs to the database: %v", err)
 	}
 }
 
-func (proc *Processor) validateSnapshotMAC(name WAPatchName, currentState HashState, keyID, expectedSnapshotMAC []byte) (keys ExpandedAppStateKeys, err error) {
-	keys, err = proc.getAppStateKey(keyID)
+func (proc *Processor) validateSnapshotMAC(ctx context.Context, name WAPatchName, currentState HashState, keyID, expectedSnapshotMAC []byte) (keys ExpandedAppStateKeys, err error) {
+	keys, err = proc.getAppStateKey(ctx, keyID)
 	if err != nil {
 		err = fmt.Errorf("failed to get key %X to verify patch v%d MACs: %w", keyID, currentState.Version, err)
 		return
@@ -200,7 +201,7 @@ func (proc *Processor) validateSnapshotMAC(name WAPatchName, currentState HashSt
 	return
 }
 
-func (proc *Processor) decodeSnapshot(name WAPatchName, ss *waProto.SyncdSnapshot, initialState HashState, validateMACs bool, newMutationsInput []Mutation) (newMutations []Mutation, currentState HashState, err error) {
+func (proc *Processor) decodeSnapshot(ctx context.Context, name WAPatchName, ss *waProto.SyncdSnapshot, initialState HashState, validateMACs bool, newMutationsInput []Mutation) (newMutations []Mutation, currentState HashState, err error) {
 	currentState = initialState
 	currentState.Version = ss.GetVersion().GetVersion()
 
@@ -225,7 +226,7 @@ func (proc *Processor) decodeSnapshot(name WAPatchName, ss *waProto.SyncdSnapsho
 	}
 
 	if validateMACs {
-		_, err = proc.validateSnapshotMAC(name, currentState, ss.GetKeyId().GetId(), ss.GetMac())
+		_, err = proc.validateSnapshotMAC(ctx, name, currentState, ss.GetKeyId().GetId(), ss.GetMac())
 		if err != nil {
 			return
 		}
@@ -233,18 +234,23 @@ func (proc *Processor) decodeSnapshot(name WAPatchName, ss *waProto.SyncdSnapsho
 
 	var out patchOutput
 	out.Mutations = newMutationsInput
-	err = proc.decodeMutations(encryptedMutations, &out, validateMACs)
+	err = proc.decodeMutations(ctx, encryptedMutations, &out, validateMACs)
 	if err != nil {
 		err = fmt.Errorf("failed to decode snapshot of v%d: %w", currentState.Version, err)
 		return
 	}
-	proc.storeMACs(name, currentState, &out)
+	proc.storeMACs(ctx, name, currentState, &out)
 	newMutations = out.Mutations
 	return
 }
 
 // DecodePatches will decode all the patches in a PatchList into a list of app state mutations.
 func (proc *Processor) DecodePatches(list *PatchList, initialState HashState, validateMACs bool) (newMutations []Mutation, currentState HashState, err error) {
+	return proc.DecodePatchesContext(context.Background(), list, initialState, validateMACs)
+}
+
+// DecodePatchesContext is a variant of DecodePatches that passes the given context to the store.
+func (proc *Processor) DecodePatchesContext(ctx context.Context, list *PatchList, initialState HashState, validateMACs bool) (newMutations []Mutation, currentState HashState, err error) {
 	currentState = initialState
 	var expectedLength int
 	if list.Snapshot != nil {
@@ -256,7 +262,7 @@ func (proc *Processor) DecodePatches(list *PatchList, initialState HashState, va
 	newMutations = make([]Mutation, 0, expectedLength)
 
 	if list.Snapshot != nil {
-		newMutations, currentState, err = proc.decodeSnapshot(list.Name, list.Snapshot, currentState, validateMACs, newMutations)
+		newMutations, currentState, err = proc.decodeSnapshot(ctx, list.Name, list.Snapshot, currentState, validateMACs, newMutations)
 		if err != nil {
 			return
 		}
@@ -274,7 +280,7 @@ func (proc *Processor) DecodePatches(list *PatchList, initialState HashState, va
 				}
 			}
 			// Previous value not found in current patch, look in the database
-			return proc.Store.AppState.GetAppStateMutationMAC(string(list.Name), indexMAC)
+			return proc.Store.AppState.GetAppStateMutationMACContext(ctx, string(list.Name), indexMAC)
 		})
 		if len(warn) > 0 {
 			proc.Log.Warnf("Warnings while updating hash for %s: %+v", list.Name, warn)
@@ -286,7 +292,7 @@ func (proc *Processor) DecodePatches(list *PatchList, initialState HashState, va
 
 		if validateMACs {
 			var keys ExpandedAppStateKeys
-			keys, err = proc.validateSnapshotMAC(list.Name, currentState, patch.GetKeyId().GetId(), patch.GetSnapshotMac())
+			keys, err = proc.validateSnapshotMAC(ctx, list.Name, currentState, patch.GetKeyId().GetId(), patch.GetSnapshotMac())
 			if err != nil {
 				return
 			}
@@ -299,11 +305,11 @@ func (proc *Processor) DecodePatches(list *PatchList, initialState HashState, va
 
 		var out patchOutput
 		out.Mutations = newMutations
-		err = proc.decodeMutations(patch.GetMutations(), &out, validateMACs)
+		err = proc.decodeMutations(ctx, patch.GetMutations(), &out, validateMACs)
 		if err != nil {
 			return
 		}
-		proc.storeMACs(list.Name, currentState, &out)
+		proc.storeMACs(ctx, list.Name, currentState, &out)
 		newMutations = out.Mutations
 	}
 	return
@@ -1,6 +1,7 @@
 package appstate
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
@@ -124,7 +125,12 @@ func BuildArchive(target types.JID, archive bool, lastMessageTimestamp time.Time
 }
 
 func (proc *Processor) EncodePatch(keyID []byte, state HashState, patchInfo PatchInfo) ([]byte, error) {
-	keys, err := proc.getAppStateKey(keyID)
+	return proc.EncodePatchContext(context.Background(), keyID, state, patchInfo)
+}
+
+// EncodePatchContext is a variant of EncodePatch that passes the given context to the store.
+func (proc *Processor) EncodePatchContext(ctx context.Context, keyID []byte, state HashState, patchInfo PatchInfo) ([]byte, error) {
+	keys, err := proc.getAppStateKey(ctx, keyID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get app state key details with key ID %x: %w", keyID, err)
 	}
@@ -173,7 +179,7 @@ func (proc *Processor) EncodePatch(keyID []byte, state HashState, patchInfo Patc
 	}
 
 	warn, err := state.updateHash(mutations, func(indexMAC []byte, _ int) ([]byte, error) {
-		return proc.Store.AppState.GetAppStateMutationMAC(string(patchInfo.Type), indexMAC)
+		return proc.Store.AppState.GetAppStateMutationMACContext(ctx, string(patchInfo.Type), indexMAC)
 	})
 	if len(warn) > 0 {
 		proc.Log.Warnf("Warnings while updating hash for %s (sending new app state): %+v", patchInfo.Type, warn)
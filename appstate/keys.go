@@ -8,6 +8,7 @@
 package appstate
 
 import (
+	"context"
 	"encoding/base64"
 	"sync"
 
@@ -79,7 +80,7 @@ func expandAppStateKeys(keyData []byte) (keys ExpandedAppStateKeys) {
 	return ExpandedAppStateKeys{appStateKeyExpanded[0:32], appStateKeyExpanded[32:64], appStateKeyExpanded[64:96], appStateKeyExpanded[96:128], appStateKeyExpanded[128:160]}
 }
 
-func (proc *Processor) getAppStateKey(keyID []byte) (keys ExpandedAppStateKeys, err error) {
+func (proc *Processor) getAppStateKey(ctx context.Context, keyID []byte) (keys ExpandedAppStateKeys, err error) {
 	keyCacheID := base64.RawStdEncoding.EncodeToString(keyID)
 	var ok bool
 
@@ -89,7 +90,7 @@ func (proc *Processor) getAppStateKey(keyID []byte) (keys ExpandedAppStateKeys,
 	keys, ok = proc.keyCache[keyCacheID]
 	if !ok {
 		var keyData *store.AppStateSyncKey
-		keyData, err = proc.Store.AppStateKeys.GetAppStateSyncKey(keyID)
+		keyData, err = proc.Store.AppStateKeys.GetAppStateSyncKeyContext(ctx, keyID)
 		if keyData != nil {
 			keys = expandAppStateKeys(keyData.Data)
 			proc.keyCache[keyCacheID] = keys
@@ -100,7 +101,13 @@ func (proc *Processor) getAppStateKey(keyID []byte) (keys ExpandedAppStateKeys,
 	return
 }
 
+// GetMissingKeyIDs returns the IDs of the app state keys used in the given patch list that aren't in the store.
 func (proc *Processor) GetMissingKeyIDs(pl *PatchList) [][]byte {
+	return proc.GetMissingKeyIDsContext(context.Background(), pl)
+}
+
+// GetMissingKeyIDsContext is a variant of GetMissingKeyIDs that passes the given context to the store.
+func (proc *Processor) GetMissingKeyIDsContext(ctx context.Context, pl *PatchList) [][]byte {
 	cache := make(map[string]bool)
 	var missingKeys [][]byte
 	checkMissing := func(keyID []byte) {
@@ -110,7 +117,7 @@ func (proc *Processor) GetMissingKeyIDs(pl *PatchList) [][]byte {
 		stringKeyID := base64.RawStdEncoding.EncodeToString(keyID)
 		_, alreadyAdded := cache[stringKeyID]
 		if !alreadyAdded {
-			keyData, err := proc.Store.AppStateKeys.GetAppStateSyncKey(keyID)
+			keyData, err := proc.Store.AppStateKeys.GetAppStateSyncKeyContext(ctx, keyID)
 			if err != nil {
 				proc.Log.Warnf("Error fetching key %X while checking if it's missing: %v", keyID, err)
 			}
@@ -10,3 +10,9 @@ var (
 	ErrInvalidToken   = errors.New("invalid token with tag")
 	ErrNonStringKey   = errors.New("non-string key")
 )
+
+// Errors returned by ParseXML.
+var (
+	ErrInvalidXML   = errors.New("invalid XML")
+	ErrTruncatedXML = errors.New("XML contains truncated byte content")
+)
@@ -0,0 +1,178 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package binary
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+type jsonNode struct {
+	Tag     string                     `json:"tag"`
+	Attrs   map[string]json.RawMessage `json:"attrs,omitempty"`
+	Content json.RawMessage            `json:"content,omitempty"`
+}
+
+type jsonTypedValue struct {
+	JID    *string `json:"jid,omitempty"`
+	Bytes  *[]byte `json:"bytes,omitempty"`
+	String *string `json:"string,omitempty"`
+}
+
+// stringifyValue converts scalar values the same way the binary encoder does.
+func stringifyValue(value interface{}) (string, bool) {
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue, true
+	case int:
+		return strconv.Itoa(typedValue), true
+	case int32:
+		return strconv.FormatInt(int64(typedValue), 10), true
+	case uint:
+		return strconv.FormatUint(uint64(typedValue), 10), true
+	case uint32:
+		return strconv.FormatUint(uint64(typedValue), 10), true
+	case int64:
+		return strconv.FormatInt(typedValue, 10), true
+	case uint64:
+		return strconv.FormatUint(typedValue, 10), true
+	case bool:
+		return strconv.FormatBool(typedValue), true
+	default:
+		return "", false
+	}
+}
+
+func marshalJSONJID(jid types.JID) (json.RawMessage, error) {
+	str := jid.String()
+	return json.Marshal(jsonTypedValue{JID: &str})
+}
+
+// MarshalJSON implements json.Marshaler. The JSON encoding of a Node is a stable format meant to be readable outside
+// of Go too. Each node is an object with the following fields:
+//
+//	{
+//	  "tag": "iq",
+//	  "attrs": {"id": "1234", "to": {"jid": "s.whatsapp.net"}},
+//	  "content": [{"tag": "query"}]
+//	}
+//
+// The tag is always present. The attrs object is omitted if the node has no attributes. Each attribute value is
+// either a JSON string for string attributes, or an object with a single "jid" field containing the string form of
+// the JID (e.g. "123456789:1@s.whatsapp.net") for JID attributes. Numeric and boolean attribute values are encoded
+// as strings, because that's how they're sent over the wire.
+//
+// The content field is omitted if the node has no content. Otherwise, it's one of:
+//   - an array of nodes (which may be empty) for child elements.
+//   - an object with a single "bytes" field containing the content as standard base64 for byte content.
+//   - an object with a single "string" field for string content.
+//   - an object with a single "jid" field for JID content.
+func (n Node) MarshalJSON() ([]byte, error) {
+	out := jsonNode{Tag: n.Tag}
+	var err error
+	if len(n.Attrs) > 0 {
+		out.Attrs = make(map[string]json.RawMessage, len(n.Attrs))
+		for key, value := range n.Attrs {
+			if jid, ok := value.(types.JID); ok {
+				out.Attrs[key], err = marshalJSONJID(jid)
+			} else if str, ok := stringifyValue(value); ok {
+				out.Attrs[key], err = json.Marshal(str)
+			} else {
+				err = fmt.Errorf("%w: %T in attribute %s", ErrInvalidType, value, key)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	switch content := n.Content.(type) {
+	case nil:
+	case []Node:
+		if content == nil {
+			content = []Node{}
+		}
+		out.Content, err = json.Marshal(content)
+	case []byte:
+		out.Content, err = json.Marshal(jsonTypedValue{Bytes: &content})
+	case types.JID:
+		out.Content, err = marshalJSONJID(content)
+	default:
+		str, ok := stringifyValue(content)
+		if !ok {
+			return nil, fmt.Errorf("%w: %T in content of %s", ErrInvalidType, content, n.Tag)
+		}
+		out.Content, err = json.Marshal(jsonTypedValue{String: &str})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&out)
+}
+
+func (tv *jsonTypedValue) parse() (interface{}, error) {
+	switch {
+	case tv.JID != nil && tv.Bytes == nil && tv.String == nil:
+		return types.ParseJID(*tv.JID)
+	case tv.Bytes != nil && tv.JID == nil && tv.String == nil:
+		if *tv.Bytes == nil {
+			return []byte{}, nil
+		}
+		return *tv.Bytes, nil
+	case tv.String != nil && tv.JID == nil && tv.Bytes == nil:
+		return *tv.String, nil
+	default:
+		return nil, fmt.Errorf("typed value must have exactly one of jid, bytes or string")
+	}
+}
+
+// UnmarshalJSON implements json.Unmarshaler, parsing the encoding described in MarshalJSON.
+func (n *Node) UnmarshalJSON(data []byte) error {
+	var in jsonNode
+	err := json.Unmarshal(data, &in)
+	if err != nil {
+		return err
+	}
+	out := Node{Tag: in.Tag}
+	if len(in.Attrs) > 0 {
+		out.Attrs = make(Attrs, len(in.Attrs))
+		for key, rawValue := range in.Attrs {
+			var str string
+			var tv jsonTypedValue
+			if json.Unmarshal(rawValue, &str) == nil {
+				out.Attrs[key] = str
+			} else if err = json.Unmarshal(rawValue, &tv); err != nil {
+				return fmt.Errorf("invalid value for attribute %s: %w", key, err)
+			} else if tv.JID == nil || tv.Bytes != nil || tv.String != nil {
+				return fmt.Errorf("invalid value for attribute %s: must be a string or an object with a jid field", key)
+			} else if out.Attrs[key], err = types.ParseJID(*tv.JID); err != nil {
+				return fmt.Errorf("invalid JID in attribute %s: %w", key, err)
+			}
+		}
+	}
+	rawContent := bytes.TrimSpace(in.Content)
+	if len(rawContent) > 0 && !bytes.Equal(rawContent, []byte("null")) {
+		if rawContent[0] == '[' {
+			children := []Node{}
+			err = json.Unmarshal(rawContent, &children)
+			out.Content = children
+		} else {
+			var tv jsonTypedValue
+			if err = json.Unmarshal(rawContent, &tv); err == nil {
+				out.Content, err = tv.parse()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid content in %s: %w", in.Tag, err)
+		}
+	}
+	*n = out
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package binary
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestNodeJSON_RoundTrip(t *testing.T) {
+	nodes := append([]Node{
+		{Tag: "list", Content: []Node{}},
+		{Tag: "status", Content: "text content"},
+		{Tag: "jid", Content: types.NewJID("1234567890", types.DefaultUserServer)},
+	}, xmlTestNodes...)
+	for _, node := range nodes {
+		data, err := json.Marshal(node)
+		if err != nil {
+			t.Fatalf("Failed to marshal %s: %v", node.XMLString(), err)
+		}
+		var parsed Node
+		err = json.Unmarshal(data, &parsed)
+		if err != nil {
+			t.Errorf("Failed to unmarshal %s: %v", data, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, node) {
+			t.Errorf("Unmarshaled node doesn't match original:\noriginal: %#v\nparsed:   %#v", node, parsed)
+		}
+	}
+}
+
+func TestNodeJSON_Format(t *testing.T) {
+	node := Node{
+		Tag:   "iq",
+		Attrs: Attrs{"to": types.ServerJID, "id": 123},
+		Content: []Node{
+			{Tag: "enc", Content: []byte{0x01, 0x02, 0x03}},
+			{Tag: "count"},
+		},
+	}
+	data, err := json.Marshal(&node)
+	if err != nil {
+		t.Fatalf("Failed to marshal node: %v", err)
+	}
+	expected := `{"tag":"iq","attrs":{"id":"123","to":{"jid":"s.whatsapp.net"}},"content":[{"tag":"enc","content":{"bytes":"AQID"}},{"tag":"count"}]}`
+	if string(data) != expected {
+		t.Errorf("Unexpected JSON:\nexpected: %s\ngot:      %s", expected, data)
+	}
+}
+
+func TestNodeJSON_Invalid(t *testing.T) {
+	for _, invalid := range []string{
+		`{"tag":"iq","attrs":{"to":123}}`,
+		`{"tag":"iq","attrs":{"to":{"bytes":"AQID"}}}`,
+		`{"tag":"iq","attrs":{"to":{"jid":"1234:abc@s.whatsapp.net"}}}`,
+		`{"tag":"iq","content":"AQID"}`,
+		`{"tag":"iq","content":{"bytes":"AQID","string":"a"}}`,
+		`{"tag":"iq","content":{}}`,
+	} {
+		var node Node
+		if err := json.Unmarshal([]byte(invalid), &node); err == nil {
+			t.Errorf("Expected error when unmarshaling %s, got %#v", invalid, node)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package binary
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// ParseXML parses the output of Node.XMLString back into a Node.
+//
+// XMLString doesn't escape anything and doesn't include type information, so the following rules are used:
+//   - Attribute values that are valid JIDs containing an @ are parsed as types.JID, as are the bare server JIDs
+//     s.whatsapp.net and g.us. All other attribute values are strings.
+//   - Content that is a lowercase hex string is decoded into bytes if the decoded bytes aren't printable text,
+//     because XMLString only uses hex for non-printable bytes. Other text content is used as-is as byte content.
+//   - Byte content that was too long to print (<!-- N bytes -->) can't be recovered and returns ErrTruncatedXML.
+//
+// Whitespace between elements is ignored, so indented output (IndentXML) can be parsed too, except that
+// indented multi-line text content will include the indentation.
+func ParseXML(data string) (*Node, error) {
+	p := &xmlParser{data: data}
+	p.skipSpace()
+	node, err := p.parseNode()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.data) {
+		return nil, p.errorf("unexpected data after root element")
+	}
+	return node, nil
+}
+
+type xmlParser struct {
+	data string
+	pos  int
+}
+
+func (p *xmlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w at position %d: %s", ErrInvalidXML, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *xmlParser) skipSpace() bool {
+	start := p.pos
+	for p.pos < len(p.data) && strings.IndexByte(" \t\r\n", p.data[p.pos]) >= 0 {
+		p.pos++
+	}
+	return p.pos > start
+}
+
+func (p *xmlParser) consume(prefix string) bool {
+	if strings.HasPrefix(p.data[p.pos:], prefix) {
+		p.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+func (p *xmlParser) readName() string {
+	start := p.pos
+	for p.pos < len(p.data) && strings.IndexByte(" \t\r\n<>/=\"", p.data[p.pos]) < 0 {
+		p.pos++
+	}
+	return p.data[start:p.pos]
+}
+
+func (p *xmlParser) parseNode() (*Node, error) {
+	if !p.consume("<") {
+		return nil, p.errorf("expected start of element")
+	}
+	node := &Node{Tag: p.readName()}
+	if node.Tag == "" {
+		return nil, p.errorf("missing element name")
+	}
+	for {
+		hadSpace := p.skipSpace()
+		if p.consume("/>") {
+			return node, nil
+		} else if p.consume(">") {
+			break
+		} else if !hadSpace {
+			return nil, p.errorf("expected whitespace before attribute")
+		}
+		key := p.readName()
+		if key == "" {
+			return nil, p.errorf("missing attribute name")
+		} else if !p.consume(`="`) {
+			return nil, p.errorf("expected quoted value for attribute %s", key)
+		}
+		end := strings.IndexByte(p.data[p.pos:], '"')
+		if end < 0 {
+			return nil, p.errorf("unterminated value for attribute %s", key)
+		}
+		if node.Attrs == nil {
+			node.Attrs = make(Attrs)
+		}
+		node.Attrs[key] = parseXMLAttrValue(p.data[p.pos : p.pos+end])
+		p.pos += end + 1
+	}
+	closeTag := "</" + node.Tag + ">"
+	contentStart := p.pos
+	p.skipSpace()
+	if strings.HasPrefix(p.data[p.pos:], "<") && !strings.HasPrefix(p.data[p.pos:], "</") && !strings.HasPrefix(p.data[p.pos:], "<!--") {
+		children, err := p.parseChildren(closeTag)
+		if err == nil {
+			node.Content = children
+			return node, nil
+		}
+		// Text content that happens to start with < isn't escaped, so try parsing it as text instead
+		p.pos = contentStart
+	} else {
+		p.pos = contentStart
+	}
+	end := strings.Index(p.data[p.pos:], closeTag)
+	if end < 0 {
+		return nil, p.errorf("missing end tag for %s", node.Tag)
+	}
+	content, err := parseXMLContent(p.data[p.pos : p.pos+end])
+	if err != nil {
+		return nil, err
+	}
+	node.Content = content
+	p.pos += end + len(closeTag)
+	return node, nil
+}
+
+func (p *xmlParser) parseChildren(closeTag string) ([]Node, error) {
+	var children []Node
+	for {
+		child, err := p.parseNode()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, *child)
+		p.skipSpace()
+		if p.consume(closeTag) {
+			return children, nil
+		}
+	}
+}
+
+func parseXMLAttrValue(value string) interface{} {
+	if strings.ContainsRune(value, '@') || value == types.DefaultUserServer || value == types.GroupServer {
+		jid, err := types.ParseJID(value)
+		if err == nil && jid.String() == value {
+			return jid
+		}
+	}
+	return value
+}
+
+var truncatedContentRegex = regexp.MustCompile(`^<!-- (\d+) bytes -->$`)
+
+func isLowerHex(data string) bool {
+	if len(data) == 0 || len(data)%2 != 0 {
+		return false
+	}
+	for _, c := range data {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func parseXMLContent(text string) ([]byte, error) {
+	if match := truncatedContentRegex.FindStringSubmatch(text); match != nil {
+		return nil, fmt.Errorf("%w (%s bytes)", ErrTruncatedXML, match[1])
+	}
+	hexData := text
+	if strings.ContainsRune(text, '\n') {
+		// IndentXML splits long hex content into multiple indented lines
+		hexData = strings.Join(strings.Fields(text), "")
+	}
+	if isLowerHex(hexData) {
+		decoded, err := hex.DecodeString(hexData)
+		if err == nil && len(printable(decoded)) == 0 {
+			return decoded, nil
+		}
+	}
+	return []byte(text), nil
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package binary
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+var xmlTestNodes = []Node{
+	{Tag: "presence", Attrs: Attrs{"type": "available", "name": "Tulir"}},
+	{
+		Tag: "iq",
+		Attrs: Attrs{
+			"id":    "1234.5678-9",
+			"to":    types.ServerJID,
+			"type":  "get",
+			"xmlns": "encrypt",
+		},
+		Content: []Node{{Tag: "count"}},
+	},
+	{
+		Tag: "iq",
+		Attrs: Attrs{
+			"id":    "1234.5678-10",
+			"to":    types.NewJID("123456789-1234567890", types.GroupServer),
+			"type":  "get",
+			"xmlns": "w:g2",
+		},
+		Content: []Node{{Tag: "query", Attrs: Attrs{"request": "interactive"}}},
+	},
+	{
+		Tag: "message",
+		Attrs: Attrs{
+			"from":        types.NewJID("123456789-1234567890", types.GroupServer),
+			"participant": types.NewADJID("1234567890", 0, 12),
+			"id":          "3EB0123456789ABCDEF0",
+			"t":           "1700000000",
+			"type":        "text",
+			"notify":      "Name with spaces & symbols <3",
+		},
+		Content: []Node{
+			{Tag: "enc", Attrs: Attrs{"v": "2", "type": "skmsg"}, Content: []byte{0x33, 0x0a, 0x00, 0xff, 0x10, 0x20}},
+			{Tag: "body", Content: []byte("Hello, world! <b>not a tag</b>")},
+		},
+	},
+	{
+		Tag:   "notification",
+		Attrs: Attrs{"from": types.NewJID("status", types.BroadcastServer), "type": "w:gp2"},
+		Content: []Node{{
+			Tag: "item",
+			Content: []Node{
+				{Tag: "empty", Content: []byte{}},
+				{Tag: "type", Content: []byte{0x05}},
+				{Tag: "multiline", Content: []byte("line1\nline2")},
+				{Tag: "lid", Attrs: Attrs{"jid": types.NewJID("987654321", types.HiddenUserServer)}},
+			},
+		}},
+	},
+	{Tag: "receipt", Attrs: Attrs{"id": "ABCD", "from": types.NewADJID("1234567890", 0, 3), "recipient": types.NewJID("1234567890", types.DefaultUserServer)}},
+}
+
+func TestParseXML_RoundTrip(t *testing.T) {
+	for _, node := range xmlTestNodes {
+		xml := node.XMLString()
+		parsed, err := ParseXML(xml)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %v", xml, err)
+			continue
+		}
+		if !reflect.DeepEqual(*parsed, node) {
+			t.Errorf("Parsed node doesn't match original:\noriginal: %#v\nparsed:   %#v", node, *parsed)
+		}
+		if parsedXML := parsed.XMLString(); parsedXML != xml {
+			t.Errorf("XML of parsed node doesn't match:\noriginal: %s\nparsed:   %s", xml, parsedXML)
+		}
+	}
+}
+
+func TestParseXML_MarshalRoundTrip(t *testing.T) {
+	for _, node := range xmlTestNodes {
+		data, err := Marshal(node)
+		if err != nil {
+			t.Fatalf("Failed to marshal %s: %v", node.XMLString(), err)
+		}
+		decoded, err := Unmarshal(data[1:])
+		if err != nil {
+			t.Fatalf("Failed to unmarshal %s: %v", node.XMLString(), err)
+		}
+		parsed, err := ParseXML(decoded.XMLString())
+		if err != nil {
+			t.Errorf("Failed to parse %s: %v", decoded.XMLString(), err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, decoded) {
+			t.Errorf("Parsed node doesn't match unmarshaled node:\nunmarshaled: %#v\nparsed:      %#v", decoded, parsed)
+		}
+		reencoded, err := Marshal(*parsed)
+		if err != nil {
+			t.Fatalf("Failed to marshal parsed node: %v", err)
+		}
+		redecoded, err := Unmarshal(reencoded[1:])
+		if err != nil {
+			t.Fatalf("Failed to unmarshal parsed node: %v", err)
+		}
+		if !reflect.DeepEqual(redecoded, decoded) {
+			t.Errorf("Re-encoded node doesn't match:\noriginal:   %#v\nre-encoded: %#v", decoded, redecoded)
+		}
+	}
+}
+
+func TestParseXML_Indented(t *testing.T) {
+	IndentXML = true
+	defer func() {
+		IndentXML = false
+	}()
+	node := Node{
+		Tag:   "iq",
+		Attrs: Attrs{"id": "1", "type": "set"},
+		Content: []Node{
+			{Tag: "list", Content: []Node{{Tag: "key"}, {Tag: "key"}}},
+			{Tag: "data", Content: bytes.Repeat([]byte{0x01, 0xfe}, 60)},
+		},
+	}
+	parsed, err := ParseXML(node.XMLString())
+	if err != nil {
+		t.Fatalf("Failed to parse indented XML: %v", err)
+	}
+	if !reflect.DeepEqual(*parsed, node) {
+		t.Errorf("Parsed node doesn't match original:\noriginal: %#v\nparsed:   %#v", node, *parsed)
+	}
+}
+
+func TestParseXML_Errors(t *testing.T) {
+	node := Node{Tag: "enc", Content: bytes.Repeat([]byte{0xff}, MaxBytesToPrintAsHex+1)}
+	if _, err := ParseXML(node.XMLString()); !errors.Is(err, ErrTruncatedXML) {
+		t.Errorf("Expected ErrTruncatedXML for truncated content, got %v", err)
+	}
+	for _, invalid := range []string{
+		"",
+		"text",
+		"<iq",
+		`<iq id="1>`,
+		`<iq id=1/>`,
+		"<iq><query/>",
+		"<iq></query>",
+		"<iq/><iq/>",
+	} {
+		if _, err := ParseXML(invalid); !errors.Is(err, ErrInvalidXML) {
+			t.Errorf("Expected ErrInvalidXML for %q, got %v", invalid, err)
+		}
+	}
+}
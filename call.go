@@ -7,12 +7,14 @@
 package whatsmeow
 
 import (
+	"context"
+
 	waBinary "go.mau.fi/whatsmeow/binary"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
 )
 
-func (cli *Client) handleCallEvent(node *waBinary.Node) {
+func (cli *Client) handleCallEvent(ctx context.Context, node *waBinary.Node) {
 	go cli.sendAck(node)
 
 	if len(node.GetChildren()) != 1 {
@@ -0,0 +1,172 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+)
+
+// CaptureDirection is the direction of a captured node.
+type CaptureDirection string
+
+const (
+	// CaptureReceived is used for nodes received from the server.
+	CaptureReceived CaptureDirection = "recv"
+	// CaptureSent is used for nodes sent to the server.
+	CaptureSent CaptureDirection = "send"
+)
+
+// CapturedNode is a single decrypted node in a capture file.
+//
+// Capture files contain one JSON object per line, with the fields time (RFC 3339 timestamp with nanoseconds),
+// dir (recv or send) and data (the node in WhatsApp's binary XML format, base64-encoded).
+type CapturedNode struct {
+	Time      time.Time        `json:"time"`
+	Direction CaptureDirection `json:"dir"`
+	// Data is the uncompressed binary node, i.e. the input for binary.Unmarshal.
+	Data []byte `json:"data"`
+}
+
+// Node decodes the captured binary node.
+func (cn *CapturedNode) Node() (*waBinary.Node, error) {
+	return waBinary.Unmarshal(cn.Data)
+}
+
+// FrameRecorder writes all nodes sent and received by a client into a capture file.
+// Use Client.SetFrameRecorder to enable recording.
+//
+// Captures contain the decrypted nodes, which include things like message secrets
+// and prekeys, so they should be handled as carefully as the device store itself.
+type FrameRecorder struct {
+	lock   sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+// NewFrameRecorder creates a recorder that writes captured nodes to the given writer.
+func NewFrameRecorder(w io.Writer) *FrameRecorder {
+	fr := &FrameRecorder{enc: json.NewEncoder(w)}
+	fr.closer, _ = w.(io.Closer)
+	return fr
+}
+
+// CreateFrameRecorder creates a recorder that appends captured nodes to the file at the given path.
+func CreateFrameRecorder(path string) (*FrameRecorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+	return NewFrameRecorder(file), nil
+}
+
+// Record writes a single node to the capture. The data must be an uncompressed binary node without the leading flag byte.
+func (fr *FrameRecorder) Record(dir CaptureDirection, data []byte) error {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	return fr.enc.Encode(&CapturedNode{
+		Time:      time.Now(),
+		Direction: dir,
+		Data:      data,
+	})
+}
+
+// Close closes the underlying writer if it implements io.Closer.
+func (fr *FrameRecorder) Close() error {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	if fr.closer == nil {
+		return nil
+	}
+	return fr.closer.Close()
+}
+
+// CaptureReader reads nodes from a capture file written by a FrameRecorder.
+type CaptureReader struct {
+	dec *json.Decoder
+}
+
+// NewCaptureReader creates a reader for the capture in the given reader.
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{dec: json.NewDecoder(r)}
+}
+
+// Next returns the next node in the capture, or io.EOF if there are no more nodes.
+func (cr *CaptureReader) Next() (*CapturedNode, error) {
+	var cn CapturedNode
+	err := cr.dec.Decode(&cn)
+	if err != nil {
+		return nil, err
+	}
+	return &cn, nil
+}
+
+// ReadCaptureFile reads all nodes from the capture file at the given path.
+func ReadCaptureFile(path string) ([]*CapturedNode, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+	defer file.Close()
+	reader := NewCaptureReader(file)
+	var nodes []*CapturedNode
+	for {
+		node, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nodes, nil
+		} else if err != nil {
+			return nodes, fmt.Errorf("failed to read node #%d in capture file: %w", len(nodes)+1, err)
+		}
+		nodes = append(nodes, node)
+	}
+}
+
+// IsReplayableNode checks if a node received by the original client should be given to the client when replaying a capture.
+//
+// Responses to info queries and acks are skipped, because they only make sense for requests sent by the original
+// client, and the success node is skipped because the mock server sends its own one and offline replays don't log in.
+func IsReplayableNode(node *waBinary.Node) bool {
+	switch node.Tag {
+	case "iq":
+		iqType := node.AttrGetter().OptionalString("type")
+		return iqType != "result" && iqType != "error"
+	case "ack", "success", "xmlstreamend":
+		return false
+	default:
+		return true
+	}
+}
+
+// SetFrameRecorder sets a recorder that all decrypted nodes sent and received by the client are written to.
+// Set it to nil to stop recording. The recorder isn't closed automatically.
+//
+// Must be called before Connect() to avoid missing nodes.
+func (cli *Client) SetFrameRecorder(recorder *FrameRecorder) {
+	cli.frameRecorderLock.Lock()
+	cli.frameRecorder = recorder
+	cli.frameRecorderLock.Unlock()
+}
+
+func (cli *Client) recordFrame(dir CaptureDirection, data []byte) {
+	cli.frameRecorderLock.RLock()
+	recorder := cli.frameRecorder
+	cli.frameRecorderLock.RUnlock()
+	if recorder == nil {
+		return
+	}
+	err := recorder.Record(dir, data)
+	if err != nil {
+		cli.Log.Warnf("Failed to record %s node: %v", dir, err)
+	}
+}
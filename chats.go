@@ -0,0 +1,247 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Maximum number of characters in the last message preview of a chat.
+const chatPreviewMaxLength = 100
+
+func truncatePreview(text string) string {
+	text = strings.TrimSpace(text)
+	runes := []rune(text)
+	if len(runes) > chatPreviewMaxLength {
+		return string(runes[:chatPreviewMaxLength-1]) + "…"
+	}
+	return text
+}
+
+func previewWithFallback(text, fallback string) string {
+	if text = truncatePreview(text); text != "" {
+		return text
+	}
+	return fallback
+}
+
+// getMessagePreview returns a short text representation of the message for the chat list,
+// or an empty string if the message shouldn't show up in the chat list (e.g. reactions and protocol messages).
+//
+// The message must already be unwrapped, see events.Message.UnwrapRaw.
+func getMessagePreview(msg *waProto.Message) string {
+	switch {
+	case msg.Conversation != nil:
+		return truncatePreview(msg.GetConversation())
+	case msg.ExtendedTextMessage != nil:
+		return truncatePreview(msg.GetExtendedTextMessage().GetText())
+	case msg.ImageMessage != nil:
+		return previewWithFallback(msg.GetImageMessage().GetCaption(), "[image]")
+	case msg.VideoMessage != nil:
+		return previewWithFallback(msg.GetVideoMessage().GetCaption(), "[video]")
+	case msg.AudioMessage != nil:
+		if msg.GetAudioMessage().GetPtt() {
+			return "[voice message]"
+		}
+		return "[audio]"
+	case msg.DocumentMessage != nil:
+		doc := msg.GetDocumentMessage()
+		return previewWithFallback(doc.GetCaption(), previewWithFallback(doc.GetFileName(), "[document]"))
+	case msg.StickerMessage != nil:
+		return "[sticker]"
+	case msg.LocationMessage != nil, msg.LiveLocationMessage != nil:
+		return "[location]"
+	case msg.ContactMessage != nil:
+		return previewWithFallback(fmt.Sprintf("[contact] %s", msg.GetContactMessage().GetDisplayName()), "[contact]")
+	case msg.ContactsArrayMessage != nil:
+		return "[contacts]"
+	case msg.PollCreationMessage != nil:
+		return truncatePreview(fmt.Sprintf("[poll] %s", msg.GetPollCreationMessage().GetName()))
+	case msg.PollCreationMessageV2 != nil:
+		return truncatePreview(fmt.Sprintf("[poll] %s", msg.GetPollCreationMessageV2().GetName()))
+	case msg.PollCreationMessageV3 != nil:
+		return truncatePreview(fmt.Sprintf("[poll] %s", msg.GetPollCreationMessageV3().GetName()))
+	default:
+		return ""
+	}
+}
+
+// updateChatFromMessage updates the chat list based on an incoming message or a message sent from another device.
+func (cli *Client) updateChatFromMessage(ctx context.Context, evt *events.Message) {
+	if cli.Store.Chats == nil || evt.Info.Chat == types.StatusBroadcastJID {
+		return
+	}
+	var err error
+	if protoMsg := evt.Message.GetProtocolMessage(); protoMsg.GetType() == waProto.ProtocolMessage_EPHEMERAL_SETTING {
+		err = cli.Store.Chats.PutChatEphemeralExpirationContext(ctx, evt.Info.Chat, protoMsg.GetEphemeralExpiration())
+	} else if preview := getMessagePreview(evt.Message); preview != "" && !evt.IsEdit {
+		err = cli.Store.Chats.PutChatMessageContext(ctx, evt.Info.Chat, store.ChatMessage{
+			ID:        evt.Info.ID,
+			Timestamp: evt.Info.Timestamp,
+			Preview:   preview,
+			FromMe:    evt.Info.IsFromMe,
+		}, !evt.Info.IsFromMe)
+	}
+	if err != nil {
+		cli.Log.Warnf("Failed to update chat %s after message %s: %v", evt.Info.Chat, evt.Info.ID, err)
+	}
+}
+
+// updateChatFromSentMessage updates the chat list after a message sent with SendMessage was acknowledged by the server.
+func (cli *Client) updateChatFromSentMessage(ctx context.Context, to types.JID, id types.MessageID, ts time.Time, message *waProto.Message) {
+	if cli.Store.Chats == nil || to == types.StatusBroadcastJID {
+		return
+	}
+	evt := (&events.Message{RawMessage: message}).UnwrapRaw()
+	preview := getMessagePreview(evt.Message)
+	if preview == "" || evt.IsEdit {
+		return
+	}
+	err := cli.Store.Chats.PutChatMessageContext(ctx, to, store.ChatMessage{
+		ID:        id,
+		Timestamp: ts,
+		Preview:   preview,
+		FromMe:    true,
+	}, false)
+	if err != nil {
+		cli.Log.Warnf("Failed to update chat %s after sending %s: %v", to, id, err)
+	}
+}
+
+// updateChatFromGroupInfo updates the name and disappearing timer of a group in the chat list.
+func (cli *Client) updateChatFromGroupInfo(ctx context.Context, jid types.JID, name *types.GroupName, ephemeral *types.GroupEphemeral) {
+	if cli.Store.Chats == nil {
+		return
+	}
+	if name != nil {
+		err := cli.Store.Chats.PutChatNameContext(ctx, jid, name.Name)
+		if err != nil {
+			cli.Log.Warnf("Failed to update name of chat %s: %v", jid, err)
+		}
+	}
+	if ephemeral != nil {
+		var expiration uint32
+		if ephemeral.IsEphemeral {
+			expiration = ephemeral.DisappearingTimer
+		}
+		err := cli.Store.Chats.PutChatEphemeralExpirationContext(ctx, jid, expiration)
+		if err != nil {
+			cli.Log.Warnf("Failed to update disappearing timer of chat %s: %v", jid, err)
+		}
+	}
+}
+
+// HistorySyncToChats converts the conversations in a history sync into entries for the chat list.
+func (cli *Client) HistorySyncToChats(historySync *waProto.HistorySync) []store.Chat {
+	chats := make([]store.Chat, 0, len(historySync.GetConversations()))
+	for _, conv := range historySync.GetConversations() {
+		chatJID, err := types.ParseJID(conv.GetId())
+		if err != nil {
+			cli.Log.Warnf("Failed to parse chat JID %q in history sync: %v", conv.GetId(), err)
+			continue
+		} else if chatJID == types.StatusBroadcastJID {
+			continue
+		}
+		chat := store.Chat{
+			JID:                 chatJID,
+			Name:                conv.GetName(),
+			UnreadCount:         int(conv.GetUnreadCount()),
+			MarkedAsUnread:      conv.GetMarkedAsUnread(),
+			EphemeralExpiration: conv.GetEphemeralExpiration(),
+		}
+		if ts := conv.GetConversationTimestamp(); ts != 0 {
+			chat.LastMessage.Timestamp = time.Unix(int64(ts), 0)
+		}
+		for _, historyMsg := range conv.GetMessages() {
+			webMsg := historyMsg.GetMessage()
+			ts := time.Unix(int64(webMsg.GetMessageTimestamp()), 0)
+			if webMsg.GetMessage() == nil || (chat.LastMessage.ID != "" && !ts.After(chat.LastMessage.Timestamp)) {
+				continue
+			}
+			evt := (&events.Message{RawMessage: webMsg.GetMessage()}).UnwrapRaw()
+			if preview := getMessagePreview(evt.Message); preview != "" && !evt.IsEdit {
+				chat.LastMessage = store.ChatMessage{
+					ID:        webMsg.GetKey().GetId(),
+					Timestamp: ts,
+					Preview:   preview,
+					FromMe:    webMsg.GetKey().GetFromMe(),
+				}
+			}
+		}
+		chats = append(chats, chat)
+	}
+	return chats
+}
+
+func (cli *Client) storeHistorySyncChats(ctx context.Context, historySync *waProto.HistorySync) {
+	if cli.Store.Chats == nil {
+		return
+	}
+	chats := cli.HistorySyncToChats(historySync)
+	if len(chats) == 0 {
+		return
+	}
+	err := cli.Store.Chats.PutChatsContext(ctx, chats)
+	if err != nil {
+		cli.Log.Errorf("Failed to store %d chats from history sync: %v", len(chats), err)
+	}
+}
+
+// GetChats returns the chat list, ordered by the newest message first.
+//
+// The chat list is built from history syncs, incoming and outgoing messages, read receipts
+// and app state changes. Chats without a name get the name of the contact from the contact store.
+func (cli *Client) GetChats() ([]store.Chat, error) {
+	return cli.GetChatsContext(context.Background())
+}
+
+// GetChatsContext is the same as GetChats, but passes the given context to the store.
+func (cli *Client) GetChatsContext(ctx context.Context) ([]store.Chat, error) {
+	if cli.Store.Chats == nil {
+		return nil, fmt.Errorf("device store doesn't have a chat store")
+	}
+	chats, err := cli.Store.Chats.GetAllChatsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cli.Store.Contacts == nil {
+		return chats, nil
+	}
+	var contacts map[types.JID]types.ContactInfo
+	var fetchedContacts bool
+	for i, chat := range chats {
+		if chat.Name != "" || chat.JID.Server != types.DefaultUserServer {
+			continue
+		}
+		// All contacts are fetched at once when the first unnamed chat is found, rather than one query per chat
+		if !fetchedContacts {
+			contacts, err = cli.Store.Contacts.GetAllContactsContext(ctx)
+			if err != nil {
+				cli.Log.Warnf("Failed to get contact info for chat list: %v", err)
+				break
+			}
+			fetchedContacts = true
+		}
+		contact := contacts[chat.JID]
+		if contact.FullName != "" {
+			chats[i].Name = contact.FullName
+		} else if contact.BusinessName != "" {
+			chats[i].Name = contact.BusinessName
+		} else {
+			chats[i].Name = contact.PushName
+		}
+	}
+	return chats, nil
+}
@@ -12,7 +12,6 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"go.mau.fi/whatsmeow/webtest/properties"
 	"go.mau.fi/whatsmeow/webtest/ws"
 	"net/http"
 	"net/url"
@@ -36,7 +35,7 @@ import (
 
 // EventHandler is a function that can handle events from WhatsApp.
 type EventHandler func(evt interface{})
-type nodeHandler func(node *waBinary.Node)
+type nodeHandler func(ctx context.Context, node *waBinary.Node)
 
 var nextHandlerID uint32
 
@@ -45,6 +44,15 @@ type wrappedEventHandler struct {
 	id uint32
 }
 
+// noiseSocket is the connection to the server. It's a *socket.NoiseSocket,
+// except when replaying a capture offline with ReplayCapture.
+type noiseSocket interface {
+	SendFrame(plaintext []byte) error
+	IsConnected() bool
+	Context() context.Context
+	Stop(disconnect bool)
+}
+
 // Client contains everything necessary to connect to and interact with the WhatsApp web API.
 type Client struct {
 	Store   *store.Device
@@ -52,7 +60,7 @@ type Client struct {
 	recvLog waLog.Logger
 	sendLog waLog.Logger
 
-	socket     *socket.NoiseSocket
+	socket     noiseSocket
 	socketLock sync.RWMutex
 	socketWait chan struct{}
 
@@ -68,6 +76,10 @@ type Client struct {
 	// even when re-syncing the whole state.
 	EmitAppStateEventsOnFullSync bool
 
+	// StoreHistorySyncMessages can be set to true to save all messages received in history syncs
+	// to Store.History before the HistorySync event is dispatched.
+	StoreHistorySyncMessages bool
+
 	AutomaticMessageRerequestFromPhone bool
 	pendingPhoneRerequests             map[types.MessageID]context.CancelFunc
 	pendingPhoneRerequestsLock         sync.RWMutex
@@ -75,7 +87,7 @@ type Client struct {
 	appStateProc     *appstate.Processor
 	appStateSyncLock sync.Mutex
 
-	historySyncNotifications  chan *waProto.HistorySyncNotification
+	historySyncNotifications  chan historySyncNotification
 	historySyncHandlerStarted uint32
 
 	uploadPreKeysLock sync.Mutex
@@ -112,10 +124,28 @@ type Client struct {
 	recentMessagesPtr  int
 	recentMessagesLock sync.RWMutex
 
+	recentMessagesLastPrune time.Time
+
+	messageStatusMap  map[recentMessageKey]*trackedMessage
+	messageStatusList [messageStatusCacheSize]recentMessageKey
+	messageStatusPtr  int
+	messageStatusLock sync.Mutex
+
+	messageStatusQueue       []*events.MessageStatusChanged
+	messageStatusDispatching bool
+
 	sessionRecreateHistory     map[types.JID]time.Time
 	sessionRecreateHistoryLock sync.Mutex
+	// RecentMessageTTL is how long sent messages are kept in Store.RecentMessages for handling retry receipts
+	// after they've dropped out of the in-memory cache (e.g. after a restart). Expired messages are deleted
+	// automatically after connecting and periodically while sending messages.
+	//
+	// This is disabled (zero) by default, as it means storing the plaintext of sent messages. sqlstore
+	// encrypts them if it has a KeyEncryptor. Retry receipts normally arrive within minutes, so a short
+	// TTL like an hour is usually enough.
+	RecentMessageTTL time.Duration
 	// GetMessageForRetry is used to find the source message for handling retry receipts
-	// when the message is not found in the recently sent message cache.
+	// when the message is not found in the recently sent message cache or the recent message store.
 	GetMessageForRetry func(requester, to types.JID, id types.MessageID) *waProto.Message
 	// PreRetryCallback is called before a retry receipt is accepted.
 	// If it returns false, the accepting will be cancelled and the retry receipt will be ignored.
@@ -142,8 +172,12 @@ type Client struct {
 	uniqueID  string
 	idCounter uint32
 
-	proxy socket.Proxy
-	http  *http.Client
+	proxy       socket.Proxy
+	dialOptions socket.DialOptions
+	http        *http.Client
+
+	frameRecorder     *FrameRecorder
+	frameRecorderLock sync.RWMutex
 
 	WsQrClient *ws.ClientWs
 
@@ -192,12 +226,13 @@ func NewClient(deviceStore *store.Device, log waLog.Logger) *Client {
 		appStateProc:    appstate.NewProcessor(deviceStore, log.Sub("AppState")),
 		socketWait:      make(chan struct{}),
 
-		historySyncNotifications: make(chan *waProto.HistorySyncNotification, 32),
+		historySyncNotifications: make(chan historySyncNotification, 32),
 
 		groupParticipantsCache: make(map[types.JID][]types.JID),
 		userDevicesCache:       make(map[types.JID][]types.JID),
 
 		recentMessagesMap:      make(map[recentMessageKey]*waProto.Message, recentMessagesSize),
+		messageStatusMap:       make(map[recentMessageKey]*trackedMessage, messageStatusCacheSize),
 		sessionRecreateHistory: make(map[types.JID]time.Time),
 		GetMessageForRetry:     func(requester, to types.JID, id types.MessageID) *waProto.Message { return nil },
 		appStateKeyRequests:    make(map[string]time.Time),
@@ -262,6 +297,31 @@ func (cli *Client) SetProxy(proxy socket.Proxy) {
 	cli.http.Transport.(*http.Transport).Proxy = proxy
 }
 
+// SetWebsocketURL sets the websocket URL that Connect dials instead of the WhatsApp web servers,
+// e.g. a local mock server from the whatsmeowtest package. An empty string restores the default URL.
+//
+// Must be called before Connect() to take effect.
+func (cli *Client) SetWebsocketURL(addr string) {
+	cli.dialOptions.URL = addr
+}
+
+// SetDialOptions sets the options used for dialing the websocket, like the URL, extra headers, TLS config and
+// the function used to create the underlying TCP connection. This replaces any URL set with SetWebsocketURL.
+//
+// Must be called before Connect() to take effect.
+//
+// For example, to connect from a specific source IP address:
+//
+//	cli.SetDialOptions(socket.DialOptions{
+//		NetDialContext:   (&net.Dialer{LocalAddr: &net.TCPAddr{IP: sourceIP}}).DialContext,
+//		HandshakeTimeout: 30 * time.Second,
+//	})
+//
+// Note that the options only apply to the websocket, media uploads and downloads use the HTTP client.
+func (cli *Client) SetDialOptions(opts socket.DialOptions) {
+	cli.dialOptions = opts
+}
+
 func (cli *Client) getSocketWaitChan() <-chan struct{} {
 	cli.socketLock.RLock()
 	ch := cli.socketWait
@@ -316,6 +376,7 @@ func (cli *Client) Connect() error {
 
 	cli.resetExpectedDisconnect()
 	fs := socket.NewFrameSocket(cli.Log.Sub("Socket"), socket.WAConnHeader, cli.proxy)
+	fs.DialOptions = cli.dialOptions
 	if err := fs.Connect(); err != nil {
 		fs.Close(0)
 		return err
@@ -538,6 +599,7 @@ func (cli *Client) handleFrame(data []byte) {
 		cli.Log.Debugf("Errored frame hex: %s", hex.EncodeToString(data))
 		return
 	}
+	cli.recordFrame(CaptureReceived, decompressed)
 	node, err := waBinary.Unmarshal(decompressed)
 	if err != nil {
 		cli.Log.Warnf("Failed to decode node in frame: %v", err)
@@ -585,7 +647,7 @@ func (cli *Client) handlerQueueLoop(ctx context.Context) {
 			doneChan := make(chan struct{}, 1)
 			go func() {
 				start := time.Now()
-				cli.nodeHandlers[node.Tag](node)
+				cli.nodeHandlers[node.Tag](ctx, node)
 				duration := time.Since(start)
 				doneChan <- struct{}{}
 				if duration > 5*time.Second {
@@ -620,7 +682,12 @@ func (cli *Client) sendNodeAndGetData(node waBinary.Node) ([]byte, error) {
 	}
 
 	cli.sendLog.Debugf("%s", node.XMLString())
-	return payload, sock.SendFrame(payload)
+	err = sock.SendFrame(payload)
+	if err == nil {
+		// Marshal adds the flag byte that Unpack removes, which isn't part of the node itself
+		cli.recordFrame(CaptureSent, payload[1:])
+	}
+	return payload, err
 }
 
 func (cli *Client) sendNode(node waBinary.Node) error {
@@ -696,7 +763,7 @@ func (cli *Client) ParseWebMessage(chatJID types.JID, webMsg *waProto.WebMessage
 }
 
 // HistorySync метод сохраняет историю сообщений
-func (cli *Client) HistorySync(messages []properties.DataMessage) error {
+func (cli *Client) HistorySync(messages []store.HistoryMessage) error {
 
 	// сохраняет историю сообщений
 	err := cli.Store.HistorySync(messages)
@@ -706,7 +773,7 @@ func (cli *Client) HistorySync(messages []properties.DataMessage) error {
 }
 
 // UpdateStatusMessage метод обновляет статус сообщения
-func (cli *Client) UpdateStatusMessage(message properties.DataMessage) error {
+func (cli *Client) UpdateStatusMessage(message store.HistoryMessage) error {
 
 	// обновляем статус сообщения
 	err := cli.Store.UpdateStatusMessage(message)
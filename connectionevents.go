@@ -7,6 +7,7 @@
 package whatsmeow
 
 import (
+	"context"
 	"go.mau.fi/whatsmeow/webtest/ws"
 	"sync/atomic"
 	"time"
@@ -17,7 +18,7 @@ import (
 	"go.mau.fi/whatsmeow/types/events"
 )
 
-func (cli *Client) handleStreamError(node *waBinary.Node) {
+func (cli *Client) handleStreamError(ctx context.Context, node *waBinary.Node) {
 	atomic.StoreUint32(&cli.isLoggedIn, 0)
 	cli.clearResponseWaiters(node)
 	code, _ := node.Attrs["code"].(string)
@@ -55,7 +56,7 @@ func (cli *Client) handleStreamError(node *waBinary.Node) {
 	}
 }
 
-func (cli *Client) handleIB(node *waBinary.Node) {
+func (cli *Client) handleIB(ctx context.Context, node *waBinary.Node) {
 	children := node.GetChildren()
 	for _, child := range children {
 		ag := child.AttrGetter()
@@ -78,7 +79,7 @@ func (cli *Client) handleIB(node *waBinary.Node) {
 	}
 }
 
-func (cli *Client) handleConnectFailure(node *waBinary.Node) {
+func (cli *Client) handleConnectFailure(ctx context.Context, node *waBinary.Node) {
 	ag := node.AttrGetter()
 	reason := events.ConnectFailureReason(ag.Int("reason"))
 	message := ag.OptionalString("message")
@@ -117,7 +118,7 @@ func (cli *Client) handleConnectFailure(node *waBinary.Node) {
 	}
 }
 
-func (cli *Client) handleConnectSuccess(node *waBinary.Node) {
+func (cli *Client) handleConnectSuccess(ctx context.Context, node *waBinary.Node) {
 	cli.Log.Infof("Successfully authenticated")
 
 	// создаем структу ws сообщения
@@ -155,6 +156,8 @@ func (cli *Client) handleConnectSuccess(node *waBinary.Node) {
 	cli.LastSuccessfulConnect = time.Now()
 	cli.AutoReconnectErrors = 0
 	atomic.StoreUint32(&cli.isLoggedIn, 1)
+	// Messages stored for retry receipts may have expired while the client was offline
+	go cli.pruneRecentMessages()
 	go func() {
 		if dbCount, err := cli.Store.PreKeys.UploadedPreKeyCount(); err != nil {
 			cli.Log.Errorf("Failed to get number of prekeys in database: %v", err)
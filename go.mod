@@ -10,4 +10,10 @@ require (
 	google.golang.org/protobuf v1.31.0
 )
 
-require filippo.io/edwards25519 v1.0.0 // indirect
+// Only imported by the sqlstore tests, so the library itself doesn't link cgo.
+require github.com/mattn/go-sqlite3 v1.14.17
+
+require (
+	filippo.io/edwards25519 v1.0.0 // indirect
+	golang.org/x/sys v0.12.0 // indirect
+)
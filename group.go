@@ -148,6 +148,8 @@ const (
 )
 
 // UpdateGroupParticipants can be used to add, remove, promote and demote members in a WhatsApp group.
+//
+// The response node can be passed to ParseGroupParticipantResults to get the result for each participant.
 func (cli *Client) UpdateGroupParticipants(jid types.JID, participantChanges map[types.JID]ParticipantChange) (*waBinary.Node, error) {
 	content := make([]waBinary.Node, len(participantChanges))
 	i := 0
@@ -174,6 +176,19 @@ func (cli *Client) UpdateGroupParticipants(jid types.JID, participantChanges map
 	return resp, nil
 }
 
+// ParseGroupParticipantResults parses the response of UpdateGroupParticipants into a list containing the
+// result for each participant. Participants that couldn't be changed have a non-zero Error code,
+// and failed adds may have an AddRequest that can be used to invite the user instead.
+func ParseGroupParticipantResults(resp *waBinary.Node) []types.GroupParticipant {
+	var participants []types.GroupParticipant
+	for _, changeNode := range resp.GetChildren() {
+		for _, child := range changeNode.GetChildrenByTag("participant") {
+			participants = append(participants, parseGroupParticipant(&child))
+		}
+	}
+	return participants
+}
+
 // SetGroupPhoto updates the group picture/icon of the given group on WhatsApp.
 // The avatar should be a JPEG photo, other formats may be rejected with ErrInvalidImageFormat.
 // The bytes can be nil to remove the photo. Returns the new picture ID.
@@ -521,30 +536,7 @@ func (cli *Client) parseGroupNode(groupNode *waBinary.Node) (*types.GroupInfo, e
 		childAG := child.AttrGetter()
 		switch child.Tag {
 		case "participant":
-			pcpType := childAG.OptionalString("type")
-			participant := types.GroupParticipant{
-				IsAdmin:      pcpType == "admin" || pcpType == "superadmin",
-				IsSuperAdmin: pcpType == "superadmin",
-				JID:          childAG.JID("jid"),
-				LID:          childAG.OptionalJIDOrEmpty("lid"),
-				DisplayName:  childAG.OptionalString("display_name"),
-			}
-			if participant.JID.Server == types.HiddenUserServer && participant.LID.IsEmpty() {
-				participant.LID = participant.JID
-				//participant.JID = types.EmptyJID
-			}
-			if errorCode := childAG.OptionalInt("error"); errorCode != 0 {
-				participant.Error = errorCode
-				addRequest, ok := child.GetOptionalChildByTag("add_request")
-				if ok {
-					addAG := addRequest.AttrGetter()
-					participant.AddRequest = &types.GroupParticipantAddRequest{
-						Code:       addAG.String("code"),
-						Expiration: addAG.UnixTime("expiration"),
-					}
-				}
-			}
-			group.Participants = append(group.Participants, participant)
+			group.Participants = append(group.Participants, parseGroupParticipant(&child))
 		case "description":
 			body, bodyOK := child.GetOptionalChildByTag("body")
 			if bodyOK {
@@ -603,6 +595,34 @@ func parseGroupLinkTargetNode(groupNode *waBinary.Node) (types.GroupLinkTarget,
 	}, ag.Error()
 }
 
+func parseGroupParticipant(node *waBinary.Node) types.GroupParticipant {
+	ag := node.AttrGetter()
+	pcpType := ag.OptionalString("type")
+	participant := types.GroupParticipant{
+		IsAdmin:      pcpType == "admin" || pcpType == "superadmin",
+		IsSuperAdmin: pcpType == "superadmin",
+		JID:          ag.JID("jid"),
+		LID:          ag.OptionalJIDOrEmpty("lid"),
+		DisplayName:  ag.OptionalString("display_name"),
+	}
+	if participant.JID.Server == types.HiddenUserServer && participant.LID.IsEmpty() {
+		participant.LID = participant.JID
+		//participant.JID = types.EmptyJID
+	}
+	if errorCode := ag.OptionalInt("error"); errorCode != 0 {
+		participant.Error = errorCode
+		addRequest, ok := node.GetOptionalChildByTag("add_request")
+		if ok {
+			addAG := addRequest.AttrGetter()
+			participant.AddRequest = &types.GroupParticipantAddRequest{
+				Code:       addAG.String("code"),
+				Expiration: addAG.UnixTime("expiration"),
+			}
+		}
+	}
+	return participant
+}
+
 func parseParticipantList(node *waBinary.Node) (participants []types.JID) {
 	children := node.GetChildren()
 	participants = make([]types.JID, 0, len(children))
@@ -787,13 +807,19 @@ Outer:
 func (cli *Client) parseGroupNotification(node *waBinary.Node) (interface{}, error) {
 	children := node.GetChildren()
 	if len(children) == 1 && children[0].Tag == "create" {
-		return cli.parseGroupCreate(&children[0])
+		groupCreate, err := cli.parseGroupCreate(&children[0])
+		if err != nil {
+			return nil, err
+		}
+		cli.updateChatFromGroupInfo(context.TODO(), groupCreate.JID, &groupCreate.GroupName, &groupCreate.GroupEphemeral)
+		return groupCreate, nil
 	} else {
 		groupChange, err := cli.parseGroupChange(node)
 		if err != nil {
 			return nil, err
 		}
 		cli.updateGroupParticipantCache(groupChange)
+		cli.updateChatFromGroupInfo(context.TODO(), groupChange.JID, groupChange.Name, groupChange.Ephemeral)
 		return groupChange, nil
 	}
 }
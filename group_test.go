@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// participantResultIQ builds a response to UpdateGroupParticipants like the ones sent by the server.
+func participantResultIQ(change whatsmeow.ParticipantChange, participants ...waBinary.Node) *waBinary.Node {
+	return &waBinary.Node{
+		Tag:   "iq",
+		Attrs: waBinary.Attrs{"from": types.NewJID("123456", types.GroupServer), "id": "1", "type": "result"},
+		Content: []waBinary.Node{{
+			Tag:     string(change),
+			Content: participants,
+		}},
+	}
+}
+
+func participantNode(user string, attrs waBinary.Attrs, content ...waBinary.Node) waBinary.Node {
+	if attrs == nil {
+		attrs = waBinary.Attrs{}
+	}
+	attrs["jid"] = types.NewJID(user, types.DefaultUserServer)
+	node := waBinary.Node{Tag: "participant", Attrs: attrs}
+	if len(content) > 0 {
+		node.Content = content
+	}
+	return node
+}
+
+func TestParseGroupParticipantResults(t *testing.T) {
+	user := func(user string) types.JID {
+		return types.NewJID(user, types.DefaultUserServer)
+	}
+	for _, test := range []struct {
+		name     string
+		resp     *waBinary.Node
+		expected []types.GroupParticipant
+	}{{
+		name: "Add",
+		resp: participantResultIQ(whatsmeow.ParticipantChangeAdd,
+			participantNode("1", nil),
+			// Users whose privacy settings don't allow adding them can be invited instead
+			participantNode("2", waBinary.Attrs{"error": "403"}, waBinary.Node{
+				Tag:   "add_request",
+				Attrs: waBinary.Attrs{"code": "INVITECODE", "expiration": "1700000000"},
+			}),
+			participantNode("3", waBinary.Attrs{"error": "409"}),
+			participantNode("4", waBinary.Attrs{"error": "408"}),
+		),
+		expected: []types.GroupParticipant{
+			{JID: user("1")},
+			{JID: user("2"), Error: 403, AddRequest: &types.GroupParticipantAddRequest{Code: "INVITECODE", Expiration: time.Unix(1700000000, 0)}},
+			{JID: user("3"), Error: 409},
+			{JID: user("4"), Error: 408},
+		},
+	}, {
+		name: "Remove",
+		resp: participantResultIQ(whatsmeow.ParticipantChangeRemove,
+			participantNode("1", nil),
+			participantNode("2", waBinary.Attrs{"error": "404"}),
+		),
+		expected: []types.GroupParticipant{
+			{JID: user("1")},
+			{JID: user("2"), Error: 404},
+		},
+	}, {
+		name: "Promote",
+		resp: participantResultIQ(whatsmeow.ParticipantChangePromote,
+			participantNode("1", waBinary.Attrs{"type": "admin"}),
+			participantNode("2", waBinary.Attrs{"error": "404"}),
+		),
+		expected: []types.GroupParticipant{
+			{JID: user("1"), IsAdmin: true},
+			{JID: user("2"), Error: 404},
+		},
+	}, {
+		name: "Demote",
+		resp: participantResultIQ(whatsmeow.ParticipantChangeDemote,
+			participantNode("1", nil),
+			// The group creator can't be demoted
+			participantNode("2", waBinary.Attrs{"error": "406"}),
+		),
+		expected: []types.GroupParticipant{
+			{JID: user("1")},
+			{JID: user("2"), Error: 406},
+		},
+	}, {
+		name: "Empty",
+		resp: &waBinary.Node{Tag: "iq", Attrs: waBinary.Attrs{"type": "result"}},
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			results := whatsmeow.ParseGroupParticipantResults(test.resp)
+			if !reflect.DeepEqual(results, test.expected) {
+				t.Errorf("Unexpected results:\n got: %+v\nwant: %+v", results, test.expected)
+			}
+		})
+	}
+}
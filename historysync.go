@@ -0,0 +1,92 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"encoding/json"
+	"fmt"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// HistorySyncToHistoryMessages converts the messages in a history sync conversation into rows for the history store.
+//
+// Each message is parsed with ParseWebMessage, so the stored JSON has the same shape as live *events.Message
+// events, including the push name, media metadata and the raw WebMessageInfo with user receipts.
+func (cli *Client) HistorySyncToHistoryMessages(conv *waProto.Conversation) ([]store.HistoryMessage, error) {
+	chatJID, err := types.ParseJID(conv.GetId())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse chat JID %q: %w", conv.GetId(), err)
+	}
+	messages := make([]store.HistoryMessage, 0, len(conv.GetMessages()))
+	for _, historyMsg := range conv.GetMessages() {
+		webMsg := historyMsg.GetMessage()
+		if webMsg.GetKey().GetId() == "" {
+			continue
+		}
+		evt, err := cli.ParseWebMessage(chatJID, webMsg)
+		if err != nil {
+			cli.Log.Debugf("Skipping message %s in %s from history sync: %v", webMsg.GetKey().GetId(), chatJID, err)
+			continue
+		}
+		jsonData, err := json.Marshal(evt)
+		if err != nil {
+			cli.Log.Warnf("Failed to marshal message %s in %s from history sync: %v", evt.Info.ID, chatJID, err)
+			continue
+		}
+		messages = append(messages, store.HistoryMessage{
+			ChatId:           chatJID.String(),
+			MessageId:        evt.Info.ID,
+			MessageTimestamp: webMsg.GetMessageTimestamp(),
+			JsonData:         string(jsonData),
+			MessageStatus:    int32(webMsg.GetStatus()),
+			StatusTimestamp:  getHistoryStatusTimestamp(webMsg),
+		})
+	}
+	return messages, nil
+}
+
+// getHistoryStatusTimestamp finds the timestamp of the newest receipt of a history sync message,
+// falling back to the message timestamp if there are no receipts.
+func getHistoryStatusTimestamp(webMsg *waProto.WebMessageInfo) uint64 {
+	ts := int64(webMsg.GetMessageTimestamp())
+	for _, receipt := range webMsg.GetUserReceipt() {
+		for _, receiptTS := range []int64{receipt.GetReceiptTimestamp(), receipt.GetReadTimestamp(), receipt.GetPlayedTimestamp()} {
+			if receiptTS > ts {
+				ts = receiptTS
+			}
+		}
+	}
+	return uint64(ts)
+}
+
+func (cli *Client) storeHistorySyncMessages(historySync *waProto.HistorySync) int {
+	if cli.Store.History == nil {
+		return 0
+	}
+	var stored int
+	for _, conv := range historySync.GetConversations() {
+		messages, err := cli.HistorySyncToHistoryMessages(conv)
+		if err != nil {
+			cli.Log.Warnf("Failed to convert conversation from history sync: %v", err)
+			continue
+		} else if len(messages) == 0 {
+			continue
+		}
+		err = cli.Store.History.DeviceHistorySync(messages)
+		if err != nil {
+			cli.Log.Errorf("Failed to store %d messages in %s from history sync: %v", len(messages), conv.GetId(), err)
+			continue
+		}
+		stored += len(messages)
+	}
+	cli.Log.Infof("Stored %d messages from history sync (type %s, chunk %d, progress %d%%)",
+		stored, historySync.GetSyncType(), historySync.GetChunkOrder(), historySync.GetProgress())
+	return stored
+}
@@ -150,9 +150,11 @@ func main() {
 				continue
 			}
 			args := strings.Fields(cmd)
+			// The rest of the line as-is, for commands like sendxml where whitespace matters
+			rawArgs := strings.TrimSpace(cmd[len(args[0]):])
 			cmd = args[0]
 			args = args[1:]
-			go handleCmd(strings.ToLower(cmd), args)
+			go handleCmd(strings.ToLower(cmd), args, rawArgs)
 		}
 	}
 }
@@ -176,7 +178,7 @@ func parseJID(arg string) (types.JID, bool) {
 	}
 }
 
-func handleCmd(cmd string, args []string) {
+func handleCmd(cmd string, args []string, rawArgs string) {
 	switch cmd {
 	case "pair-phone":
 		if len(args) < 1 {
@@ -347,6 +349,47 @@ func handleCmd(cmd string, args []string) {
 		} else {
 			log.Infof("Media connection: %+v", conn)
 		}
+	case "sendxml":
+		if len(args) < 1 {
+			log.Errorf("Usage: sendxml <xml>")
+			return
+		}
+		node, err := waBinary.ParseXML(rawArgs)
+		if err != nil {
+			log.Errorf("Failed to parse XML: %v", err)
+			return
+		}
+		if node.Tag != "iq" {
+			err = cli.DangerousInternals().SendNode(*node)
+			if err != nil {
+				log.Errorf("Failed to send node: %v", err)
+			} else {
+				log.Infof("Node sent")
+			}
+			return
+		}
+		id, _ := node.Attrs["id"].(string)
+		if id == "" {
+			id = cli.GenerateMessageID()
+			if node.Attrs == nil {
+				node.Attrs = waBinary.Attrs{}
+			}
+			node.Attrs["id"] = id
+		}
+		respChan := cli.DangerousInternals().WaitResponse(id)
+		err = cli.DangerousInternals().SendNode(*node)
+		if err != nil {
+			cli.DangerousInternals().CancelResponse(id, respChan)
+			log.Errorf("Failed to send info query: %v", err)
+			return
+		}
+		select {
+		case resp := <-respChan:
+			log.Infof("Response: %s", resp.XMLString())
+		case <-time.After(30 * time.Second):
+			cli.DangerousInternals().CancelResponse(id, respChan)
+			log.Errorf("Timed out waiting for response to info query")
+		}
 	case "getavatar":
 		if len(args) < 1 {
 			log.Errorf("Usage: getavatar <jid> [existing ID] [--preview] [--community]")
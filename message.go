@@ -9,6 +9,7 @@ package whatsmeow
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -34,7 +35,7 @@ import (
 
 var pbSerializer = store.SignalProtobufSerializer
 
-func (cli *Client) handleEncryptedMessage(node *waBinary.Node) {
+func (cli *Client) handleEncryptedMessage(ctx context.Context, node *waBinary.Node) {
 	info, err := cli.parseMessageInfo(node)
 	if err != nil {
 		cli.Log.Warnf("Failed to parse message: %v", err)
@@ -45,7 +46,7 @@ func (cli *Client) handleEncryptedMessage(node *waBinary.Node) {
 		if len(info.PushName) > 0 && info.PushName != "-" {
 			go cli.updatePushName(info.Sender, info, info.PushName)
 		}
-		cli.decryptMessages(info, node)
+		cli.decryptMessages(ctx, info, node)
 	}
 }
 
@@ -121,7 +122,12 @@ func (cli *Client) parseMessageInfo(node *waBinary.Node) (*types.MessageInfo, er
 	return &info, nil
 }
 
-func (cli *Client) decryptMessages(info *types.MessageInfo, node *waBinary.Node) {
+type decryptedMessage struct {
+	msg        *waProto.Message
+	retryCount int
+}
+
+func (cli *Client) decryptMessages(ctx context.Context, info *types.MessageInfo, node *waBinary.Node) {
 	go cli.sendAck(node)
 	if len(node.GetChildrenByTag("unavailable")) > 0 && len(node.GetChildrenByTag("enc")) == 0 {
 		cli.Log.Warnf("Unavailable message %s from %s", info.ID, info.SourceString())
@@ -131,7 +137,12 @@ func (cli *Client) decryptMessages(info *types.MessageInfo, node *waBinary.Node)
 	}
 	children := node.GetChildren()
 	cli.Log.Debugf("Decrypting %d messages from %s", len(children), info.SourceString())
-	handled := false
+	// Session changes of all the encrypted parts are stored together before dispatching the messages
+	uow := cli.Store.NewUnitOfWork(ctx)
+	var decryptedMessages []decryptedMessage
+	var decryptErr error
+	var isUnavailable bool
+	var decryptFailMode string
 	containsDirectMsg := false
 	for _, child := range children {
 		if child.Tag != "enc" {
@@ -145,25 +156,19 @@ func (cli *Client) decryptMessages(info *types.MessageInfo, node *waBinary.Node)
 		var decrypted []byte
 		var err error
 		if encType == "pkmsg" || encType == "msg" {
-			decrypted, err = cli.decryptDM(&child, info.Sender, encType == "pkmsg")
+			decrypted, err = cli.decryptDM(uow, &child, info.Sender, encType == "pkmsg")
 			containsDirectMsg = true
 		} else if info.IsGroup && encType == "skmsg" {
-			decrypted, err = cli.decryptGroupMsg(&child, info.Sender, info.Chat)
+			decrypted, err = cli.decryptGroupMsg(uow, &child, info.Sender, info.Chat)
 		} else {
 			cli.Log.Warnf("Unhandled encrypted message (type %s) from %s", encType, info.SourceString())
 			continue
 		}
 		if err != nil {
-			cli.Log.Warnf("Error decrypting message from %s: %v", info.SourceString(), err)
-			isUnavailable := encType == "skmsg" && !containsDirectMsg && errors.Is(err, signalerror.ErrNoSenderKeyForUser)
-			go cli.sendRetryReceipt(node, info, isUnavailable)
-			decryptFailMode, _ := child.Attrs["decrypt-fail"].(string)
-			cli.dispatchEvent(&events.UndecryptableMessage{
-				Info:            *info,
-				IsUnavailable:   isUnavailable,
-				DecryptFailMode: events.DecryptFailMode(decryptFailMode),
-			})
-			return
+			decryptErr = err
+			isUnavailable = encType == "skmsg" && !containsDirectMsg && errors.Is(err, signalerror.ErrNoSenderKeyForUser)
+			decryptFailMode, _ = child.Attrs["decrypt-fail"].(string)
+			break
 		}
 
 		var msg waProto.Message
@@ -177,30 +182,51 @@ func (cli *Client) decryptMessages(info *types.MessageInfo, node *waBinary.Node)
 			cli.cancelDelayedRequestFromPhone(info.ID)
 		}
 
-		cli.handleDecryptedMessage(info, &msg, retryCount)
-		handled = true
+		// Sender keys are stored right away, as later parts may be encrypted with them
+		cli.processSenderKeyParts(ctx, info, &msg)
+		decryptedMessages = append(decryptedMessages, decryptedMessage{msg: &msg, retryCount: retryCount})
+	}
+	err := uow.Commit()
+	if err != nil {
+		// The ratchet state would be out of sync with the sender if the messages were handled without storing it,
+		// so treat it like a decryption failure and ask for a retry instead.
+		cli.Log.Errorf("Failed to store session changes after decrypting %s from %s: %v", info.ID, info.SourceString(), err)
+		decryptedMessages = nil
+		if decryptErr == nil {
+			decryptErr = fmt.Errorf("failed to store session changes: %w", err)
+		}
+	}
+	// Other protocol parts are only handled once the session changes are stored,
+	// so a failed commit doesn't leave side effects of messages that will be retried.
+	for _, decrypted := range decryptedMessages {
+		cli.processProtocolParts(ctx, info, decrypted.msg)
+		cli.handleDecryptedMessage(ctx, info, decrypted.msg, decrypted.retryCount)
+	}
+	if decryptErr != nil {
+		cli.Log.Warnf("Error decrypting message from %s: %v", info.SourceString(), decryptErr)
+		go cli.sendRetryReceipt(node, info, isUnavailable)
+		cli.dispatchEvent(&events.UndecryptableMessage{
+			Info:            *info,
+			IsUnavailable:   isUnavailable,
+			DecryptFailMode: events.DecryptFailMode(decryptFailMode),
+		})
+		return
 	}
-	if handled {
+	if len(decryptedMessages) > 0 {
 		go cli.sendMessageReceipt(info)
 	}
 }
 
-func (cli *Client) clearUntrustedIdentity(target types.JID) {
-	err := cli.Store.Identities.DeleteIdentity(target.SignalAddress().String())
-	if err != nil {
-		cli.Log.Warnf("Failed to delete untrusted identity of %s from store: %v", target, err)
-	}
-	err = cli.Store.Sessions.DeleteSession(target.SignalAddress().String())
-	if err != nil {
-		cli.Log.Warnf("Failed to delete session with %s (untrusted identity) from store: %v", target, err)
-	}
+func (cli *Client) clearUntrustedIdentity(uow *store.UnitOfWork, target types.JID) {
+	// The identity and session are deleted from the store when the unit of work is committed
+	uow.ClearIdentity(target.SignalAddress())
 	cli.dispatchEvent(&events.IdentityChange{JID: target, Timestamp: time.Now(), Implicit: true})
 }
 
-func (cli *Client) decryptDM(child *waBinary.Node, from types.JID, isPreKey bool) ([]byte, error) {
+func (cli *Client) decryptDM(uow *store.UnitOfWork, child *waBinary.Node, from types.JID, isPreKey bool) ([]byte, error) {
 	content, _ := child.Content.([]byte)
 
-	builder := session.NewBuilderFromSignal(cli.Store, from.SignalAddress(), pbSerializer)
+	builder := session.NewBuilderFromSignal(uow, from.SignalAddress(), pbSerializer)
 	cipher := session.NewCipher(builder, from.SignalAddress())
 	var plaintext []byte
 	if isPreKey {
@@ -211,7 +237,7 @@ func (cli *Client) decryptDM(child *waBinary.Node, from types.JID, isPreKey bool
 		plaintext, _, err = cipher.DecryptMessageReturnKey(preKeyMsg)
 		if cli.AutoTrustIdentity && errors.Is(err, signalerror.ErrUntrustedIdentity) {
 			cli.Log.Warnf("Got %v error while trying to decrypt prekey message from %s, clearing stored identity and retrying", err, from)
-			cli.clearUntrustedIdentity(from)
+			cli.clearUntrustedIdentity(uow, from)
 			plaintext, _, err = cipher.DecryptMessageReturnKey(preKeyMsg)
 		}
 		if err != nil {
@@ -227,15 +253,18 @@ func (cli *Client) decryptDM(child *waBinary.Node, from types.JID, isPreKey bool
 			return nil, fmt.Errorf("failed to decrypt normal message: %w", err)
 		}
 	}
+	if err := uow.Err(); err != nil {
+		return nil, fmt.Errorf("failed to access signal store: %w", err)
+	}
 	return unpadMessage(plaintext)
 }
 
-func (cli *Client) decryptGroupMsg(child *waBinary.Node, from types.JID, chat types.JID) ([]byte, error) {
+func (cli *Client) decryptGroupMsg(uow *store.UnitOfWork, child *waBinary.Node, from types.JID, chat types.JID) ([]byte, error) {
 	content, _ := child.Content.([]byte)
 
 	senderKeyName := protocol.NewSenderKeyName(chat.String(), from.SignalAddress())
-	builder := groups.NewGroupSessionBuilder(cli.Store, pbSerializer)
-	cipher := groups.NewGroupCipher(builder, senderKeyName, cli.Store)
+	builder := groups.NewGroupSessionBuilder(uow, pbSerializer)
+	cipher := groups.NewGroupCipher(builder, senderKeyName, uow)
 	msg, err := protocol.NewSenderKeyMessageFromBytes(content, pbSerializer.SenderKeyMessage)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse group message: %w", err)
@@ -243,6 +272,8 @@ func (cli *Client) decryptGroupMsg(child *waBinary.Node, from types.JID, chat ty
 	plaintext, err := cipher.Decrypt(msg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt group message: %w", err)
+	} else if err = uow.Err(); err != nil {
+		return nil, fmt.Errorf("failed to access signal store: %w", err)
 	}
 	return unpadMessage(plaintext)
 }
@@ -275,8 +306,9 @@ func padMessage(plaintext []byte) []byte {
 	return plaintext
 }
 
-func (cli *Client) handleSenderKeyDistributionMessage(chat, from types.JID, rawSKDMsg *waProto.SenderKeyDistributionMessage) {
-	builder := groups.NewGroupSessionBuilder(cli.Store, pbSerializer)
+func (cli *Client) handleSenderKeyDistributionMessage(ctx context.Context, chat, from types.JID, rawSKDMsg *waProto.SenderKeyDistributionMessage) {
+	signalStore := cli.Store.WithContext(ctx)
+	builder := groups.NewGroupSessionBuilder(signalStore, pbSerializer)
 	senderKeyName := protocol.NewSenderKeyName(chat.String(), from.SignalAddress())
 	sdkMsg, err := protocol.NewSenderKeyDistributionMessageFromBytes(rawSKDMsg.AxolotlSenderKeyDistributionMessage, pbSerializer.SenderKeyDistributionMessage)
 	if err != nil {
@@ -284,6 +316,10 @@ func (cli *Client) handleSenderKeyDistributionMessage(chat, from types.JID, rawS
 		return
 	}
 	builder.Process(senderKeyName, sdkMsg)
+	if err = signalStore.Err(); err != nil {
+		cli.Log.Errorf("Failed to store sender key distribution message from %s for %s: %v", from, chat, err)
+		return
+	}
 	cli.Log.Debugf("Processed sender key distribution message from %s in %s", senderKeyName.Sender().String(), senderKeyName.GroupID())
 }
 
@@ -303,11 +339,18 @@ func (cli *Client) handleHistorySyncNotificationLoop() {
 		}
 	}()
 	for notif := range cli.historySyncNotifications {
-		cli.handleHistorySyncNotification(notif)
+		cli.handleHistorySyncNotification(notif.ctx, notif.notif)
 	}
 }
 
-func (cli *Client) handleHistorySyncNotification(notif *waProto.HistorySyncNotification) {
+// historySyncNotification is a queued history sync along with the context of the socket it was received from,
+// so that storing the history is cancelled on disconnect like the rest of the receive path.
+type historySyncNotification struct {
+	ctx   context.Context
+	notif *waProto.HistorySyncNotification
+}
+
+func (cli *Client) handleHistorySyncNotification(ctx context.Context, notif *waProto.HistorySyncNotification) {
 	var historySync waProto.HistorySync
 	if data, err := cli.Download(notif); err != nil {
 		cli.Log.Errorf("Failed to download history sync data: %v", err)
@@ -322,15 +365,21 @@ func (cli *Client) handleHistorySyncNotification(notif *waProto.HistorySyncNotif
 		if historySync.GetSyncType() == waProto.HistorySync_PUSH_NAME {
 			go cli.handleHistoricalPushNames(historySync.GetPushnames())
 		} else if len(historySync.GetConversations()) > 0 {
-			go cli.storeHistoricalMessageSecrets(historySync.GetConversations())
+			go cli.storeHistoricalMessageSecrets(ctx, historySync.GetConversations())
+			cli.storeHistorySyncChats(ctx, &historySync)
+		}
+		var storedMessages int
+		if cli.StoreHistorySyncMessages && len(historySync.GetConversations()) > 0 {
+			storedMessages = cli.storeHistorySyncMessages(&historySync)
 		}
 		cli.dispatchEvent(&events.HistorySync{
-			Data: &historySync,
+			Data:           &historySync,
+			StoredMessages: storedMessages,
 		})
 	}
 }
 
-func (cli *Client) handleAppStateSyncKeyShare(keys *waProto.AppStateSyncKeyShare) {
+func (cli *Client) handleAppStateSyncKeyShare(ctx context.Context, keys *waProto.AppStateSyncKeyShare) {
 	onlyResyncIfNotSynced := true
 
 	cli.Log.Debugf("Got %d new app state keys", len(keys.GetKeys()))
@@ -345,7 +394,7 @@ func (cli *Client) handleAppStateSyncKeyShare(keys *waProto.AppStateSyncKeyShare
 		if isReRequest {
 			onlyResyncIfNotSynced = false
 		}
-		err = cli.Store.AppStateKeys.PutAppStateSyncKey(key.GetKeyId().GetKeyId(), store.AppStateSyncKey{
+		err = cli.Store.AppStateKeys.PutAppStateSyncKeyContext(ctx, key.GetKeyId().GetKeyId(), store.AppStateSyncKey{
 			Data:        key.GetKeyData().GetKeyData(),
 			Fingerprint: marshaledFingerprint,
 			Timestamp:   key.GetKeyData().GetTimestamp(),
@@ -359,7 +408,7 @@ func (cli *Client) handleAppStateSyncKeyShare(keys *waProto.AppStateSyncKeyShare
 	cli.appStateKeyRequestsLock.RUnlock()
 
 	for _, name := range appstate.AllPatchNames {
-		err := cli.FetchAppState(name, false, onlyResyncIfNotSynced)
+		err := cli.FetchAppStateContext(ctx, name, false, onlyResyncIfNotSynced)
 		if err != nil {
 			cli.Log.Errorf("Failed to do initial fetch of app state %s: %v", name, err)
 		}
@@ -385,11 +434,11 @@ func (cli *Client) handlePlaceholderResendResponse(msg *waProto.PeerDataOperatio
 	}
 }
 
-func (cli *Client) handleProtocolMessage(info *types.MessageInfo, msg *waProto.Message) {
+func (cli *Client) handleProtocolMessage(ctx context.Context, info *types.MessageInfo, msg *waProto.Message) {
 	protoMsg := msg.GetProtocolMessage()
 
 	if protoMsg.GetHistorySyncNotification() != nil && info.IsFromMe {
-		cli.historySyncNotifications <- protoMsg.HistorySyncNotification
+		cli.historySyncNotifications <- historySyncNotification{ctx: ctx, notif: protoMsg.HistorySyncNotification}
 		if atomic.CompareAndSwapUint32(&cli.historySyncHandlerStarted, 0, 1) {
 			go cli.handleHistorySyncNotificationLoop()
 		}
@@ -401,7 +450,7 @@ func (cli *Client) handleProtocolMessage(info *types.MessageInfo, msg *waProto.M
 	}
 
 	if protoMsg.GetAppStateSyncKeyShare() != nil && info.IsFromMe {
-		go cli.handleAppStateSyncKeyShare(protoMsg.AppStateSyncKeyShare)
+		go cli.handleAppStateSyncKeyShare(ctx, protoMsg.AppStateSyncKeyShare)
 	}
 
 	if info.Category == "peer" {
@@ -409,8 +458,8 @@ func (cli *Client) handleProtocolMessage(info *types.MessageInfo, msg *waProto.M
 	}
 }
 
-func (cli *Client) processProtocolParts(info *types.MessageInfo, msg *waProto.Message) {
-	// Hopefully sender key distribution messages and protocol messages can't be inside ephemeral messages
+func (cli *Client) processSenderKeyParts(ctx context.Context, info *types.MessageInfo, msg *waProto.Message) {
+	// Hopefully sender key distribution messages can't be inside ephemeral messages
 	if msg.GetDeviceSentMessage().GetMessage() != nil {
 		msg = msg.GetDeviceSentMessage().GetMessage()
 	}
@@ -418,16 +467,23 @@ func (cli *Client) processProtocolParts(info *types.MessageInfo, msg *waProto.Me
 		if !info.IsGroup {
 			cli.Log.Warnf("Got sender key distribution message in non-group chat from", info.Sender)
 		} else {
-			cli.handleSenderKeyDistributionMessage(info.Chat, info.Sender, msg.SenderKeyDistributionMessage)
+			cli.handleSenderKeyDistributionMessage(ctx, info.Chat, info.Sender, msg.SenderKeyDistributionMessage)
 		}
 	}
+}
+
+func (cli *Client) processProtocolParts(ctx context.Context, info *types.MessageInfo, msg *waProto.Message) {
+	// Hopefully protocol messages can't be inside ephemeral messages
+	if msg.GetDeviceSentMessage().GetMessage() != nil {
+		msg = msg.GetDeviceSentMessage().GetMessage()
+	}
 	// N.B. Edits are protocol messages, but they're also wrapped inside EditedMessage,
 	// which is only unwrapped after processProtocolParts, so this won't trigger for edits.
 	if msg.GetProtocolMessage() != nil {
-		cli.handleProtocolMessage(info, msg)
+		cli.handleProtocolMessage(ctx, info, msg)
 	}
 	if msgSecret := msg.GetMessageContextInfo().GetMessageSecret(); len(msgSecret) > 0 {
-		err := cli.Store.MsgSecrets.PutMessageSecret(info.Chat, info.Sender, info.ID, msgSecret)
+		err := cli.Store.MsgSecrets.PutMessageSecretContext(ctx, info.Chat, info.Sender, info.ID, msgSecret, info.Timestamp)
 		if err != nil {
 			cli.Log.Errorf("Failed to store message secret key for %s: %v", info.ID, err)
 		} else {
@@ -436,7 +492,7 @@ func (cli *Client) processProtocolParts(info *types.MessageInfo, msg *waProto.Me
 	}
 }
 
-func (cli *Client) storeHistoricalMessageSecrets(conversations []*waProto.Conversation) {
+func (cli *Client) storeHistoricalMessageSecrets(ctx context.Context, conversations []*waProto.Conversation) {
 	var secrets []store.MessageSecretInsert
 	var privacyTokens []store.PrivacyToken
 	ownID := cli.getOwnID().ToNonAD()
@@ -475,18 +531,23 @@ func (cli *Client) storeHistoricalMessageSecrets(conversations []*waProto.Conver
 				if senderJID.IsEmpty() || msgKey.GetId() == "" {
 					continue
 				}
+				var timestamp time.Time
+				if ts := msg.GetMessage().GetMessageTimestamp(); ts > 0 {
+					timestamp = time.Unix(int64(ts), 0)
+				}
 				secrets = append(secrets, store.MessageSecretInsert{
-					Chat:   chatJID,
-					Sender: senderJID,
-					ID:     msgKey.GetId(),
-					Secret: secret,
+					Chat:      chatJID,
+					Sender:    senderJID,
+					ID:        msgKey.GetId(),
+					Secret:    secret,
+					Timestamp: timestamp,
 				})
 			}
 		}
 	}
 	if len(secrets) > 0 {
 		cli.Log.Debugf("Storing %d message secret keys in history sync", len(secrets))
-		err := cli.Store.MsgSecrets.PutMessageSecrets(secrets)
+		err := cli.Store.MsgSecrets.PutMessageSecretsContext(ctx, secrets)
 		if err != nil {
 			cli.Log.Errorf("Failed to store message secret keys in history sync: %v", err)
 		} else {
@@ -495,7 +556,7 @@ func (cli *Client) storeHistoricalMessageSecrets(conversations []*waProto.Conver
 	}
 	if len(privacyTokens) > 0 {
 		cli.Log.Debugf("Storing %d privacy tokens in history sync", len(privacyTokens))
-		err := cli.Store.PrivacyTokens.PutPrivacyTokens(privacyTokens...)
+		err := cli.Store.PrivacyTokens.PutPrivacyTokensContext(ctx, privacyTokens...)
 		if err != nil {
 			cli.Log.Errorf("Failed to store privacy tokens in history sync: %v", err)
 		} else {
@@ -504,10 +565,10 @@ func (cli *Client) storeHistoricalMessageSecrets(conversations []*waProto.Conver
 	}
 }
 
-func (cli *Client) handleDecryptedMessage(info *types.MessageInfo, msg *waProto.Message, retryCount int) {
-	cli.processProtocolParts(info, msg)
-	evt := &events.Message{Info: *info, RawMessage: msg, RetryCount: retryCount}
-	cli.dispatchEvent(evt.UnwrapRaw())
+func (cli *Client) handleDecryptedMessage(ctx context.Context, info *types.MessageInfo, msg *waProto.Message, retryCount int) {
+	evt := (&events.Message{Info: *info, RawMessage: msg, RetryCount: retryCount}).UnwrapRaw()
+	cli.updateChatFromMessage(ctx, evt)
+	cli.dispatchEvent(evt)
 }
 
 func (cli *Client) sendProtocolMessageReceipt(id, msgType string) {
@@ -0,0 +1,215 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Number of sent messages whose status is tracked in memory.
+const messageStatusCacheSize = 1024
+
+type trackedMessage struct {
+	types.OutgoingMessageStatus
+	// The status reported by the server, i.e. pending, sent, server ack or failed.
+	serverStatus types.MessageStatus
+	// The users who should receive the message in groups and broadcast lists.
+	participants []types.JID
+}
+
+// recipientStatus returns the lowest status of all recipients, where the status of each recipient user
+// is the highest status of any of their devices.
+func (msg *trackedMessage) recipientStatus() types.MessageStatus {
+	users := msg.participants
+	if users == nil {
+		users = []types.JID{msg.Chat.ToNonAD()}
+	} else if len(users) == 0 {
+		return 0
+	}
+	userStatuses := make(map[types.JID]types.MessageStatus, len(users))
+	for device, status := range msg.Recipients {
+		user := device.ToNonAD()
+		if status > userStatuses[user] {
+			userStatuses[user] = status
+		}
+	}
+	lowest := types.MessageStatusPlayed
+	for _, user := range users {
+		if userStatuses[user] < lowest {
+			lowest = userStatuses[user]
+		}
+	}
+	return lowest
+}
+
+func (msg *trackedMessage) updateStatus(ts time.Time) (prev types.MessageStatus, changed bool) {
+	prev = msg.Status
+	newStatus := msg.serverStatus
+	// recipientStatus is zero until every recipient has sent a receipt, which shouldn't mark pending messages as failed
+	if recipientStatus := msg.recipientStatus(); recipientStatus >= types.MessageStatusDelivered && recipientStatus > newStatus {
+		newStatus = recipientStatus
+	}
+	if newStatus != prev {
+		msg.Status = newStatus
+		msg.Timestamp = ts
+		changed = true
+	}
+	return
+}
+
+// getTrackedMessage returns the tracked status of the given message, optionally starting to track it if it's not
+// tracked yet. The caller must hold messageStatusLock.
+func (cli *Client) getTrackedMessage(chat types.JID, id types.MessageID, create bool) *trackedMessage {
+	key := recentMessageKey{chat, id}
+	msg, ok := cli.messageStatusMap[key]
+	if ok || !create {
+		return msg
+	}
+	if cli.messageStatusList[cli.messageStatusPtr].ID != "" {
+		delete(cli.messageStatusMap, cli.messageStatusList[cli.messageStatusPtr])
+	}
+	msg = &trackedMessage{
+		OutgoingMessageStatus: types.OutgoingMessageStatus{
+			Chat:       chat,
+			ID:         id,
+			Status:     types.MessageStatusPending,
+			Recipients: make(map[types.JID]types.MessageStatus),
+			Timestamp:  time.Now(),
+		},
+		serverStatus: types.MessageStatusPending,
+	}
+	cli.messageStatusMap[key] = msg
+	cli.messageStatusList[cli.messageStatusPtr] = key
+	cli.messageStatusPtr++
+	if cli.messageStatusPtr >= len(cli.messageStatusList) {
+		cli.messageStatusPtr = 0
+	}
+	return msg
+}
+
+// setMessageRecipients stores the participants a group or broadcast list message is being sent to,
+// which are needed to know when the message has been delivered to or read by everyone.
+func (cli *Client) setMessageRecipients(chat types.JID, id types.MessageID, participants []types.JID) {
+	ownUser := cli.getOwnID().ToNonAD()
+	users := make([]types.JID, 0, len(participants))
+	for _, participant := range participants {
+		if participant.ToNonAD() != ownUser {
+			users = append(users, participant.ToNonAD())
+		}
+	}
+	cli.messageStatusLock.Lock()
+	cli.getTrackedMessage(chat, id, true).participants = users
+	cli.messageStatusLock.Unlock()
+}
+
+// setServerMessageStatus updates the status of an outgoing message based on the result of sending it.
+func (cli *Client) setServerMessageStatus(chat types.JID, id types.MessageID, status types.MessageStatus, ts time.Time) {
+	cli.messageStatusLock.Lock()
+	msg := cli.getTrackedMessage(chat, id, true)
+	msg.serverStatus = status
+	prev, changed := msg.updateStatus(ts)
+	if changed {
+		cli.queueMessageStatusEvents(&events.MessageStatusChanged{
+			Chat:           chat,
+			ID:             id,
+			PreviousStatus: prev,
+			Status:         msg.Status,
+			Timestamp:      ts,
+		})
+	}
+	cli.messageStatusLock.Unlock()
+}
+
+func receiptTypeToMessageStatus(receiptType events.ReceiptType) (types.MessageStatus, bool) {
+	switch receiptType {
+	case events.ReceiptTypeDelivered:
+		return types.MessageStatusDelivered, true
+	case events.ReceiptTypeRead:
+		return types.MessageStatusRead, true
+	case events.ReceiptTypePlayed:
+		return types.MessageStatusPlayed, true
+	default:
+		return 0, false
+	}
+}
+
+// handleMessageStatusReceipt updates the statuses of tracked outgoing messages based on a receipt from a recipient.
+func (cli *Client) handleMessageStatusReceipt(receipt *events.Receipt) {
+	status, ok := receiptTypeToMessageStatus(receipt.Type)
+	if !ok || receipt.IsFromMe {
+		return
+	}
+	cli.messageStatusLock.Lock()
+	defer cli.messageStatusLock.Unlock()
+	for _, id := range receipt.MessageIDs {
+		msg := cli.getTrackedMessage(receipt.Chat, id, false)
+		if msg == nil || msg.Recipients[receipt.Sender] >= status {
+			continue
+		}
+		msg.Recipients[receipt.Sender] = status
+		prev, _ := msg.updateStatus(receipt.Timestamp)
+		cli.queueMessageStatusEvents(&events.MessageStatusChanged{
+			Chat:            receipt.Chat,
+			ID:              id,
+			Recipient:       receipt.Sender,
+			RecipientStatus: status,
+			PreviousStatus:  prev,
+			Status:          msg.Status,
+			Timestamp:       receipt.Timestamp,
+		})
+	}
+}
+
+// queueMessageStatusEvents queues events to be dispatched in the background. The events are dispatched one by one
+// in the order they were queued, so handlers never see an older status after a newer one. The caller must hold
+// messageStatusLock, which ensures the queue order is the same as the order of the status changes.
+func (cli *Client) queueMessageStatusEvents(evts ...*events.MessageStatusChanged) {
+	cli.messageStatusQueue = append(cli.messageStatusQueue, evts...)
+	if !cli.messageStatusDispatching {
+		cli.messageStatusDispatching = true
+		go cli.dispatchMessageStatusEvents()
+	}
+}
+
+func (cli *Client) dispatchMessageStatusEvents() {
+	for {
+		cli.messageStatusLock.Lock()
+		if len(cli.messageStatusQueue) == 0 {
+			cli.messageStatusQueue = nil
+			cli.messageStatusDispatching = false
+			cli.messageStatusLock.Unlock()
+			return
+		}
+		evt := cli.messageStatusQueue[0]
+		cli.messageStatusQueue[0] = nil
+		cli.messageStatusQueue = cli.messageStatusQueue[1:]
+		cli.messageStatusLock.Unlock()
+		cli.dispatchEvent(evt)
+	}
+}
+
+// GetMessageStatus returns the current status of a message sent by this client, or nil if the message isn't tracked.
+//
+// The statuses are only kept in memory for the most recently sent messages, so messages sent before
+// the client was created or a long time ago won't be found.
+func (cli *Client) GetMessageStatus(chat types.JID, id types.MessageID) *types.OutgoingMessageStatus {
+	cli.messageStatusLock.Lock()
+	defer cli.messageStatusLock.Unlock()
+	msg := cli.getTrackedMessage(chat, id, false)
+	if msg == nil {
+		return nil
+	}
+	status := msg.OutgoingMessageStatus
+	status.Recipients = make(map[types.JID]types.MessageStatus, len(msg.Recipients))
+	for device, deviceStatus := range msg.Recipients {
+		status.Recipients[device] = deviceStatus
+	}
+	return &status
+}
@@ -7,6 +7,7 @@
 package whatsmeow
 
 import (
+	"context"
 	"errors"
 
 	"go.mau.fi/whatsmeow/appstate"
@@ -253,7 +254,7 @@ func (cli *Client) handlePrivacyTokenNotification(node *waBinary.Node) {
 	}
 }
 
-func (cli *Client) handleNotification(node *waBinary.Node) {
+func (cli *Client) handleNotification(ctx context.Context, node *waBinary.Node) {
 	ag := node.AttrGetter()
 	notifType := ag.String("type")
 	if !ag.OK() {
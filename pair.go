@@ -8,6 +8,7 @@ package whatsmeow
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -24,7 +25,7 @@ import (
 	"go.mau.fi/whatsmeow/util/keys"
 )
 
-func (cli *Client) handleIQ(node *waBinary.Node) {
+func (cli *Client) handleIQ(ctx context.Context, node *waBinary.Node) {
 	children := node.GetChildren()
 	if len(children) != 1 || node.Attrs["from"] != types.ServerJID {
 		return
@@ -7,6 +7,7 @@
 package whatsmeow
 
 import (
+	"context"
 	"fmt"
 	"sync/atomic"
 	"time"
@@ -16,19 +17,20 @@ import (
 	"go.mau.fi/whatsmeow/types/events"
 )
 
-func (cli *Client) handleReceipt(node *waBinary.Node) {
+func (cli *Client) handleReceipt(ctx context.Context, node *waBinary.Node) {
 	receipt, err := cli.parseReceipt(node)
 	if err != nil {
 		cli.Log.Warnf("Failed to parse receipt: %v", err)
 	} else if receipt != nil {
 		if receipt.Type == events.ReceiptTypeRetry {
 			go func() {
-				err := cli.handleRetryReceipt(receipt, node)
+				err := cli.handleRetryReceipt(ctx, receipt, node)
 				if err != nil {
 					cli.Log.Errorf("Failed to handle retry receipt for %s/%s from %s: %v", receipt.Chat, receipt.MessageIDs[0], receipt.Sender, err)
 				}
 			}()
 		}
+		cli.handleMessageStatusReceipt(receipt)
 		go cli.dispatchEvent(receipt)
 	}
 	go cli.sendAck(node)
@@ -50,6 +52,7 @@ func (cli *Client) handleGroupedReceipt(partialReceipt events.Receipt, participa
 			cli.Log.Warnf("Failed to parse user node %s in grouped receipt: %v", child.XMLString(), ag.Error())
 			continue
 		}
+		cli.handleMessageStatusReceipt(&receipt)
 		go cli.dispatchEvent(&receipt)
 	}
 }
@@ -154,7 +157,17 @@ func (cli *Client) MarkRead(ids []types.MessageID, timestamp time.Time, chat, se
 			Content: children,
 		}}
 	}
-	return cli.sendNode(node)
+	err := cli.sendNode(node)
+	if err != nil {
+		return err
+	}
+	if cli.Store.Chats != nil {
+		err = cli.Store.Chats.PutChatRead(chat, true)
+		if err != nil {
+			cli.Log.Warnf("Failed to reset unread count of %s after marking messages as read: %v", chat, err)
+		}
+	}
+	return nil
 }
 
 // SetForceActiveDeliveryReceipts will force the client to send normal delivery
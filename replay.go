@@ -0,0 +1,117 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"context"
+	"fmt"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/socket"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// replaySocket is a fake socket used by ReplayCapture. Nothing is actually sent anywhere.
+type replaySocket struct {
+	cli    *Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	onSend func(node *waBinary.Node)
+}
+
+func (rs *replaySocket) SendFrame(plaintext []byte) error {
+	if rs.ctx.Err() != nil {
+		return socket.ErrSocketClosed
+	}
+	data, err := waBinary.Unpack(plaintext)
+	if err != nil {
+		return fmt.Errorf("failed to decompress sent node: %w", err)
+	}
+	node, err := waBinary.Unmarshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to decode sent node: %w", err)
+	}
+	if rs.onSend != nil {
+		rs.onSend(node)
+	}
+	// Nobody will ever answer queries, so fail them immediately instead of letting them time out
+	iqType := node.AttrGetter().OptionalString("type")
+	if node.Tag == "iq" && (iqType == "get" || iqType == "set") {
+		rs.cli.receiveResponse(&waBinary.Node{
+			Tag:   "iq",
+			Attrs: waBinary.Attrs{"id": node.Attrs["id"], "type": "error", "from": types.ServerJID},
+			Content: []waBinary.Node{{
+				Tag:   "error",
+				Attrs: waBinary.Attrs{"code": 503, "text": "service-unavailable"},
+			}},
+		})
+	}
+	return nil
+}
+
+func (rs *replaySocket) IsConnected() bool {
+	return rs.ctx.Err() == nil
+}
+
+func (rs *replaySocket) Context() context.Context {
+	return rs.ctx
+}
+
+func (rs *replaySocket) Stop(disconnect bool) {
+	rs.cancel()
+}
+
+// ReplayCapture feeds the nodes that the original client received in the given capture into this client without
+// connecting to WhatsApp. The nodes that the original client sent and the nodes skipped by IsReplayableNode are ignored.
+//
+// The client must not be connected. Instead, it's given a fake socket: nodes the client sends while handling the
+// replayed nodes are passed to onSend (if it's not nil) and then dropped, and info queries are answered with an error.
+// The nodes are handled one by one in the calling goroutine, but handlers may still dispatch events and send acks
+// in the background after this returns, so the fake socket stays in place until Disconnect is called.
+//
+// Encrypted messages can only be decrypted if the client uses a copy of the device store of the client that made
+// the capture, taken before the capture was started.
+//
+//	nodes, err := whatsmeow.ReadCaptureFile("capture.jsonl")
+//	cli := whatsmeow.NewClient(deviceStoreCopy, log)
+//	err = cli.ReplayCapture(ctx, nodes, nil)
+//	defer cli.Disconnect()
+func (cli *Client) ReplayCapture(ctx context.Context, nodes []*CapturedNode, onSend func(node *waBinary.Node)) error {
+	rs := &replaySocket{cli: cli, onSend: onSend}
+	rs.ctx, rs.cancel = context.WithCancel(context.Background())
+	cli.socketLock.Lock()
+	if cli.socket != nil {
+		cli.socketLock.Unlock()
+		rs.cancel()
+		return ErrAlreadyConnected
+	}
+	cli.socket = rs
+	cli.socketLock.Unlock()
+
+	for i, captured := range nodes {
+		if captured.Direction != CaptureReceived {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		node, err := captured.Node()
+		if err != nil {
+			cli.Log.Warnf("Failed to decode node #%d in capture: %v", i+1, err)
+			continue
+		} else if !IsReplayableNode(node) {
+			continue
+		}
+		cli.recvLog.Debugf("%s", node.XMLString())
+		if handler, ok := cli.nodeHandlers[node.Tag]; ok {
+			handler(rs.ctx, node)
+		} else {
+			cli.Log.Debugf("Didn't handle WhatsApp node %s", node.Tag)
+		}
+	}
+	return nil
+}
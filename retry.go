@@ -27,6 +27,9 @@ import (
 // Number of sent messages to cache in memory for handling retry receipts.
 const recentMessagesSize = 256
 
+// How often expired messages are deleted from the recent message store.
+const recentMessagesPruneInterval = 1 * time.Hour
+
 type recentMessageKey struct {
 	To types.JID
 	ID types.MessageID
@@ -38,7 +41,7 @@ type RecentMessage struct {
 	Timestamp time.Time
 }
 
-func (cli *Client) addRecentMessage(to types.JID, id types.MessageID, message *waProto.Message) {
+func (cli *Client) addRecentMessage(ctx context.Context, to types.JID, id types.MessageID, message *waProto.Message) {
 	cli.recentMessagesLock.Lock()
 	key := recentMessageKey{to, id}
 	if cli.recentMessagesList[cli.recentMessagesPtr].ID != "" {
@@ -50,7 +53,40 @@ func (cli *Client) addRecentMessage(to types.JID, id types.MessageID, message *w
 	if cli.recentMessagesPtr >= len(cli.recentMessagesList) {
 		cli.recentMessagesPtr = 0
 	}
+	shouldPrune := time.Since(cli.recentMessagesLastPrune) > recentMessagesPruneInterval
+	if shouldPrune {
+		cli.recentMessagesLastPrune = time.Now()
+	}
 	cli.recentMessagesLock.Unlock()
+
+	if cli.RecentMessageTTL <= 0 || cli.Store.RecentMessages == nil {
+		return
+	}
+	data, err := proto.Marshal(message)
+	if err != nil {
+		cli.Log.Warnf("Failed to marshal message %s to store for retry receipts: %v", id, err)
+		return
+	}
+	err = cli.Store.RecentMessages.PutRecentMessageContext(ctx, to, id, data, time.Now().Add(cli.RecentMessageTTL))
+	if err != nil {
+		cli.Log.Warnf("Failed to store message %s for retry receipts: %v", id, err)
+	}
+	if shouldPrune {
+		go cli.pruneRecentMessages()
+	}
+}
+
+// pruneRecentMessages deletes expired messages from the recent message store. It's called after connecting
+// and then at most once per recentMessagesPruneInterval when sending messages. Expired messages are deleted
+// even if RecentMessageTTL is disabled, so that disabling it doesn't leave old messages in the store.
+func (cli *Client) pruneRecentMessages() {
+	if cli.Store.RecentMessages == nil {
+		return
+	}
+	err := cli.Store.RecentMessages.DeleteExpiredRecentMessages(time.Now())
+	if err != nil {
+		cli.Log.Warnf("Failed to delete expired messages from recent message store: %v", err)
+	}
 }
 
 func (cli *Client) getRecentMessage(to types.JID, id types.MessageID) *waProto.Message {
@@ -60,17 +96,36 @@ func (cli *Client) getRecentMessage(to types.JID, id types.MessageID) *waProto.M
 	return msg
 }
 
+func (cli *Client) getStoredRecentMessage(to types.JID, id types.MessageID) *waProto.Message {
+	if cli.Store.RecentMessages == nil {
+		return nil
+	}
+	data, err := cli.Store.RecentMessages.GetRecentMessage(to, id)
+	if err != nil {
+		cli.Log.Warnf("Failed to get message %s from recent message store: %v", id, err)
+		return nil
+	} else if data == nil {
+		return nil
+	}
+	var msg waProto.Message
+	err = proto.Unmarshal(data, &msg)
+	if err != nil {
+		cli.Log.Warnf("Failed to unmarshal message %s from recent message store: %v", id, err)
+		return nil
+	}
+	return &msg
+}
+
 func (cli *Client) getMessageForRetry(receipt *events.Receipt, messageID types.MessageID) (*waProto.Message, error) {
 	msg := cli.getRecentMessage(receipt.Chat, messageID)
-	if msg == nil {
-		msg = cli.GetMessageForRetry(receipt.Sender, receipt.Chat, messageID)
-		if msg == nil {
-			return nil, fmt.Errorf("couldn't find message %s", messageID)
-		} else {
-			cli.Log.Debugf("Found message in GetMessageForRetry to accept retry receipt for %s/%s from %s", receipt.Chat, messageID, receipt.Sender)
-		}
-	} else {
+	if msg != nil {
 		cli.Log.Debugf("Found message in local cache to accept retry receipt for %s/%s from %s", receipt.Chat, messageID, receipt.Sender)
+	} else if msg = cli.getStoredRecentMessage(receipt.Chat, messageID); msg != nil {
+		cli.Log.Debugf("Found message in recent message store to accept retry receipt for %s/%s from %s", receipt.Chat, messageID, receipt.Sender)
+	} else if msg = cli.GetMessageForRetry(receipt.Sender, receipt.Chat, messageID); msg != nil {
+		cli.Log.Debugf("Found message in GetMessageForRetry to accept retry receipt for %s/%s from %s", receipt.Chat, messageID, receipt.Sender)
+	} else {
+		return nil, fmt.Errorf("couldn't find message %s", messageID)
 	}
 	return proto.Clone(msg).(*waProto.Message), nil
 }
@@ -95,7 +150,7 @@ func (cli *Client) shouldRecreateSession(retryCount int, jid types.JID) (reason
 }
 
 // handleRetryReceipt handles an incoming retry receipt for an outgoing message.
-func (cli *Client) handleRetryReceipt(receipt *events.Receipt, node *waBinary.Node) error {
+func (cli *Client) handleRetryReceipt(ctx context.Context, receipt *events.Receipt, node *waBinary.Node) error {
 	retryChild, ok := node.GetOptionalChildByTag("retry")
 	if !ok {
 		return &ElementMissingError{Tag: "retry", In: "retry receipt"}
@@ -156,7 +211,7 @@ func (cli *Client) handleRetryReceipt(receipt *events.Receipt, node *waBinary.No
 	} else if reason, recreate := cli.shouldRecreateSession(retryCount, receipt.Sender); recreate {
 		cli.Log.Debugf("Fetching prekeys for %s for handling retry receipt with no prekey bundle because %s", receipt.Sender, reason)
 		var keys map[types.JID]preKeyResp
-		keys, err = cli.fetchPreKeys(context.TODO(), []types.JID{receipt.Sender})
+		keys, err = cli.fetchPreKeys(ctx, []types.JID{receipt.Sender})
 		if err != nil {
 			return err
 		}
@@ -171,10 +226,15 @@ func (cli *Client) handleRetryReceipt(receipt *events.Receipt, node *waBinary.No
 	if mediaType := getMediaTypeFromMessage(msg); mediaType != "" {
 		encAttrs["mediatype"] = mediaType
 	}
-	encrypted, includeDeviceIdentity, err := cli.encryptMessageForDevice(plaintext, receipt.Sender, bundle, encAttrs)
+	uow := cli.Store.NewUnitOfWork(ctx)
+	encrypted, includeDeviceIdentity, err := cli.encryptMessageForDevice(uow, plaintext, receipt.Sender, bundle, encAttrs)
 	if err != nil {
 		return fmt.Errorf("failed to encrypt message for retry: %w", err)
 	}
+	err = uow.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to store session after encrypting message for retry: %w", err)
+	}
 	encrypted.Attrs["count"] = retryCount
 
 	attrs := waBinary.Attrs{
@@ -29,6 +29,7 @@ import (
 
 	waBinary "go.mau.fi/whatsmeow/binary"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
 )
@@ -159,10 +160,10 @@ func (cli *Client) SendMessage(ctx context.Context, to types.JID, message *waPro
 	respChan := cli.waitResponse(req.ID)
 	// Peer message retries aren't implemented yet
 	if !req.Peer {
-		cli.addRecentMessage(to, req.ID, message)
+		cli.addRecentMessage(ctx, to, req.ID, message)
 	}
 	if message.GetMessageContextInfo().GetMessageSecret() != nil {
-		err = cli.Store.MsgSecrets.PutMessageSecret(to, ownID, req.ID, message.GetMessageContextInfo().GetMessageSecret())
+		err = cli.Store.MsgSecrets.PutMessageSecretContext(ctx, to, ownID, req.ID, message.GetMessageContextInfo().GetMessageSecret(), time.Now())
 		if err != nil {
 			cli.Log.Warnf("Failed to store message secret key for outgoing message %s: %v", req.ID, err)
 		} else {
@@ -176,7 +177,7 @@ func (cli *Client) SendMessage(ctx context.Context, to types.JID, message *waPro
 		phash, data, err = cli.sendGroup(ctx, to, ownID, req.ID, message, &resp.DebugTimings)
 	case types.DefaultUserServer:
 		if req.Peer {
-			data, err = cli.sendPeerMessage(to, req.ID, message, &resp.DebugTimings)
+			data, err = cli.sendPeerMessage(ctx, to, req.ID, message, &resp.DebugTimings)
 		} else {
 			data, err = cli.sendDM(ctx, to, ownID, req.ID, message, &resp.DebugTimings)
 		}
@@ -186,13 +187,22 @@ func (cli *Client) SendMessage(ctx context.Context, to types.JID, message *waPro
 	start = time.Now()
 	if err != nil {
 		cli.cancelResponse(req.ID, respChan)
+		if !req.Peer {
+			cli.setServerMessageStatus(to, req.ID, types.MessageStatusFailed, time.Now())
+		}
 		return
 	}
+	if !req.Peer {
+		cli.setServerMessageStatus(to, req.ID, types.MessageStatusSent, time.Now())
+	}
 	var respNode *waBinary.Node
 	select {
 	case respNode = <-respChan:
 	case <-ctx.Done():
 		err = ctx.Err()
+		if !req.Peer {
+			cli.setServerMessageStatus(to, req.ID, types.MessageStatusFailed, time.Now())
+		}
 		return
 	}
 	resp.DebugTimings.Resp = time.Since(start)
@@ -201,6 +211,9 @@ func (cli *Client) SendMessage(ctx context.Context, to types.JID, message *waPro
 		respNode, err = cli.retryFrame("message send", req.ID, data, respNode, ctx, 0)
 		resp.DebugTimings.Retry = time.Since(start)
 		if err != nil {
+			if !req.Peer {
+				cli.setServerMessageStatus(to, req.ID, types.MessageStatusFailed, time.Now())
+			}
 			return
 		}
 	}
@@ -209,6 +222,14 @@ func (cli *Client) SendMessage(ctx context.Context, to types.JID, message *waPro
 	if errorCode := ag.Int("error"); errorCode != 0 {
 		err = fmt.Errorf("%w %d", ErrServerReturnedError, errorCode)
 	}
+	if !req.Peer {
+		if err != nil {
+			cli.setServerMessageStatus(to, req.ID, types.MessageStatusFailed, time.Now())
+		} else {
+			cli.setServerMessageStatus(to, req.ID, types.MessageStatusServerAck, resp.Timestamp)
+			cli.updateChatFromSentMessage(ctx, to, req.ID, resp.Timestamp, message)
+		}
+	}
 	expectedPHash := ag.OptionalString("phash")
 	if len(expectedPHash) > 0 && phash != expectedPHash {
 		cli.Log.Warnf("Server returned different participant list hash when sending to %s. Some devices may not have received the message.", to)
@@ -441,6 +462,7 @@ func (cli *Client) sendGroup(ctx context.Context, to, ownID types.JID, id types.
 		}
 	}
 	timings.GetParticipants = time.Since(start)
+	cli.setMessageRecipients(to, id, participants)
 	start = time.Now()
 	plaintext, _, err := marshalMessage(to, message)
 	timings.Marshal = time.Since(start)
@@ -449,9 +471,13 @@ func (cli *Client) sendGroup(ctx context.Context, to, ownID types.JID, id types.
 	}
 
 	start = time.Now()
-	builder := groups.NewGroupSessionBuilder(cli.Store, pbSerializer)
+	signalStore := cli.Store.WithContext(ctx)
+	builder := groups.NewGroupSessionBuilder(signalStore, pbSerializer)
 	senderKeyName := protocol.NewSenderKeyName(to.String(), ownID.SignalAddress())
 	signalSKDMessage, err := builder.Create(senderKeyName)
+	if err == nil {
+		err = signalStore.Err()
+	}
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to create sender key distribution message to send %s to %s: %w", id, to, err)
 	}
@@ -466,8 +492,11 @@ func (cli *Client) sendGroup(ctx context.Context, to, ownID types.JID, id types.
 		return "", nil, fmt.Errorf("failed to marshal sender key distribution message to send %s to %s: %w", id, to, err)
 	}
 
-	cipher := groups.NewGroupCipher(builder, senderKeyName, cli.Store)
+	cipher := groups.NewGroupCipher(builder, senderKeyName, signalStore)
 	encrypted, err := cipher.Encrypt(padMessage(plaintext))
+	if err == nil {
+		err = signalStore.Err()
+	}
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to encrypt group message to send %s to %s: %w", id, to, err)
 	}
@@ -500,8 +529,8 @@ func (cli *Client) sendGroup(ctx context.Context, to, ownID types.JID, id types.
 	return phash, data, nil
 }
 
-func (cli *Client) sendPeerMessage(to types.JID, id types.MessageID, message *waProto.Message, timings *MessageDebugTimings) ([]byte, error) {
-	node, err := cli.preparePeerMessageNode(to, id, message, timings)
+func (cli *Client) sendPeerMessage(ctx context.Context, to types.JID, id types.MessageID, message *waProto.Message, timings *MessageDebugTimings) ([]byte, error) {
+	node, err := cli.preparePeerMessageNode(ctx, to, id, message, timings)
 	if err != nil {
 		return nil, err
 	}
@@ -686,7 +715,7 @@ func getEditAttribute(msg *waProto.Message) string {
 	return EditAttributeEmpty
 }
 
-func (cli *Client) preparePeerMessageNode(to types.JID, id types.MessageID, message *waProto.Message, timings *MessageDebugTimings) (*waBinary.Node, error) {
+func (cli *Client) preparePeerMessageNode(ctx context.Context, to types.JID, id types.MessageID, message *waProto.Message, timings *MessageDebugTimings) (*waBinary.Node, error) {
 	attrs := waBinary.Attrs{
 		"id":       id,
 		"type":     "text",
@@ -704,7 +733,11 @@ func (cli *Client) preparePeerMessageNode(to types.JID, id types.MessageID, mess
 		return nil, err
 	}
 	start = time.Now()
-	encrypted, isPreKey, err := cli.encryptMessageForDevice(plaintext, to, nil, nil)
+	uow := cli.Store.NewUnitOfWork(ctx)
+	encrypted, isPreKey, err := cli.encryptMessageForDevice(uow, plaintext, to, nil, nil)
+	if err == nil {
+		err = uow.Commit()
+	}
 	timings.PeerEncrypt = time.Since(start)
 	if err != nil {
 		return nil, fmt.Errorf("failed to encrypt peer message for %s: %v", to, err)
@@ -777,8 +810,11 @@ func (cli *Client) prepareMessageNode(ctx context.Context, to, ownID types.JID,
 	}
 
 	start = time.Now()
-	participantNodes, includeIdentity := cli.encryptMessageForDevices(ctx, allDevices, ownID, id, plaintext, dsmPlaintext, encAttrs)
+	participantNodes, includeIdentity, err := cli.encryptMessageForDevices(ctx, allDevices, ownID, id, plaintext, dsmPlaintext, encAttrs)
 	timings.PeerEncrypt = time.Since(start)
+	if err != nil {
+		return nil, nil, err
+	}
 	participantNode := waBinary.Node{
 		Tag:     "participants",
 		Content: participantNodes,
@@ -824,7 +860,9 @@ func (cli *Client) makeDeviceIdentityNode() waBinary.Node {
 	}
 }
 
-func (cli *Client) encryptMessageForDevices(ctx context.Context, allDevices []types.JID, ownID types.JID, id string, msgPlaintext, dsmPlaintext []byte, encAttrs waBinary.Attrs) ([]waBinary.Node, bool) {
+func (cli *Client) encryptMessageForDevices(ctx context.Context, allDevices []types.JID, ownID types.JID, id string, msgPlaintext, dsmPlaintext []byte, encAttrs waBinary.Attrs) ([]waBinary.Node, bool, error) {
+	// All session changes are stored in one go after encrypting for every device
+	uow := cli.Store.NewUnitOfWork(ctx)
 	includeIdentity := false
 	participantNodes := make([]waBinary.Node, 0, len(allDevices))
 	var retryDevices []types.JID
@@ -836,7 +874,7 @@ func (cli *Client) encryptMessageForDevices(ctx context.Context, allDevices []ty
 			}
 			plaintext = dsmPlaintext
 		}
-		encrypted, isPreKey, err := cli.encryptMessageForDeviceAndWrap(plaintext, jid, nil, encAttrs)
+		encrypted, isPreKey, err := cli.encryptMessageForDeviceAndWrap(uow, plaintext, jid, nil, encAttrs)
 		if errors.Is(err, ErrNoSession) {
 			retryDevices = append(retryDevices, jid)
 			continue
@@ -850,6 +888,12 @@ func (cli *Client) encryptMessageForDevices(ctx context.Context, allDevices []ty
 		}
 	}
 	if len(retryDevices) > 0 {
+		// Store the sessions before fetching prekeys, so they aren't held in memory over the network request,
+		// where another message could update the same sessions in the meantime.
+		err := uow.Commit()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to store sessions after encrypting %s: %w", id, err)
+		}
 		bundles, err := cli.fetchPreKeys(ctx, retryDevices)
 		if err != nil {
 			cli.Log.Warnf("Failed to fetch prekeys for %v to retry encryption: %v", retryDevices, err)
@@ -864,7 +908,7 @@ func (cli *Client) encryptMessageForDevices(ctx context.Context, allDevices []ty
 				if jid.User == ownID.User && dsmPlaintext != nil {
 					plaintext = dsmPlaintext
 				}
-				encrypted, isPreKey, err := cli.encryptMessageForDeviceAndWrap(plaintext, jid, resp.bundle, encAttrs)
+				encrypted, isPreKey, err := cli.encryptMessageForDeviceAndWrap(uow, plaintext, jid, resp.bundle, encAttrs)
 				if err != nil {
 					cli.Log.Warnf("Failed to encrypt %s for %s (retry): %v", id, jid, err)
 					continue
@@ -876,11 +920,15 @@ func (cli *Client) encryptMessageForDevices(ctx context.Context, allDevices []ty
 			}
 		}
 	}
-	return participantNodes, includeIdentity
+	err := uow.Commit()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to store sessions after encrypting %s: %w", id, err)
+	}
+	return participantNodes, includeIdentity, nil
 }
 
-func (cli *Client) encryptMessageForDeviceAndWrap(plaintext []byte, to types.JID, bundle *prekey.Bundle, encAttrs waBinary.Attrs) (*waBinary.Node, bool, error) {
-	node, includeDeviceIdentity, err := cli.encryptMessageForDevice(plaintext, to, bundle, encAttrs)
+func (cli *Client) encryptMessageForDeviceAndWrap(uow *store.UnitOfWork, plaintext []byte, to types.JID, bundle *prekey.Bundle, encAttrs waBinary.Attrs) (*waBinary.Node, bool, error) {
+	node, includeDeviceIdentity, err := cli.encryptMessageForDevice(uow, plaintext, to, bundle, encAttrs)
 	if err != nil {
 		return nil, false, err
 	}
@@ -897,24 +945,30 @@ func copyAttrs(from, to waBinary.Attrs) {
 	}
 }
 
-func (cli *Client) encryptMessageForDevice(plaintext []byte, to types.JID, bundle *prekey.Bundle, extraAttrs waBinary.Attrs) (*waBinary.Node, bool, error) {
-	builder := session.NewBuilderFromSignal(cli.Store, to.SignalAddress(), pbSerializer)
+func (cli *Client) encryptMessageForDevice(uow *store.UnitOfWork, plaintext []byte, to types.JID, bundle *prekey.Bundle, extraAttrs waBinary.Attrs) (*waBinary.Node, bool, error) {
+	builder := session.NewBuilderFromSignal(uow, to.SignalAddress(), pbSerializer)
 	if bundle != nil {
 		cli.Log.Debugf("Processing prekey bundle for %s", to)
 		err := builder.ProcessBundle(bundle)
 		if cli.AutoTrustIdentity && errors.Is(err, signalerror.ErrUntrustedIdentity) {
 			cli.Log.Warnf("Got %v error while trying to process prekey bundle for %s, clearing stored identity and retrying", err, to)
-			cli.clearUntrustedIdentity(to)
+			cli.clearUntrustedIdentity(uow, to)
 			err = builder.ProcessBundle(bundle)
 		}
 		if err != nil {
 			return nil, false, fmt.Errorf("failed to process prekey bundle: %w", err)
 		}
-	} else if !cli.Store.ContainsSession(to.SignalAddress()) {
+	} else if !uow.ContainsSession(to.SignalAddress()) {
+		if err := uow.Err(); err != nil {
+			return nil, false, fmt.Errorf("failed to check session: %w", err)
+		}
 		return nil, false, ErrNoSession
 	}
 	cipher := session.NewCipher(builder, to.SignalAddress())
 	ciphertext, err := cipher.Encrypt(padMessage(plaintext))
+	if err == nil {
+		err = uow.Err()
+	}
 	if err != nil {
 		return nil, false, fmt.Errorf("cipher encryption failed: %w", err)
 	}
@@ -8,8 +8,10 @@ package socket
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"sync"
@@ -22,6 +24,24 @@ import (
 
 type Proxy = func(*http.Request) (*url.URL, error)
 
+// DialOptions contains optional settings for dialing the websocket. The zero value connects to the WhatsApp web servers.
+type DialOptions struct {
+	// URL is the websocket URL to connect to. Defaults to URL.
+	URL string
+	// Origin is the value of the Origin header. Defaults to Origin.
+	Origin string
+	// Header contains extra HTTP headers to send in the websocket upgrade request.
+	Header http.Header
+	// TLSConfig is the TLS configuration to use for wss:// URLs. Defaults to the crypto/tls defaults.
+	TLSConfig *tls.Config
+	// NetDialContext is used to create the TCP connection, e.g. the DialContext method of
+	// a net.Dialer with LocalAddr set to bind the connection to a specific source IP.
+	// When a proxy is set, this is used to connect to the proxy.
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// HandshakeTimeout is the timeout for the TCP, TLS and websocket handshakes. Zero means no timeout.
+	HandshakeTimeout time.Duration
+}
+
 type FrameSocket struct {
 	conn   *websocket.Conn
 	ctx    context.Context
@@ -33,8 +53,9 @@ type FrameSocket struct {
 	OnDisconnect func(remote bool)
 	WriteTimeout time.Duration
 
-	Header []byte
-	Proxy  Proxy
+	Header      []byte
+	Proxy       Proxy
+	DialOptions DialOptions
 
 	incomingLength int
 	receivedLength int
@@ -99,12 +120,26 @@ func (fs *FrameSocket) Connect() error {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	dialer := websocket.Dialer{
-		Proxy: fs.Proxy,
+		Proxy:            fs.Proxy,
+		TLSClientConfig:  fs.DialOptions.TLSConfig,
+		NetDialContext:   fs.DialOptions.NetDialContext,
+		HandshakeTimeout: fs.DialOptions.HandshakeTimeout,
 	}
 
-	headers := http.Header{"Origin": []string{Origin}}
-	fs.log.Debugf("Dialing %s", URL)
-	conn, _, err := dialer.Dial(URL, headers)
+	wsURL, origin := fs.DialOptions.URL, fs.DialOptions.Origin
+	if wsURL == "" {
+		wsURL = URL
+	}
+	if origin == "" {
+		origin = Origin
+	}
+	headers := fs.DialOptions.Header.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Set("Origin", origin)
+	fs.log.Debugf("Dialing %s", wsURL)
+	conn, _, err := dialer.Dial(wsURL, headers)
 	if err != nil {
 		cancel()
 		return fmt.Errorf("couldn't dial whatsapp web websocket: %w", err)
@@ -74,13 +74,24 @@ func (nh *NoiseHandshake) Decrypt(ciphertext []byte) (plaintext []byte, err erro
 	return
 }
 
-func (nh *NoiseHandshake) Finish(fs *FrameSocket, frameHandler FrameHandler, disconnectHandler DisconnectHandler) (*NoiseSocket, error) {
+// FinalCiphers derives the ciphers for the encrypted transport after the handshake is complete.
+//
+// The client encrypts frames with the write cipher and decrypts them with the read cipher,
+// so the server end of the connection must use them the other way around.
+func (nh *NoiseHandshake) FinalCiphers() (writeKey, readKey cipher.AEAD, err error) {
 	if write, read, err := nh.extractAndExpand(nh.salt, nil); err != nil {
-		return nil, fmt.Errorf("failed to extract final keys: %w", err)
-	} else if writeKey, err := gcmutil.Prepare(write); err != nil {
-		return nil, fmt.Errorf("failed to create final write cipher: %w", err)
-	} else if readKey, err := gcmutil.Prepare(read); err != nil {
-		return nil, fmt.Errorf("failed to create final read cipher: %w", err)
+		return nil, nil, fmt.Errorf("failed to extract final keys: %w", err)
+	} else if writeKey, err = gcmutil.Prepare(write); err != nil {
+		return nil, nil, fmt.Errorf("failed to create final write cipher: %w", err)
+	} else if readKey, err = gcmutil.Prepare(read); err != nil {
+		return nil, nil, fmt.Errorf("failed to create final read cipher: %w", err)
+	}
+	return
+}
+
+func (nh *NoiseHandshake) Finish(fs *FrameSocket, frameHandler FrameHandler, disconnectHandler DisconnectHandler) (*NoiseSocket, error) {
+	if writeKey, readKey, err := nh.FinalCiphers(); err != nil {
+		return nil, err
 	} else if ns, err := newNoiseSocket(fs, writeKey, readKey, frameHandler, disconnectHandler); err != nil {
 		return nil, fmt.Errorf("failed to create noise socket: %w", err)
 	} else {
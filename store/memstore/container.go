@@ -0,0 +1,258 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memstore
+
+import (
+	"errors"
+	mathRand "math/rand"
+	"sort"
+	"sync"
+
+	"go.mau.fi/util/random"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/util/keys"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Container is an in-memory store that can contain multiple whatsmeow sessions.
+//
+// All data is lost when the process exits, unless the container was created with NewWithSnapshot
+// and Save is called before exiting.
+type Container struct {
+	log          waLog.Logger
+	snapshotPath string
+
+	lock    sync.RWMutex
+	devices map[types.JID]deviceRecord
+	stores  map[types.JID]*MemStore
+}
+
+var _ store.DeviceContainer = (*Container)(nil)
+
+// deviceRecord contains the same device fields as the whatsmeow_device table in sqlstore.
+type deviceRecord struct {
+	JID            types.JID
+	RegistrationID uint32
+	NoiseKey       [32]byte
+	IdentityKey    [32]byte
+
+	SignedPreKey    [32]byte
+	SignedPreKeyID  uint32
+	SignedPreKeySig [64]byte
+
+	AdvKey           []byte
+	AdvDetails       []byte
+	AdvAccountSig    []byte
+	AdvAccountSigKey []byte
+	AdvDeviceSig     []byte
+
+	Platform     string
+	BusinessName string
+	PushName     string
+}
+
+// New creates a new empty in-memory Container.
+//
+// The logger can be nil and will default to a no-op logger.
+func New(log waLog.Logger) *Container {
+	if log == nil {
+		log = waLog.Noop
+	}
+	return &Container{
+		log:     log,
+		devices: make(map[types.JID]deviceRecord),
+		stores:  make(map[types.JID]*MemStore),
+	}
+}
+
+// ErrDeviceIDMustBeSet is the error returned by PutDevice if you try to save a device before knowing its JID.
+var ErrDeviceIDMustBeSet = errors.New("device JID must be known before accessing the store")
+
+func (c *Container) getStore(jid types.JID) *MemStore {
+	memStore, ok := c.stores[jid]
+	if !ok {
+		memStore = NewMemStore(c, jid)
+		c.stores[jid] = memStore
+	}
+	return memStore
+}
+
+func (c *Container) attachStores(device *store.Device, memStore *MemStore) {
+	device.Identities = memStore
+	device.Sessions = memStore
+	device.PreKeys = memStore
+	device.SenderKeys = memStore
+	device.AppStateKeys = memStore
+	device.AppState = memStore
+	device.Contacts = memStore
+	device.ChatSettings = memStore
+	device.Chats = memStore
+	device.MsgSecrets = memStore
+	device.PrivacyTokens = memStore
+	device.RecentMessages = memStore
+	device.History = memStore
+	device.Initialized = true
+}
+
+func (c *Container) newDeviceFromRecord(record deviceRecord) *store.Device {
+	jid := record.JID
+	device := &store.Device{
+		Log:       c.log,
+		Container: c,
+
+		NoiseKey:       keys.NewKeyPairFromPrivateKey(record.NoiseKey),
+		IdentityKey:    keys.NewKeyPairFromPrivateKey(record.IdentityKey),
+		RegistrationID: record.RegistrationID,
+		AdvSecretKey:   append([]byte(nil), record.AdvKey...),
+		SignedPreKey: &keys.PreKey{
+			KeyPair:   *keys.NewKeyPairFromPrivateKey(record.SignedPreKey),
+			KeyID:     record.SignedPreKeyID,
+			Signature: &record.SignedPreKeySig,
+		},
+
+		ID: &jid,
+		Account: &waProto.ADVSignedDeviceIdentity{
+			Details:             record.AdvDetails,
+			AccountSignature:    record.AdvAccountSig,
+			AccountSignatureKey: record.AdvAccountSigKey,
+			DeviceSignature:     record.AdvDeviceSig,
+		},
+		Platform:     record.Platform,
+		BusinessName: record.BusinessName,
+		PushName:     record.PushName,
+	}
+	c.attachStores(device, c.getStore(jid))
+	return device
+}
+
+// GetAllDevices returns all the devices in the container, sorted by JID.
+func (c *Container) GetAllDevices() ([]*store.Device, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	records := make([]deviceRecord, 0, len(c.devices))
+	for _, record := range c.devices {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].JID.String() < records[j].JID.String()
+	})
+	devices := make([]*store.Device, len(records))
+	for i, record := range records {
+		devices[i] = c.newDeviceFromRecord(record)
+	}
+	return devices, nil
+}
+
+// GetFirstDevice is a convenience method for getting the first device in the store. If there are
+// no devices, then a new device will be created. You should only use this if you don't want to
+// have multiple sessions simultaneously.
+func (c *Container) GetFirstDevice() (*store.Device, error) {
+	devices, err := c.GetAllDevices()
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return c.NewDevice(), nil
+	} else {
+		return devices[0], nil
+	}
+}
+
+// GetDevice finds the device with the specified JID in the container.
+//
+// If the device is not found, nil is returned instead.
+//
+// Note that the parameter usually must be an AD-JID.
+func (c *Container) GetDevice(jid types.JID) (*store.Device, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	record, ok := c.devices[jid]
+	if !ok {
+		return nil, nil
+	}
+	return c.newDeviceFromRecord(record), nil
+}
+
+// NewDevice creates a new device in this container.
+//
+// No data is actually stored before Save is called. However, the pairing process will automatically
+// call Save after a successful pairing, so you most likely don't need to call it yourself.
+func (c *Container) NewDevice() *store.Device {
+	device := &store.Device{
+		Log:       c.log,
+		Container: c,
+
+		NoiseKey:       keys.NewKeyPair(),
+		IdentityKey:    keys.NewKeyPair(),
+		RegistrationID: mathRand.Uint32(),
+		AdvSecretKey:   random.Bytes(32),
+	}
+	device.SignedPreKey = device.IdentityKey.CreateSignedPreKey(1)
+	return device
+}
+
+// PutDevice stores the given device in this container. This should be called through Device.Save()
+// (which usually doesn't need to be called manually, as the library does that automatically when relevant).
+func (c *Container) PutDevice(device *store.Device) error {
+	if device.ID == nil {
+		return ErrDeviceIDMustBeSet
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	jid := *device.ID
+	record, exists := c.devices[jid]
+	if !exists {
+		// Like the SQL store, only the platform and names can be changed after the device is first stored
+		record = deviceRecord{
+			JID:             jid,
+			RegistrationID:  device.RegistrationID,
+			NoiseKey:        *device.NoiseKey.Priv,
+			IdentityKey:     *device.IdentityKey.Priv,
+			SignedPreKey:    *device.SignedPreKey.Priv,
+			SignedPreKeyID:  device.SignedPreKey.KeyID,
+			SignedPreKeySig: *device.SignedPreKey.Signature,
+			AdvKey:          append([]byte(nil), device.AdvSecretKey...),
+		}
+		if device.Account != nil {
+			record.AdvDetails = append([]byte(nil), device.Account.Details...)
+			record.AdvAccountSig = append([]byte(nil), device.Account.AccountSignature...)
+			record.AdvAccountSigKey = append([]byte(nil), device.Account.AccountSignatureKey...)
+			record.AdvDeviceSig = append([]byte(nil), device.Account.DeviceSignature...)
+		}
+	}
+	record.Platform = device.Platform
+	record.BusinessName = device.BusinessName
+	record.PushName = device.PushName
+	c.devices[jid] = record
+
+	if !device.Initialized {
+		c.attachStores(device, c.getStore(jid))
+	}
+	return nil
+}
+
+// DeleteDevice deletes the given device and all of its data from this container.
+// This should be called through Device.Delete()
+func (c *Container) DeleteDevice(device *store.Device) error {
+	if device.ID == nil {
+		return ErrDeviceIDMustBeSet
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.devices, *device.ID)
+	memStore, ok := c.stores[*device.ID]
+	if ok {
+		// Clear the data in case someone still holds a reference to the store,
+		// the same way the SQL store cascades the deletion to all tables.
+		memStore.reset()
+		delete(c.stores, *device.ID)
+	}
+	return nil
+}
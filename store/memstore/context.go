@@ -0,0 +1,447 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memstore
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/util/keys"
+)
+
+// All data is kept in memory, so there is no slow work to cancel. The Context variants
+// of the store methods only check that the context hasn't been cancelled before doing anything.
+
+func (c *Container) PutDeviceContext(ctx context.Context, device *store.Device) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.PutDevice(device)
+}
+
+func (c *Container) DeleteDeviceContext(ctx context.Context, device *store.Device) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.DeleteDevice(device)
+}
+
+func (s *MemStore) PutIdentityContext(ctx context.Context, address string, key [32]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutIdentity(address, key)
+}
+
+func (s *MemStore) DeleteAllIdentitiesContext(ctx context.Context, phone string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeleteAllIdentities(phone)
+}
+
+func (s *MemStore) DeleteIdentityContext(ctx context.Context, address string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeleteIdentity(address)
+}
+
+func (s *MemStore) IsTrustedIdentityContext(ctx context.Context, address string, key [32]byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.IsTrustedIdentity(address, key)
+}
+
+func (s *MemStore) GetSessionContext(ctx context.Context, address string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetSession(address)
+}
+
+func (s *MemStore) HasSessionContext(ctx context.Context, address string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.HasSession(address)
+}
+
+func (s *MemStore) PutSessionContext(ctx context.Context, address string, session []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutSession(address, session)
+}
+
+func (s *MemStore) DeleteAllSessionsContext(ctx context.Context, phone string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeleteAllSessions(phone)
+}
+
+func (s *MemStore) DeleteSessionContext(ctx context.Context, address string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeleteSession(address)
+}
+
+func (s *MemStore) GenOnePreKeyContext(ctx context.Context) (*keys.PreKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GenOnePreKey()
+}
+
+func (s *MemStore) GetOrGenPreKeysContext(ctx context.Context, count uint32) ([]*keys.PreKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetOrGenPreKeys(count)
+}
+
+func (s *MemStore) GetPreKeyContext(ctx context.Context, id uint32) (*keys.PreKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetPreKey(id)
+}
+
+func (s *MemStore) RemovePreKeyContext(ctx context.Context, id uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RemovePreKey(id)
+}
+
+func (s *MemStore) MarkPreKeysAsUploadedContext(ctx context.Context, upToID uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.MarkPreKeysAsUploaded(upToID)
+}
+
+func (s *MemStore) UploadedPreKeyCountContext(ctx context.Context) (count int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.UploadedPreKeyCount()
+}
+
+func (s *MemStore) PutSenderKeyContext(ctx context.Context, group, user string, session []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutSenderKey(group, user, session)
+}
+
+func (s *MemStore) GetSenderKeyContext(ctx context.Context, group, user string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetSenderKey(group, user)
+}
+
+func (s *MemStore) PutAppStateSyncKeyContext(ctx context.Context, id []byte, key store.AppStateSyncKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutAppStateSyncKey(id, key)
+}
+
+func (s *MemStore) GetAppStateSyncKeyContext(ctx context.Context, id []byte) (*store.AppStateSyncKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetAppStateSyncKey(id)
+}
+
+func (s *MemStore) GetLatestAppStateSyncKeyIDContext(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetLatestAppStateSyncKeyID()
+}
+
+func (s *MemStore) PutAppStateVersionContext(ctx context.Context, name string, version uint64, hash [128]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutAppStateVersion(name, version, hash)
+}
+
+func (s *MemStore) GetAppStateVersionContext(ctx context.Context, name string) (version uint64, hash [128]byte, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, [128]byte{}, err
+	}
+	return s.GetAppStateVersion(name)
+}
+
+func (s *MemStore) DeleteAppStateVersionContext(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeleteAppStateVersion(name)
+}
+
+func (s *MemStore) PutAppStateMutationMACsContext(ctx context.Context, name string, version uint64, mutations []store.AppStateMutationMAC) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutAppStateMutationMACs(name, version, mutations)
+}
+
+func (s *MemStore) DeleteAppStateMutationMACsContext(ctx context.Context, name string, indexMACs [][]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeleteAppStateMutationMACs(name, indexMACs)
+}
+
+func (s *MemStore) GetAppStateMutationMACContext(ctx context.Context, name string, indexMAC []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetAppStateMutationMAC(name, indexMAC)
+}
+
+func (s *MemStore) PutPushNameContext(ctx context.Context, user types.JID, pushName string) (bool, string, error) {
+	if err := ctx.Err(); err != nil {
+		return false, "", err
+	}
+	return s.PutPushName(user, pushName)
+}
+
+func (s *MemStore) PutBusinessNameContext(ctx context.Context, user types.JID, businessName string) (bool, string, error) {
+	if err := ctx.Err(); err != nil {
+		return false, "", err
+	}
+	return s.PutBusinessName(user, businessName)
+}
+
+func (s *MemStore) PutContactNameContext(ctx context.Context, user types.JID, firstName, fullName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutContactName(user, firstName, fullName)
+}
+
+func (s *MemStore) PutAllContactNamesContext(ctx context.Context, contacts []store.ContactEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutAllContactNames(contacts)
+}
+
+func (s *MemStore) GetContactContext(ctx context.Context, user types.JID) (types.ContactInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return types.ContactInfo{}, err
+	}
+	return s.GetContact(user)
+}
+
+func (s *MemStore) GetAllContactsContext(ctx context.Context) (map[types.JID]types.ContactInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetAllContacts()
+}
+
+func (s *MemStore) PutMutedUntilContext(ctx context.Context, chat types.JID, mutedUntil time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutMutedUntil(chat, mutedUntil)
+}
+
+func (s *MemStore) PutPinnedContext(ctx context.Context, chat types.JID, pinned bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutPinned(chat, pinned)
+}
+
+func (s *MemStore) PutArchivedContext(ctx context.Context, chat types.JID, archived bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutArchived(chat, archived)
+}
+
+func (s *MemStore) GetChatSettingsContext(ctx context.Context, chat types.JID) (types.LocalChatSettings, error) {
+	if err := ctx.Err(); err != nil {
+		return types.LocalChatSettings{}, err
+	}
+	return s.GetChatSettings(chat)
+}
+
+func (s *MemStore) PutChatMessageContext(ctx context.Context, chat types.JID, message store.ChatMessage, incrementUnread bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutChatMessage(chat, message, incrementUnread)
+}
+
+func (s *MemStore) PutChatReadContext(ctx context.Context, chat types.JID, read bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutChatRead(chat, read)
+}
+
+func (s *MemStore) PutChatNameContext(ctx context.Context, chat types.JID, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutChatName(chat, name)
+}
+
+func (s *MemStore) PutChatEphemeralExpirationContext(ctx context.Context, chat types.JID, expiration uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutChatEphemeralExpiration(chat, expiration)
+}
+
+func (s *MemStore) PutChatsContext(ctx context.Context, chats []store.Chat) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutChats(chats)
+}
+
+func (s *MemStore) GetChatContext(ctx context.Context, chat types.JID) (*store.Chat, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetChat(chat)
+}
+
+func (s *MemStore) GetAllChatsContext(ctx context.Context) ([]store.Chat, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetAllChats()
+}
+
+func (s *MemStore) DeleteChatContext(ctx context.Context, chat types.JID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeleteChat(chat)
+}
+
+func (s *MemStore) PutMessageSecretsContext(ctx context.Context, inserts []store.MessageSecretInsert) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutMessageSecrets(inserts)
+}
+
+// PutMessageSecretContext stores the secret of a message. The timestamp is ignored, as the memory store has no retention policy.
+func (s *MemStore) PutMessageSecretContext(ctx context.Context, chat, sender types.JID, id types.MessageID, secret []byte, timestamp time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutMessageSecret(chat, sender, id, secret)
+}
+
+func (s *MemStore) GetMessageSecretContext(ctx context.Context, chat, sender types.JID, id types.MessageID) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetMessageSecret(chat, sender, id)
+}
+
+func (s *MemStore) PutPrivacyTokensContext(ctx context.Context, tokens ...store.PrivacyToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutPrivacyTokens(tokens...)
+}
+
+func (s *MemStore) GetPrivacyTokenContext(ctx context.Context, user types.JID) (*store.PrivacyToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetPrivacyToken(user)
+}
+
+func (s *MemStore) PutRecentMessageContext(ctx context.Context, to types.JID, id types.MessageID, message []byte, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutRecentMessage(to, id, message, expiry)
+}
+
+func (s *MemStore) GetRecentMessageContext(ctx context.Context, to types.JID, id types.MessageID) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetRecentMessage(to, id)
+}
+
+func (s *MemStore) DeleteExpiredRecentMessagesContext(ctx context.Context, now time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeleteExpiredRecentMessages(now)
+}
+
+func (s *MemStore) DeviceHistorySyncContext(ctx context.Context, messages []store.HistoryMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeviceHistorySync(messages)
+}
+
+func (s *MemStore) DeleteDeviceHistoryContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeleteDeviceHistory()
+}
+
+func (s *MemStore) DeviceUpdateStatusMessageContext(ctx context.Context, msg store.HistoryMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeviceUpdateStatusMessage(msg)
+}
+
+func (s *MemStore) GetChatHistoryContext(ctx context.Context, chat string, before store.HistoryCursor, limit int) ([]store.HistoryMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetChatHistory(chat, before, limit)
+}
+
+func (s *MemStore) GetMessageContext(ctx context.Context, chat, id string) (*store.HistoryMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetMessage(chat, id)
+}
+
+func (s *MemStore) ListChatsContext(ctx context.Context) ([]store.HistoryChat, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.ListChats()
+}
+
+func (s *MemStore) SearchMessagesContext(ctx context.Context, query, chat string, from, to time.Time, limit int) ([]store.HistoryMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.SearchMessages(query, chat, from, to, limit)
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memstore
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.mau.fi/whatsmeow/types"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// snapshotVersion is the version of the snapshot format. It must be bumped whenever
+// deviceRecord or deviceData change in an incompatible way.
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version int
+	Devices []deviceRecord
+	Stores  map[types.JID]*deviceData
+}
+
+// ErrNoSnapshotPath is returned by Save if the container wasn't created with NewWithSnapshot.
+var ErrNoSnapshotPath = errors.New("container doesn't have a snapshot path")
+
+// ErrUnsupportedSnapshotVersion is returned when reading a snapshot written by an incompatible version.
+var ErrUnsupportedSnapshotVersion = errors.New("unsupported snapshot version")
+
+// NewWithSnapshot creates an in-memory Container that is loaded from the given file if it exists.
+// The data is written back to the same file when Save is called.
+//
+// Snapshots contain private keys, so the file is created with 0600 permissions.
+//
+//	container, err := memstore.NewWithSnapshot("whatsmeow.snapshot", nil)
+//	if err != nil {
+//	    panic(err)
+//	}
+//	defer container.Save()
+func NewWithSnapshot(path string, log waLog.Logger) (*Container, error) {
+	container := New(log)
+	container.snapshotPath = path
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return container, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer file.Close()
+	err = container.ReadSnapshot(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot from %s: %w", path, err)
+	}
+	return container, nil
+}
+
+// Save writes a snapshot of the container into the file it was loaded from.
+// The file is replaced atomically, so a crash while saving doesn't corrupt the previous snapshot.
+func (c *Container) Save() error {
+	if c.snapshotPath == "" {
+		return ErrNoSnapshotPath
+	}
+	file, err := os.CreateTemp(filepath.Dir(c.snapshotPath), filepath.Base(c.snapshotPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary snapshot file: %w", err)
+	}
+	tempPath := file.Name()
+	err = c.WriteSnapshot(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, c.snapshotPath)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("failed to save snapshot: %w", err)
+	}
+	return nil
+}
+
+// WriteSnapshot writes all devices and their data into the given writer.
+func (c *Container) WriteSnapshot(w io.Writer) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	snap := snapshot{
+		Version: snapshotVersion,
+		Devices: make([]deviceRecord, 0, len(c.devices)),
+		Stores:  make(map[types.JID]*deviceData, len(c.stores)),
+	}
+	for _, record := range c.devices {
+		snap.Devices = append(snap.Devices, record)
+	}
+	for jid, memStore := range c.stores {
+		memStore.lock.Lock()
+		// Only the data of stored devices is kept, like the foreign keys in sqlstore
+		if _, ok := c.devices[jid]; ok {
+			snap.Stores[jid] = memStore.data
+		}
+	}
+	err := gob.NewEncoder(w).Encode(&snap)
+	for _, memStore := range c.stores {
+		memStore.lock.Unlock()
+	}
+	return err
+}
+
+// ReadSnapshot replaces all devices and their data with the contents of a snapshot
+// previously written with WriteSnapshot.
+func (c *Container) ReadSnapshot(r io.Reader) error {
+	var snap snapshot
+	err := gob.NewDecoder(r).Decode(&snap)
+	if err != nil {
+		return err
+	} else if snap.Version != snapshotVersion {
+		return fmt.Errorf("%w %d", ErrUnsupportedSnapshotVersion, snap.Version)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.devices = make(map[types.JID]deviceRecord, len(snap.Devices))
+	for _, record := range snap.Devices {
+		c.devices[record.JID] = record
+	}
+	for jid, memStore := range c.stores {
+		if _, ok := snap.Stores[jid]; !ok {
+			memStore.reset()
+			delete(c.stores, jid)
+		}
+	}
+	for jid, data := range snap.Stores {
+		fillDeviceData(data)
+		// Existing stores are updated in place so that devices which are already in use see the new data
+		memStore := c.getStore(jid)
+		memStore.lock.Lock()
+		memStore.data = data
+		memStore.lock.Unlock()
+	}
+	return nil
+}
+
+// fillDeviceData initializes the maps that gob left nil because they were empty when the snapshot was written.
+func fillDeviceData(data *deviceData) {
+	empty := newDeviceData()
+	if data.Identities == nil {
+		data.Identities = empty.Identities
+	}
+	if data.Sessions == nil {
+		data.Sessions = empty.Sessions
+	}
+	if data.PreKeys == nil {
+		data.PreKeys = empty.PreKeys
+	}
+	if data.SenderKeys == nil {
+		data.SenderKeys = empty.SenderKeys
+	}
+	if data.AppStateSyncKeys == nil {
+		data.AppStateSyncKeys = empty.AppStateSyncKeys
+	}
+	if data.AppStateVersions == nil {
+		data.AppStateVersions = empty.AppStateVersions
+	}
+	if data.AppStateMACs == nil {
+		data.AppStateMACs = empty.AppStateMACs
+	}
+	if data.Contacts == nil {
+		data.Contacts = empty.Contacts
+	}
+	if data.ChatSettings == nil {
+		data.ChatSettings = empty.ChatSettings
+	}
+	if data.Chats == nil {
+		data.Chats = empty.Chats
+	}
+	if data.MessageSecrets == nil {
+		data.MessageSecrets = empty.MessageSecrets
+	}
+	if data.PrivacyTokens == nil {
+		data.PrivacyTokens = empty.PrivacyTokens
+	}
+	if data.RecentMessages == nil {
+		data.RecentMessages = empty.RecentMessages
+	}
+	if data.History == nil {
+		data.History = empty.History
+	}
+}
@@ -0,0 +1,930 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package memstore contains an in-memory implementation of the interfaces in the store package.
+//
+// It behaves the same way as sqlstore, but doesn't need a database, which makes it useful for tests
+// and short-lived tools. The data can optionally be snapshotted to a file, see NewWithSnapshot.
+package memstore
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/util/keys"
+)
+
+type MemStore struct {
+	*Container
+	JID types.JID
+
+	lock sync.Mutex
+	data *deviceData
+}
+
+// deviceData contains all the data of a single device. The fields are exported so that the struct
+// can be encoded into snapshots.
+type deviceData struct {
+	Identities       map[string][32]byte
+	Sessions         map[string][]byte
+	PreKeys          map[uint32]preKeyRecord
+	SenderKeys       map[senderKeyID][]byte
+	AppStateSyncKeys map[string]store.AppStateSyncKey
+	AppStateVersions map[string]appStateVersion
+	AppStateMACs     map[appStateMACID][]appStateMAC
+	Contacts         map[types.JID]types.ContactInfo
+	ChatSettings     map[types.JID]types.LocalChatSettings
+	Chats            map[types.JID]store.Chat
+	MessageSecrets   map[messageSecretID][]byte
+	PrivacyTokens    map[types.JID]store.PrivacyToken
+	RecentMessages   map[recentMessageID]recentMessage
+	History          map[string]map[string]store.HistoryMessage
+}
+
+type preKeyRecord struct {
+	Priv     [32]byte
+	Uploaded bool
+}
+
+type senderKeyID struct {
+	Group string
+	User  string
+}
+
+type appStateVersion struct {
+	Version uint64
+	Hash    [128]byte
+}
+
+type appStateMACID struct {
+	Name     string
+	IndexMAC string
+}
+
+type appStateMAC struct {
+	Version  uint64
+	ValueMAC []byte
+}
+
+type recentMessageID struct {
+	To types.JID
+	ID types.MessageID
+}
+
+type recentMessage struct {
+	Message []byte
+	Expiry  time.Time
+}
+
+type messageSecretID struct {
+	Chat   types.JID
+	Sender types.JID
+	ID     types.MessageID
+}
+
+func newDeviceData() *deviceData {
+	return &deviceData{
+		Identities:       make(map[string][32]byte),
+		Sessions:         make(map[string][]byte),
+		PreKeys:          make(map[uint32]preKeyRecord),
+		SenderKeys:       make(map[senderKeyID][]byte),
+		AppStateSyncKeys: make(map[string]store.AppStateSyncKey),
+		AppStateVersions: make(map[string]appStateVersion),
+		AppStateMACs:     make(map[appStateMACID][]appStateMAC),
+		Contacts:         make(map[types.JID]types.ContactInfo),
+		ChatSettings:     make(map[types.JID]types.LocalChatSettings),
+		Chats:            make(map[types.JID]store.Chat),
+		MessageSecrets:   make(map[messageSecretID][]byte),
+		PrivacyTokens:    make(map[types.JID]store.PrivacyToken),
+		RecentMessages:   make(map[recentMessageID]recentMessage),
+		History:          make(map[string]map[string]store.HistoryMessage),
+	}
+}
+
+// NewMemStore creates a new MemStore with the given container and user JID.
+// It contains implementations of all the different stores in the store package.
+//
+// In general, you should use Container.NewDevice or Container.GetDevice instead of this.
+func NewMemStore(c *Container, jid types.JID) *MemStore {
+	return &MemStore{
+		Container: c,
+		JID:       jid,
+		data:      newDeviceData(),
+	}
+}
+
+var _ store.IdentityStore = (*MemStore)(nil)
+var _ store.SessionStore = (*MemStore)(nil)
+var _ store.PreKeyStore = (*MemStore)(nil)
+var _ store.SenderKeyStore = (*MemStore)(nil)
+var _ store.AppStateSyncKeyStore = (*MemStore)(nil)
+var _ store.AppStateStore = (*MemStore)(nil)
+var _ store.ContactStore = (*MemStore)(nil)
+var _ store.ChatSettingsStore = (*MemStore)(nil)
+var _ store.ChatStore = (*MemStore)(nil)
+var _ store.MsgSecretStore = (*MemStore)(nil)
+var _ store.PrivacyTokenStore = (*MemStore)(nil)
+var _ store.RecentMessageStore = (*MemStore)(nil)
+var _ store.HistoryStore = (*MemStore)(nil)
+
+func (s *MemStore) reset() {
+	s.lock.Lock()
+	s.data = newDeviceData()
+	s.lock.Unlock()
+}
+
+func cloneBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	return bytes.Clone(data)
+}
+
+func (s *MemStore) PutIdentity(address string, key [32]byte) error {
+	s.lock.Lock()
+	s.data.Identities[address] = key
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) DeleteAllIdentities(phone string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for address := range s.data.Identities {
+		if strings.HasPrefix(address, phone+":") {
+			delete(s.data.Identities, address)
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) DeleteIdentity(address string) error {
+	s.lock.Lock()
+	delete(s.data.Identities, address)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) IsTrustedIdentity(address string, key [32]byte) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	existingIdentity, ok := s.data.Identities[address]
+	if !ok {
+		// Trust if not known, it'll be saved automatically later
+		return true, nil
+	}
+	return existingIdentity == key, nil
+}
+
+func (s *MemStore) GetSession(address string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return cloneBytes(s.data.Sessions[address]), nil
+}
+
+func (s *MemStore) HasSession(address string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.data.Sessions[address]
+	return ok, nil
+}
+
+func (s *MemStore) PutSession(address string, session []byte) error {
+	s.lock.Lock()
+	s.data.Sessions[address] = cloneBytes(session)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) DeleteAllSessions(phone string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for address := range s.data.Sessions {
+		if strings.HasPrefix(address, phone+":") {
+			delete(s.data.Sessions, address)
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) DeleteSession(address string) error {
+	s.lock.Lock()
+	delete(s.data.Sessions, address)
+	s.lock.Unlock()
+	return nil
+}
+
+var _ store.UnitOfWorkStore = (*MemStore)(nil)
+
+// CommitUnitOfWork applies all the session and identity changes of a store.UnitOfWork at once.
+func (s *MemStore) CommitUnitOfWork(ctx context.Context, changes *store.SignalChanges) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for address := range changes.DeletedIdentities {
+		delete(s.data.Identities, address)
+	}
+	for address := range changes.DeletedSessions {
+		delete(s.data.Sessions, address)
+	}
+	for address, key := range changes.Identities {
+		s.data.Identities[address] = key
+	}
+	for address, session := range changes.Sessions {
+		s.data.Sessions[address] = cloneBytes(session)
+	}
+	return nil
+}
+
+func (s *MemStore) genOnePreKey(id uint32, markUploaded bool) *keys.PreKey {
+	key := keys.NewPreKey(id)
+	s.data.PreKeys[id] = preKeyRecord{Priv: *key.Priv, Uploaded: markUploaded}
+	return key
+}
+
+func (s *MemStore) getNextPreKeyID() uint32 {
+	var lastKeyID uint32
+	for id := range s.data.PreKeys {
+		if id > lastKeyID {
+			lastKeyID = id
+		}
+	}
+	return lastKeyID + 1
+}
+
+func (s *MemStore) GenOnePreKey() (*keys.PreKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.genOnePreKey(s.getNextPreKeyID(), true), nil
+}
+
+func (s *MemStore) GetOrGenPreKeys(count uint32) ([]*keys.PreKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	existingIDs := make([]uint32, 0, count)
+	for id, key := range s.data.PreKeys {
+		if !key.Uploaded {
+			existingIDs = append(existingIDs, id)
+		}
+	}
+	sort.Slice(existingIDs, func(i, j int) bool {
+		return existingIDs[i] < existingIDs[j]
+	})
+	if uint32(len(existingIDs)) > count {
+		existingIDs = existingIDs[:count]
+	}
+
+	newKeys := make([]*keys.PreKey, count)
+	for i, id := range existingIDs {
+		newKeys[i] = &keys.PreKey{
+			KeyPair: *keys.NewKeyPairFromPrivateKey(s.data.PreKeys[id].Priv),
+			KeyID:   id,
+		}
+	}
+	nextKeyID := s.getNextPreKeyID()
+	for i := uint32(len(existingIDs)); i < count; i++ {
+		newKeys[i] = s.genOnePreKey(nextKeyID, false)
+		nextKeyID++
+	}
+	return newKeys, nil
+}
+
+func (s *MemStore) GetPreKey(id uint32) (*keys.PreKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key, ok := s.data.PreKeys[id]
+	if !ok {
+		return nil, nil
+	}
+	return &keys.PreKey{
+		KeyPair: *keys.NewKeyPairFromPrivateKey(key.Priv),
+		KeyID:   id,
+	}, nil
+}
+
+func (s *MemStore) RemovePreKey(id uint32) error {
+	s.lock.Lock()
+	delete(s.data.PreKeys, id)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) MarkPreKeysAsUploaded(upToID uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, key := range s.data.PreKeys {
+		if id <= upToID && !key.Uploaded {
+			key.Uploaded = true
+			s.data.PreKeys[id] = key
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) UploadedPreKeyCount() (count int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, key := range s.data.PreKeys {
+		if key.Uploaded {
+			count++
+		}
+	}
+	return
+}
+
+func (s *MemStore) PutSenderKey(group, user string, session []byte) error {
+	s.lock.Lock()
+	s.data.SenderKeys[senderKeyID{Group: group, User: user}] = cloneBytes(session)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetSenderKey(group, user string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return cloneBytes(s.data.SenderKeys[senderKeyID{Group: group, User: user}]), nil
+}
+
+func (s *MemStore) PutAppStateSyncKey(id []byte, key store.AppStateSyncKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	existing, ok := s.data.AppStateSyncKeys[string(id)]
+	// Existing keys are only replaced by newer ones, like the ON CONFLICT clause in sqlstore
+	if ok && key.Timestamp <= existing.Timestamp {
+		return nil
+	}
+	s.data.AppStateSyncKeys[string(id)] = store.AppStateSyncKey{
+		Data:        cloneBytes(key.Data),
+		Fingerprint: cloneBytes(key.Fingerprint),
+		Timestamp:   key.Timestamp,
+	}
+	return nil
+}
+
+func (s *MemStore) GetAppStateSyncKey(id []byte) (*store.AppStateSyncKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key, ok := s.data.AppStateSyncKeys[string(id)]
+	if !ok {
+		return nil, nil
+	}
+	key.Data = cloneBytes(key.Data)
+	key.Fingerprint = cloneBytes(key.Fingerprint)
+	return &key, nil
+}
+
+func (s *MemStore) GetLatestAppStateSyncKeyID() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var latestID string
+	var latestTimestamp int64
+	found := false
+	for id, key := range s.data.AppStateSyncKeys {
+		// Ties are broken by the key ID to keep the result stable
+		if !found || key.Timestamp > latestTimestamp || (key.Timestamp == latestTimestamp && id > latestID) {
+			latestID = id
+			latestTimestamp = key.Timestamp
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return []byte(latestID), nil
+}
+
+func (s *MemStore) PutAppStateVersion(name string, version uint64, hash [128]byte) error {
+	s.lock.Lock()
+	s.data.AppStateVersions[name] = appStateVersion{Version: version, Hash: hash}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetAppStateVersion(name string) (version uint64, hash [128]byte, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// If the version isn't found, it'll be 0 and hash will be an empty array, which is the correct initial state
+	stored := s.data.AppStateVersions[name]
+	return stored.Version, stored.Hash, nil
+}
+
+func (s *MemStore) DeleteAppStateVersion(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.data.AppStateVersions, name)
+	// The mutation MACs are deleted too, the same way the SQL store cascades the deletion
+	for id := range s.data.AppStateMACs {
+		if id.Name == name {
+			delete(s.data.AppStateMACs, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) PutAppStateMutationMACs(name string, version uint64, mutations []store.AppStateMutationMAC) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, mutation := range mutations {
+		id := appStateMACID{Name: name, IndexMAC: string(mutation.IndexMAC)}
+		macs := s.data.AppStateMACs[id]
+		replaced := false
+		for i, mac := range macs {
+			if mac.Version == version {
+				macs[i].ValueMAC = cloneBytes(mutation.ValueMAC)
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			macs = append(macs, appStateMAC{Version: version, ValueMAC: cloneBytes(mutation.ValueMAC)})
+		}
+		s.data.AppStateMACs[id] = macs
+	}
+	return nil
+}
+
+func (s *MemStore) DeleteAppStateMutationMACs(name string, indexMACs [][]byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, indexMAC := range indexMACs {
+		delete(s.data.AppStateMACs, appStateMACID{Name: name, IndexMAC: string(indexMAC)})
+	}
+	return nil
+}
+
+func (s *MemStore) GetAppStateMutationMAC(name string, indexMAC []byte) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var latest *appStateMAC
+	macs := s.data.AppStateMACs[appStateMACID{Name: name, IndexMAC: string(indexMAC)}]
+	for i, mac := range macs {
+		if latest == nil || mac.Version > latest.Version {
+			latest = &macs[i]
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	return cloneBytes(latest.ValueMAC), nil
+}
+
+func (s *MemStore) PutPushName(user types.JID, pushName string) (bool, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	contact := s.data.Contacts[user]
+	if contact.PushName != pushName {
+		previousName := contact.PushName
+		contact.PushName = pushName
+		contact.Found = true
+		s.data.Contacts[user] = contact
+		return true, previousName, nil
+	}
+	return false, "", nil
+}
+
+func (s *MemStore) PutBusinessName(user types.JID, businessName string) (bool, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	contact := s.data.Contacts[user]
+	if contact.BusinessName != businessName {
+		previousName := contact.BusinessName
+		contact.BusinessName = businessName
+		contact.Found = true
+		s.data.Contacts[user] = contact
+		return true, previousName, nil
+	}
+	return false, "", nil
+}
+
+func (s *MemStore) PutContactName(user types.JID, firstName, fullName string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	contact := s.data.Contacts[user]
+	if contact.FirstName != firstName || contact.FullName != fullName {
+		contact.FirstName = firstName
+		contact.FullName = fullName
+		contact.Found = true
+		s.data.Contacts[user] = contact
+	}
+	return nil
+}
+
+func (s *MemStore) PutAllContactNames(contacts []store.ContactEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, entry := range contacts {
+		if entry.JID.IsEmpty() {
+			s.log.Warnf("Empty contact info in mass insert: %+v", entry)
+			continue
+		}
+		contact := s.data.Contacts[entry.JID]
+		contact.FirstName = entry.FirstName
+		contact.FullName = entry.FullName
+		contact.Found = true
+		s.data.Contacts[entry.JID] = contact
+	}
+	return nil
+}
+
+func (s *MemStore) GetContact(user types.JID) (types.ContactInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.data.Contacts[user], nil
+}
+
+func (s *MemStore) GetAllContacts() (map[types.JID]types.ContactInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	output := make(map[types.JID]types.ContactInfo, len(s.data.Contacts))
+	for jid, contact := range s.data.Contacts {
+		output[jid] = contact
+	}
+	return output, nil
+}
+
+func (s *MemStore) updateChatSettings(chat types.JID, update func(settings *types.LocalChatSettings)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	settings := s.data.ChatSettings[chat]
+	settings.Found = true
+	update(&settings)
+	s.data.ChatSettings[chat] = settings
+}
+
+func (s *MemStore) PutMutedUntil(chat types.JID, mutedUntil time.Time) error {
+	s.updateChatSettings(chat, func(settings *types.LocalChatSettings) {
+		// The SQL store only has second precision, so drop the rest here too
+		if mutedUntil.IsZero() {
+			settings.MutedUntil = time.Time{}
+		} else {
+			settings.MutedUntil = time.Unix(mutedUntil.Unix(), 0)
+		}
+	})
+	return nil
+}
+
+func (s *MemStore) PutPinned(chat types.JID, pinned bool) error {
+	s.updateChatSettings(chat, func(settings *types.LocalChatSettings) {
+		settings.Pinned = pinned
+	})
+	return nil
+}
+
+func (s *MemStore) PutArchived(chat types.JID, archived bool) error {
+	s.updateChatSettings(chat, func(settings *types.LocalChatSettings) {
+		settings.Archived = archived
+	})
+	return nil
+}
+
+func (s *MemStore) GetChatSettings(chat types.JID) (types.LocalChatSettings, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.data.ChatSettings[chat], nil
+}
+
+func (s *MemStore) updateChat(chat types.JID, update func(chat *store.Chat)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry := s.data.Chats[chat]
+	entry.JID = chat
+	update(&entry)
+	s.data.Chats[chat] = entry
+}
+
+// putChatLastMessage replaces the last message of the chat if the new one isn't older.
+func putChatLastMessage(chat *store.Chat, message store.ChatMessage) {
+	// The SQL store only has second precision, so drop the rest here too
+	message.Timestamp = time.Unix(message.Timestamp.Unix(), 0)
+	if !message.Timestamp.Before(chat.LastMessage.Timestamp) {
+		chat.LastMessage = message
+	}
+}
+
+func (s *MemStore) PutChatMessage(chat types.JID, message store.ChatMessage, incrementUnread bool) error {
+	s.updateChat(chat, func(entry *store.Chat) {
+		putChatLastMessage(entry, message)
+		if incrementUnread {
+			entry.UnreadCount++
+		}
+	})
+	return nil
+}
+
+func (s *MemStore) PutChatRead(chat types.JID, read bool) error {
+	s.updateChat(chat, func(entry *store.Chat) {
+		if read {
+			entry.UnreadCount = 0
+		}
+		entry.MarkedAsUnread = !read
+	})
+	return nil
+}
+
+func (s *MemStore) PutChatName(chat types.JID, name string) error {
+	s.updateChat(chat, func(entry *store.Chat) {
+		entry.Name = name
+	})
+	return nil
+}
+
+func (s *MemStore) PutChatEphemeralExpiration(chat types.JID, expiration uint32) error {
+	s.updateChat(chat, func(entry *store.Chat) {
+		entry.EphemeralExpiration = expiration
+	})
+	return nil
+}
+
+func (s *MemStore) PutChats(chats []store.Chat) error {
+	for _, chat := range chats {
+		s.updateChat(chat.JID, func(entry *store.Chat) {
+			if chat.Name != "" {
+				entry.Name = chat.Name
+			}
+			putChatLastMessage(entry, chat.LastMessage)
+			entry.UnreadCount = chat.UnreadCount
+			entry.MarkedAsUnread = chat.MarkedAsUnread
+			entry.EphemeralExpiration = chat.EphemeralExpiration
+		})
+	}
+	return nil
+}
+
+// getChat returns the chat with its settings. The caller must hold the lock.
+func (s *MemStore) getChat(chat store.Chat) store.Chat {
+	chat.Settings = s.data.ChatSettings[chat.JID]
+	return chat
+}
+
+func (s *MemStore) GetChat(chat types.JID) (*store.Chat, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry, ok := s.data.Chats[chat]
+	if !ok {
+		return nil, nil
+	}
+	entry = s.getChat(entry)
+	return &entry, nil
+}
+
+func (s *MemStore) GetAllChats() ([]store.Chat, error) {
+	s.lock.Lock()
+	chats := make([]store.Chat, 0, len(s.data.Chats))
+	for _, chat := range s.data.Chats {
+		chats = append(chats, s.getChat(chat))
+	}
+	s.lock.Unlock()
+	sort.Slice(chats, func(i, j int) bool {
+		if !chats[i].LastMessage.Timestamp.Equal(chats[j].LastMessage.Timestamp) {
+			return chats[i].LastMessage.Timestamp.After(chats[j].LastMessage.Timestamp)
+		}
+		return chats[i].JID.String() < chats[j].JID.String()
+	})
+	return chats, nil
+}
+
+func (s *MemStore) DeleteChat(chat types.JID) error {
+	s.lock.Lock()
+	delete(s.data.Chats, chat)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) putMessageSecret(chat, sender types.JID, id types.MessageID, secret []byte) {
+	secretID := messageSecretID{Chat: chat.ToNonAD(), Sender: sender.ToNonAD(), ID: id}
+	// Existing secrets are never replaced, like the ON CONFLICT DO NOTHING clause in sqlstore
+	if _, ok := s.data.MessageSecrets[secretID]; !ok {
+		s.data.MessageSecrets[secretID] = cloneBytes(secret)
+	}
+}
+
+func (s *MemStore) PutMessageSecrets(inserts []store.MessageSecretInsert) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, insert := range inserts {
+		s.putMessageSecret(insert.Chat, insert.Sender, insert.ID, insert.Secret)
+	}
+	return nil
+}
+
+func (s *MemStore) PutMessageSecret(chat, sender types.JID, id types.MessageID, secret []byte) error {
+	s.lock.Lock()
+	s.putMessageSecret(chat, sender, id, secret)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetMessageSecret(chat, sender types.JID, id types.MessageID) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return cloneBytes(s.data.MessageSecrets[messageSecretID{Chat: chat.ToNonAD(), Sender: sender.ToNonAD(), ID: id}]), nil
+}
+
+func (s *MemStore) PutPrivacyTokens(tokens ...store.PrivacyToken) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, token := range tokens {
+		user := token.User.ToNonAD()
+		s.data.PrivacyTokens[user] = store.PrivacyToken{
+			User:      user,
+			Token:     cloneBytes(token.Token),
+			Timestamp: time.Unix(token.Timestamp.Unix(), 0),
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) GetPrivacyToken(user types.JID) (*store.PrivacyToken, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	token, ok := s.data.PrivacyTokens[user.ToNonAD()]
+	if !ok {
+		return nil, nil
+	}
+	token.Token = cloneBytes(token.Token)
+	return &token, nil
+}
+
+func (s *MemStore) PutRecentMessage(to types.JID, id types.MessageID, message []byte, expiry time.Time) error {
+	s.lock.Lock()
+	s.data.RecentMessages[recentMessageID{To: to, ID: id}] = recentMessage{Message: cloneBytes(message), Expiry: expiry}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetRecentMessage(to types.JID, id types.MessageID) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	msg, ok := s.data.RecentMessages[recentMessageID{To: to, ID: id}]
+	if !ok || msg.Expiry.Before(time.Now()) {
+		return nil, nil
+	}
+	return cloneBytes(msg.Message), nil
+}
+
+func (s *MemStore) DeleteExpiredRecentMessages(now time.Time) error {
+	s.lock.Lock()
+	for key, msg := range s.data.RecentMessages {
+		if msg.Expiry.Before(now) {
+			delete(s.data.RecentMessages, key)
+		}
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) DeviceHistorySync(messages []store.HistoryMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, msg := range messages {
+		chat, ok := s.data.History[msg.ChatId]
+		if !ok {
+			chat = make(map[string]store.HistoryMessage)
+			s.data.History[msg.ChatId] = chat
+		}
+		existing, ok := chat[msg.MessageId]
+		if ok {
+			// The status of existing messages is only updated if it's higher
+			existing.MessageTimestamp = msg.MessageTimestamp
+			existing.JsonData = msg.JsonData
+			if msg.MessageStatus > existing.MessageStatus {
+				existing.MessageStatus = msg.MessageStatus
+				existing.StatusTimestamp = msg.StatusTimestamp
+			}
+			chat[msg.MessageId] = existing
+		} else {
+			chat[msg.MessageId] = msg
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) DeleteDeviceHistory() error {
+	s.lock.Lock()
+	s.data.History = make(map[string]map[string]store.HistoryMessage)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) DeviceUpdateStatusMessage(msg store.HistoryMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for chatID, chat := range s.data.History {
+		if msg.ChatId != "" && chatID != msg.ChatId {
+			continue
+		}
+		existing, ok := chat[msg.MessageId]
+		if ok && store.IsHistoryStatusUpgrade(existing.MessageStatus, msg.MessageStatus) {
+			existing.MessageStatus = msg.MessageStatus
+			existing.StatusTimestamp = msg.StatusTimestamp
+			chat[msg.MessageId] = existing
+		}
+	}
+	return nil
+}
+
+// isNewerMessage returns true if a comes before b in the history order, i.e. newest first.
+func isNewerMessage(a, b *store.HistoryMessage) bool {
+	if a.MessageTimestamp != b.MessageTimestamp {
+		return a.MessageTimestamp > b.MessageTimestamp
+	}
+	return a.MessageId > b.MessageId
+}
+
+func (s *MemStore) GetChatHistory(chat string, before store.HistoryCursor, limit int) ([]store.HistoryMessage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cursor := store.HistoryMessage{MessageTimestamp: before.MessageTimestamp, MessageId: before.MessageId}
+	messages := make([]store.HistoryMessage, 0, len(s.data.History[chat]))
+	for _, msg := range s.data.History[chat] {
+		if before.IsZero() || isNewerMessage(&cursor, &msg) {
+			messages = append(messages, msg)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return isNewerMessage(&messages[i], &messages[j])
+	})
+	if limit >= 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (s *MemStore) GetMessage(chat, id string) (*store.HistoryMessage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	msg, ok := s.data.History[chat][id]
+	if !ok {
+		return nil, nil
+	}
+	return &msg, nil
+}
+
+func (s *MemStore) ListChats() ([]store.HistoryChat, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var chats []store.HistoryChat
+	for chatID, messages := range s.data.History {
+		if len(messages) == 0 {
+			continue
+		}
+		chat := store.HistoryChat{ChatId: chatID, MessageCount: len(messages)}
+		first := true
+		for _, msg := range messages {
+			if first || isNewerMessage(&msg, &chat.LastMessage) {
+				chat.LastMessage = msg
+				first = false
+			}
+		}
+		chats = append(chats, chat)
+	}
+	sort.Slice(chats, func(i, j int) bool {
+		if chats[i].LastMessage.MessageTimestamp != chats[j].LastMessage.MessageTimestamp {
+			return chats[i].LastMessage.MessageTimestamp > chats[j].LastMessage.MessageTimestamp
+		}
+		return chats[i].ChatId < chats[j].ChatId
+	})
+	return chats, nil
+}
+
+func (s *MemStore) SearchMessages(query, chat string, from, to time.Time, limit int) ([]store.HistoryMessage, error) {
+	terms := store.SearchTerms(query)
+	if len(terms) == 0 {
+		return []store.HistoryMessage{}, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var messages []store.HistoryMessage
+	for chatID, chatMessages := range s.data.History {
+		if chat != "" && chatID != chat {
+			continue
+		}
+		for _, msg := range chatMessages {
+			if (!from.IsZero() && msg.MessageTimestamp < uint64(from.Unix())) || (!to.IsZero() && msg.MessageTimestamp > uint64(to.Unix())) {
+				continue
+			}
+			if store.MatchesSearchTerms(store.ExtractSearchText(msg.JsonData), terms) {
+				messages = append(messages, msg)
+			}
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return isNewerMessage(&messages[i], &messages[j])
+	})
+	if limit >= 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
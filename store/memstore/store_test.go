@@ -0,0 +1,33 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memstore
+
+import (
+	"fmt"
+	"testing"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/store/storetest"
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestConformance(t *testing.T) {
+	container := New(nil)
+	deviceCounter := 0
+	storetest.RunDeviceStoreTests(t, func(t *testing.T) *store.Device {
+		deviceCounter++
+		device := container.NewDevice()
+		device.ID = &types.JID{User: fmt.Sprintf("1000%d", deviceCounter), Device: 1, Server: types.DefaultUserServer}
+		device.Account = &waProto.ADVSignedDeviceIdentity{}
+		err := container.PutDevice(device)
+		if err != nil {
+			t.Fatalf("Failed to store device: %v", err)
+		}
+		return device
+	})
+}
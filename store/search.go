@@ -0,0 +1,70 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"encoding/json"
+	"strings"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// ExtractSearchText returns the searchable text of a stored history message, i.e. the text of the message,
+// media captions, document file names and poll names and options. The JSON data must be a serialized
+// *events.Message, which is what the client stores in the history.
+//
+// An empty string is returned if the data can't be parsed or the message doesn't contain any text.
+func ExtractSearchText(jsonData string) string {
+	var data struct {
+		Message *waProto.Message
+	}
+	if json.Unmarshal([]byte(jsonData), &data) != nil || data.Message == nil {
+		return ""
+	}
+	msg := data.Message
+	parts := []string{
+		msg.GetConversation(),
+		msg.GetExtendedTextMessage().GetText(),
+		msg.GetImageMessage().GetCaption(),
+		msg.GetVideoMessage().GetCaption(),
+		msg.GetDocumentMessage().GetCaption(),
+		msg.GetDocumentMessage().GetTitle(),
+		msg.GetDocumentMessage().GetFileName(),
+	}
+	for _, poll := range []*waProto.PollCreationMessage{msg.GetPollCreationMessage(), msg.GetPollCreationMessageV2(), msg.GetPollCreationMessageV3()} {
+		parts = append(parts, poll.GetName())
+		for _, option := range poll.GetOptions() {
+			parts = append(parts, option.GetOptionName())
+		}
+	}
+	nonEmpty := parts[:0]
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, "\n")
+}
+
+// SearchTerms splits a search query into lowercase terms. All terms must be found in a message for it to match.
+func SearchTerms(query string) []string {
+	return strings.Fields(strings.ToLower(query))
+}
+
+// MatchesSearchTerms returns true if the given text contains all the terms returned by SearchTerms.
+func MatchesSearchTerms(text string, terms []string) bool {
+	if len(terms) == 0 {
+		return false
+	}
+	text = strings.ToLower(text)
+	for _, term := range terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
@@ -7,6 +7,9 @@
 package store
 
 import (
+	"context"
+	"sync"
+
 	"go.mau.fi/libsignal/ecc"
 	groupRecord "go.mau.fi/libsignal/groups/state/record"
 	"go.mau.fi/libsignal/keys/identity"
@@ -33,47 +36,47 @@ func (device *Device) GetLocalRegistrationId() uint32 {
 	return device.RegistrationID
 }
 
-func (device *Device) SaveIdentity(address *protocol.SignalAddress, identityKey *identity.Key) {
+func (device *Device) saveIdentity(ctx context.Context, address *protocol.SignalAddress, identityKey *identity.Key) (err error) {
 	for i := 0; ; i++ {
-		err := device.Identities.PutIdentity(address.String(), identityKey.PublicKey().PublicKey())
-		if err == nil || !device.handleDatabaseError(i, err, "save identity of %s", address.String()) {
-			break
+		err = device.Identities.PutIdentityContext(ctx, address.String(), identityKey.PublicKey().PublicKey())
+		if err == nil || !device.handleDatabaseError(i, err, "save identity of %s", address.String()) || ctx.Err() != nil {
+			return
 		}
 	}
 }
 
-func (device *Device) IsTrustedIdentity(address *protocol.SignalAddress, identityKey *identity.Key) bool {
+func (device *Device) isTrustedIdentity(ctx context.Context, address *protocol.SignalAddress, identityKey *identity.Key) (isTrusted bool, err error) {
 	for i := 0; ; i++ {
-		isTrusted, err := device.Identities.IsTrustedIdentity(address.String(), identityKey.PublicKey().PublicKey())
-		if err == nil || !device.handleDatabaseError(i, err, "check if %s's identity is trusted", address.String()) {
-			return isTrusted
+		isTrusted, err = device.Identities.IsTrustedIdentityContext(ctx, address.String(), identityKey.PublicKey().PublicKey())
+		if err == nil || !device.handleDatabaseError(i, err, "check if %s's identity is trusted", address.String()) || ctx.Err() != nil {
+			return
 		}
 	}
 }
 
-func (device *Device) LoadPreKey(id uint32) *record.PreKey {
+func (device *Device) loadPreKey(ctx context.Context, id uint32) (*record.PreKey, error) {
 	var preKey *keys.PreKey
+	var err error
 	for i := 0; ; i++ {
-		var err error
-		preKey, err = device.PreKeys.GetPreKey(id)
-		if err == nil || !device.handleDatabaseError(i, err, "load prekey %d", id) {
+		preKey, err = device.PreKeys.GetPreKeyContext(ctx, id)
+		if err == nil || !device.handleDatabaseError(i, err, "load prekey %d", id) || ctx.Err() != nil {
 			break
 		}
 	}
-	if preKey == nil {
-		return nil
+	if err != nil || preKey == nil {
+		return nil, err
 	}
 	return record.NewPreKey(preKey.KeyID, ecc.NewECKeyPair(
 		ecc.NewDjbECPublicKey(*preKey.Pub),
 		ecc.NewDjbECPrivateKey(*preKey.Priv),
-	), nil)
+	), nil), nil
 }
 
-func (device *Device) RemovePreKey(id uint32) {
+func (device *Device) removePreKey(ctx context.Context, id uint32) (err error) {
 	for i := 0; ; i++ {
-		err := device.PreKeys.RemovePreKey(id)
-		if err == nil || !device.handleDatabaseError(i, err, "remove prekey %d", id) {
-			break
+		err = device.PreKeys.RemovePreKeyContext(ctx, id)
+		if err == nil || !device.handleDatabaseError(i, err, "remove prekey %d", id) || ctx.Err() != nil {
+			return
 		}
 	}
 }
@@ -86,44 +89,50 @@ func (device *Device) ContainsPreKey(preKeyID uint32) bool {
 	panic("not implemented")
 }
 
-func (device *Device) LoadSession(address *protocol.SignalAddress) *record.Session {
+func newEmptySession() *record.Session {
+	return record.NewSession(SignalProtobufSerializer.Session, SignalProtobufSerializer.State)
+}
+
+func (device *Device) loadSession(ctx context.Context, address *protocol.SignalAddress) (*record.Session, error) {
 	var rawSess []byte
+	var err error
 	for i := 0; ; i++ {
-		var err error
-		rawSess, err = device.Sessions.GetSession(address.String())
-		if err == nil || !device.handleDatabaseError(i, err, "load session with %s", address.String()) {
+		rawSess, err = device.Sessions.GetSessionContext(ctx, address.String())
+		if err == nil || !device.handleDatabaseError(i, err, "load session with %s", address.String()) || ctx.Err() != nil {
 			break
 		}
 	}
-	if rawSess == nil {
-		return record.NewSession(SignalProtobufSerializer.Session, SignalProtobufSerializer.State)
+	if err != nil {
+		return nil, err
+	} else if rawSess == nil {
+		return newEmptySession(), nil
 	}
 	sess, err := record.NewSessionFromBytes(rawSess, SignalProtobufSerializer.Session, SignalProtobufSerializer.State)
 	if err != nil {
 		device.Log.Errorf("Failed to deserialize session with %s: %v", address.String(), err)
-		return record.NewSession(SignalProtobufSerializer.Session, SignalProtobufSerializer.State)
+		return newEmptySession(), nil
 	}
-	return sess
+	return sess, nil
 }
 
 func (device *Device) GetSubDeviceSessions(name string) []uint32 {
 	panic("not implemented")
 }
 
-func (device *Device) StoreSession(address *protocol.SignalAddress, record *record.Session) {
+func (device *Device) storeSession(ctx context.Context, address *protocol.SignalAddress, record *record.Session) (err error) {
 	for i := 0; ; i++ {
-		err := device.Sessions.PutSession(address.String(), record.Serialize())
-		if err == nil || !device.handleDatabaseError(i, err, "store session with %s", address.String()) {
+		err = device.Sessions.PutSessionContext(ctx, address.String(), record.Serialize())
+		if err == nil || !device.handleDatabaseError(i, err, "store session with %s", address.String()) || ctx.Err() != nil {
 			return
 		}
 	}
 }
 
-func (device *Device) ContainsSession(remoteAddress *protocol.SignalAddress) bool {
+func (device *Device) containsSession(ctx context.Context, remoteAddress *protocol.SignalAddress) (hasSession bool, err error) {
 	for i := 0; ; i++ {
-		hasSession, err := device.Sessions.HasSession(remoteAddress.String())
-		if err == nil || !device.handleDatabaseError(i, err, "store has session for %s", remoteAddress.String()) {
-			return hasSession
+		hasSession, err = device.Sessions.HasSessionContext(ctx, remoteAddress.String())
+		if err == nil || !device.handleDatabaseError(i, err, "store has session for %s", remoteAddress.String()) || ctx.Err() != nil {
+			return
 		}
 	}
 }
@@ -162,31 +171,192 @@ func (device *Device) RemoveSignedPreKey(signedPreKeyID uint32) {
 	panic("not implemented")
 }
 
-func (device *Device) StoreSenderKey(senderKeyName *protocol.SenderKeyName, keyRecord *groupRecord.SenderKey) {
+func (device *Device) storeSenderKey(ctx context.Context, senderKeyName *protocol.SenderKeyName, keyRecord *groupRecord.SenderKey) (err error) {
 	for i := 0; ; i++ {
-		err := device.SenderKeys.PutSenderKey(senderKeyName.GroupID(), senderKeyName.Sender().String(), keyRecord.Serialize())
-		if err == nil || !device.handleDatabaseError(i, err, "store sender key from %s", senderKeyName.Sender().String()) {
+		err = device.SenderKeys.PutSenderKeyContext(ctx, senderKeyName.GroupID(), senderKeyName.Sender().String(), keyRecord.Serialize())
+		if err == nil || !device.handleDatabaseError(i, err, "store sender key from %s", senderKeyName.Sender().String()) || ctx.Err() != nil {
 			return
 		}
 	}
 }
 
-func (device *Device) LoadSenderKey(senderKeyName *protocol.SenderKeyName) *groupRecord.SenderKey {
+func newEmptySenderKey() *groupRecord.SenderKey {
+	return groupRecord.NewSenderKey(SignalProtobufSerializer.SenderKeyRecord, SignalProtobufSerializer.SenderKeyState)
+}
+
+func (device *Device) loadSenderKey(ctx context.Context, senderKeyName *protocol.SenderKeyName) (*groupRecord.SenderKey, error) {
 	var rawKey []byte
+	var err error
 	for i := 0; ; i++ {
-		var err error
-		rawKey, err = device.SenderKeys.GetSenderKey(senderKeyName.GroupID(), senderKeyName.Sender().String())
-		if err == nil || !device.handleDatabaseError(i, err, "load sender key from %s for %s", senderKeyName.Sender().String(), senderKeyName.GroupID()) {
+		rawKey, err = device.SenderKeys.GetSenderKeyContext(ctx, senderKeyName.GroupID(), senderKeyName.Sender().String())
+		if err == nil || !device.handleDatabaseError(i, err, "load sender key from %s for %s", senderKeyName.Sender().String(), senderKeyName.GroupID()) || ctx.Err() != nil {
 			break
 		}
 	}
-	if rawKey == nil {
-		return groupRecord.NewSenderKey(SignalProtobufSerializer.SenderKeyRecord, SignalProtobufSerializer.SenderKeyState)
+	if err != nil {
+		return nil, err
+	} else if rawKey == nil {
+		return newEmptySenderKey(), nil
 	}
 	key, err := groupRecord.NewSenderKeyFromBytes(rawKey, SignalProtobufSerializer.SenderKeyRecord, SignalProtobufSerializer.SenderKeyState)
 	if err != nil {
 		device.Log.Errorf("Failed to deserialize sender key from %s for %s: %v", senderKeyName.Sender().String(), senderKeyName.GroupID(), err)
-		return groupRecord.NewSenderKey(SignalProtobufSerializer.SenderKeyRecord, SignalProtobufSerializer.SenderKeyState)
+		return newEmptySenderKey(), nil
+	}
+	return key, nil
+}
+
+// The methods below implement the libsignal interfaces, which don't support errors. Database errors have
+// already been logged by handleDatabaseError, so they fall back to empty values like before. Use WithContext
+// or NewUnitOfWork to find out if a store call failed.
+
+func (device *Device) SaveIdentity(address *protocol.SignalAddress, identityKey *identity.Key) {
+	_ = device.saveIdentity(context.Background(), address, identityKey)
+}
+
+func (device *Device) IsTrustedIdentity(address *protocol.SignalAddress, identityKey *identity.Key) bool {
+	isTrusted, _ := device.isTrustedIdentity(context.Background(), address, identityKey)
+	return isTrusted
+}
+
+func (device *Device) LoadPreKey(id uint32) *record.PreKey {
+	preKey, _ := device.loadPreKey(context.Background(), id)
+	return preKey
+}
+
+func (device *Device) RemovePreKey(id uint32) {
+	_ = device.removePreKey(context.Background(), id)
+}
+
+func (device *Device) LoadSession(address *protocol.SignalAddress) *record.Session {
+	sess, err := device.loadSession(context.Background(), address)
+	if err != nil {
+		return newEmptySession()
+	}
+	return sess
+}
+
+func (device *Device) StoreSession(address *protocol.SignalAddress, record *record.Session) {
+	_ = device.storeSession(context.Background(), address, record)
+}
+
+func (device *Device) ContainsSession(remoteAddress *protocol.SignalAddress) bool {
+	hasSession, _ := device.containsSession(context.Background(), remoteAddress)
+	return hasSession
+}
+
+func (device *Device) StoreSenderKey(senderKeyName *protocol.SenderKeyName, keyRecord *groupRecord.SenderKey) {
+	_ = device.storeSenderKey(context.Background(), senderKeyName, keyRecord)
+}
+
+func (device *Device) LoadSenderKey(senderKeyName *protocol.SenderKeyName) *groupRecord.SenderKey {
+	key, err := device.loadSenderKey(context.Background(), senderKeyName)
+	if err != nil {
+		return newEmptySenderKey()
+	}
+	return key
+}
+
+// ContextSignalStore is a libsignal protocol store that passes a context to the underlying stores.
+// The libsignal interfaces don't accept contexts, so this is used to bind the caller's context
+// to the store calls made while encrypting or decrypting a single message.
+//
+// The libsignal interfaces don't return errors either. If a store call fails (e.g. because the context
+// was canceled), the error is remembered and returned by Err, and all later writes are skipped. Loads
+// still have to return something to libsignal, so they return empty records, which means that the
+// result of the libsignal call must be discarded if Err returns an error.
+type ContextSignalStore struct {
+	*Device
+	ctx context.Context
+
+	errLock sync.Mutex
+	err     error
+}
+
+var _ store.SignalProtocol = (*ContextSignalStore)(nil)
+
+// WithContext returns a libsignal protocol store that uses the given context for all database calls.
+func (device *Device) WithContext(ctx context.Context) *ContextSignalStore {
+	return &ContextSignalStore{Device: device, ctx: ctx}
+}
+
+// Err returns the first error returned by the underlying stores, or nil if all store calls succeeded.
+func (cs *ContextSignalStore) Err() error {
+	cs.errLock.Lock()
+	defer cs.errLock.Unlock()
+	return cs.err
+}
+
+func (cs *ContextSignalStore) setErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	cs.errLock.Lock()
+	if cs.err == nil {
+		cs.err = err
+	}
+	cs.errLock.Unlock()
+	return true
+}
+
+func (cs *ContextSignalStore) SaveIdentity(address *protocol.SignalAddress, identityKey *identity.Key) {
+	if cs.Err() == nil {
+		cs.setErr(cs.saveIdentity(cs.ctx, address, identityKey))
+	}
+}
+
+func (cs *ContextSignalStore) IsTrustedIdentity(address *protocol.SignalAddress, identityKey *identity.Key) bool {
+	isTrusted, err := cs.isTrustedIdentity(cs.ctx, address, identityKey)
+	if cs.setErr(err) {
+		return false
+	}
+	return isTrusted
+}
+
+func (cs *ContextSignalStore) LoadPreKey(id uint32) *record.PreKey {
+	preKey, err := cs.loadPreKey(cs.ctx, id)
+	cs.setErr(err)
+	return preKey
+}
+
+func (cs *ContextSignalStore) RemovePreKey(id uint32) {
+	if cs.Err() == nil {
+		cs.setErr(cs.removePreKey(cs.ctx, id))
+	}
+}
+
+func (cs *ContextSignalStore) LoadSession(address *protocol.SignalAddress) *record.Session {
+	sess, err := cs.loadSession(cs.ctx, address)
+	if cs.setErr(err) {
+		return newEmptySession()
+	}
+	return sess
+}
+
+func (cs *ContextSignalStore) StoreSession(address *protocol.SignalAddress, record *record.Session) {
+	if cs.Err() == nil {
+		cs.setErr(cs.storeSession(cs.ctx, address, record))
+	}
+}
+
+func (cs *ContextSignalStore) ContainsSession(remoteAddress *protocol.SignalAddress) bool {
+	hasSession, err := cs.containsSession(cs.ctx, remoteAddress)
+	if cs.setErr(err) {
+		return false
+	}
+	return hasSession
+}
+
+func (cs *ContextSignalStore) StoreSenderKey(senderKeyName *protocol.SenderKeyName, keyRecord *groupRecord.SenderKey) {
+	if cs.Err() == nil {
+		cs.setErr(cs.storeSenderKey(cs.ctx, senderKeyName, keyRecord))
+	}
+}
+
+func (cs *ContextSignalStore) LoadSenderKey(senderKeyName *protocol.SenderKeyName) *groupRecord.SenderKey {
+	key, err := cs.loadSenderKey(cs.ctx, senderKeyName)
+	if cs.setErr(err) {
+		return newEmptySenderKey()
 	}
 	return key
 }
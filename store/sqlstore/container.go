@@ -7,11 +7,12 @@
 package sqlstore
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"go.mau.fi/whatsmeow/webtest/properties"
 	mathRand "math/rand"
+	"sync"
 
 	"go.mau.fi/util/random"
 
@@ -28,6 +29,15 @@ type Container struct {
 	dialect string
 	log     waLog.Logger
 
+	keyEncryptor KeyEncryptor
+
+	// searchIndexEnabled is set by Upgrade if SQLite has FTS5, see setupSearchIndex.
+	searchIndexEnabled bool
+
+	retention   RetentionPolicy
+	janitorLock sync.Mutex
+	stopJanitor context.CancelFunc
+
 	DatabaseErrorHandler func(device *store.Device, action string, attemptIndex int, err error) (retry bool)
 }
 
@@ -42,16 +52,20 @@ var _ store.DeviceContainer = (*Container)(nil)
 // When using SQLite, it's strongly recommended to enable foreign keys by adding `?_foreign_keys=true`:
 //
 //	container, err := sqlstore.New("sqlite3", "file:yoursqlitefile.db?_foreign_keys=on", nil)
-func New(dialect, address string, log waLog.Logger) (*Container, error) {
+//
+// Private keys can be encrypted in the database by passing WithKeyEncryptor as an option,
+// and old data can be pruned automatically by passing WithRetentionPolicy.
+func New(dialect, address string, log waLog.Logger, opts ...ContainerOption) (*Container, error) {
 	db, err := sql.Open(dialect, address)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
-	container := NewWithDB(db, dialect, log)
+	container := NewWithDB(db, dialect, log, opts...)
 	err = container.Upgrade()
 	if err != nil {
 		return nil, fmt.Errorf("failed to upgrade database: %w", err)
 	}
+	container.StartJanitor()
 	return container, nil
 }
 
@@ -73,15 +87,21 @@ func New(dialect, address string, log waLog.Logger) (*Container, error) {
 //
 //	container := sqlstore.NewWithDB(...)
 //	err := container.Upgrade()
-func NewWithDB(db *sql.DB, dialect string, log waLog.Logger) *Container {
+//
+// The same applies to StartJanitor if a retention policy with an interval is used.
+func NewWithDB(db *sql.DB, dialect string, log waLog.Logger, opts ...ContainerOption) *Container {
 	if log == nil {
 		log = waLog.Noop
 	}
-	return &Container{
+	container := &Container{
 		db:      db,
 		dialect: dialect,
 		log:     log,
 	}
+	for _, opt := range opts {
+		opt(container)
+	}
+	return container
 }
 
 const getAllDevicesQuery = `
@@ -113,6 +133,16 @@ func (c *Container) scanDevice(row scannable) (*store.Device, error) {
 		&device.Platform, &device.BusinessName, &device.PushName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to scan session: %w", err)
+	}
+	jid := device.ID.String()
+	if noisePriv, err = c.decryptKey(columnNoiseKey, noisePriv, jid); err != nil {
+		return nil, err
+	} else if identityPriv, err = c.decryptKey(columnIdentityKey, identityPriv, jid); err != nil {
+		return nil, err
+	} else if preKeyPriv, err = c.decryptKey(columnSignedPreKey, preKeyPriv, jid); err != nil {
+		return nil, err
+	} else if device.AdvSecretKey, err = c.decryptKey(columnAdvKey, device.AdvSecretKey, jid); err != nil {
+		return nil, err
 	} else if len(noisePriv) != 32 || len(identityPriv) != 32 || len(preKeyPriv) != 32 || len(preKeySig) != 64 {
 		return nil, ErrInvalidLength
 	}
@@ -132,8 +162,10 @@ func (c *Container) scanDevice(row scannable) (*store.Device, error) {
 	device.AppState = innerStore
 	device.Contacts = innerStore
 	device.ChatSettings = innerStore
+	device.Chats = innerStore
 	device.MsgSecrets = innerStore
 	device.PrivacyTokens = innerStore
+	device.RecentMessages = innerStore
 	device.Container = c
 	device.History = innerStore
 	device.Initialized = true
@@ -225,13 +257,35 @@ var ErrDeviceIDMustBeSet = errors.New("device JID must be known before accessing
 // PutDevice stores the given device in this database. This should be called through Device.Save()
 // (which usually doesn't need to be called manually, as the library does that automatically when relevant).
 func (c *Container) PutDevice(device *store.Device) error {
+	return c.PutDeviceContext(context.Background(), device)
+}
+
+// PutDeviceContext stores the given device in this database using the given context for the query.
+func (c *Container) PutDeviceContext(ctx context.Context, device *store.Device) error {
 	if device.ID == nil {
 		return ErrDeviceIDMustBeSet
 	}
-	_, err := c.db.Exec(insertDeviceQuery,
-		device.ID.String(), device.RegistrationID, device.NoiseKey.Priv[:], device.IdentityKey.Priv[:],
-		device.SignedPreKey.Priv[:], device.SignedPreKey.KeyID, device.SignedPreKey.Signature[:],
-		device.AdvSecretKey, device.Account.Details, device.Account.AccountSignature, device.Account.AccountSignatureKey, device.Account.DeviceSignature,
+	jid := device.ID.String()
+	noisePriv, err := c.encryptKey(columnNoiseKey, device.NoiseKey.Priv[:], jid)
+	if err != nil {
+		return err
+	}
+	identityPriv, err := c.encryptKey(columnIdentityKey, device.IdentityKey.Priv[:], jid)
+	if err != nil {
+		return err
+	}
+	preKeyPriv, err := c.encryptKey(columnSignedPreKey, device.SignedPreKey.Priv[:], jid)
+	if err != nil {
+		return err
+	}
+	advKey, err := c.encryptKey(columnAdvKey, device.AdvSecretKey, jid)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.ExecContext(ctx, insertDeviceQuery,
+		jid, device.RegistrationID, noisePriv, identityPriv,
+		preKeyPriv, device.SignedPreKey.KeyID, device.SignedPreKey.Signature[:],
+		advKey, device.Account.Details, device.Account.AccountSignature, device.Account.AccountSignatureKey, device.Account.DeviceSignature,
 		device.Platform, device.BusinessName, device.PushName)
 
 	if !device.Initialized {
@@ -244,8 +298,10 @@ func (c *Container) PutDevice(device *store.Device) error {
 		device.AppState = innerStore
 		device.Contacts = innerStore
 		device.ChatSettings = innerStore
+		device.Chats = innerStore
 		device.MsgSecrets = innerStore
 		device.PrivacyTokens = innerStore
+		device.RecentMessages = innerStore
 		device.History = innerStore
 		device.Initialized = true
 	}
@@ -254,59 +310,21 @@ func (c *Container) PutDevice(device *store.Device) error {
 
 // DeleteDevice deletes the given device from this database. This should be called through Device.Delete()
 func (c *Container) DeleteDevice(store *store.Device) error {
+	return c.DeleteDeviceContext(context.Background(), store)
+}
+
+// DeleteDeviceContext deletes the given device from this database using the given context for the queries.
+func (c *Container) DeleteDeviceContext(ctx context.Context, store *store.Device) error {
 	if store.ID == nil {
 		return ErrDeviceIDMustBeSet
 	}
-	_, err := c.db.Exec(deleteDeviceQuery, store.ID.String())
+	_, err := c.db.ExecContext(ctx, deleteDeviceQuery, store.ID.String())
 
 	if err != nil {
 		return err
 	}
 
-	_, err = c.db.Exec(deletePrivacyToken, store.ID.String())
-
-	return err
-}
-
-const (
-	saveOrUpdateMessage = `
-		INSERT INTO history_messages (chat_id, message_id, message_timestamp, message_data, message_status, status_timestamp)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT (chat_id, message_id) DO UPDATE SET message_timestamp = $3, message_data = $4`
-	deleteHistoryMessage = `DELETE FROM history_messages`
-	updateStatusMessage  = `UPDATE history_messages SET message_status = $1, status_timestamp = $2 WHERE message_id = $3`
-)
-
-// DeviceHistorySync метод сохраняет историю
-func (c *Container) DeviceHistorySync(messages []properties.DataMessage) error {
-
-	if messages == nil || len(messages) < 1 {
-		return nil
-	}
-
-	for _, message := range messages {
-
-		_, err := c.db.Exec(saveOrUpdateMessage, message.ChatId, message.MessageId, message.MessageTimestamp, message.JsonData, message.MessageStatus, message.StatusTimestamp)
-
-		if err != nil {
-
-			fmt.Errorf("error saveOrUpdateMessage %v", err)
-		}
-	}
-
-	return nil
-}
-
-// DeleteDeviceHistory метод удаляет историю сообщений
-func (c *Container) DeleteDeviceHistory() error {
-
-	_, err := c.db.Exec(deleteHistoryMessage)
-	return err
-}
-
-// DeviceUpdateStatusMessage метод обновляет статус сообщения
-func (c *Container) DeviceUpdateStatusMessage(message properties.DataMessage) error {
+	_, err = c.db.ExecContext(ctx, deletePrivacyToken, store.ID.String())
 
-	_, err := c.db.Exec(updateStatusMessage, message.MessageStatus, message.StatusTimestamp, message.MessageId)
 	return err
 }
@@ -0,0 +1,66 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+)
+
+var testDBCounter uint32
+
+// newTestDB opens a new empty in-memory SQLite database. Each database has a unique name,
+// so that all connections in the pool see the same data, but separate tests don't.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	name := fmt.Sprintf("file:whatsmeow-test-%d?mode=memory&cache=shared&_foreign_keys=on", atomic.AddUint32(&testDBCounter, 1))
+	db, err := sql.Open("sqlite3", name)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+// newTestContainer creates a new fully upgraded container backed by an in-memory SQLite database.
+func newTestContainer(t *testing.T, opts ...ContainerOption) *Container {
+	t.Helper()
+	container := NewWithDB(newTestDB(t), "sqlite3", nil, opts...)
+	err := container.Upgrade()
+	if err != nil {
+		t.Fatalf("Failed to upgrade database: %v", err)
+	}
+	return container
+}
+
+// newTestDevice creates and stores a new device with the given user in the container.
+func newTestDevice(t *testing.T, container *Container, user string) *store.Device {
+	t.Helper()
+	device := container.NewDevice()
+	device.ID = &types.JID{User: user, Device: 1, Server: types.DefaultUserServer}
+	device.Account = &waProto.ADVSignedDeviceIdentity{
+		Details:             []byte("details"),
+		AccountSignature:    make([]byte, 64),
+		AccountSignatureKey: make([]byte, 32),
+		DeviceSignature:     make([]byte, 64),
+	}
+	err := container.PutDevice(device)
+	if err != nil {
+		t.Fatalf("Failed to store device: %v", err)
+	}
+	return device
+}
@@ -0,0 +1,372 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.mau.fi/util/random"
+
+	"go.mau.fi/whatsmeow/util/gcmutil"
+)
+
+// KeyEncryptor encrypts private key material before it's written to the database.
+//
+// When a Container has a KeyEncryptor, the private keys in whatsmeow_device, signal sessions,
+// sender keys, app state sync keys and the sent messages stored for retry receipts are encrypted. Unencrypted values that were written before
+// the encryptor was added can still be read, use Container.ReencryptKeys to encrypt them.
+type KeyEncryptor interface {
+	// Encrypt encrypts the given plaintext. The additional data must be authenticated, but not included in the output.
+	Encrypt(plaintext, additionalData []byte) ([]byte, error)
+	// Decrypt decrypts a value returned by Encrypt.
+	Decrypt(ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// ContainerOption is an optional setting for New and NewWithDB.
+type ContainerOption func(*Container)
+
+// WithKeyEncryptor makes the container encrypt private key material with the given encryptor.
+func WithKeyEncryptor(encryptor KeyEncryptor) ContainerOption {
+	return func(c *Container) {
+		c.keyEncryptor = encryptor
+	}
+}
+
+var (
+	// ErrKeyEncryptorRequired is returned when reading encrypted keys from a container that doesn't have a KeyEncryptor.
+	ErrKeyEncryptorRequired = errors.New("database contains encrypted keys, but no key encryptor is configured")
+	// ErrInvalidEncryptionKey is returned by NewAESGCMKeyEncryptor and ParseEncryptionKey if the key isn't 32 bytes.
+	ErrInvalidEncryptionKey = errors.New("encryption key must be 32 bytes")
+	// ErrUnknownEncryptionKey is returned by AESGCMKeyEncryptor.Decrypt if the value was encrypted with a key it doesn't have.
+	ErrUnknownEncryptionKey = errors.New("value was encrypted with an unknown key")
+)
+
+// encryptedValuePrefix is prepended to all encrypted values in the database. Signal sessions and sender keys are
+// protobufs, which can't start with a null byte, and plaintext keys are exactly 32 bytes, which is shorter than any
+// encrypted value, so the prefix can't be confused with unencrypted data.
+//
+// The last byte of the prefix is the format version. Version 1 values only authenticate the column name, version 2
+// values also authenticate the primary key of the row. Version 1 values can still be read, ReencryptKeys upgrades them.
+var (
+	encryptedValuePrefixV1 = []byte{0x00, 'W', 'M', 'E', 0x01}
+	encryptedValuePrefix   = []byte{0x00, 'W', 'M', 'E', 0x02}
+)
+
+func isEncryptedValue(value []byte) bool {
+	return len(value) > 32 && (bytes.HasPrefix(value, encryptedValuePrefix) || bytes.HasPrefix(value, encryptedValuePrefixV1))
+}
+
+// encryptionAdditionalData returns the additional data for an encrypted value in the given column and row.
+// The column name and each primary key value (a string or a byte slice) are prefixed with their length,
+// so that different rows can't produce the same additional data.
+func encryptionAdditionalData(column string, rowKey []interface{}) []byte {
+	parts := make([][]byte, 1, 1+len(rowKey))
+	parts[0] = []byte(column)
+	for _, key := range rowKey {
+		switch typedKey := key.(type) {
+		case string:
+			parts = append(parts, []byte(typedKey))
+		case []byte:
+			parts = append(parts, typedKey)
+		default:
+			panic(fmt.Errorf("unsupported row key type %T", key))
+		}
+	}
+	var ad []byte
+	for _, part := range parts {
+		ad = binary.BigEndian.AppendUint32(ad, uint32(len(part)))
+		ad = append(ad, part...)
+	}
+	return ad
+}
+
+// encryptKey encrypts the given value of the given column if the container has a KeyEncryptor.
+// The column name and the primary key of the row (in the same order as in encryptedColumns) are used as
+// additional data, so encrypted values can't be moved to other columns or rows.
+func (c *Container) encryptKey(column string, plaintext []byte, rowKey ...interface{}) ([]byte, error) {
+	if c.keyEncryptor == nil || plaintext == nil {
+		return plaintext, nil
+	}
+	ciphertext, err := c.keyEncryptor.Encrypt(plaintext, encryptionAdditionalData(column, rowKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt %s: %w", column, err)
+	}
+	return append(append([]byte{}, encryptedValuePrefix...), ciphertext...), nil
+}
+
+// decryptKey decrypts a value read from the given column and row. Unencrypted values are returned as-is.
+func (c *Container) decryptKey(column string, value []byte, rowKey ...interface{}) ([]byte, error) {
+	if !isEncryptedValue(value) {
+		return value, nil
+	} else if c.keyEncryptor == nil {
+		return nil, ErrKeyEncryptorRequired
+	}
+	additionalData := encryptionAdditionalData(column, rowKey)
+	if bytes.HasPrefix(value, encryptedValuePrefixV1) {
+		additionalData = []byte(column)
+	}
+	plaintext, err := c.keyEncryptor.Decrypt(value[len(encryptedValuePrefix):], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", column, err)
+	}
+	return plaintext, nil
+}
+
+const (
+	columnNoiseKey     = "whatsmeow_device.noise_key"
+	columnIdentityKey  = "whatsmeow_device.identity_key"
+	columnSignedPreKey = "whatsmeow_device.signed_pre_key"
+	columnAdvKey       = "whatsmeow_device.adv_key"
+	columnSession      = "whatsmeow_sessions.session"
+	columnSenderKey    = "whatsmeow_sender_keys.sender_key"
+	columnAppStateKey  = "whatsmeow_app_state_sync_keys.key_data"
+	columnRecentMsg    = "whatsmeow_recent_messages.message"
+)
+
+// encryptedColumn describes a column that contains key material and the primary key of its table.
+// The values of the primary key are bound to the encrypted value as additional data.
+type encryptedColumn struct {
+	table     string
+	column    string
+	keys      []string
+	binaryKey []bool
+}
+
+var encryptedColumns = []encryptedColumn{
+	{table: "whatsmeow_device", column: "noise_key", keys: []string{"jid"}, binaryKey: []bool{false}},
+	{table: "whatsmeow_device", column: "identity_key", keys: []string{"jid"}, binaryKey: []bool{false}},
+	{table: "whatsmeow_device", column: "signed_pre_key", keys: []string{"jid"}, binaryKey: []bool{false}},
+	{table: "whatsmeow_device", column: "adv_key", keys: []string{"jid"}, binaryKey: []bool{false}},
+	{table: "whatsmeow_sessions", column: "session", keys: []string{"our_jid", "their_id"}, binaryKey: []bool{false, false}},
+	{table: "whatsmeow_sender_keys", column: "sender_key", keys: []string{"our_jid", "chat_id", "sender_id"}, binaryKey: []bool{false, false, false}},
+	{table: "whatsmeow_app_state_sync_keys", column: "key_data", keys: []string{"jid", "key_id"}, binaryKey: []bool{false, true}},
+	{table: "whatsmeow_recent_messages", column: "message", keys: []string{"our_jid", "to_jid", "message_id"}, binaryKey: []bool{false, false, false}},
+}
+
+// ReencryptKeys encrypts all key material in the database with the current key of the container's KeyEncryptor.
+//
+// This is used both to encrypt existing unencrypted databases and to rotate keys: to rotate, create an encryptor
+// that has the new key as the current key and the old key as a decryption-only key, call this method, and then
+// remove the old key. Each column is re-encrypted in its own transaction, so the method can be safely run again
+// if it fails halfway.
+//
+// Values written by older versions, which only bound the column name (not the row) to the ciphertext, are
+// upgraded to the current format too, so this should be run once after updating.
+//
+// The number of re-encrypted values is returned. The clients using the container should be disconnected while
+// this is running.
+func (c *Container) ReencryptKeys() (int, error) {
+	if c.keyEncryptor == nil {
+		return 0, ErrKeyEncryptorRequired
+	}
+	total := 0
+	for _, col := range encryptedColumns {
+		count, err := c.reencryptColumn(col)
+		total += count
+		if err != nil {
+			return total, fmt.Errorf("failed to re-encrypt %s.%s: %w", col.table, col.column, err)
+		}
+	}
+	return total, nil
+}
+
+type encryptedRow struct {
+	keys  []interface{}
+	value []byte
+}
+
+func (c *Container) reencryptColumn(col encryptedColumn) (int, error) {
+	name := col.table + "." + col.column
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	rows, err := tx.Query(fmt.Sprintf("SELECT %s, %s FROM %s", strings.Join(col.keys, ", "), col.column, col.table))
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	var values []encryptedRow
+	for rows.Next() {
+		row := encryptedRow{keys: make([]interface{}, len(col.keys))}
+		dest := make([]interface{}, len(col.keys)+1)
+		for i, binaryKey := range col.binaryKey {
+			if binaryKey {
+				dest[i] = new([]byte)
+			} else {
+				dest[i] = new(string)
+			}
+		}
+		dest[len(col.keys)] = &row.value
+		err = rows.Scan(dest...)
+		if err != nil {
+			_ = rows.Close()
+			_ = tx.Rollback()
+			return 0, err
+		}
+		for i, binaryKey := range col.binaryKey {
+			if binaryKey {
+				row.keys[i] = *dest[i].(*[]byte)
+			} else {
+				row.keys[i] = *dest[i].(*string)
+			}
+		}
+		values = append(values, row)
+	}
+	if err = rows.Err(); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	conditions := make([]string, len(col.keys))
+	for i, key := range col.keys {
+		conditions[i] = fmt.Sprintf("%s=$%d", key, i+2)
+	}
+	updateQuery := fmt.Sprintf("UPDATE %s SET %s=$1 WHERE %s", col.table, col.column, strings.Join(conditions, " AND "))
+	count := 0
+	for _, row := range values {
+		if row.value == nil {
+			continue
+		}
+		var plaintext, ciphertext []byte
+		plaintext, err = c.decryptKey(name, row.value, row.keys...)
+		if err == nil {
+			ciphertext, err = c.encryptKey(name, plaintext, row.keys...)
+		}
+		if err == nil {
+			_, err = tx.Exec(updateQuery, append([]interface{}{ciphertext}, row.keys...)...)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		count++
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return count, nil
+}
+
+// AESGCMKeyEncryptor is a KeyEncryptor that uses AES-256-GCM.
+//
+// Encrypted values start with a short identifier of the key, so values encrypted with previous keys can still
+// be decrypted during key rotation.
+type AESGCMKeyEncryptor struct {
+	currentID [keyIDLength]byte
+	keys      map[[keyIDLength]byte]cipher.AEAD
+}
+
+var _ KeyEncryptor = (*AESGCMKeyEncryptor)(nil)
+
+const keyIDLength = 4
+
+func encryptionKeyID(key []byte) (id [keyIDLength]byte) {
+	hash := sha256.Sum256(key)
+	copy(id[:], hash[:])
+	return
+}
+
+// NewAESGCMKeyEncryptor creates a new AES-GCM encryptor. New values are encrypted with key,
+// while the old keys are only used for decrypting existing values.
+func NewAESGCMKeyEncryptor(key []byte, oldKeys ...[]byte) (*AESGCMKeyEncryptor, error) {
+	encryptor := &AESGCMKeyEncryptor{
+		currentID: encryptionKeyID(key),
+		keys:      make(map[[keyIDLength]byte]cipher.AEAD, 1+len(oldKeys)),
+	}
+	for _, item := range append([][]byte{key}, oldKeys...) {
+		if len(item) != 32 {
+			return nil, ErrInvalidEncryptionKey
+		}
+		gcm, err := gcmutil.Prepare(item)
+		if err != nil {
+			return nil, err
+		}
+		id := encryptionKeyID(item)
+		// Don't let an old key with a colliding ID replace the current key
+		if _, exists := encryptor.keys[id]; !exists {
+			encryptor.keys[id] = gcm
+		}
+	}
+	return encryptor, nil
+}
+
+func (enc *AESGCMKeyEncryptor) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	gcm := enc.keys[enc.currentID]
+	iv := random.Bytes(gcm.NonceSize())
+	output := make([]byte, 0, keyIDLength+len(iv)+len(plaintext)+gcm.Overhead())
+	output = append(output, enc.currentID[:]...)
+	output = append(output, iv...)
+	return gcm.Seal(output, iv, plaintext, additionalData), nil
+}
+
+func (enc *AESGCMKeyEncryptor) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < keyIDLength {
+		return nil, ErrInvalidLength
+	}
+	gcm, ok := enc.keys[*(*[keyIDLength]byte)(ciphertext[:keyIDLength])]
+	if !ok {
+		return nil, ErrUnknownEncryptionKey
+	}
+	ciphertext = ciphertext[keyIDLength:]
+	if len(ciphertext) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, ErrInvalidLength
+	}
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], additionalData)
+}
+
+// ParseEncryptionKey parses a 32-byte encryption key encoded as hex or base64.
+func ParseEncryptionKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	var key []byte
+	var err error
+	if len(encoded) == hex.EncodedLen(32) {
+		key, err = hex.DecodeString(encoded)
+	} else {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, ErrInvalidEncryptionKey
+	}
+	return key, nil
+}
+
+// EncryptionKeyFromEnv reads an encryption key from the given environment variable.
+func EncryptionKeyFromEnv(name string) ([]byte, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	key, err := ParseEncryptionKey(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %w", name, err)
+	}
+	return key, nil
+}
+
+// EncryptionKeyFromFile reads an encryption key from the given file.
+func EncryptionKeyFromFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	key, err := ParseEncryptionKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %w", path, err)
+	}
+	return key, nil
+}
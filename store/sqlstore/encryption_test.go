@@ -0,0 +1,243 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mau.fi/util/random"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func newTestEncryptor(t *testing.T, key []byte, oldKeys ...[]byte) *AESGCMKeyEncryptor {
+	t.Helper()
+	enc, err := NewAESGCMKeyEncryptor(key, oldKeys...)
+	if err != nil {
+		t.Fatalf("Failed to create encryptor: %v", err)
+	}
+	return enc
+}
+
+func getRawSession(t *testing.T, container *Container, ourJID, theirID string) []byte {
+	t.Helper()
+	var raw []byte
+	err := container.db.QueryRow("SELECT session FROM whatsmeow_sessions WHERE our_jid=$1 AND their_id=$2", ourJID, theirID).Scan(&raw)
+	if err != nil {
+		t.Fatalf("Failed to read raw session: %v", err)
+	}
+	return raw
+}
+
+func setRawSession(t *testing.T, container *Container, ourJID, theirID string, raw []byte) {
+	t.Helper()
+	_, err := container.db.Exec("UPDATE whatsmeow_sessions SET session=$1 WHERE our_jid=$2 AND their_id=$3", raw, ourJID, theirID)
+	if err != nil {
+		t.Fatalf("Failed to write raw session: %v", err)
+	}
+}
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	container := newTestContainer(t, WithKeyEncryptor(newTestEncryptor(t, random.Bytes(32))))
+	device := newTestDevice(t, container, "1")
+	session := []byte("session data")
+	if err := device.Sessions.PutSession("2.0:1", session); err != nil {
+		t.Fatalf("Failed to store session: %v", err)
+	}
+	raw := getRawSession(t, container, device.ID.String(), "2.0:1")
+	if !isEncryptedValue(raw) || bytes.Contains(raw, session) {
+		t.Fatalf("Session wasn't encrypted in the database: %X", raw)
+	}
+	got, err := device.Sessions.GetSession("2.0:1")
+	if err != nil {
+		t.Fatalf("Failed to get session: %v", err)
+	} else if !bytes.Equal(got, session) {
+		t.Fatalf("Got wrong session %q", got)
+	}
+
+	loaded, err := container.GetDevice(*device.ID)
+	if err != nil {
+		t.Fatalf("Failed to load device: %v", err)
+	} else if *loaded.NoiseKey.Priv != *device.NoiseKey.Priv || *loaded.IdentityKey.Priv != *device.IdentityKey.Priv {
+		t.Fatalf("Loaded device has different keys")
+	}
+}
+
+func TestEncryption_WrongKey(t *testing.T) {
+	db := newTestDB(t)
+	container := NewWithDB(db, "sqlite3", nil, WithKeyEncryptor(newTestEncryptor(t, random.Bytes(32))))
+	if err := container.Upgrade(); err != nil {
+		t.Fatalf("Failed to upgrade database: %v", err)
+	}
+	device := newTestDevice(t, container, "1")
+
+	wrongContainer := NewWithDB(db, "sqlite3", nil, WithKeyEncryptor(newTestEncryptor(t, random.Bytes(32))))
+	_, err := wrongContainer.GetDevice(*device.ID)
+	if !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Fatalf("Expected ErrUnknownEncryptionKey, got %v", err)
+	}
+
+	noKeyContainer := NewWithDB(db, "sqlite3", nil)
+	_, err = noKeyContainer.GetDevice(*device.ID)
+	if !errors.Is(err, ErrKeyEncryptorRequired) {
+		t.Fatalf("Expected ErrKeyEncryptorRequired, got %v", err)
+	}
+}
+
+func TestEncryption_TamperedCiphertext(t *testing.T) {
+	container := newTestContainer(t, WithKeyEncryptor(newTestEncryptor(t, random.Bytes(32))))
+	device := newTestDevice(t, container, "1")
+	ourJID := device.ID.String()
+	if err := device.Sessions.PutSession("2.0:1", []byte("session data")); err != nil {
+		t.Fatalf("Failed to store session: %v", err)
+	}
+	raw := getRawSession(t, container, ourJID, "2.0:1")
+	raw[len(raw)-1] ^= 0x01
+	setRawSession(t, container, ourJID, "2.0:1", raw)
+	if _, err := device.Sessions.GetSession("2.0:1"); err == nil {
+		t.Fatalf("Tampered session was decrypted successfully")
+	}
+}
+
+func TestEncryption_MovedCiphertext(t *testing.T) {
+	container := newTestContainer(t, WithKeyEncryptor(newTestEncryptor(t, random.Bytes(32))))
+	device := newTestDevice(t, container, "1")
+	ourJID := device.ID.String()
+	if err := device.Sessions.PutSession("2.0:1", []byte("session with 2")); err != nil {
+		t.Fatalf("Failed to store session: %v", err)
+	} else if err = device.Sessions.PutSession("3.0:1", []byte("session with 3")); err != nil {
+		t.Fatalf("Failed to store session: %v", err)
+	}
+	// Copying a valid ciphertext to another row must not decrypt, even though the column is the same
+	setRawSession(t, container, ourJID, "3.0:1", getRawSession(t, container, ourJID, "2.0:1"))
+	if _, err := device.Sessions.GetSession("3.0:1"); err == nil {
+		t.Fatalf("Session copied from another row was decrypted successfully")
+	}
+	if _, err := device.Sessions.GetSession("2.0:1"); err != nil {
+		t.Fatalf("Failed to get original session: %v", err)
+	}
+}
+
+func TestEncryption_PlaintextPassthrough(t *testing.T) {
+	db := newTestDB(t)
+	plainContainer := NewWithDB(db, "sqlite3", nil)
+	if err := plainContainer.Upgrade(); err != nil {
+		t.Fatalf("Failed to upgrade database: %v", err)
+	}
+	device := newTestDevice(t, plainContainer, "1")
+	session := []byte("session data")
+	if err := device.Sessions.PutSession("2.0:1", session); err != nil {
+		t.Fatalf("Failed to store session: %v", err)
+	}
+	if raw := getRawSession(t, plainContainer, device.ID.String(), "2.0:1"); !bytes.Equal(raw, session) {
+		t.Fatalf("Session was modified without a key encryptor: %X", raw)
+	}
+
+	encContainer := NewWithDB(db, "sqlite3", nil, WithKeyEncryptor(newTestEncryptor(t, random.Bytes(32))))
+	loaded, err := encContainer.GetDevice(*device.ID)
+	if err != nil {
+		t.Fatalf("Failed to load unencrypted device with key encryptor: %v", err)
+	} else if *loaded.NoiseKey.Priv != *device.NoiseKey.Priv {
+		t.Fatalf("Loaded device has different noise key")
+	}
+	got, err := loaded.Sessions.GetSession("2.0:1")
+	if err != nil {
+		t.Fatalf("Failed to get unencrypted session: %v", err)
+	} else if !bytes.Equal(got, session) {
+		t.Fatalf("Got wrong session %q", got)
+	}
+}
+
+func TestEncryption_Reencrypt(t *testing.T) {
+	oldKey, newKey := random.Bytes(32), random.Bytes(32)
+	db := newTestDB(t)
+	oldContainer := NewWithDB(db, "sqlite3", nil, WithKeyEncryptor(newTestEncryptor(t, oldKey)))
+	if err := oldContainer.Upgrade(); err != nil {
+		t.Fatalf("Failed to upgrade database: %v", err)
+	}
+	device := newTestDevice(t, oldContainer, "1")
+	ourJID := device.ID.String()
+	session := []byte("session data")
+	if err := device.Sessions.PutSession("2.0:1", session); err != nil {
+		t.Fatalf("Failed to store session: %v", err)
+	}
+	// Simulate a value written in the legacy format, which only bound the column name
+	legacy, err := oldContainer.keyEncryptor.Encrypt(session, []byte(columnSession))
+	if err != nil {
+		t.Fatalf("Failed to encrypt legacy value: %v", err)
+	}
+	setRawSession(t, oldContainer, ourJID, "2.0:1", append(append([]byte{}, encryptedValuePrefixV1...), legacy...))
+	if got, err := device.Sessions.GetSession("2.0:1"); err != nil || !bytes.Equal(got, session) {
+		t.Fatalf("Failed to read legacy session: %q / %v", got, err)
+	}
+
+	rotatingContainer := NewWithDB(db, "sqlite3", nil, WithKeyEncryptor(newTestEncryptor(t, newKey, oldKey)))
+	count, err := rotatingContainer.ReencryptKeys()
+	if err != nil {
+		t.Fatalf("Failed to re-encrypt keys: %v", err)
+	} else if count != 5 {
+		// 4 device keys and 1 session
+		t.Fatalf("Expected 5 re-encrypted values, got %d", count)
+	}
+	if raw := getRawSession(t, rotatingContainer, ourJID, "2.0:1"); !bytes.HasPrefix(raw, encryptedValuePrefix) {
+		t.Fatalf("Legacy session wasn't upgraded to the current format")
+	}
+
+	newContainer := NewWithDB(db, "sqlite3", nil, WithKeyEncryptor(newTestEncryptor(t, newKey)))
+	loaded, err := newContainer.GetDevice(*device.ID)
+	if err != nil {
+		t.Fatalf("Failed to load device with only the new key: %v", err)
+	} else if *loaded.IdentityKey.Priv != *device.IdentityKey.Priv {
+		t.Fatalf("Loaded device has different identity key")
+	}
+	if got, err := loaded.Sessions.GetSession("2.0:1"); err != nil || !bytes.Equal(got, session) {
+		t.Fatalf("Failed to read session with only the new key: %q / %v", got, err)
+	}
+
+	_, err = oldContainer.GetDevice(*device.ID)
+	if !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Fatalf("Expected ErrUnknownEncryptionKey with the old key after rotation, got %v", err)
+	}
+}
+
+func TestEncryption_RecentMessages(t *testing.T) {
+	container := newTestContainer(t, WithKeyEncryptor(newTestEncryptor(t, random.Bytes(32))))
+	device := newTestDevice(t, container, "1")
+	to := types.NewJID("2", types.DefaultUserServer)
+	message := []byte("secret message")
+	err := device.RecentMessages.PutRecentMessage(to, "ABCD", message, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to store recent message: %v", err)
+	}
+	var raw []byte
+	err = container.db.QueryRow("SELECT message FROM whatsmeow_recent_messages WHERE to_jid=$1 AND message_id=$2", to.String(), "ABCD").Scan(&raw)
+	if err != nil {
+		t.Fatalf("Failed to read raw recent message: %v", err)
+	} else if !isEncryptedValue(raw) || bytes.Contains(raw, message) {
+		t.Fatalf("Recent message wasn't encrypted in the database: %X", raw)
+	}
+	got, err := device.RecentMessages.GetRecentMessage(to, "ABCD")
+	if err != nil {
+		t.Fatalf("Failed to get recent message: %v", err)
+	} else if !bytes.Equal(got, message) {
+		t.Fatalf("Got wrong recent message %q", got)
+	}
+
+	err = device.RecentMessages.PutRecentMessage(to, "EXPIRED", message, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to store recent message: %v", err)
+	}
+	res, err := container.Prune()
+	if err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	} else if res.RecentMessages != 1 {
+		t.Fatalf("Expected 1 pruned recent message, got %d", res.RecentMessages)
+	}
+}
@@ -0,0 +1,759 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mau.fi/util/random"
+	"golang.org/x/crypto/argon2"
+
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/util/gcmutil"
+)
+
+// DeviceArchiveVersion is the current version of the device archive format.
+// ReadDeviceArchive refuses archives with a different version.
+const DeviceArchiveVersion = 1
+
+// DeviceArchive contains all data of a single device, as exported by Container.ExportDevice.
+//
+// Byte fields are stored exactly like in the database, the archive doesn't validate or convert them. The only
+// exception is key material encrypted with a KeyEncryptor, which is decrypted on export and encrypted again
+// with the key encryptor of the importing container.
+type DeviceArchive struct {
+	Version    int
+	ExportedAt time.Time
+
+	Device           ArchivedDevice
+	Identities       []ArchivedIdentity
+	Sessions         []ArchivedSession
+	PreKeys          []ArchivedPreKey
+	SenderKeys       []ArchivedSenderKey
+	AppStateSyncKeys []ArchivedAppStateSyncKey
+	AppStateVersions []ArchivedAppStateVersion
+	Contacts         []ArchivedContact
+	ChatSettings     []ArchivedChatSettings
+	Chats            []ArchivedChat
+	MessageSecrets   []ArchivedMessageSecret
+	PrivacyTokens    []ArchivedPrivacyToken
+	History          []store.HistoryMessage
+}
+
+// ArchivedDevice is a row of the whatsmeow_device table.
+type ArchivedDevice struct {
+	JID            types.JID
+	RegistrationID uint32
+	NoiseKey       []byte
+	IdentityKey    []byte
+
+	SignedPreKey    []byte
+	SignedPreKeyID  uint32
+	SignedPreKeySig []byte
+
+	AdvKey           []byte
+	AdvDetails       []byte
+	AdvAccountSig    []byte
+	AdvAccountSigKey []byte
+	AdvDeviceSig     []byte
+
+	Platform     string
+	BusinessName string
+	PushName     string
+}
+
+// ArchivedIdentity is a row of the whatsmeow_identity_keys table.
+type ArchivedIdentity struct {
+	TheirID  string
+	Identity []byte
+}
+
+// ArchivedSession is a row of the whatsmeow_sessions table.
+type ArchivedSession struct {
+	TheirID string
+	Session []byte
+}
+
+// ArchivedPreKey is a row of the whatsmeow_pre_keys table.
+type ArchivedPreKey struct {
+	KeyID    uint32
+	Key      []byte
+	Uploaded bool
+}
+
+// ArchivedSenderKey is a row of the whatsmeow_sender_keys table.
+type ArchivedSenderKey struct {
+	ChatID    string
+	SenderID  string
+	SenderKey []byte
+}
+
+// ArchivedAppStateSyncKey is a row of the whatsmeow_app_state_sync_keys table.
+type ArchivedAppStateSyncKey struct {
+	KeyID       []byte
+	KeyData     []byte
+	Timestamp   int64
+	Fingerprint []byte
+}
+
+// ArchivedAppStateVersion is a row of the whatsmeow_app_state_version table
+// along with the rows of whatsmeow_app_state_mutation_macs that belong to it.
+type ArchivedAppStateVersion struct {
+	Name         string
+	Version      uint64
+	Hash         []byte
+	MutationMACs []ArchivedMutationMAC
+}
+
+// ArchivedMutationMAC is a row of the whatsmeow_app_state_mutation_macs table.
+type ArchivedMutationMAC struct {
+	Version  uint64
+	IndexMAC []byte
+	ValueMAC []byte
+}
+
+// ArchivedContact is a row of the whatsmeow_contacts table. Nil fields are NULL in the database.
+type ArchivedContact struct {
+	TheirJID     string
+	FirstName    *string
+	FullName     *string
+	PushName     *string
+	BusinessName *string
+}
+
+// ArchivedChatSettings is a row of the whatsmeow_chat_settings table.
+type ArchivedChatSettings struct {
+	ChatJID    string
+	MutedUntil int64
+	Pinned     bool
+	Archived   bool
+}
+
+// ArchivedChat is a row of the whatsmeow_chats table.
+type ArchivedChat struct {
+	ChatJID string
+	Name    string
+
+	LastMessageID      string
+	LastMessageTime    int64
+	LastMessagePreview string
+	LastMessageFromMe  bool
+
+	UnreadCount         int
+	MarkedUnread        bool
+	EphemeralExpiration int64
+}
+
+// ArchivedMessageSecret is a row of the whatsmeow_message_secrets table.
+type ArchivedMessageSecret struct {
+	ChatJID   string
+	SenderJID string
+	MessageID string
+	Key       []byte
+	Timestamp int64
+}
+
+// ArchivedPrivacyToken is a row of the whatsmeow_privacy_tokens table.
+type ArchivedPrivacyToken struct {
+	TheirJID  string
+	Token     []byte
+	Timestamp int64
+}
+
+var (
+	// ErrDeviceNotFound is returned by ExportDevice if the device doesn't exist.
+	ErrDeviceNotFound = errors.New("device not found")
+	// ErrDeviceAlreadyExists is returned by ImportDevice if the database already contains the device.
+	ErrDeviceAlreadyExists = errors.New("device already exists")
+	// ErrInvalidArchive is returned by ReadDeviceArchive if the input isn't a device archive.
+	ErrInvalidArchive = errors.New("not a device archive")
+	// ErrUnsupportedArchiveVersion is returned by ReadDeviceArchive if the archive was written by an incompatible version.
+	ErrUnsupportedArchiveVersion = errors.New("unsupported device archive version")
+	// ErrArchivePassphraseRequired is returned by ReadDeviceArchive if the archive is encrypted, but no passphrase was given.
+	ErrArchivePassphraseRequired = errors.New("device archive is encrypted, but no passphrase was given")
+	// ErrWrongArchivePassphrase is returned by ReadDeviceArchive if the archive can't be decrypted with the given passphrase.
+	ErrWrongArchivePassphrase = errors.New("wrong passphrase or corrupted device archive")
+)
+
+const (
+	exportIdentitiesQuery       = `SELECT their_id, identity FROM whatsmeow_identity_keys WHERE our_jid=$1`
+	exportSessionsQuery         = `SELECT their_id, session FROM whatsmeow_sessions WHERE our_jid=$1`
+	exportPreKeysQuery          = `SELECT key_id, key, uploaded FROM whatsmeow_pre_keys WHERE jid=$1`
+	exportSenderKeysQuery       = `SELECT chat_id, sender_id, sender_key FROM whatsmeow_sender_keys WHERE our_jid=$1`
+	exportAppStateSyncKeysQuery = `SELECT key_id, key_data, timestamp, fingerprint FROM whatsmeow_app_state_sync_keys WHERE jid=$1`
+	exportAppStateVersionsQuery = `SELECT name, version, hash FROM whatsmeow_app_state_version WHERE jid=$1`
+	exportMutationMACsQuery     = `SELECT name, version, index_mac, value_mac FROM whatsmeow_app_state_mutation_macs WHERE jid=$1`
+	exportContactsQuery         = `SELECT their_jid, first_name, full_name, push_name, business_name FROM whatsmeow_contacts WHERE our_jid=$1`
+	exportChatSettingsQuery     = `SELECT chat_jid, muted_until, pinned, archived FROM whatsmeow_chat_settings WHERE our_jid=$1`
+	exportChatsQuery            = `SELECT chat_jid, name, last_message_id, last_message_time, last_message_preview, last_message_from_me, unread_count, marked_unread, ephemeral_expiration FROM whatsmeow_chats WHERE our_jid=$1`
+	exportMessageSecretsQuery   = `SELECT chat_jid, sender_jid, message_id, key, timestamp FROM whatsmeow_message_secrets WHERE our_jid=$1`
+	exportPrivacyTokensQuery    = `SELECT their_jid, token, timestamp FROM whatsmeow_privacy_tokens WHERE our_jid=$1`
+	exportHistoryQuery          = `SELECT ` + historyMessageColumns + ` FROM history_messages WHERE our_jid=$1`
+
+	importIdentityQuery        = `INSERT INTO whatsmeow_identity_keys (our_jid, their_id, identity) VALUES ($1, $2, $3)`
+	importSessionQuery         = `INSERT INTO whatsmeow_sessions (our_jid, their_id, session) VALUES ($1, $2, $3)`
+	importSenderKeyQuery       = `INSERT INTO whatsmeow_sender_keys (our_jid, chat_id, sender_id, sender_key) VALUES ($1, $2, $3, $4)`
+	importAppStateSyncKeyQuery = `INSERT INTO whatsmeow_app_state_sync_keys (jid, key_id, key_data, timestamp, fingerprint) VALUES ($1, $2, $3, $4, $5)`
+	importAppStateVersionQuery = `INSERT INTO whatsmeow_app_state_version (jid, name, version, hash) VALUES ($1, $2, $3, $4)`
+	importMutationMACQuery     = `INSERT INTO whatsmeow_app_state_mutation_macs (jid, name, version, index_mac, value_mac) VALUES ($1, $2, $3, $4, $5)`
+	importContactQuery         = `
+		INSERT INTO whatsmeow_contacts (our_jid, their_jid, first_name, full_name, push_name, business_name)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	importChatSettingsQuery = `
+		INSERT INTO whatsmeow_chat_settings (our_jid, chat_jid, muted_until, pinned, archived) VALUES ($1, $2, $3, $4, $5)
+	`
+	importChatQuery = `
+		INSERT INTO whatsmeow_chats (our_jid, chat_jid, name, last_message_id, last_message_time, last_message_preview,
+		                             last_message_from_me, unread_count, marked_unread, ephemeral_expiration)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+	importMessageSecretQuery = `
+		INSERT INTO whatsmeow_message_secrets (our_jid, chat_jid, sender_jid, message_id, key, timestamp) VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	importPrivacyTokenQuery = `
+		INSERT INTO whatsmeow_privacy_tokens (our_jid, their_jid, token, timestamp) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (our_jid, their_jid) DO UPDATE SET token=excluded.token, timestamp=excluded.timestamp
+	`
+)
+
+type queryable interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// exportRows runs the given query with the device JID and calls scan for each row.
+func exportRows(db queryable, query, jid string, scan func(row scannable) error) error {
+	rows, err := db.Query(query, jid)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ExportDevice reads all data of the device with the given JID into a DeviceArchive.
+//
+// The data is read in a single transaction, but the device shouldn't be connected while it's being exported,
+// as any changes made after the export (e.g. new signal sessions) will be missing from the archive.
+func (c *Container) ExportDevice(jid types.JID) (*DeviceArchive, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	archive := &DeviceArchive{
+		Version:    DeviceArchiveVersion,
+		ExportedAt: time.Now(),
+	}
+	dev := &archive.Device
+	err = tx.QueryRow(getDeviceQuery, jid).Scan(
+		&dev.JID, &dev.RegistrationID, &dev.NoiseKey, &dev.IdentityKey,
+		&dev.SignedPreKey, &dev.SignedPreKeyID, &dev.SignedPreKeySig,
+		&dev.AdvKey, &dev.AdvDetails, &dev.AdvAccountSig, &dev.AdvAccountSigKey, &dev.AdvDeviceSig,
+		&dev.Platform, &dev.BusinessName, &dev.PushName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, jid)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read device: %w", err)
+	}
+	ourJID := jid.String()
+	if dev.NoiseKey, err = c.decryptKey(columnNoiseKey, dev.NoiseKey, ourJID); err != nil {
+		return nil, err
+	} else if dev.IdentityKey, err = c.decryptKey(columnIdentityKey, dev.IdentityKey, ourJID); err != nil {
+		return nil, err
+	} else if dev.SignedPreKey, err = c.decryptKey(columnSignedPreKey, dev.SignedPreKey, ourJID); err != nil {
+		return nil, err
+	} else if dev.AdvKey, err = c.decryptKey(columnAdvKey, dev.AdvKey, ourJID); err != nil {
+		return nil, err
+	}
+
+	err = exportRows(tx, exportIdentitiesQuery, ourJID, func(row scannable) error {
+		var identity ArchivedIdentity
+		err := row.Scan(&identity.TheirID, &identity.Identity)
+		archive.Identities = append(archive.Identities, identity)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export identity keys: %w", err)
+	}
+	err = exportRows(tx, exportSessionsQuery, ourJID, func(row scannable) error {
+		var session ArchivedSession
+		err := row.Scan(&session.TheirID, &session.Session)
+		if err != nil {
+			return err
+		}
+		session.Session, err = c.decryptKey(columnSession, session.Session, ourJID, session.TheirID)
+		archive.Sessions = append(archive.Sessions, session)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export sessions: %w", err)
+	}
+	err = exportRows(tx, exportPreKeysQuery, ourJID, func(row scannable) error {
+		var preKey ArchivedPreKey
+		err := row.Scan(&preKey.KeyID, &preKey.Key, &preKey.Uploaded)
+		archive.PreKeys = append(archive.PreKeys, preKey)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export prekeys: %w", err)
+	}
+	err = exportRows(tx, exportSenderKeysQuery, ourJID, func(row scannable) error {
+		var senderKey ArchivedSenderKey
+		err := row.Scan(&senderKey.ChatID, &senderKey.SenderID, &senderKey.SenderKey)
+		if err != nil {
+			return err
+		}
+		senderKey.SenderKey, err = c.decryptKey(columnSenderKey, senderKey.SenderKey, ourJID, senderKey.ChatID, senderKey.SenderID)
+		archive.SenderKeys = append(archive.SenderKeys, senderKey)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export sender keys: %w", err)
+	}
+	err = exportRows(tx, exportAppStateSyncKeysQuery, ourJID, func(row scannable) error {
+		var key ArchivedAppStateSyncKey
+		err := row.Scan(&key.KeyID, &key.KeyData, &key.Timestamp, &key.Fingerprint)
+		if err != nil {
+			return err
+		}
+		key.KeyData, err = c.decryptKey(columnAppStateKey, key.KeyData, ourJID, key.KeyID)
+		archive.AppStateSyncKeys = append(archive.AppStateSyncKeys, key)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export app state sync keys: %w", err)
+	}
+	versionIndexes := make(map[string]int)
+	err = exportRows(tx, exportAppStateVersionsQuery, ourJID, func(row scannable) error {
+		var version ArchivedAppStateVersion
+		err := row.Scan(&version.Name, &version.Version, &version.Hash)
+		versionIndexes[version.Name] = len(archive.AppStateVersions)
+		archive.AppStateVersions = append(archive.AppStateVersions, version)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export app state versions: %w", err)
+	}
+	err = exportRows(tx, exportMutationMACsQuery, ourJID, func(row scannable) error {
+		var name string
+		var mac ArchivedMutationMAC
+		err := row.Scan(&name, &mac.Version, &mac.IndexMAC, &mac.ValueMAC)
+		if err != nil {
+			return err
+		}
+		index, ok := versionIndexes[name]
+		if !ok {
+			// Can't happen thanks to the foreign key, but skip the MAC instead of crashing if it does
+			c.log.Warnf("Skipping app state mutation MAC of unknown state %s", name)
+			return nil
+		}
+		archive.AppStateVersions[index].MutationMACs = append(archive.AppStateVersions[index].MutationMACs, mac)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export app state mutation MACs: %w", err)
+	}
+	err = exportRows(tx, exportContactsQuery, ourJID, func(row scannable) error {
+		var contact ArchivedContact
+		var first, full, push, business sql.NullString
+		err := row.Scan(&contact.TheirJID, &first, &full, &push, &business)
+		contact.FirstName = nullStringPtr(first)
+		contact.FullName = nullStringPtr(full)
+		contact.PushName = nullStringPtr(push)
+		contact.BusinessName = nullStringPtr(business)
+		archive.Contacts = append(archive.Contacts, contact)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export contacts: %w", err)
+	}
+	err = exportRows(tx, exportChatSettingsQuery, ourJID, func(row scannable) error {
+		var settings ArchivedChatSettings
+		err := row.Scan(&settings.ChatJID, &settings.MutedUntil, &settings.Pinned, &settings.Archived)
+		archive.ChatSettings = append(archive.ChatSettings, settings)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export chat settings: %w", err)
+	}
+	err = exportRows(tx, exportChatsQuery, ourJID, func(row scannable) error {
+		var chat ArchivedChat
+		err := row.Scan(
+			&chat.ChatJID, &chat.Name, &chat.LastMessageID, &chat.LastMessageTime, &chat.LastMessagePreview, &chat.LastMessageFromMe,
+			&chat.UnreadCount, &chat.MarkedUnread, &chat.EphemeralExpiration)
+		archive.Chats = append(archive.Chats, chat)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export chats: %w", err)
+	}
+	err = exportRows(tx, exportMessageSecretsQuery, ourJID, func(row scannable) error {
+		var secret ArchivedMessageSecret
+		err := row.Scan(&secret.ChatJID, &secret.SenderJID, &secret.MessageID, &secret.Key, &secret.Timestamp)
+		archive.MessageSecrets = append(archive.MessageSecrets, secret)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export message secrets: %w", err)
+	}
+	err = exportRows(tx, exportPrivacyTokensQuery, ourJID, func(row scannable) error {
+		var token ArchivedPrivacyToken
+		err := row.Scan(&token.TheirJID, &token.Token, &token.Timestamp)
+		archive.PrivacyTokens = append(archive.PrivacyTokens, token)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export privacy tokens: %w", err)
+	}
+	err = exportRows(tx, exportHistoryQuery, ourJID, func(row scannable) error {
+		msg, err := scanHistoryMessage(row)
+		if err == nil {
+			archive.History = append(archive.History, *msg)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export history: %w", err)
+	}
+	return archive, nil
+}
+
+func nullStringPtr(str sql.NullString) *string {
+	if !str.Valid {
+		return nil
+	}
+	return &str.String
+}
+
+// ImportDevice inserts all data from the given archive into the database and returns the imported device.
+//
+// The import happens in a single transaction. If the device already exists in the database,
+// ErrDeviceAlreadyExists is returned and nothing is changed.
+func (c *Container) ImportDevice(archive *DeviceArchive) (*store.Device, error) {
+	if archive.Version != DeviceArchiveVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedArchiveVersion, archive.Version)
+	}
+	dev := &archive.Device
+	if dev.JID.IsEmpty() {
+		return nil, ErrDeviceIDMustBeSet
+	}
+	existing, err := c.GetDevice(dev.JID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if device exists: %w", err)
+	} else if existing != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceAlreadyExists, dev.JID)
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	err = c.importDevice(tx, archive)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return c.GetDevice(dev.JID)
+}
+
+func (c *Container) importDevice(tx *sql.Tx, archive *DeviceArchive) error {
+	dev := &archive.Device
+	ourJID := dev.JID.String()
+	noiseKey, err := c.encryptKey(columnNoiseKey, dev.NoiseKey, ourJID)
+	if err != nil {
+		return err
+	}
+	identityKey, err := c.encryptKey(columnIdentityKey, dev.IdentityKey, ourJID)
+	if err != nil {
+		return err
+	}
+	signedPreKey, err := c.encryptKey(columnSignedPreKey, dev.SignedPreKey, ourJID)
+	if err != nil {
+		return err
+	}
+	advKey, err := c.encryptKey(columnAdvKey, dev.AdvKey, ourJID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertDeviceQuery,
+		ourJID, dev.RegistrationID, noiseKey, identityKey,
+		signedPreKey, dev.SignedPreKeyID, dev.SignedPreKeySig,
+		advKey, dev.AdvDetails, dev.AdvAccountSig, dev.AdvAccountSigKey, dev.AdvDeviceSig,
+		dev.Platform, dev.BusinessName, dev.PushName)
+	if err != nil {
+		return fmt.Errorf("failed to import device: %w", err)
+	}
+	for _, identity := range archive.Identities {
+		if _, err = tx.Exec(importIdentityQuery, ourJID, identity.TheirID, identity.Identity); err != nil {
+			return fmt.Errorf("failed to import identity key of %s: %w", identity.TheirID, err)
+		}
+	}
+	for _, session := range archive.Sessions {
+		var sessionData []byte
+		if sessionData, err = c.encryptKey(columnSession, session.Session, ourJID, session.TheirID); err != nil {
+			return err
+		} else if _, err = tx.Exec(importSessionQuery, ourJID, session.TheirID, sessionData); err != nil {
+			return fmt.Errorf("failed to import session with %s: %w", session.TheirID, err)
+		}
+	}
+	// The archive doesn't contain the creation times of prekeys and message secrets,
+	// so the retention policy counts their age from the import.
+	importTime := time.Now().Unix()
+	for _, preKey := range archive.PreKeys {
+		if _, err = tx.Exec(insertPreKeyQuery, ourJID, preKey.KeyID, preKey.Key, preKey.Uploaded, importTime); err != nil {
+			return fmt.Errorf("failed to import prekey %d: %w", preKey.KeyID, err)
+		}
+	}
+	for _, senderKey := range archive.SenderKeys {
+		var senderKeyData []byte
+		if senderKeyData, err = c.encryptKey(columnSenderKey, senderKey.SenderKey, ourJID, senderKey.ChatID, senderKey.SenderID); err != nil {
+			return err
+		} else if _, err = tx.Exec(importSenderKeyQuery, ourJID, senderKey.ChatID, senderKey.SenderID, senderKeyData); err != nil {
+			return fmt.Errorf("failed to import sender key of %s in %s: %w", senderKey.SenderID, senderKey.ChatID, err)
+		}
+	}
+	for _, key := range archive.AppStateSyncKeys {
+		var keyData []byte
+		if keyData, err = c.encryptKey(columnAppStateKey, key.KeyData, ourJID, key.KeyID); err != nil {
+			return err
+		} else if _, err = tx.Exec(importAppStateSyncKeyQuery, ourJID, key.KeyID, keyData, key.Timestamp, key.Fingerprint); err != nil {
+			return fmt.Errorf("failed to import app state sync key %X: %w", key.KeyID, err)
+		}
+	}
+	for _, version := range archive.AppStateVersions {
+		if _, err = tx.Exec(importAppStateVersionQuery, ourJID, version.Name, version.Version, version.Hash); err != nil {
+			return fmt.Errorf("failed to import version of app state %s: %w", version.Name, err)
+		}
+		for _, mac := range version.MutationMACs {
+			if _, err = tx.Exec(importMutationMACQuery, ourJID, version.Name, mac.Version, mac.IndexMAC, mac.ValueMAC); err != nil {
+				return fmt.Errorf("failed to import mutation MAC of app state %s: %w", version.Name, err)
+			}
+		}
+	}
+	for _, contact := range archive.Contacts {
+		_, err = tx.Exec(importContactQuery, ourJID, contact.TheirJID, contact.FirstName, contact.FullName, contact.PushName, contact.BusinessName)
+		if err != nil {
+			return fmt.Errorf("failed to import contact %s: %w", contact.TheirJID, err)
+		}
+	}
+	for _, settings := range archive.ChatSettings {
+		_, err = tx.Exec(importChatSettingsQuery, ourJID, settings.ChatJID, settings.MutedUntil, settings.Pinned, settings.Archived)
+		if err != nil {
+			return fmt.Errorf("failed to import settings of chat %s: %w", settings.ChatJID, err)
+		}
+	}
+	for _, chat := range archive.Chats {
+		_, err = tx.Exec(importChatQuery, ourJID, chat.ChatJID, chat.Name,
+			chat.LastMessageID, chat.LastMessageTime, chat.LastMessagePreview, chat.LastMessageFromMe,
+			chat.UnreadCount, chat.MarkedUnread, chat.EphemeralExpiration)
+		if err != nil {
+			return fmt.Errorf("failed to import chat %s: %w", chat.ChatJID, err)
+		}
+	}
+	for _, secret := range archive.MessageSecrets {
+		// Archives made before message secrets had timestamps are treated like secrets stored now
+		if secret.Timestamp == 0 {
+			secret.Timestamp = importTime
+		}
+		_, err = tx.Exec(importMessageSecretQuery, ourJID, secret.ChatJID, secret.SenderJID, secret.MessageID, secret.Key, secret.Timestamp)
+		if err != nil {
+			return fmt.Errorf("failed to import secret of message %s: %w", secret.MessageID, err)
+		}
+	}
+	// Privacy tokens aren't deleted by a foreign key, so there may be leftovers from a previously deleted device
+	for _, token := range archive.PrivacyTokens {
+		if _, err = tx.Exec(importPrivacyTokenQuery, ourJID, token.TheirJID, token.Token, token.Timestamp); err != nil {
+			return fmt.Errorf("failed to import privacy token of %s: %w", token.TheirJID, err)
+		}
+	}
+	for _, msg := range archive.History {
+		_, err = tx.Exec(putHistoryMessageQuery, ourJID, msg.ChatId, msg.MessageId, msg.MessageTimestamp, msg.JsonData, msg.MessageStatus, msg.StatusTimestamp, store.ExtractSearchText(msg.JsonData))
+		if err != nil {
+			return fmt.Errorf("failed to import message %s: %w", msg.MessageId, err)
+		}
+	}
+	return nil
+}
+
+// The archive file starts with a magic string, the archive version and a mode byte.
+//
+// In plaintext mode, the header is followed by the gzipped JSON of the DeviceArchive.
+//
+// In encrypted mode, the header is followed by the argon2id parameters (time and memory as big-endian uint32,
+// threads as a single byte), a 16-byte salt and a 12-byte nonce. The rest of the file is the gzipped JSON
+// encrypted with AES-256-GCM, using the whole header as additional data.
+const archiveMagic = "WMDEVARC"
+
+const (
+	archiveModePlaintext byte = 0
+	archiveModeEncrypted byte = 1
+)
+
+const (
+	archiveKDFTime    = 3
+	archiveKDFMemory  = 64 * 1024
+	archiveKDFThreads = 4
+	archiveSaltLength = 16
+	archiveIVLength   = 12
+
+	// Upper bounds for the KDF parameters read from an archive, so that a malicious file can't exhaust memory
+	maxArchiveKDFTime   = 64
+	maxArchiveKDFMemory = 1024 * 1024
+)
+
+func deriveArchiveKey(passphrase string, salt []byte, kdfTime, kdfMemory uint32, kdfThreads uint8) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, kdfTime, kdfMemory, kdfThreads, 32)
+}
+
+// WriteDeviceArchive writes the given archive into w. If passphrase is not empty, the archive is encrypted with
+// a key derived from the passphrase.
+func WriteDeviceArchive(w io.Writer, archive *DeviceArchive, passphrase string) error {
+	var compressed bytes.Buffer
+	zipper := gzip.NewWriter(&compressed)
+	err := json.NewEncoder(zipper).Encode(archive)
+	if err != nil {
+		return fmt.Errorf("failed to encode archive: %w", err)
+	} else if err = zipper.Close(); err != nil {
+		return fmt.Errorf("failed to compress archive: %w", err)
+	}
+
+	header := []byte(archiveMagic)
+	header = append(header, DeviceArchiveVersion)
+	if passphrase == "" {
+		header = append(header, archiveModePlaintext)
+		if _, err = w.Write(header); err != nil {
+			return err
+		}
+		_, err = w.Write(compressed.Bytes())
+		return err
+	}
+
+	header = append(header, archiveModeEncrypted)
+	header = binary.BigEndian.AppendUint32(header, archiveKDFTime)
+	header = binary.BigEndian.AppendUint32(header, archiveKDFMemory)
+	header = append(header, archiveKDFThreads)
+	salt := random.Bytes(archiveSaltLength)
+	iv := random.Bytes(archiveIVLength)
+	header = append(header, salt...)
+	header = append(header, iv...)
+	key := deriveArchiveKey(passphrase, salt, archiveKDFTime, archiveKDFMemory, archiveKDFThreads)
+	ciphertext, err := gcmutil.Encrypt(key, iv, compressed.Bytes(), header)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt archive: %w", err)
+	}
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(ciphertext)
+	return err
+}
+
+// ReadDeviceArchive reads an archive previously written with WriteDeviceArchive.
+//
+// The passphrase is only used if the archive is encrypted.
+func ReadDeviceArchive(r io.Reader, passphrase string) (*DeviceArchive, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, len(archiveMagic)+2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	} else if string(header[:len(archiveMagic)]) != archiveMagic {
+		return nil, ErrInvalidArchive
+	} else if version := header[len(archiveMagic)]; version != DeviceArchiveVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedArchiveVersion, version)
+	}
+
+	var payload io.Reader
+	switch mode := header[len(archiveMagic)+1]; mode {
+	case archiveModePlaintext:
+		payload = reader
+	case archiveModeEncrypted:
+		if passphrase == "" {
+			return nil, ErrArchivePassphraseRequired
+		}
+		params := make([]byte, 4+4+1+archiveSaltLength+archiveIVLength)
+		if _, err := io.ReadFull(reader, params); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+		header = append(header, params...)
+		kdfTime := binary.BigEndian.Uint32(params[0:4])
+		kdfMemory := binary.BigEndian.Uint32(params[4:8])
+		kdfThreads := params[8]
+		if kdfTime == 0 || kdfTime > maxArchiveKDFTime || kdfMemory == 0 || kdfMemory > maxArchiveKDFMemory || kdfThreads == 0 {
+			return nil, fmt.Errorf("%w: invalid key derivation parameters", ErrInvalidArchive)
+		}
+		salt := params[9 : 9+archiveSaltLength]
+		iv := params[9+archiveSaltLength:]
+		ciphertext, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		key := deriveArchiveKey(passphrase, salt, kdfTime, kdfMemory, kdfThreads)
+		plaintext, err := gcmutil.Decrypt(key, iv, ciphertext, header)
+		if err != nil {
+			return nil, ErrWrongArchivePassphrase
+		}
+		payload = bytes.NewReader(plaintext)
+	default:
+		return nil, fmt.Errorf("%w: unknown mode %d", ErrInvalidArchive, mode)
+	}
+
+	unzipper, err := gzip.NewReader(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress archive: %w", err)
+	}
+	var archive DeviceArchive
+	err = json.NewDecoder(unzipper).Decode(&archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode archive: %w", err)
+	} else if archive.Version != DeviceArchiveVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedArchiveVersion, archive.Version)
+	}
+	return &archive, nil
+}
+
+// ExportDeviceTo exports the device with the given JID and writes it into w.
+// If passphrase is not empty, the archive is encrypted.
+func (c *Container) ExportDeviceTo(jid types.JID, w io.Writer, passphrase string) error {
+	archive, err := c.ExportDevice(jid)
+	if err != nil {
+		return err
+	}
+	return WriteDeviceArchive(w, archive, passphrase)
+}
+
+// ImportDeviceFrom reads an archive from r and imports the device in it.
+func (c *Container) ImportDeviceFrom(r io.Reader, passphrase string) (*store.Device, error) {
+	archive, err := ReadDeviceArchive(r, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return c.ImportDevice(archive)
+}
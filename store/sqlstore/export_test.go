@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestExportImport_RoundTrip(t *testing.T) {
+	source := newTestContainer(t)
+	device := newTestDevice(t, source, "1")
+	chatJID := types.NewJID("2", types.DefaultUserServer)
+	groupJID := types.NewJID("123-456", types.GroupServer)
+	ts := time.Unix(1700000000, 0)
+
+	err := device.Chats.PutChats([]store.Chat{{
+		JID:                 chatJID,
+		Name:                "Chat",
+		LastMessage:         store.ChatMessage{ID: "MSG1", Timestamp: ts, Preview: "hello", FromMe: true},
+		UnreadCount:         3,
+		EphemeralExpiration: 86400,
+	}, {
+		JID:            groupJID,
+		Name:           "Group",
+		LastMessage:    store.ChatMessage{ID: "MSG2", Timestamp: ts.Add(time.Minute), Preview: "hi"},
+		MarkedAsUnread: true,
+	}})
+	if err != nil {
+		t.Fatalf("Failed to store chats: %v", err)
+	}
+	err = device.ChatSettings.PutPinned(chatJID, true)
+	if err != nil {
+		t.Fatalf("Failed to store chat settings: %v", err)
+	}
+	err = device.Sessions.PutSession("2.0:1", []byte("session"))
+	if err != nil {
+		t.Fatalf("Failed to store session: %v", err)
+	}
+	err = device.History.DeviceHistorySync([]store.HistoryMessage{{
+		ChatId: chatJID.String(), MessageId: "MSG1", MessageTimestamp: uint64(ts.Unix()), JsonData: "{}", MessageStatus: 2,
+	}})
+	if err != nil {
+		t.Fatalf("Failed to store history: %v", err)
+	}
+	expectedChats, err := device.Chats.GetAllChats()
+	if err != nil {
+		t.Fatalf("Failed to get chats: %v", err)
+	} else if len(expectedChats) != 2 {
+		t.Fatalf("Expected 2 chats before export, got %d", len(expectedChats))
+	}
+
+	var buf bytes.Buffer
+	err = source.ExportDeviceTo(*device.ID, &buf, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to export device: %v", err)
+	}
+	target := newTestContainer(t)
+	imported, err := target.ImportDeviceFrom(&buf, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to import device: %v", err)
+	} else if imported == nil || *imported.ID != *device.ID {
+		t.Fatalf("Imported device has wrong ID")
+	}
+
+	importedChats, err := imported.Chats.GetAllChats()
+	if err != nil {
+		t.Fatalf("Failed to get imported chats: %v", err)
+	} else if !reflect.DeepEqual(importedChats, expectedChats) {
+		t.Fatalf("Imported chats don't match:\n%+v\n%+v", importedChats, expectedChats)
+	}
+	session, err := imported.Sessions.GetSession("2.0:1")
+	if err != nil || !bytes.Equal(session, []byte("session")) {
+		t.Fatalf("Imported session doesn't match: %q / %v", session, err)
+	}
+	msg, err := imported.History.GetMessage(chatJID.String(), "MSG1")
+	if err != nil || msg == nil || msg.MessageStatus != 2 {
+		t.Fatalf("Imported history message doesn't match: %+v / %v", msg, err)
+	}
+
+	// Exporting the imported device must produce the same data
+	sourceArchive, err := source.ExportDevice(*device.ID)
+	if err != nil {
+		t.Fatalf("Failed to export source device: %v", err)
+	}
+	targetArchive, err := target.ExportDevice(*device.ID)
+	if err != nil {
+		t.Fatalf("Failed to export imported device: %v", err)
+	}
+	targetArchive.ExportedAt = sourceArchive.ExportedAt
+	if !reflect.DeepEqual(sourceArchive, targetArchive) {
+		t.Fatalf("Archive of imported device doesn't match the original:\n%+v\n%+v", targetArchive, sourceArchive)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/util/keys"
+)
+
+// The methods in this file implement the store interfaces without a context
+// by calling the Context variants with context.Background().
+
+func (s *SQLStore) PutIdentity(address string, key [32]byte) error {
+	return s.PutIdentityContext(context.Background(), address, key)
+}
+
+func (s *SQLStore) DeleteAllIdentities(phone string) error {
+	return s.DeleteAllIdentitiesContext(context.Background(), phone)
+}
+
+func (s *SQLStore) DeleteIdentity(address string) error {
+	return s.DeleteIdentityContext(context.Background(), address)
+}
+
+func (s *SQLStore) IsTrustedIdentity(address string, key [32]byte) (bool, error) {
+	return s.IsTrustedIdentityContext(context.Background(), address, key)
+}
+
+func (s *SQLStore) GetSession(address string) (session []byte, err error) {
+	return s.GetSessionContext(context.Background(), address)
+}
+
+func (s *SQLStore) HasSession(address string) (has bool, err error) {
+	return s.HasSessionContext(context.Background(), address)
+}
+
+func (s *SQLStore) PutSession(address string, session []byte) error {
+	return s.PutSessionContext(context.Background(), address, session)
+}
+
+func (s *SQLStore) DeleteAllSessions(phone string) error {
+	return s.DeleteAllSessionsContext(context.Background(), phone)
+}
+
+func (s *SQLStore) DeleteSession(address string) error {
+	return s.DeleteSessionContext(context.Background(), address)
+}
+
+func (s *SQLStore) GenOnePreKey() (*keys.PreKey, error) {
+	return s.GenOnePreKeyContext(context.Background())
+}
+
+func (s *SQLStore) GetOrGenPreKeys(count uint32) ([]*keys.PreKey, error) {
+	return s.GetOrGenPreKeysContext(context.Background(), count)
+}
+
+func (s *SQLStore) GetPreKey(id uint32) (*keys.PreKey, error) {
+	return s.GetPreKeyContext(context.Background(), id)
+}
+
+func (s *SQLStore) RemovePreKey(id uint32) error {
+	return s.RemovePreKeyContext(context.Background(), id)
+}
+
+func (s *SQLStore) MarkPreKeysAsUploaded(upToID uint32) error {
+	return s.MarkPreKeysAsUploadedContext(context.Background(), upToID)
+}
+
+func (s *SQLStore) UploadedPreKeyCount() (count int, err error) {
+	return s.UploadedPreKeyCountContext(context.Background())
+}
+
+func (s *SQLStore) PutSenderKey(group, user string, session []byte) error {
+	return s.PutSenderKeyContext(context.Background(), group, user, session)
+}
+
+func (s *SQLStore) GetSenderKey(group, user string) (key []byte, err error) {
+	return s.GetSenderKeyContext(context.Background(), group, user)
+}
+
+func (s *SQLStore) PutAppStateSyncKey(id []byte, key store.AppStateSyncKey) error {
+	return s.PutAppStateSyncKeyContext(context.Background(), id, key)
+}
+
+func (s *SQLStore) GetAppStateSyncKey(id []byte) (*store.AppStateSyncKey, error) {
+	return s.GetAppStateSyncKeyContext(context.Background(), id)
+}
+
+func (s *SQLStore) GetLatestAppStateSyncKeyID() ([]byte, error) {
+	return s.GetLatestAppStateSyncKeyIDContext(context.Background())
+}
+
+func (s *SQLStore) PutAppStateVersion(name string, version uint64, hash [128]byte) error {
+	return s.PutAppStateVersionContext(context.Background(), name, version, hash)
+}
+
+func (s *SQLStore) GetAppStateVersion(name string) (version uint64, hash [128]byte, err error) {
+	return s.GetAppStateVersionContext(context.Background(), name)
+}
+
+func (s *SQLStore) DeleteAppStateVersion(name string) error {
+	return s.DeleteAppStateVersionContext(context.Background(), name)
+}
+
+func (s *SQLStore) PutAppStateMutationMACs(name string, version uint64, mutations []store.AppStateMutationMAC) error {
+	return s.PutAppStateMutationMACsContext(context.Background(), name, version, mutations)
+}
+
+func (s *SQLStore) DeleteAppStateMutationMACs(name string, indexMACs [][]byte) (err error) {
+	return s.DeleteAppStateMutationMACsContext(context.Background(), name, indexMACs)
+}
+
+func (s *SQLStore) GetAppStateMutationMAC(name string, indexMAC []byte) (valueMAC []byte, err error) {
+	return s.GetAppStateMutationMACContext(context.Background(), name, indexMAC)
+}
+
+func (s *SQLStore) PutPushName(user types.JID, pushName string) (bool, string, error) {
+	return s.PutPushNameContext(context.Background(), user, pushName)
+}
+
+func (s *SQLStore) PutBusinessName(user types.JID, businessName string) (bool, string, error) {
+	return s.PutBusinessNameContext(context.Background(), user, businessName)
+}
+
+func (s *SQLStore) PutContactName(user types.JID, firstName, fullName string) error {
+	return s.PutContactNameContext(context.Background(), user, firstName, fullName)
+}
+
+func (s *SQLStore) PutAllContactNames(contacts []store.ContactEntry) error {
+	return s.PutAllContactNamesContext(context.Background(), contacts)
+}
+
+func (s *SQLStore) GetContact(user types.JID) (types.ContactInfo, error) {
+	return s.GetContactContext(context.Background(), user)
+}
+
+func (s *SQLStore) GetAllContacts() (map[types.JID]types.ContactInfo, error) {
+	return s.GetAllContactsContext(context.Background())
+}
+
+func (s *SQLStore) PutMutedUntil(chat types.JID, mutedUntil time.Time) error {
+	return s.PutMutedUntilContext(context.Background(), chat, mutedUntil)
+}
+
+func (s *SQLStore) PutPinned(chat types.JID, pinned bool) error {
+	return s.PutPinnedContext(context.Background(), chat, pinned)
+}
+
+func (s *SQLStore) PutArchived(chat types.JID, archived bool) error {
+	return s.PutArchivedContext(context.Background(), chat, archived)
+}
+
+func (s *SQLStore) GetChatSettings(chat types.JID) (settings types.LocalChatSettings, err error) {
+	return s.GetChatSettingsContext(context.Background(), chat)
+}
+
+func (s *SQLStore) PutChatMessage(chat types.JID, message store.ChatMessage, incrementUnread bool) error {
+	return s.PutChatMessageContext(context.Background(), chat, message, incrementUnread)
+}
+
+func (s *SQLStore) PutChatRead(chat types.JID, read bool) error {
+	return s.PutChatReadContext(context.Background(), chat, read)
+}
+
+func (s *SQLStore) PutChatName(chat types.JID, name string) error {
+	return s.PutChatNameContext(context.Background(), chat, name)
+}
+
+func (s *SQLStore) PutChatEphemeralExpiration(chat types.JID, expiration uint32) error {
+	return s.PutChatEphemeralExpirationContext(context.Background(), chat, expiration)
+}
+
+func (s *SQLStore) PutChats(chats []store.Chat) error {
+	return s.PutChatsContext(context.Background(), chats)
+}
+
+func (s *SQLStore) GetChat(chat types.JID) (*store.Chat, error) {
+	return s.GetChatContext(context.Background(), chat)
+}
+
+func (s *SQLStore) GetAllChats() ([]store.Chat, error) {
+	return s.GetAllChatsContext(context.Background())
+}
+
+func (s *SQLStore) DeleteChat(chat types.JID) error {
+	return s.DeleteChatContext(context.Background(), chat)
+}
+
+func (s *SQLStore) PutMessageSecrets(inserts []store.MessageSecretInsert) (err error) {
+	return s.PutMessageSecretsContext(context.Background(), inserts)
+}
+
+func (s *SQLStore) PutMessageSecret(chat, sender types.JID, id types.MessageID, secret []byte) (err error) {
+	return s.PutMessageSecretContext(context.Background(), chat, sender, id, secret, time.Time{})
+}
+
+func (s *SQLStore) GetMessageSecret(chat, sender types.JID, id types.MessageID) (secret []byte, err error) {
+	return s.GetMessageSecretContext(context.Background(), chat, sender, id)
+}
+
+func (s *SQLStore) PutPrivacyTokens(tokens ...store.PrivacyToken) error {
+	return s.PutPrivacyTokensContext(context.Background(), tokens...)
+}
+
+func (s *SQLStore) GetPrivacyToken(user types.JID) (*store.PrivacyToken, error) {
+	return s.GetPrivacyTokenContext(context.Background(), user)
+}
+
+func (s *SQLStore) PutRecentMessage(to types.JID, id types.MessageID, message []byte, expiry time.Time) error {
+	return s.PutRecentMessageContext(context.Background(), to, id, message, expiry)
+}
+
+func (s *SQLStore) GetRecentMessage(to types.JID, id types.MessageID) ([]byte, error) {
+	return s.GetRecentMessageContext(context.Background(), to, id)
+}
+
+func (s *SQLStore) DeleteExpiredRecentMessages(now time.Time) error {
+	return s.DeleteExpiredRecentMessagesContext(context.Background(), now)
+}
+
+func (s *SQLStore) DeviceHistorySync(messages []store.HistoryMessage) error {
+	return s.DeviceHistorySyncContext(context.Background(), messages)
+}
+
+func (s *SQLStore) DeleteDeviceHistory() error {
+	return s.DeleteDeviceHistoryContext(context.Background())
+}
+
+func (s *SQLStore) DeviceUpdateStatusMessage(msg store.HistoryMessage) (err error) {
+	return s.DeviceUpdateStatusMessageContext(context.Background(), msg)
+}
+
+func (s *SQLStore) GetChatHistory(chat string, before store.HistoryCursor, limit int) ([]store.HistoryMessage, error) {
+	return s.GetChatHistoryContext(context.Background(), chat, before, limit)
+}
+
+func (s *SQLStore) GetMessage(chat, id string) (*store.HistoryMessage, error) {
+	return s.GetMessageContext(context.Background(), chat, id)
+}
+
+func (s *SQLStore) ListChats() ([]store.HistoryChat, error) {
+	return s.ListChatsContext(context.Background())
+}
+
+func (s *SQLStore) SearchMessages(query, chat string, from, to time.Time, limit int) ([]store.HistoryMessage, error) {
+	return s.SearchMessagesContext(context.Background(), query, chat, from, to, limit)
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy configures how long data that would otherwise grow forever is kept in the database.
+// Zero values disable the corresponding kind of pruning. The policy applies to all devices in the container.
+//
+// Sent messages stored for retry receipts have their own expiry time (see Client.RecentMessageTTL),
+// so expired ones are always deleted when pruning.
+type RetentionPolicy struct {
+	// HistoryMaxAge is the maximum age of messages in history_messages, based on the message timestamp.
+	HistoryMaxAge time.Duration
+	// HistoryMaxPerChat is the maximum number of messages kept in history_messages per chat.
+	// The oldest messages are deleted first.
+	HistoryMaxPerChat int
+	// MessageSecretMaxAge is the maximum age of message secrets, based on the timestamp of the message they belong to.
+	// Poll votes and reactions to messages whose secret has been deleted can't be decrypted anymore.
+	MessageSecretMaxAge time.Duration
+	// PrivacyTokenMaxAge is the maximum age of privacy tokens, based on the token timestamp.
+	PrivacyTokenMaxAge time.Duration
+	// PreKeyMaxAge is the maximum age of prekeys that have been uploaded to the server, but never used.
+	// The newest prekey of each device is always kept, so that prekey IDs aren't reused.
+	//
+	// If the server still hands out a deleted prekey, the first message from that sender will fail to decrypt
+	// and has to be recovered with a retry receipt, so this shouldn't be set to less than a few weeks.
+	PreKeyMaxAge time.Duration
+
+	// Interval is how often the background janitor prunes the database.
+	// If zero, the janitor isn't started and Container.Prune must be called manually.
+	Interval time.Duration
+}
+
+// WithRetentionPolicy makes the container prune old data according to the given policy.
+//
+// The background janitor is started by New, or by StartJanitor when using NewWithDB.
+func WithRetentionPolicy(policy RetentionPolicy) ContainerOption {
+	return func(c *Container) {
+		c.retention = policy
+	}
+}
+
+// PruneResult contains the number of rows deleted by Container.Prune.
+type PruneResult struct {
+	HistoryMessages int64
+	MessageSecrets  int64
+	PrivacyTokens   int64
+	PreKeys         int64
+	RecentMessages  int64
+}
+
+// Total returns the total number of deleted rows.
+func (res PruneResult) Total() int64 {
+	return res.HistoryMessages + res.MessageSecrets + res.PrivacyTokens + res.PreKeys + res.RecentMessages
+}
+
+func (res PruneResult) String() string {
+	return fmt.Sprintf("%d history messages, %d message secrets, %d privacy tokens, %d prekeys and %d recent messages",
+		res.HistoryMessages, res.MessageSecrets, res.PrivacyTokens, res.PreKeys, res.RecentMessages)
+}
+
+const (
+	pruneHistoryByAgeQuery   = `DELETE FROM history_messages WHERE message_timestamp<$1`
+	pruneHistoryByCountQuery = `
+		DELETE FROM history_messages WHERE (our_jid, chat_id, message_id) IN (
+			SELECT our_jid, chat_id, message_id FROM (
+				SELECT our_jid, chat_id, message_id,
+				       ROW_NUMBER() OVER (PARTITION BY our_jid, chat_id ORDER BY message_timestamp DESC, message_id DESC) AS row_index
+				FROM history_messages
+			) AS ranked
+			WHERE row_index>$1
+		)
+	`
+	pruneMessageSecretsQuery = `DELETE FROM whatsmeow_message_secrets WHERE timestamp<$1`
+	prunePrivacyTokensQuery  = `DELETE FROM whatsmeow_privacy_tokens WHERE timestamp<$1`
+	pruneRecentMessagesQuery = `DELETE FROM whatsmeow_recent_messages WHERE expiry<$1`
+	prunePreKeysQuery        = `
+		DELETE FROM whatsmeow_pre_keys
+		WHERE uploaded=true AND timestamp<$1
+		  AND key_id<(SELECT MAX(key_id) FROM whatsmeow_pre_keys AS newest WHERE newest.jid=whatsmeow_pre_keys.jid)
+	`
+)
+
+// Prune deletes data that is older than allowed by the retention policy set with WithRetentionPolicy.
+func (c *Container) Prune() (PruneResult, error) {
+	return c.PruneContext(context.Background())
+}
+
+// PruneContext is the same as Prune, but passes the given context to the database.
+func (c *Container) PruneContext(ctx context.Context) (res PruneResult, err error) {
+	policy := c.retention
+	now := time.Now()
+	if policy.HistoryMaxAge > 0 {
+		if res.HistoryMessages, err = c.pruneRows(ctx, pruneHistoryByAgeQuery, now.Add(-policy.HistoryMaxAge).Unix()); err != nil {
+			return res, fmt.Errorf("failed to prune old history messages: %w", err)
+		}
+	}
+	if policy.HistoryMaxPerChat > 0 {
+		var deleted int64
+		if deleted, err = c.pruneRows(ctx, pruneHistoryByCountQuery, policy.HistoryMaxPerChat); err != nil {
+			return res, fmt.Errorf("failed to prune history messages over the per-chat limit: %w", err)
+		}
+		res.HistoryMessages += deleted
+	}
+	if policy.MessageSecretMaxAge > 0 {
+		if res.MessageSecrets, err = c.pruneRows(ctx, pruneMessageSecretsQuery, now.Add(-policy.MessageSecretMaxAge).Unix()); err != nil {
+			return res, fmt.Errorf("failed to prune message secrets: %w", err)
+		}
+	}
+	if policy.PrivacyTokenMaxAge > 0 {
+		if res.PrivacyTokens, err = c.pruneRows(ctx, prunePrivacyTokensQuery, now.Add(-policy.PrivacyTokenMaxAge).Unix()); err != nil {
+			return res, fmt.Errorf("failed to prune privacy tokens: %w", err)
+		}
+	}
+	if policy.PreKeyMaxAge > 0 {
+		if res.PreKeys, err = c.pruneRows(ctx, prunePreKeysQuery, now.Add(-policy.PreKeyMaxAge).Unix()); err != nil {
+			return res, fmt.Errorf("failed to prune prekeys: %w", err)
+		}
+	}
+	if res.RecentMessages, err = c.pruneRows(ctx, pruneRecentMessagesQuery, now.Unix()); err != nil {
+		return res, fmt.Errorf("failed to prune expired recent messages: %w", err)
+	}
+	return res, nil
+}
+
+func (c *Container) pruneRows(ctx context.Context, query string, arg interface{}) (int64, error) {
+	result, err := c.db.ExecContext(ctx, query, arg)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// StartJanitor starts a background goroutine that calls Prune at the interval of the retention policy.
+// It does nothing if the policy doesn't have an interval or the janitor is already running.
+//
+// New starts the janitor automatically. When using NewWithDB, this must be called after Upgrade.
+func (c *Container) StartJanitor() {
+	if c.retention.Interval <= 0 {
+		return
+	}
+	c.janitorLock.Lock()
+	defer c.janitorLock.Unlock()
+	if c.stopJanitor != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopJanitor = cancel
+	c.log.Infof("Starting database janitor with interval %s (%s)", c.retention.Interval, c.retention)
+	go c.runJanitor(ctx, c.retention.Interval)
+}
+
+// StopJanitor stops the background goroutine started by StartJanitor.
+func (c *Container) StopJanitor() {
+	c.janitorLock.Lock()
+	defer c.janitorLock.Unlock()
+	if c.stopJanitor != nil {
+		c.stopJanitor()
+		c.stopJanitor = nil
+	}
+}
+
+func (c *Container) runJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		res, err := c.PruneContext(ctx)
+		if err != nil && ctx.Err() == nil {
+			c.log.Errorf("Failed to prune database: %v", err)
+		}
+		if res.Total() > 0 {
+			c.log.Infof("Pruned %s from the database", res)
+		} else if err == nil {
+			c.log.Debugf("Pruned database, nothing to delete")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// String is used to log the retention policy.
+func (policy RetentionPolicy) String() string {
+	var parts []string
+	if policy.HistoryMaxAge > 0 {
+		parts = append(parts, fmt.Sprintf("history max age %s", policy.HistoryMaxAge))
+	}
+	if policy.HistoryMaxPerChat > 0 {
+		parts = append(parts, fmt.Sprintf("history max %d per chat", policy.HistoryMaxPerChat))
+	}
+	if policy.MessageSecretMaxAge > 0 {
+		parts = append(parts, fmt.Sprintf("message secret max age %s", policy.MessageSecretMaxAge))
+	}
+	if policy.PrivacyTokenMaxAge > 0 {
+		parts = append(parts, fmt.Sprintf("privacy token max age %s", policy.PrivacyTokenMaxAge))
+	}
+	if policy.PreKeyMaxAge > 0 {
+		parts = append(parts, fmt.Sprintf("prekey max age %s", policy.PreKeyMaxAge))
+	}
+	if len(parts) == 0 {
+		return "keep everything"
+	}
+	return strings.Join(parts, ", ")
+}
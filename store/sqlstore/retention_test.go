@@ -0,0 +1,257 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+)
+
+func putHistoryMessages(t *testing.T, device *store.Device, chat string, timestamps map[string]time.Time) {
+	t.Helper()
+	var messages []store.HistoryMessage
+	for id, ts := range timestamps {
+		messages = append(messages, store.HistoryMessage{ChatId: chat, MessageId: id, MessageTimestamp: uint64(ts.Unix()), JsonData: "{}"})
+	}
+	err := device.History.DeviceHistorySync(messages)
+	if err != nil {
+		t.Fatalf("Failed to store history messages: %v", err)
+	}
+}
+
+func getHistoryMessageIDs(t *testing.T, container *Container) []string {
+	t.Helper()
+	rows, err := container.db.Query("SELECT message_id FROM history_messages")
+	if err != nil {
+		t.Fatalf("Failed to get history messages: %v", err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			t.Fatalf("Failed to scan history message: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatalf("Failed to get history messages: %v", err)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func getPreKeyIDs(t *testing.T, container *Container) []uint32 {
+	t.Helper()
+	rows, err := container.db.Query("SELECT key_id FROM whatsmeow_pre_keys ORDER BY key_id")
+	if err != nil {
+		t.Fatalf("Failed to get prekeys: %v", err)
+	}
+	defer rows.Close()
+	var ids []uint32
+	for rows.Next() {
+		var id uint32
+		if err = rows.Scan(&id); err != nil {
+			t.Fatalf("Failed to scan prekey: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatalf("Failed to get prekeys: %v", err)
+	}
+	return ids
+}
+
+func TestPrune_HistoryMaxAge(t *testing.T) {
+	container := newTestContainer(t, WithRetentionPolicy(RetentionPolicy{HistoryMaxAge: 24 * time.Hour}))
+	device := newTestDevice(t, container, "1")
+	now := time.Now()
+	putHistoryMessages(t, device, "2@s.whatsapp.net", map[string]time.Time{"OLD": now.Add(-48 * time.Hour), "NEW": now.Add(-time.Hour)})
+	putHistoryMessages(t, device, "3@s.whatsapp.net", map[string]time.Time{"OTHER": now.Add(-25 * time.Hour)})
+
+	res, err := container.Prune()
+	if err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	} else if res.HistoryMessages != 2 {
+		t.Errorf("Expected 2 pruned history messages, got %d", res.HistoryMessages)
+	}
+	if ids := getHistoryMessageIDs(t, container); len(ids) != 1 || ids[0] != "NEW" {
+		t.Errorf("Expected only NEW to be kept, got %v", ids)
+	}
+}
+
+func TestPrune_HistoryMaxPerChat(t *testing.T) {
+	container := newTestContainer(t, WithRetentionPolicy(RetentionPolicy{HistoryMaxPerChat: 2}))
+	device := newTestDevice(t, container, "1")
+	otherDevice := newTestDevice(t, container, "2")
+	now := time.Now()
+	putHistoryMessages(t, device, "2@s.whatsapp.net", map[string]time.Time{
+		"A1": now.Add(-3 * time.Hour),
+		"A2": now.Add(-2 * time.Hour),
+		// Messages with the same timestamp are ordered by ID
+		"A3": now.Add(-time.Hour),
+		"A4": now.Add(-time.Hour),
+	})
+	putHistoryMessages(t, device, "3@s.whatsapp.net", map[string]time.Time{"B1": now.Add(-5 * time.Hour), "B2": now})
+	// The limit applies to each device separately
+	putHistoryMessages(t, otherDevice, "2@s.whatsapp.net", map[string]time.Time{"C1": now.Add(-5 * time.Hour), "C2": now})
+
+	res, err := container.Prune()
+	if err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	} else if res.HistoryMessages != 2 {
+		t.Errorf("Expected 2 pruned history messages, got %d", res.HistoryMessages)
+	}
+	expected := []string{"A3", "A4", "B1", "B2", "C1", "C2"}
+	if ids := getHistoryMessageIDs(t, container); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected %v to be kept, got %v", expected, ids)
+	}
+}
+
+func TestPrune_PrivacyTokenMaxAge(t *testing.T) {
+	container := newTestContainer(t, WithRetentionPolicy(RetentionPolicy{PrivacyTokenMaxAge: 24 * time.Hour}))
+	device := newTestDevice(t, container, "1")
+	oldUser := types.NewJID("2", types.DefaultUserServer)
+	newUser := types.NewJID("3", types.DefaultUserServer)
+	now := time.Now()
+	err := device.PrivacyTokens.PutPrivacyTokens(
+		store.PrivacyToken{User: oldUser, Token: []byte("old"), Timestamp: now.Add(-48 * time.Hour)},
+		store.PrivacyToken{User: newUser, Token: []byte("new"), Timestamp: now.Add(-time.Hour)},
+	)
+	if err != nil {
+		t.Fatalf("Failed to store privacy tokens: %v", err)
+	}
+
+	res, err := container.Prune()
+	if err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	} else if res.PrivacyTokens != 1 {
+		t.Errorf("Expected 1 pruned privacy token, got %d", res.PrivacyTokens)
+	}
+	for user, shouldExist := range map[types.JID]bool{oldUser: false, newUser: true} {
+		token, err := device.PrivacyTokens.GetPrivacyToken(user)
+		if err != nil {
+			t.Fatalf("Failed to get privacy token of %s: %v", user, err)
+		} else if exists := token != nil; exists != shouldExist {
+			t.Errorf("Expected token of %s to exist: %t, but it exists: %t", user, shouldExist, exists)
+		}
+	}
+}
+
+func TestPrune_PreKeyMaxAge(t *testing.T) {
+	container := newTestContainer(t, WithRetentionPolicy(RetentionPolicy{PreKeyMaxAge: 24 * time.Hour}))
+	device := newTestDevice(t, container, "1")
+	preKeys, err := device.PreKeys.GetOrGenPreKeys(4)
+	if err != nil {
+		t.Fatalf("Failed to generate prekeys: %v", err)
+	}
+	// The first three keys are uploaded, the last one isn't
+	if err = device.PreKeys.MarkPreKeysAsUploaded(preKeys[2].KeyID); err != nil {
+		t.Fatalf("Failed to mark prekeys as uploaded: %v", err)
+	}
+	// Keys 1 and 2 are old enough to be pruned, key 3 is new
+	_, err = container.db.Exec("UPDATE whatsmeow_pre_keys SET timestamp=$1 WHERE key_id<=$2", time.Now().Add(-48*time.Hour).Unix(), preKeys[1].KeyID)
+	if err != nil {
+		t.Fatalf("Failed to change prekey timestamps: %v", err)
+	}
+	res, err := container.Prune()
+	if err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	} else if res.PreKeys != 2 {
+		t.Errorf("Expected 2 pruned prekeys, got %d", res.PreKeys)
+	}
+	if ids := getPreKeyIDs(t, container); len(ids) != 2 || ids[0] != preKeys[2].KeyID || ids[1] != preKeys[3].KeyID {
+		t.Errorf("Expected the new and unuploaded prekeys to be kept, got %v", ids)
+	}
+
+	// The newest key is kept even if it's old and uploaded
+	if err = device.PreKeys.MarkPreKeysAsUploaded(preKeys[3].KeyID); err != nil {
+		t.Fatalf("Failed to mark prekeys as uploaded: %v", err)
+	}
+	_, err = container.db.Exec("UPDATE whatsmeow_pre_keys SET timestamp=$1", time.Now().Add(-48*time.Hour).Unix())
+	if err != nil {
+		t.Fatalf("Failed to change prekey timestamps: %v", err)
+	}
+	res, err = container.Prune()
+	if err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	} else if res.PreKeys != 1 {
+		t.Errorf("Expected 1 pruned prekey, got %d", res.PreKeys)
+	}
+	if ids := getPreKeyIDs(t, container); len(ids) != 1 || ids[0] != preKeys[3].KeyID {
+		t.Errorf("Expected only the newest prekey to be kept, got %v", ids)
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	container := newTestContainer(t, WithRetentionPolicy(RetentionPolicy{HistoryMaxAge: 24 * time.Hour, Interval: 10 * time.Millisecond}))
+	device := newTestDevice(t, container, "1")
+	container.StartJanitor()
+	defer container.StopJanitor()
+	// Starting the janitor again does nothing
+	container.StartJanitor()
+
+	putHistoryMessages(t, device, "2@s.whatsapp.net", map[string]time.Time{"OLD": time.Now().Add(-48 * time.Hour)})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(getHistoryMessageIDs(t, container)) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Janitor didn't prune the old message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	container.StopJanitor()
+	// Wait for a possible in-progress prune to finish
+	time.Sleep(50 * time.Millisecond)
+	putHistoryMessages(t, device, "2@s.whatsapp.net", map[string]time.Time{"OLD": time.Now().Add(-48 * time.Hour)})
+	time.Sleep(50 * time.Millisecond)
+	if ids := getHistoryMessageIDs(t, container); len(ids) != 1 {
+		t.Errorf("Expected the stopped janitor not to prune anything, got %v", ids)
+	}
+}
+
+func TestPrune_MessageSecretsByMessageTime(t *testing.T) {
+	container := newTestContainer(t, WithRetentionPolicy(RetentionPolicy{MessageSecretMaxAge: 24 * time.Hour}))
+	device := newTestDevice(t, container, "1")
+	chat := types.NewJID("2", types.DefaultUserServer)
+	now := time.Now()
+
+	// Secrets from history syncs are stored long after the message was sent
+	err := device.MsgSecrets.PutMessageSecrets([]store.MessageSecretInsert{
+		{Chat: chat, Sender: chat, ID: "OLD", Secret: []byte("old"), Timestamp: now.Add(-48 * time.Hour)},
+		{Chat: chat, Sender: chat, ID: "NEW", Secret: []byte("new"), Timestamp: now.Add(-time.Hour)},
+		{Chat: chat, Sender: chat, ID: "UNKNOWN", Secret: []byte("unknown")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to store message secrets: %v", err)
+	}
+	err = device.MsgSecrets.PutMessageSecretContext(context.Background(), chat, chat, "LIVE", []byte("live"), now.Add(-25*time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to store message secret: %v", err)
+	}
+
+	res, err := container.Prune()
+	if err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	} else if res.MessageSecrets != 2 {
+		t.Errorf("Expected 2 pruned message secrets, got %d", res.MessageSecrets)
+	}
+	for id, shouldExist := range map[types.MessageID]bool{"OLD": false, "LIVE": false, "NEW": true, "UNKNOWN": true} {
+		secret, err := device.MsgSecrets.GetMessageSecret(chat, chat, id)
+		if err != nil {
+			t.Fatalf("Failed to get message secret %s: %v", id, err)
+		} else if exists := secret != nil; exists != shouldExist {
+			t.Errorf("Expected secret %s to exist: %t, but it exists: %t", id, shouldExist, exists)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/store"
+)
+
+func putSearchMessage(t *testing.T, device *store.Device, id, text string) {
+	t.Helper()
+	err := device.History.DeviceHistorySync([]store.HistoryMessage{{
+		ChatId:           "2@s.whatsapp.net",
+		MessageId:        id,
+		MessageTimestamp: uint64(time.Now().Unix()),
+		JsonData:         fmt.Sprintf(`{"Message":{"conversation":%q}}`, text),
+	}})
+	if err != nil {
+		t.Fatalf("Failed to store message %s: %v", id, err)
+	}
+}
+
+func searchMessageIDs(t *testing.T, device *store.Device, query string) []string {
+	t.Helper()
+	messages, err := device.History.SearchMessages(query, "", time.Time{}, time.Time{}, 10)
+	if err != nil {
+		t.Fatalf("Failed to search for %q: %v", query, err)
+	}
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.MessageId
+	}
+	return ids
+}
+
+func TestSearch_Semantics(t *testing.T) {
+	container := newTestContainer(t)
+	device := newTestDevice(t, container, "1")
+	putSearchMessage(t, device, "MSG1", "Hello World")
+	putSearchMessage(t, device, "MSG2", "Say hello to everyone")
+
+	if ids := searchMessageIDs(t, device, "HELLO"); len(ids) != 2 {
+		t.Errorf("Expected case-insensitive search to find both messages, got %v", ids)
+	}
+	if ids := searchMessageIDs(t, device, "hello world"); len(ids) != 1 || ids[0] != "MSG1" {
+		t.Errorf("Expected all terms to be required, got %v", ids)
+	}
+	if ids := searchMessageIDs(t, device, "wor"); len(ids) != 1 || ids[0] != "MSG1" {
+		t.Errorf("Expected word prefix to match, got %v", ids)
+	}
+	// Only the LIKE fallback matches terms in the middle of words
+	ids := searchMessageIDs(t, device, "orld")
+	if container.searchIndexEnabled && len(ids) != 0 {
+		t.Errorf("Expected FTS5 search not to match the middle of a word, got %v", ids)
+	} else if !container.searchIndexEnabled && (len(ids) != 1 || ids[0] != "MSG1") {
+		t.Errorf("Expected LIKE search to match the middle of a word, got %v", ids)
+	}
+}
+
+func TestSearch_TriggersWithoutFTS5(t *testing.T) {
+	container := newTestContainer(t)
+	if container.searchIndexEnabled {
+		t.Skip("SQLite was built with FTS5")
+	}
+	device := newTestDevice(t, container, "1")
+	// Recreate the state left behind by a binary with FTS5, which the triggers can't be used without
+	tx, err := container.db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to start transaction: %v", err)
+	}
+	for _, query := range []string{
+		"CREATE TRIGGER history_messages_fts_insert AFTER INSERT ON history_messages BEGIN INSERT INTO history_messages_fts (rowid, search_text) VALUES (new.rowid, new.search_text); END",
+		"CREATE TRIGGER history_messages_fts_delete AFTER DELETE ON history_messages BEGIN SELECT 1; END",
+		"CREATE TRIGGER history_messages_fts_update AFTER UPDATE OF search_text ON history_messages BEGIN SELECT 1; END",
+	} {
+		if _, err = tx.Exec(query); err != nil {
+			t.Fatalf("Failed to create trigger: %v", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	err = device.History.DeviceHistorySync([]store.HistoryMessage{{ChatId: "2@s.whatsapp.net", MessageId: "MSG1", JsonData: "{}"}})
+	if err == nil {
+		t.Fatalf("Expected inserting a message to fail with the FTS5 triggers")
+	}
+
+	if err = container.Upgrade(); err != nil {
+		t.Fatalf("Failed to upgrade database: %v", err)
+	}
+	putSearchMessage(t, device, "MSG1", "Hello World")
+	if ids := searchMessageIDs(t, device, "hello"); len(ids) != 1 {
+		t.Errorf("Expected search to find the message after dropping the triggers, got %v", ids)
+	}
+}
+
+func TestSearch_RebuildWithFTS5(t *testing.T) {
+	container := newTestContainer(t)
+	if !container.searchIndexEnabled {
+		t.Skip("SQLite was built without FTS5")
+	}
+	device := newTestDevice(t, container, "1")
+	putSearchMessage(t, device, "MSG1", "Hello World")
+
+	// Simulate a binary without FTS5 writing messages, which drops the triggers
+	tx, err := container.db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to start transaction: %v", err)
+	}
+	if err = dropSearchIndexTriggers(tx); err != nil {
+		t.Fatalf("Failed to drop triggers: %v", err)
+	} else if err = tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	putSearchMessage(t, device, "MSG2", "Hello again")
+
+	if err = container.Upgrade(); err != nil {
+		t.Fatalf("Failed to upgrade database: %v", err)
+	}
+	if ids := searchMessageIDs(t, device, "again"); len(ids) != 1 || ids[0] != "MSG2" {
+		t.Errorf("Expected the rebuilt index to contain messages written without triggers, got %v", ids)
+	}
+	putSearchMessage(t, device, "MSG3", "Hello once more")
+	if ids := searchMessageIDs(t, device, "hello"); len(ids) != 3 {
+		t.Errorf("Expected the recreated triggers to index new messages, got %v", ids)
+	}
+}
@@ -8,10 +8,12 @@
 package sqlstore
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
 	"errors"
 	"fmt"
+	"math"
 	"strings"
 	"sync"
 	"time"
@@ -64,6 +66,9 @@ var _ store.SenderKeyStore = (*SQLStore)(nil)
 var _ store.AppStateSyncKeyStore = (*SQLStore)(nil)
 var _ store.AppStateStore = (*SQLStore)(nil)
 var _ store.ContactStore = (*SQLStore)(nil)
+var _ store.HistoryStore = (*SQLStore)(nil)
+var _ store.RecentMessageStore = (*SQLStore)(nil)
+var _ store.ChatStore = (*SQLStore)(nil)
 
 const (
 	putIdentityQuery = `
@@ -75,24 +80,24 @@ const (
 	getIdentityQuery         = `SELECT identity FROM whatsmeow_identity_keys WHERE our_jid=$1 AND their_id=$2`
 )
 
-func (s *SQLStore) PutIdentity(address string, key [32]byte) error {
-	_, err := s.db.Exec(putIdentityQuery, s.JID, address, key[:])
+func (s *SQLStore) PutIdentityContext(ctx context.Context, address string, key [32]byte) error {
+	_, err := s.db.ExecContext(ctx, putIdentityQuery, s.JID, address, key[:])
 	return err
 }
 
-func (s *SQLStore) DeleteAllIdentities(phone string) error {
-	_, err := s.db.Exec(deleteAllIdentitiesQuery, s.JID, phone+":%")
+func (s *SQLStore) DeleteAllIdentitiesContext(ctx context.Context, phone string) error {
+	_, err := s.db.ExecContext(ctx, deleteAllIdentitiesQuery, s.JID, phone+":%")
 	return err
 }
 
-func (s *SQLStore) DeleteIdentity(address string) error {
-	_, err := s.db.Exec(deleteAllIdentitiesQuery, s.JID, address)
+func (s *SQLStore) DeleteIdentityContext(ctx context.Context, address string) error {
+	_, err := s.db.ExecContext(ctx, deleteAllIdentitiesQuery, s.JID, address)
 	return err
 }
 
-func (s *SQLStore) IsTrustedIdentity(address string, key [32]byte) (bool, error) {
+func (s *SQLStore) IsTrustedIdentityContext(ctx context.Context, address string, key [32]byte) (bool, error) {
 	var existingIdentity []byte
-	err := s.db.QueryRow(getIdentityQuery, s.JID, address).Scan(&existingIdentity)
+	err := s.db.QueryRowContext(ctx, getIdentityQuery, s.JID, address).Scan(&existingIdentity)
 	if errors.Is(err, sql.ErrNoRows) {
 		// Trust if not known, it'll be saved automatically later
 		return true, nil
@@ -115,40 +120,98 @@ const (
 	deleteSessionQuery     = `DELETE FROM whatsmeow_sessions WHERE our_jid=$1 AND their_id=$2`
 )
 
-func (s *SQLStore) GetSession(address string) (session []byte, err error) {
-	err = s.db.QueryRow(getSessionQuery, s.JID, address).Scan(&session)
+func (s *SQLStore) GetSessionContext(ctx context.Context, address string) (session []byte, err error) {
+	err = s.db.QueryRowContext(ctx, getSessionQuery, s.JID, address).Scan(&session)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
+	} else if err == nil {
+		session, err = s.decryptKey(columnSession, session, s.JID, address)
 	}
 	return
 }
 
-func (s *SQLStore) HasSession(address string) (has bool, err error) {
-	err = s.db.QueryRow(hasSessionQuery, s.JID, address).Scan(&has)
+func (s *SQLStore) HasSessionContext(ctx context.Context, address string) (has bool, err error) {
+	err = s.db.QueryRowContext(ctx, hasSessionQuery, s.JID, address).Scan(&has)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
 	}
 	return
 }
 
-func (s *SQLStore) PutSession(address string, session []byte) error {
-	_, err := s.db.Exec(putSessionQuery, s.JID, address, session)
+func (s *SQLStore) PutSessionContext(ctx context.Context, address string, session []byte) error {
+	session, err := s.encryptKey(columnSession, session, s.JID, address)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, putSessionQuery, s.JID, address, session)
 	return err
 }
 
-func (s *SQLStore) DeleteAllSessions(phone string) error {
-	_, err := s.db.Exec(deleteAllSessionsQuery, s.JID, phone+":%")
+func (s *SQLStore) DeleteAllSessionsContext(ctx context.Context, phone string) error {
+	_, err := s.db.ExecContext(ctx, deleteAllSessionsQuery, s.JID, phone+":%")
 	return err
 }
 
-func (s *SQLStore) DeleteSession(address string) error {
-	_, err := s.db.Exec(deleteSessionQuery, s.JID, address)
+func (s *SQLStore) DeleteSessionContext(ctx context.Context, address string) error {
+	_, err := s.db.ExecContext(ctx, deleteSessionQuery, s.JID, address)
 	return err
 }
 
+var _ store.UnitOfWorkStore = (*SQLStore)(nil)
+
+// CommitUnitOfWork stores all the session and identity changes of a store.UnitOfWork in a single transaction.
+func (s *SQLStore) CommitUnitOfWork(ctx context.Context, changes *store.SignalChanges) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	err = s.commitUnitOfWork(ctx, tx, changes)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) commitUnitOfWork(ctx context.Context, tx execable, changes *store.SignalChanges) error {
+	for address := range changes.DeletedIdentities {
+		_, err := tx.ExecContext(ctx, deleteIdentityQuery, s.JID, address)
+		if err != nil {
+			return fmt.Errorf("failed to delete identity of %s: %w", address, err)
+		}
+	}
+	for address := range changes.DeletedSessions {
+		_, err := tx.ExecContext(ctx, deleteSessionQuery, s.JID, address)
+		if err != nil {
+			return fmt.Errorf("failed to delete session with %s: %w", address, err)
+		}
+	}
+	for address, key := range changes.Identities {
+		_, err := tx.ExecContext(ctx, putIdentityQuery, s.JID, address, key[:])
+		if err != nil {
+			return fmt.Errorf("failed to save identity of %s: %w", address, err)
+		}
+	}
+	for address, session := range changes.Sessions {
+		session, err := s.encryptKey(columnSession, session, s.JID, address)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, putSessionQuery, s.JID, address, session)
+		if err != nil {
+			return fmt.Errorf("failed to store session with %s: %w", address, err)
+		}
+	}
+	return nil
+}
+
 const (
 	getLastPreKeyIDQuery        = `SELECT MAX(key_id) FROM whatsmeow_pre_keys WHERE jid=$1`
-	insertPreKeyQuery           = `INSERT INTO whatsmeow_pre_keys (jid, key_id, key, uploaded) VALUES ($1, $2, $3, $4)`
+	insertPreKeyQuery           = `INSERT INTO whatsmeow_pre_keys (jid, key_id, key, uploaded, timestamp) VALUES ($1, $2, $3, $4, $5)`
 	getUnuploadedPreKeysQuery   = `SELECT key_id, key FROM whatsmeow_pre_keys WHERE jid=$1 AND uploaded=false ORDER BY key_id LIMIT $2`
 	getPreKeyQuery              = `SELECT key_id, key FROM whatsmeow_pre_keys WHERE jid=$1 AND key_id=$2`
 	deletePreKeyQuery           = `DELETE FROM whatsmeow_pre_keys WHERE jid=$1 AND key_id=$2`
@@ -156,36 +219,36 @@ const (
 	getUploadedPreKeyCountQuery = `SELECT COUNT(*) FROM whatsmeow_pre_keys WHERE jid=$1 AND uploaded=true`
 )
 
-func (s *SQLStore) genOnePreKey(id uint32, markUploaded bool) (*keys.PreKey, error) {
+func (s *SQLStore) genOnePreKey(ctx context.Context, id uint32, markUploaded bool) (*keys.PreKey, error) {
 	key := keys.NewPreKey(id)
-	_, err := s.db.Exec(insertPreKeyQuery, s.JID, key.KeyID, key.Priv[:], markUploaded)
+	_, err := s.db.ExecContext(ctx, insertPreKeyQuery, s.JID, key.KeyID, key.Priv[:], markUploaded, time.Now().Unix())
 	return key, err
 }
 
-func (s *SQLStore) getNextPreKeyID() (uint32, error) {
+func (s *SQLStore) getNextPreKeyID(ctx context.Context) (uint32, error) {
 	var lastKeyID sql.NullInt32
-	err := s.db.QueryRow(getLastPreKeyIDQuery, s.JID).Scan(&lastKeyID)
+	err := s.db.QueryRowContext(ctx, getLastPreKeyIDQuery, s.JID).Scan(&lastKeyID)
 	if err != nil {
 		return 0, fmt.Errorf("failed to query next prekey ID: %w", err)
 	}
 	return uint32(lastKeyID.Int32) + 1, nil
 }
 
-func (s *SQLStore) GenOnePreKey() (*keys.PreKey, error) {
+func (s *SQLStore) GenOnePreKeyContext(ctx context.Context) (*keys.PreKey, error) {
 	s.preKeyLock.Lock()
 	defer s.preKeyLock.Unlock()
-	nextKeyID, err := s.getNextPreKeyID()
+	nextKeyID, err := s.getNextPreKeyID(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return s.genOnePreKey(nextKeyID, true)
+	return s.genOnePreKey(ctx, nextKeyID, true)
 }
 
-func (s *SQLStore) GetOrGenPreKeys(count uint32) ([]*keys.PreKey, error) {
+func (s *SQLStore) GetOrGenPreKeysContext(ctx context.Context, count uint32) ([]*keys.PreKey, error) {
 	s.preKeyLock.Lock()
 	defer s.preKeyLock.Unlock()
 
-	res, err := s.db.Query(getUnuploadedPreKeysQuery, s.JID, count)
+	res, err := s.db.QueryContext(ctx, getUnuploadedPreKeysQuery, s.JID, count)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query existing prekeys: %w", err)
 	}
@@ -204,12 +267,12 @@ func (s *SQLStore) GetOrGenPreKeys(count uint32) ([]*keys.PreKey, error) {
 
 	if existingCount < uint32(len(newKeys)) {
 		var nextKeyID uint32
-		nextKeyID, err = s.getNextPreKeyID()
+		nextKeyID, err = s.getNextPreKeyID(ctx)
 		if err != nil {
 			return nil, err
 		}
 		for i := existingCount; i < count; i++ {
-			newKeys[i], err = s.genOnePreKey(nextKeyID, false)
+			newKeys[i], err = s.genOnePreKey(ctx, nextKeyID, false)
 			if err != nil {
 				return nil, fmt.Errorf("failed to generate prekey: %w", err)
 			}
@@ -237,22 +300,22 @@ func scanPreKey(row scannable) (*keys.PreKey, error) {
 	}, nil
 }
 
-func (s *SQLStore) GetPreKey(id uint32) (*keys.PreKey, error) {
-	return scanPreKey(s.db.QueryRow(getPreKeyQuery, s.JID, id))
+func (s *SQLStore) GetPreKeyContext(ctx context.Context, id uint32) (*keys.PreKey, error) {
+	return scanPreKey(s.db.QueryRowContext(ctx, getPreKeyQuery, s.JID, id))
 }
 
-func (s *SQLStore) RemovePreKey(id uint32) error {
-	_, err := s.db.Exec(deletePreKeyQuery, s.JID, id)
+func (s *SQLStore) RemovePreKeyContext(ctx context.Context, id uint32) error {
+	_, err := s.db.ExecContext(ctx, deletePreKeyQuery, s.JID, id)
 	return err
 }
 
-func (s *SQLStore) MarkPreKeysAsUploaded(upToID uint32) error {
-	_, err := s.db.Exec(markPreKeysAsUploadedQuery, s.JID, upToID)
+func (s *SQLStore) MarkPreKeysAsUploadedContext(ctx context.Context, upToID uint32) error {
+	_, err := s.db.ExecContext(ctx, markPreKeysAsUploadedQuery, s.JID, upToID)
 	return err
 }
 
-func (s *SQLStore) UploadedPreKeyCount() (count int, err error) {
-	err = s.db.QueryRow(getUploadedPreKeyCountQuery, s.JID).Scan(&count)
+func (s *SQLStore) UploadedPreKeyCountContext(ctx context.Context) (count int, err error) {
+	err = s.db.QueryRowContext(ctx, getUploadedPreKeyCountQuery, s.JID).Scan(&count)
 	return
 }
 
@@ -264,15 +327,21 @@ const (
 	`
 )
 
-func (s *SQLStore) PutSenderKey(group, user string, session []byte) error {
-	_, err := s.db.Exec(putSenderKeyQuery, s.JID, group, user, session)
+func (s *SQLStore) PutSenderKeyContext(ctx context.Context, group, user string, session []byte) error {
+	session, err := s.encryptKey(columnSenderKey, session, s.JID, group, user)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, putSenderKeyQuery, s.JID, group, user, session)
 	return err
 }
 
-func (s *SQLStore) GetSenderKey(group, user string) (key []byte, err error) {
-	err = s.db.QueryRow(getSenderKeyQuery, s.JID, group, user).Scan(&key)
+func (s *SQLStore) GetSenderKeyContext(ctx context.Context, group, user string) (key []byte, err error) {
+	err = s.db.QueryRowContext(ctx, getSenderKeyQuery, s.JID, group, user).Scan(&key)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
+	} else if err == nil {
+		key, err = s.decryptKey(columnSenderKey, key, s.JID, group, user)
 	}
 	return
 }
@@ -288,23 +357,33 @@ const (
 	getLatestAppStateSyncKeyIDQuery = `SELECT key_id FROM whatsmeow_app_state_sync_keys WHERE jid=$1 ORDER BY timestamp DESC LIMIT 1`
 )
 
-func (s *SQLStore) PutAppStateSyncKey(id []byte, key store.AppStateSyncKey) error {
-	_, err := s.db.Exec(putAppStateSyncKeyQuery, s.JID, id, key.Data, key.Timestamp, key.Fingerprint)
+func (s *SQLStore) PutAppStateSyncKeyContext(ctx context.Context, id []byte, key store.AppStateSyncKey) error {
+	keyData, err := s.encryptKey(columnAppStateKey, key.Data, s.JID, id)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, putAppStateSyncKeyQuery, s.JID, id, keyData, key.Timestamp, key.Fingerprint)
 	return err
 }
 
-func (s *SQLStore) GetAppStateSyncKey(id []byte) (*store.AppStateSyncKey, error) {
+func (s *SQLStore) GetAppStateSyncKeyContext(ctx context.Context, id []byte) (*store.AppStateSyncKey, error) {
 	var key store.AppStateSyncKey
-	err := s.db.QueryRow(getAppStateSyncKeyQuery, s.JID, id).Scan(&key.Data, &key.Timestamp, &key.Fingerprint)
+	err := s.db.QueryRowContext(ctx, getAppStateSyncKeyQuery, s.JID, id).Scan(&key.Data, &key.Timestamp, &key.Fingerprint)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
-	return &key, err
+	key.Data, err = s.decryptKey(columnAppStateKey, key.Data, s.JID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
 }
 
-func (s *SQLStore) GetLatestAppStateSyncKeyID() ([]byte, error) {
+func (s *SQLStore) GetLatestAppStateSyncKeyIDContext(ctx context.Context) ([]byte, error) {
 	var keyID []byte
-	err := s.db.QueryRow(getLatestAppStateSyncKeyIDQuery, s.JID).Scan(&keyID)
+	err := s.db.QueryRowContext(ctx, getLatestAppStateSyncKeyIDQuery, s.JID).Scan(&keyID)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
@@ -324,14 +403,14 @@ const (
 	getAppStateMutationMACQuery             = `SELECT value_mac FROM whatsmeow_app_state_mutation_macs WHERE jid=$1 AND name=$2 AND index_mac=$3 ORDER BY version DESC LIMIT 1`
 )
 
-func (s *SQLStore) PutAppStateVersion(name string, version uint64, hash [128]byte) error {
-	_, err := s.db.Exec(putAppStateVersionQuery, s.JID, name, version, hash[:])
+func (s *SQLStore) PutAppStateVersionContext(ctx context.Context, name string, version uint64, hash [128]byte) error {
+	_, err := s.db.ExecContext(ctx, putAppStateVersionQuery, s.JID, name, version, hash[:])
 	return err
 }
 
-func (s *SQLStore) GetAppStateVersion(name string) (version uint64, hash [128]byte, err error) {
+func (s *SQLStore) GetAppStateVersionContext(ctx context.Context, name string) (version uint64, hash [128]byte, err error) {
 	var uncheckedHash []byte
-	err = s.db.QueryRow(getAppStateVersionQuery, s.JID, name).Scan(&version, &uncheckedHash)
+	err = s.db.QueryRowContext(ctx, getAppStateVersionQuery, s.JID, name).Scan(&version, &uncheckedHash)
 	if errors.Is(err, sql.ErrNoRows) {
 		// version will be 0 and hash will be an empty array, which is the correct initial state
 		err = nil
@@ -347,16 +426,16 @@ func (s *SQLStore) GetAppStateVersion(name string) (version uint64, hash [128]by
 	return
 }
 
-func (s *SQLStore) DeleteAppStateVersion(name string) error {
-	_, err := s.db.Exec(deleteAppStateVersionQuery, s.JID, name)
+func (s *SQLStore) DeleteAppStateVersionContext(ctx context.Context, name string) error {
+	_, err := s.db.ExecContext(ctx, deleteAppStateVersionQuery, s.JID, name)
 	return err
 }
 
 type execable interface {
-	Exec(query string, args ...interface{}) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 }
 
-func (s *SQLStore) putAppStateMutationMACs(tx execable, name string, version uint64, mutations []store.AppStateMutationMAC) error {
+func (s *SQLStore) putAppStateMutationMACs(ctx context.Context, tx execable, name string, version uint64, mutations []store.AppStateMutationMAC) error {
 	values := make([]interface{}, 3+len(mutations)*2)
 	queryParts := make([]string, len(mutations))
 	values[0] = s.JID
@@ -372,15 +451,15 @@ func (s *SQLStore) putAppStateMutationMACs(tx execable, name string, version uin
 		values[baseIndex+1] = mutation.ValueMAC
 		queryParts[i] = fmt.Sprintf(placeholderSyntax, baseIndex+1, baseIndex+2)
 	}
-	_, err := tx.Exec(putAppStateMutationMACsQuery+strings.Join(queryParts, ","), values...)
+	_, err := tx.ExecContext(ctx, putAppStateMutationMACsQuery+strings.Join(queryParts, ","), values...)
 	return err
 }
 
 const mutationBatchSize = 400
 
-func (s *SQLStore) PutAppStateMutationMACs(name string, version uint64, mutations []store.AppStateMutationMAC) error {
+func (s *SQLStore) PutAppStateMutationMACsContext(ctx context.Context, name string, version uint64, mutations []store.AppStateMutationMAC) error {
 	if len(mutations) > mutationBatchSize {
-		tx, err := s.db.Begin()
+		tx, err := s.db.BeginTx(ctx, nil)
 		if err != nil {
 			return fmt.Errorf("failed to start transaction: %w", err)
 		}
@@ -391,7 +470,7 @@ func (s *SQLStore) PutAppStateMutationMACs(name string, version uint64, mutation
 			} else {
 				mutationSlice = mutations[i:]
 			}
-			err = s.putAppStateMutationMACs(tx, name, version, mutationSlice)
+			err = s.putAppStateMutationMACs(ctx, tx, name, version, mutationSlice)
 			if err != nil {
 				_ = tx.Rollback()
 				return err
@@ -403,17 +482,17 @@ func (s *SQLStore) PutAppStateMutationMACs(name string, version uint64, mutation
 		}
 		return nil
 	} else if len(mutations) > 0 {
-		return s.putAppStateMutationMACs(s.db, name, version, mutations)
+		return s.putAppStateMutationMACs(ctx, s.db, name, version, mutations)
 	}
 	return nil
 }
 
-func (s *SQLStore) DeleteAppStateMutationMACs(name string, indexMACs [][]byte) (err error) {
+func (s *SQLStore) DeleteAppStateMutationMACsContext(ctx context.Context, name string, indexMACs [][]byte) (err error) {
 	if len(indexMACs) == 0 {
 		return
 	}
 	if s.dialect == "postgres" && PostgresArrayWrapper != nil {
-		_, err = s.db.Exec(deleteAppStateMutationMACsQueryPostgres, s.JID, name, PostgresArrayWrapper(indexMACs))
+		_, err = s.db.ExecContext(ctx, deleteAppStateMutationMACsQueryPostgres, s.JID, name, PostgresArrayWrapper(indexMACs))
 	} else {
 		args := make([]interface{}, 2+len(indexMACs))
 		args[0] = s.JID
@@ -423,13 +502,13 @@ func (s *SQLStore) DeleteAppStateMutationMACs(name string, indexMACs [][]byte) (
 			args[2+i] = item
 			queryParts[i] = fmt.Sprintf("$%d", i+3)
 		}
-		_, err = s.db.Exec(deleteAppStateMutationMACsQueryGeneric+"("+strings.Join(queryParts, ",")+")", args...)
+		_, err = s.db.ExecContext(ctx, deleteAppStateMutationMACsQueryGeneric+"("+strings.Join(queryParts, ",")+")", args...)
 	}
 	return
 }
 
-func (s *SQLStore) GetAppStateMutationMAC(name string, indexMAC []byte) (valueMAC []byte, err error) {
-	err = s.db.QueryRow(getAppStateMutationMACQuery, s.JID, name, indexMAC).Scan(&valueMAC)
+func (s *SQLStore) GetAppStateMutationMACContext(ctx context.Context, name string, indexMAC []byte) (valueMAC []byte, err error) {
+	err = s.db.QueryRowContext(ctx, getAppStateMutationMACQuery, s.JID, name, indexMAC).Scan(&valueMAC)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
 	}
@@ -462,16 +541,16 @@ const (
 	`
 )
 
-func (s *SQLStore) PutPushName(user types.JID, pushName string) (bool, string, error) {
+func (s *SQLStore) PutPushNameContext(ctx context.Context, user types.JID, pushName string) (bool, string, error) {
 	s.contactCacheLock.Lock()
 	defer s.contactCacheLock.Unlock()
 
-	cached, err := s.getContact(user)
+	cached, err := s.getContact(ctx, user)
 	if err != nil {
 		return false, "", err
 	}
 	if cached.PushName != pushName {
-		_, err = s.db.Exec(putPushNameQuery, s.JID, user, pushName)
+		_, err = s.db.ExecContext(ctx, putPushNameQuery, s.JID, user, pushName)
 		if err != nil {
 			return false, "", err
 		}
@@ -483,16 +562,16 @@ func (s *SQLStore) PutPushName(user types.JID, pushName string) (bool, string, e
 	return false, "", nil
 }
 
-func (s *SQLStore) PutBusinessName(user types.JID, businessName string) (bool, string, error) {
+func (s *SQLStore) PutBusinessNameContext(ctx context.Context, user types.JID, businessName string) (bool, string, error) {
 	s.contactCacheLock.Lock()
 	defer s.contactCacheLock.Unlock()
 
-	cached, err := s.getContact(user)
+	cached, err := s.getContact(ctx, user)
 	if err != nil {
 		return false, "", err
 	}
 	if cached.BusinessName != businessName {
-		_, err = s.db.Exec(putBusinessNameQuery, s.JID, user, businessName)
+		_, err = s.db.ExecContext(ctx, putBusinessNameQuery, s.JID, user, businessName)
 		if err != nil {
 			return false, "", err
 		}
@@ -504,16 +583,16 @@ func (s *SQLStore) PutBusinessName(user types.JID, businessName string) (bool, s
 	return false, "", nil
 }
 
-func (s *SQLStore) PutContactName(user types.JID, firstName, fullName string) error {
+func (s *SQLStore) PutContactNameContext(ctx context.Context, user types.JID, firstName, fullName string) error {
 	s.contactCacheLock.Lock()
 	defer s.contactCacheLock.Unlock()
 
-	cached, err := s.getContact(user)
+	cached, err := s.getContact(ctx, user)
 	if err != nil {
 		return err
 	}
 	if cached.FirstName != firstName || cached.FullName != fullName {
-		_, err = s.db.Exec(putContactNameQuery, s.JID, user, firstName, fullName)
+		_, err = s.db.ExecContext(ctx, putContactNameQuery, s.JID, user, firstName, fullName)
 		if err != nil {
 			return err
 		}
@@ -526,7 +605,7 @@ func (s *SQLStore) PutContactName(user types.JID, firstName, fullName string) er
 
 const contactBatchSize = 300
 
-func (s *SQLStore) putContactNamesBatch(tx execable, contacts []store.ContactEntry) error {
+func (s *SQLStore) putContactNamesBatch(ctx context.Context, tx execable, contacts []store.ContactEntry) error {
 	values := make([]interface{}, 1, 1+len(contacts)*3)
 	queryParts := make([]string, 0, len(contacts))
 	values[0] = s.JID
@@ -553,13 +632,13 @@ func (s *SQLStore) putContactNamesBatch(tx execable, contacts []store.ContactEnt
 		queryParts = append(queryParts, fmt.Sprintf(placeholderSyntax, baseIndex+1, baseIndex+2, baseIndex+3))
 		i++
 	}
-	_, err := tx.Exec(fmt.Sprintf(putManyContactNamesQuery, strings.Join(queryParts, ",")), values...)
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(putManyContactNamesQuery, strings.Join(queryParts, ",")), values...)
 	return err
 }
 
-func (s *SQLStore) PutAllContactNames(contacts []store.ContactEntry) error {
+func (s *SQLStore) PutAllContactNamesContext(ctx context.Context, contacts []store.ContactEntry) error {
 	if len(contacts) > contactBatchSize {
-		tx, err := s.db.Begin()
+		tx, err := s.db.BeginTx(ctx, nil)
 		if err != nil {
 			return fmt.Errorf("failed to start transaction: %w", err)
 		}
@@ -570,7 +649,7 @@ func (s *SQLStore) PutAllContactNames(contacts []store.ContactEntry) error {
 			} else {
 				contactSlice = contacts[i:]
 			}
-			err = s.putContactNamesBatch(tx, contactSlice)
+			err = s.putContactNamesBatch(ctx, tx, contactSlice)
 			if err != nil {
 				_ = tx.Rollback()
 				return err
@@ -581,7 +660,7 @@ func (s *SQLStore) PutAllContactNames(contacts []store.ContactEntry) error {
 			return fmt.Errorf("failed to commit transaction: %w", err)
 		}
 	} else if len(contacts) > 0 {
-		err := s.putContactNamesBatch(s.db, contacts)
+		err := s.putContactNamesBatch(ctx, s.db, contacts)
 		if err != nil {
 			return err
 		}
@@ -595,14 +674,14 @@ func (s *SQLStore) PutAllContactNames(contacts []store.ContactEntry) error {
 	return nil
 }
 
-func (s *SQLStore) getContact(user types.JID) (*types.ContactInfo, error) {
+func (s *SQLStore) getContact(ctx context.Context, user types.JID) (*types.ContactInfo, error) {
 	cached, ok := s.contactCache[user]
 	if ok {
 		return cached, nil
 	}
 
 	var first, full, push, business sql.NullString
-	err := s.db.QueryRow(getContactQuery, s.JID, user).Scan(&first, &full, &push, &business)
+	err := s.db.QueryRowContext(ctx, getContactQuery, s.JID, user).Scan(&first, &full, &push, &business)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return nil, err
 	}
@@ -617,9 +696,9 @@ func (s *SQLStore) getContact(user types.JID) (*types.ContactInfo, error) {
 	return info, nil
 }
 
-func (s *SQLStore) GetContact(user types.JID) (types.ContactInfo, error) {
+func (s *SQLStore) GetContactContext(ctx context.Context, user types.JID) (types.ContactInfo, error) {
 	s.contactCacheLock.Lock()
-	info, err := s.getContact(user)
+	info, err := s.getContact(ctx, user)
 	s.contactCacheLock.Unlock()
 	if err != nil {
 		return types.ContactInfo{}, err
@@ -627,10 +706,10 @@ func (s *SQLStore) GetContact(user types.JID) (types.ContactInfo, error) {
 	return *info, nil
 }
 
-func (s *SQLStore) GetAllContacts() (map[types.JID]types.ContactInfo, error) {
+func (s *SQLStore) GetAllContactsContext(ctx context.Context) (map[types.JID]types.ContactInfo, error) {
 	s.contactCacheLock.Lock()
 	defer s.contactCacheLock.Unlock()
-	rows, err := s.db.Query(getAllContactsQuery, s.JID)
+	rows, err := s.db.QueryContext(ctx, getAllContactsQuery, s.JID)
 	if err != nil {
 		return nil, err
 	}
@@ -665,28 +744,28 @@ const (
 	`
 )
 
-func (s *SQLStore) PutMutedUntil(chat types.JID, mutedUntil time.Time) error {
+func (s *SQLStore) PutMutedUntilContext(ctx context.Context, chat types.JID, mutedUntil time.Time) error {
 	var val int64
 	if !mutedUntil.IsZero() {
 		val = mutedUntil.Unix()
 	}
-	_, err := s.db.Exec(fmt.Sprintf(putChatSettingQuery, "muted_until"), s.JID, chat, val)
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(putChatSettingQuery, "muted_until"), s.JID, chat, val)
 	return err
 }
 
-func (s *SQLStore) PutPinned(chat types.JID, pinned bool) error {
-	_, err := s.db.Exec(fmt.Sprintf(putChatSettingQuery, "pinned"), s.JID, chat, pinned)
+func (s *SQLStore) PutPinnedContext(ctx context.Context, chat types.JID, pinned bool) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(putChatSettingQuery, "pinned"), s.JID, chat, pinned)
 	return err
 }
 
-func (s *SQLStore) PutArchived(chat types.JID, archived bool) error {
-	_, err := s.db.Exec(fmt.Sprintf(putChatSettingQuery, "archived"), s.JID, chat, archived)
+func (s *SQLStore) PutArchivedContext(ctx context.Context, chat types.JID, archived bool) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(putChatSettingQuery, "archived"), s.JID, chat, archived)
 	return err
 }
 
-func (s *SQLStore) GetChatSettings(chat types.JID) (settings types.LocalChatSettings, err error) {
+func (s *SQLStore) GetChatSettingsContext(ctx context.Context, chat types.JID) (settings types.LocalChatSettings, err error) {
 	var mutedUntil int64
-	err = s.db.QueryRow(getChatSettingsQuery, s.JID, chat).Scan(&mutedUntil, &settings.Pinned, &settings.Archived)
+	err = s.db.QueryRowContext(ctx, getChatSettingsQuery, s.JID, chat).Scan(&mutedUntil, &settings.Pinned, &settings.Archived)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
 	} else if err != nil {
@@ -700,10 +779,154 @@ func (s *SQLStore) GetChatSettings(chat types.JID) (settings types.LocalChatSett
 	return
 }
 
+// updateChatLastMessage is the part of an upsert into whatsmeow_chats that replaces the last message if the new one isn't older.
+const updateChatLastMessage = `
+	last_message_id=CASE WHEN excluded.last_message_time>=whatsmeow_chats.last_message_time THEN excluded.last_message_id ELSE whatsmeow_chats.last_message_id END,
+	last_message_preview=CASE WHEN excluded.last_message_time>=whatsmeow_chats.last_message_time THEN excluded.last_message_preview ELSE whatsmeow_chats.last_message_preview END,
+	last_message_from_me=CASE WHEN excluded.last_message_time>=whatsmeow_chats.last_message_time THEN excluded.last_message_from_me ELSE whatsmeow_chats.last_message_from_me END,
+	last_message_time=CASE WHEN excluded.last_message_time>=whatsmeow_chats.last_message_time THEN excluded.last_message_time ELSE whatsmeow_chats.last_message_time END
+`
+
+const (
+	putChatMessageQuery = `
+		INSERT INTO whatsmeow_chats (our_jid, chat_jid, last_message_id, last_message_time, last_message_preview, last_message_from_me, unread_count)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (our_jid, chat_jid) DO UPDATE SET unread_count=whatsmeow_chats.unread_count+excluded.unread_count,
+	` + updateChatLastMessage
+	putChatReadQuery = `
+		INSERT INTO whatsmeow_chats (our_jid, chat_jid, marked_unread) VALUES ($1, $2, $3)
+		ON CONFLICT (our_jid, chat_jid) DO UPDATE
+			SET unread_count=CASE WHEN excluded.marked_unread THEN whatsmeow_chats.unread_count ELSE 0 END,
+			    marked_unread=excluded.marked_unread
+	`
+	putChatFieldQuery = `
+		INSERT INTO whatsmeow_chats (our_jid, chat_jid, %[1]s) VALUES ($1, $2, $3)
+		ON CONFLICT (our_jid, chat_jid) DO UPDATE SET %[1]s=excluded.%[1]s
+	`
+	putChatQuery = `
+		INSERT INTO whatsmeow_chats (our_jid, chat_jid, name, last_message_id, last_message_time, last_message_preview,
+		                             last_message_from_me, unread_count, marked_unread, ephemeral_expiration)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (our_jid, chat_jid) DO UPDATE
+			SET name=CASE WHEN excluded.name<>'' THEN excluded.name ELSE whatsmeow_chats.name END,
+			    unread_count=excluded.unread_count,
+			    marked_unread=excluded.marked_unread,
+			    ephemeral_expiration=excluded.ephemeral_expiration,
+	` + updateChatLastMessage
+	getAllChatsQuery = `
+		SELECT c.chat_jid, c.name, c.last_message_id, c.last_message_time, c.last_message_preview, c.last_message_from_me,
+		       c.unread_count, c.marked_unread, c.ephemeral_expiration, s.muted_until, s.pinned, s.archived
+		FROM whatsmeow_chats c
+		LEFT JOIN whatsmeow_chat_settings s ON s.our_jid=c.our_jid AND s.chat_jid=c.chat_jid
+		WHERE c.our_jid=$1
+	`
+	getChatQuery    = getAllChatsQuery + ` AND c.chat_jid=$2`
+	orderChatsQuery = ` ORDER BY c.last_message_time DESC, c.chat_jid`
+	deleteChatQuery = `DELETE FROM whatsmeow_chats WHERE our_jid=$1 AND chat_jid=$2`
+)
+
+func (s *SQLStore) PutChatMessageContext(ctx context.Context, chat types.JID, message store.ChatMessage, incrementUnread bool) error {
+	var unread int
+	if incrementUnread {
+		unread = 1
+	}
+	_, err := s.db.ExecContext(ctx, putChatMessageQuery, s.JID, chat, message.ID, message.Timestamp.Unix(), message.Preview, message.FromMe, unread)
+	return err
+}
+
+func (s *SQLStore) PutChatReadContext(ctx context.Context, chat types.JID, read bool) error {
+	_, err := s.db.ExecContext(ctx, putChatReadQuery, s.JID, chat, !read)
+	return err
+}
+
+func (s *SQLStore) PutChatNameContext(ctx context.Context, chat types.JID, name string) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(putChatFieldQuery, "name"), s.JID, chat, name)
+	return err
+}
+
+func (s *SQLStore) PutChatEphemeralExpirationContext(ctx context.Context, chat types.JID, expiration uint32) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(putChatFieldQuery, "ephemeral_expiration"), s.JID, chat, expiration)
+	return err
+}
+
+func (s *SQLStore) PutChatsContext(ctx context.Context, chats []store.Chat) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	for _, chat := range chats {
+		_, err = tx.ExecContext(ctx, putChatQuery, s.JID, chat.JID, chat.Name,
+			chat.LastMessage.ID, chat.LastMessage.Timestamp.Unix(), chat.LastMessage.Preview, chat.LastMessage.FromMe,
+			chat.UnreadCount, chat.MarkedAsUnread, chat.EphemeralExpiration)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to store chat %s: %w", chat.JID, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func scanChat(row scannable) (chat store.Chat, err error) {
+	var lastMessageTime int64
+	var mutedUntil sql.NullInt64
+	var pinned, archived sql.NullBool
+	err = row.Scan(&chat.JID, &chat.Name, &chat.LastMessage.ID, &lastMessageTime, &chat.LastMessage.Preview, &chat.LastMessage.FromMe,
+		&chat.UnreadCount, &chat.MarkedAsUnread, &chat.EphemeralExpiration, &mutedUntil, &pinned, &archived)
+	if err != nil {
+		return
+	}
+	if lastMessageTime != 0 {
+		chat.LastMessage.Timestamp = time.Unix(lastMessageTime, 0)
+	}
+	chat.Settings.Found = mutedUntil.Valid
+	if mutedUntil.Int64 != 0 {
+		chat.Settings.MutedUntil = time.Unix(mutedUntil.Int64, 0)
+	}
+	chat.Settings.Pinned = pinned.Bool
+	chat.Settings.Archived = archived.Bool
+	return
+}
+
+func (s *SQLStore) GetChatContext(ctx context.Context, jid types.JID) (*store.Chat, error) {
+	chat, err := scanChat(s.db.QueryRowContext(ctx, getChatQuery, s.JID, jid))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &chat, nil
+}
+
+func (s *SQLStore) GetAllChatsContext(ctx context.Context) ([]store.Chat, error) {
+	rows, err := s.db.QueryContext(ctx, getAllChatsQuery+orderChatsQuery, s.JID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chats: %w", err)
+	}
+	defer rows.Close()
+	chats := make([]store.Chat, 0)
+	for rows.Next() {
+		chat, err := scanChat(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		chats = append(chats, chat)
+	}
+	return chats, rows.Err()
+}
+
+func (s *SQLStore) DeleteChatContext(ctx context.Context, chat types.JID) error {
+	_, err := s.db.ExecContext(ctx, deleteChatQuery, s.JID, chat)
+	return err
+}
+
 const (
 	putMsgSecret = `
-		INSERT INTO whatsmeow_message_secrets (our_jid, chat_jid, sender_jid, message_id, key)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO whatsmeow_message_secrets (our_jid, chat_jid, sender_jid, message_id, key, timestamp)
+		VALUES ($1, $2, $3, $4, $5, $6)
 		ON CONFLICT (our_jid, chat_jid, sender_jid, message_id) DO NOTHING
 	`
 	getMsgSecret = `
@@ -711,13 +934,13 @@ const (
 	`
 )
 
-func (s *SQLStore) PutMessageSecrets(inserts []store.MessageSecretInsert) (err error) {
-	tx, err := s.db.Begin()
+func (s *SQLStore) PutMessageSecretsContext(ctx context.Context, inserts []store.MessageSecretInsert) (err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	for _, insert := range inserts {
-		_, err = tx.Exec(putMsgSecret, s.JID, insert.Chat.ToNonAD(), insert.Sender.ToNonAD(), insert.ID, insert.Secret)
+		_, err = tx.ExecContext(ctx, putMsgSecret, s.JID, insert.Chat.ToNonAD(), insert.Sender.ToNonAD(), insert.ID, insert.Secret, messageSecretTimestamp(insert.Timestamp))
 	}
 	err = tx.Commit()
 	if err != nil {
@@ -726,13 +949,22 @@ func (s *SQLStore) PutMessageSecrets(inserts []store.MessageSecretInsert) (err e
 	return
 }
 
-func (s *SQLStore) PutMessageSecret(chat, sender types.JID, id types.MessageID, secret []byte) (err error) {
-	_, err = s.db.Exec(putMsgSecret, s.JID, chat.ToNonAD(), sender.ToNonAD(), id, secret)
+func (s *SQLStore) PutMessageSecretContext(ctx context.Context, chat, sender types.JID, id types.MessageID, secret []byte, timestamp time.Time) (err error) {
+	_, err = s.db.ExecContext(ctx, putMsgSecret, s.JID, chat.ToNonAD(), sender.ToNonAD(), id, secret, messageSecretTimestamp(timestamp))
 	return
 }
 
-func (s *SQLStore) GetMessageSecret(chat, sender types.JID, id types.MessageID) (secret []byte, err error) {
-	err = s.db.QueryRow(getMsgSecret, s.JID, chat.ToNonAD(), sender.ToNonAD(), id).Scan(&secret)
+// messageSecretTimestamp returns the value of the timestamp column for a secret of a message sent at the given time.
+// Secrets without a message timestamp are treated as if the message was sent now, so they aren't pruned immediately.
+func messageSecretTimestamp(ts time.Time) int64 {
+	if ts.IsZero() {
+		return time.Now().Unix()
+	}
+	return ts.Unix()
+}
+
+func (s *SQLStore) GetMessageSecretContext(ctx context.Context, chat, sender types.JID, id types.MessageID) (secret []byte, err error) {
+	err = s.db.QueryRowContext(ctx, getMsgSecret, s.JID, chat.ToNonAD(), sender.ToNonAD(), id).Scan(&secret)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
 	}
@@ -749,7 +981,7 @@ const (
 	deletePrivacyToken = `DELETE FROM whatsmeow_privacy_tokens WHERE our_jid=$1`
 )
 
-func (s *SQLStore) PutPrivacyTokens(tokens ...store.PrivacyToken) error {
+func (s *SQLStore) PutPrivacyTokensContext(ctx context.Context, tokens ...store.PrivacyToken) error {
 	args := make([]any, 1+len(tokens)*3)
 	placeholders := make([]string, len(tokens))
 	args[0] = s.JID
@@ -760,15 +992,15 @@ func (s *SQLStore) PutPrivacyTokens(tokens ...store.PrivacyToken) error {
 		placeholders[i] = fmt.Sprintf("($1, $%d, $%d, $%d)", i*3+2, i*3+3, i*3+4)
 	}
 	query := strings.ReplaceAll(putPrivacyTokens, "($1, $2, $3, $4)", strings.Join(placeholders, ","))
-	_, err := s.db.Exec(query, args...)
+	_, err := s.db.ExecContext(ctx, query, args...)
 	return err
 }
 
-func (s *SQLStore) GetPrivacyToken(user types.JID) (*store.PrivacyToken, error) {
+func (s *SQLStore) GetPrivacyTokenContext(ctx context.Context, user types.JID) (*store.PrivacyToken, error) {
 	var token store.PrivacyToken
 	token.User = user.ToNonAD()
 	var ts int64
-	err := s.db.QueryRow(getPrivacyToken, s.JID, token.User).Scan(&token.Token, &ts)
+	err := s.db.QueryRowContext(ctx, getPrivacyToken, s.JID, token.User).Scan(&token.Token, &ts)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	} else if err != nil {
@@ -778,3 +1010,249 @@ func (s *SQLStore) GetPrivacyToken(user types.JID) (*store.PrivacyToken, error)
 		return &token, nil
 	}
 }
+
+const (
+	putRecentMessageQuery = `
+		INSERT INTO whatsmeow_recent_messages (our_jid, to_jid, message_id, message, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (our_jid, to_jid, message_id) DO UPDATE SET message=excluded.message, expiry=excluded.expiry
+	`
+	getRecentMessageQuery = `
+		SELECT message FROM whatsmeow_recent_messages WHERE our_jid=$1 AND to_jid=$2 AND message_id=$3 AND expiry>=$4
+	`
+	deleteExpiredRecentMessagesQuery = `DELETE FROM whatsmeow_recent_messages WHERE our_jid=$1 AND expiry<$2`
+)
+
+func (s *SQLStore) PutRecentMessageContext(ctx context.Context, to types.JID, id types.MessageID, message []byte, expiry time.Time) error {
+	toJID := to.String()
+	message, err := s.encryptKey(columnRecentMsg, message, s.JID, toJID, id)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, putRecentMessageQuery, s.JID, toJID, id, message, expiry.Unix())
+	return err
+}
+
+func (s *SQLStore) GetRecentMessageContext(ctx context.Context, to types.JID, id types.MessageID) (message []byte, err error) {
+	toJID := to.String()
+	err = s.db.QueryRowContext(ctx, getRecentMessageQuery, s.JID, toJID, id, time.Now().Unix()).Scan(&message)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	} else if err == nil {
+		message, err = s.decryptKey(columnRecentMsg, message, s.JID, toJID, id)
+	}
+	return
+}
+
+func (s *SQLStore) DeleteExpiredRecentMessagesContext(ctx context.Context, now time.Time) error {
+	_, err := s.db.ExecContext(ctx, deleteExpiredRecentMessagesQuery, s.JID, now.Unix())
+	return err
+}
+
+const (
+	putHistoryMessageQuery = `
+		INSERT INTO history_messages (our_jid, chat_id, message_id, message_timestamp, message_data, message_status, status_timestamp, search_text)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (our_jid, chat_id, message_id) DO UPDATE
+			SET message_timestamp=excluded.message_timestamp, message_data=excluded.message_data, search_text=excluded.search_text,
+				message_status=CASE WHEN excluded.message_status>history_messages.message_status
+					THEN excluded.message_status ELSE history_messages.message_status END,
+				status_timestamp=CASE WHEN excluded.message_status>history_messages.message_status
+					THEN excluded.status_timestamp ELSE history_messages.status_timestamp END
+	`
+	deleteHistoryMessagesQuery = `DELETE FROM history_messages WHERE our_jid=$1`
+	// Same as store.IsHistoryStatusUpgrade: statuses only go up, except failed (0) can replace sent (1)
+	updateHistoryMessageStatusQuery = `
+		UPDATE history_messages SET message_status=$1, status_timestamp=$2
+		WHERE our_jid=$3 AND message_id=$4 AND (message_status<$1 OR ($1=0 AND message_status=1))
+	`
+	updateHistoryMessageStatusInChat = updateHistoryMessageStatusQuery + ` AND chat_id=$5`
+
+	historyMessageColumns   = `chat_id, message_id, message_timestamp, message_data, message_status, status_timestamp`
+	getHistoryMessageQuery  = `SELECT ` + historyMessageColumns + ` FROM history_messages WHERE our_jid=$1 AND chat_id=$2 AND message_id=$3`
+	getChatHistoryQuery     = `SELECT ` + historyMessageColumns + ` FROM history_messages WHERE our_jid=$1 AND chat_id=$2 ORDER BY message_timestamp DESC, message_id DESC LIMIT $3`
+	getChatHistoryPageQuery = `
+		SELECT ` + historyMessageColumns + ` FROM history_messages
+		WHERE our_jid=$1 AND chat_id=$2 AND (message_timestamp, message_id) < ($3, $4)
+		ORDER BY message_timestamp DESC, message_id DESC LIMIT $5
+	`
+	listHistoryChatsQuery = `
+		SELECT ` + historyMessageColumns + `, message_count FROM (
+			SELECT ` + historyMessageColumns + `,
+			       ROW_NUMBER() OVER (PARTITION BY chat_id ORDER BY message_timestamp DESC, message_id DESC) AS row_index,
+			       COUNT(*) OVER (PARTITION BY chat_id) AS message_count
+			FROM history_messages WHERE our_jid=$1
+		) AS latest
+		WHERE row_index=1
+		ORDER BY message_timestamp DESC, chat_id
+	`
+	searchHistoryQuery = `
+		SELECT ` + historyMessageColumns + ` FROM history_messages
+		WHERE our_jid=$1 AND ($2='' OR chat_id=$2) AND message_timestamp BETWEEN $3 AND $4 AND %s
+		ORDER BY message_timestamp DESC, message_id DESC LIMIT $%d
+	`
+	searchHistoryFTSCondition      = `rowid IN (SELECT rowid FROM history_messages_fts WHERE history_messages_fts MATCH $5)`
+	searchHistoryTSVectorCondition = `search_vector @@ plainto_tsquery('simple', $5)`
+)
+
+func (s *SQLStore) DeviceHistorySyncContext(ctx context.Context, messages []store.HistoryMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	for _, msg := range messages {
+		_, err = tx.ExecContext(ctx, putHistoryMessageQuery, s.JID, msg.ChatId, msg.MessageId, msg.MessageTimestamp, msg.JsonData, msg.MessageStatus, msg.StatusTimestamp, store.ExtractSearchText(msg.JsonData))
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to insert message %s: %w", msg.MessageId, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) DeleteDeviceHistoryContext(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, deleteHistoryMessagesQuery, s.JID)
+	return err
+}
+
+func (s *SQLStore) DeviceUpdateStatusMessageContext(ctx context.Context, msg store.HistoryMessage) (err error) {
+	if msg.ChatId != "" {
+		_, err = s.db.ExecContext(ctx, updateHistoryMessageStatusInChat, msg.MessageStatus, msg.StatusTimestamp, s.JID, msg.MessageId, msg.ChatId)
+	} else {
+		_, err = s.db.ExecContext(ctx, updateHistoryMessageStatusQuery, msg.MessageStatus, msg.StatusTimestamp, s.JID, msg.MessageId)
+	}
+	return
+}
+
+func scanHistoryMessage(row scannable, extra ...interface{}) (*store.HistoryMessage, error) {
+	var msg store.HistoryMessage
+	dest := append([]interface{}{&msg.ChatId, &msg.MessageId, &msg.MessageTimestamp, &msg.JsonData, &msg.MessageStatus, &msg.StatusTimestamp}, extra...)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (s *SQLStore) GetChatHistoryContext(ctx context.Context, chat string, before store.HistoryCursor, limit int) ([]store.HistoryMessage, error) {
+	var rows *sql.Rows
+	var err error
+	if before.IsZero() {
+		rows, err = s.db.QueryContext(ctx, getChatHistoryQuery, s.JID, chat, limit)
+	} else {
+		rows, err = s.db.QueryContext(ctx, getChatHistoryPageQuery, s.JID, chat, before.MessageTimestamp, before.MessageId, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := make([]store.HistoryMessage, 0, limit)
+	for rows.Next() {
+		msg, err := scanHistoryMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		messages = append(messages, *msg)
+	}
+	return messages, rows.Err()
+}
+
+func (s *SQLStore) GetMessageContext(ctx context.Context, chat, id string) (*store.HistoryMessage, error) {
+	msg, err := scanHistoryMessage(s.db.QueryRowContext(ctx, getHistoryMessageQuery, s.JID, chat, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return msg, err
+}
+
+func (s *SQLStore) ListChatsContext(ctx context.Context) ([]store.HistoryChat, error) {
+	rows, err := s.db.QueryContext(ctx, listHistoryChatsQuery, s.JID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var chats []store.HistoryChat
+	for rows.Next() {
+		var chat store.HistoryChat
+		msg, err := scanHistoryMessage(rows, &chat.MessageCount)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		chat.ChatId = msg.ChatId
+		chat.LastMessage = *msg
+		chats = append(chats, chat)
+	}
+	return chats, rows.Err()
+}
+
+// ftsPrefixQuery converts search terms into an FTS5 query where every term must be found as a prefix of a word.
+func ftsPrefixQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+	}
+	return strings.Join(quoted, " ")
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchMessagesContext searches the stored messages. How the query terms are matched depends on the backend:
+//
+//   - Postgres matches whole words with the 'simple' text search configuration.
+//   - SQLite with FTS5 matches words that start with each term.
+//   - SQLite without FTS5 matches each term anywhere in the text (like the in-memory store), using an unindexed LIKE query.
+//
+// All backends are case-insensitive and require every term to match.
+func (s *SQLStore) SearchMessagesContext(ctx context.Context, query, chat string, from, to time.Time, limit int) ([]store.HistoryMessage, error) {
+	terms := store.SearchTerms(query)
+	if len(terms) == 0 {
+		return []store.HistoryMessage{}, nil
+	}
+	var minTS, maxTS int64 = 0, math.MaxInt64
+	if !from.IsZero() {
+		minTS = from.Unix()
+	}
+	if !to.IsZero() {
+		maxTS = to.Unix()
+	}
+	args := []interface{}{s.JID, chat, minTS, maxTS}
+	var condition string
+	switch {
+	case s.dialect == "postgres" || s.dialect == "pgx":
+		condition = searchHistoryTSVectorCondition
+		args = append(args, query)
+	case s.dialect == "sqlite3" && s.searchIndexEnabled:
+		condition = searchHistoryFTSCondition
+		args = append(args, ftsPrefixQuery(terms))
+	default:
+		conditions := make([]string, len(terms))
+		for i, term := range terms {
+			conditions[i] = fmt.Sprintf(`LOWER(search_text) LIKE $%d ESCAPE '\'`, len(args)+1)
+			args = append(args, "%"+likeEscaper.Replace(term)+"%")
+		}
+		condition = strings.Join(conditions, " AND ")
+	}
+	// The limit is the last parameter, as SQLite numbers parameters in the order they appear in the query
+	args = append(args, limit)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(searchHistoryQuery, condition, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []store.HistoryMessage
+	for rows.Next() {
+		msg, err := scanHistoryMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		messages = append(messages, *msg)
+	}
+	return messages, rows.Err()
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.mau.fi/libsignal/protocol"
+	"go.mau.fi/libsignal/state/record"
+
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	container := newTestContainer(t)
+	deviceCounter := 0
+	storetest.RunDeviceStoreTests(t, func(t *testing.T) *store.Device {
+		deviceCounter++
+		return newTestDevice(t, container, fmt.Sprintf("1000%d", deviceCounter))
+	})
+}
+
+func TestContextSignalStore_CanceledContext(t *testing.T) {
+	container := newTestContainer(t)
+	device := newTestDevice(t, container, "1")
+	address := protocol.NewSignalAddress("2", 0)
+	err := device.Sessions.PutSession(address.String(), []byte("not a valid session"))
+	if err != nil {
+		t.Fatalf("Failed to store session: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	signalStore := device.WithContext(ctx)
+	signalStore.LoadSession(address)
+	if !errors.Is(signalStore.Err(), context.Canceled) {
+		t.Fatalf("Expected context.Canceled from Err, got %v", signalStore.Err())
+	}
+	signalStore.StoreSession(address, record.NewSession(store.SignalProtobufSerializer.Session, store.SignalProtobufSerializer.State))
+	if sess, err := device.Sessions.GetSession(address.String()); err != nil || string(sess) != "not a valid session" {
+		t.Fatalf("Session was overwritten after a failed load: %q / %v", sess, err)
+	}
+
+	uow := device.NewUnitOfWork(ctx)
+	if uow.ContainsSession(address) {
+		t.Fatalf("ContainsSession returned true with a canceled context")
+	}
+	uow.ClearIdentity(address)
+	if err = uow.Commit(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled from Commit, got %v", err)
+	}
+}
@@ -9,6 +9,9 @@ package sqlstore
 import (
 	"database/sql"
 	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow/store"
 )
 
 type upgradeFunc func(*sql.Tx, *Container) error
@@ -17,7 +20,7 @@ type upgradeFunc func(*sql.Tx, *Container) error
 //
 // This may be of use if you want to manage the database fully manually, but in most cases you
 // should just call Container.Upgrade to let the library handle everything.
-var Upgrades = [...]upgradeFunc{upgradeV1, upgradeV2, upgradeV3, upgradeV4, upgradeV5}
+var Upgrades = [...]upgradeFunc{upgradeV1, upgradeV2, upgradeV3, upgradeV4, upgradeV5, upgradeV6, upgradeV7, upgradeV8, upgradeV9, upgradeV10, upgradeV11, upgradeV12}
 
 func (c *Container) getVersion() (int, error) {
 	_, err := c.db.Exec("CREATE TABLE IF NOT EXISTS whatsmeow_version (version INTEGER)")
@@ -73,7 +76,7 @@ func (c *Container) Upgrade() error {
 		}
 	}
 
-	return nil
+	return c.setupSearchIndex()
 }
 
 func upgradeV1(tx *sql.Tx, _ *Container) error {
@@ -299,3 +302,347 @@ func upgradeV5(tx *sql.Tx, container *Container) error {
 	_, err := tx.Exec("UPDATE whatsmeow_device SET jid=REPLACE(jid, '.0', '')")
 	return err
 }
+
+const createHistoryMessagesV6 = `CREATE TABLE history_messages (
+	our_jid           TEXT,
+	chat_id           TEXT,
+	message_id        TEXT,
+	message_timestamp BIGINT  NOT NULL,
+	message_data      TEXT    NOT NULL,
+	message_status    INTEGER NOT NULL,
+	status_timestamp  BIGINT  NOT NULL,
+
+	PRIMARY KEY (our_jid, chat_id, message_id),
+	FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+)`
+
+// upgradeV6 scopes history_messages to a device. Existing rows are assigned to the only device
+// in the database if there is exactly one. Otherwise their owner can't be known, so they're moved
+// to history_messages_quarantine for manual inspection instead of being attached to every device.
+func upgradeV6(tx *sql.Tx, container *Container) error {
+	_, err := tx.Exec("ALTER TABLE history_messages RENAME TO history_messages_quarantine")
+	if err != nil {
+		return err
+	}
+	if container.dialect == "postgres" || container.dialect == "pgx" {
+		_, err = tx.Exec("ALTER TABLE history_messages_quarantine RENAME CONSTRAINT history_messages_pkey TO history_messages_quarantine_pkey")
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(createHistoryMessagesV6)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE INDEX history_messages_message_id_idx ON history_messages (our_jid, message_id)")
+	if err != nil {
+		return err
+	}
+	var deviceCount, messageCount int
+	err = tx.QueryRow("SELECT COUNT(*) FROM whatsmeow_device").Scan(&deviceCount)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow("SELECT COUNT(*) FROM history_messages_quarantine").Scan(&messageCount)
+	if err != nil {
+		return err
+	}
+	if messageCount == 0 || deviceCount == 1 {
+		_, err = tx.Exec(`
+			INSERT INTO history_messages (our_jid, chat_id, message_id, message_timestamp, message_data, message_status, status_timestamp)
+			SELECT (SELECT jid FROM whatsmeow_device), chat_id, message_id, message_timestamp, message_data, message_status, status_timestamp
+			FROM history_messages_quarantine
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DROP TABLE history_messages_quarantine")
+		return err
+	}
+	container.log.Warnf("Found %d history messages and %d devices, moved messages with unknown owner to history_messages_quarantine", messageCount, deviceCount)
+	return nil
+}
+
+func upgradeV7(tx *sql.Tx, container *Container) error {
+	_, err := tx.Exec("CREATE INDEX history_messages_chat_timestamp_idx ON history_messages (our_jid, chat_id, message_timestamp, message_id)")
+	return err
+}
+
+// upgradeV8 removes the length checks from the private key columns of whatsmeow_device,
+// so that they can contain encrypted keys (see KeyEncryptor). The lengths are still checked
+// when the device is loaded.
+//
+// Neither SQLite nor Postgres can change the checks in place (without recreating the table,
+// which would cascade to every other table), so the columns are replaced with new ones instead.
+//
+// SQLite only allows adding NOT NULL columns that have a default value, so the new columns
+// get an empty default, which is dropped on Postgres.
+func upgradeV8(tx *sql.Tx, container *Container) error {
+	isPostgres := container.dialect == "postgres" || container.dialect == "pgx"
+	for _, column := range []string{"noise_key", "identity_key", "signed_pre_key"} {
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE whatsmeow_device RENAME COLUMN %[1]s TO %[1]s_old", column))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE whatsmeow_device ADD COLUMN %s bytea NOT NULL DEFAULT ''", column))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("UPDATE whatsmeow_device SET %[1]s=%[1]s_old", column))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE whatsmeow_device DROP COLUMN %s_old", column))
+		if err != nil {
+			return err
+		}
+		if isPostgres {
+			_, err = tx.Exec(fmt.Sprintf("ALTER TABLE whatsmeow_device ALTER COLUMN %s DROP DEFAULT", column))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func upgradeV9(tx *sql.Tx, container *Container) error {
+	_, err := tx.Exec(`CREATE TABLE whatsmeow_recent_messages (
+		our_jid    TEXT,
+		to_jid     TEXT,
+		message_id TEXT,
+		message    bytea  NOT NULL,
+		expiry     BIGINT NOT NULL,
+
+		PRIMARY KEY (our_jid, to_jid, message_id),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE INDEX whatsmeow_recent_messages_expiry_idx ON whatsmeow_recent_messages (our_jid, expiry)")
+	return err
+}
+
+func upgradeV10(tx *sql.Tx, container *Container) error {
+	_, err := tx.Exec(`CREATE TABLE whatsmeow_chats (
+		our_jid  TEXT,
+		chat_jid TEXT,
+		name     TEXT NOT NULL DEFAULT '',
+
+		last_message_id      TEXT    NOT NULL DEFAULT '',
+		last_message_time    BIGINT  NOT NULL DEFAULT 0,
+		last_message_preview TEXT    NOT NULL DEFAULT '',
+		last_message_from_me BOOLEAN NOT NULL DEFAULT false,
+
+		unread_count         INTEGER NOT NULL DEFAULT 0,
+		marked_unread        BOOLEAN NOT NULL DEFAULT false,
+		ephemeral_expiration BIGINT  NOT NULL DEFAULT 0,
+
+		PRIMARY KEY (our_jid, chat_jid),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE INDEX whatsmeow_chats_last_message_idx ON whatsmeow_chats (our_jid, last_message_time)")
+	return err
+}
+
+// upgradeV11 adds full-text search over history_messages. The text extracted from the message JSON
+// (see store.ExtractSearchText) is stored in the search_text column, which is indexed with a generated
+// tsvector column on Postgres.
+//
+// On SQLite, the index depends on how the binary was built rather than on the database version,
+// so it's managed by setupSearchIndex every time the database is upgraded instead of here.
+func upgradeV11(tx *sql.Tx, container *Container) error {
+	_, err := tx.Exec("ALTER TABLE history_messages ADD COLUMN search_text TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = backfillSearchText(tx)
+	if err != nil {
+		return fmt.Errorf("failed to extract search text of existing messages: %w", err)
+	}
+	switch container.dialect {
+	case "postgres", "pgx":
+		_, err = tx.Exec("ALTER TABLE history_messages ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple', search_text)) STORED")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("CREATE INDEX history_messages_search_idx ON history_messages USING GIN (search_vector)")
+		return err
+	default:
+		return nil
+	}
+}
+
+func backfillSearchText(tx *sql.Tx) error {
+	type messageKey struct {
+		ourJID, chatID, messageID string
+	}
+	rows, err := tx.Query("SELECT our_jid, chat_id, message_id, message_data FROM history_messages")
+	if err != nil {
+		return err
+	}
+	texts := make(map[messageKey]string)
+	for rows.Next() {
+		var key messageKey
+		var data string
+		if err = rows.Scan(&key.ourJID, &key.chatID, &key.messageID, &data); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if text := store.ExtractSearchText(data); text != "" {
+			texts[key] = text
+		}
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for key, text := range texts {
+		_, err = tx.Exec("UPDATE history_messages SET search_text=$1 WHERE our_jid=$2 AND chat_id=$3 AND message_id=$4", text, key.ourJID, key.chatID, key.messageID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var searchIndexTriggers = []string{"history_messages_fts_insert", "history_messages_fts_delete", "history_messages_fts_update"}
+
+// setupSearchIndex picks the message search mode of SQLite databases. FTS5 is only available in go-sqlite3
+// with the sqlite_fts5 build tag (or with libsqlite3 if the system SQLite has it), so it's checked every time
+// the database is opened instead of being decided once by a migration.
+//
+// The FTS5 index is kept up to date by triggers on history_messages, which would make every write to the table
+// fail with "no such module: fts5" if the database was opened by a binary without FTS5. The triggers are therefore
+// dropped when FTS5 is missing, and searches use LIKE queries instead. When FTS5 is available again,
+// the triggers are recreated and the index is rebuilt, as it missed all changes made in between.
+// The presence of the triggers is what records the current search mode in the database.
+func (c *Container) setupSearchIndex() error {
+	if c.dialect != "sqlite3" {
+		return nil
+	}
+	var hasFTS5 bool
+	err := c.db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&hasFTS5)
+	if err != nil {
+		return fmt.Errorf("failed to check if SQLite has FTS5: %w", err)
+	}
+	var triggerCount int
+	err = c.db.QueryRow(
+		"SELECT COUNT(*) FROM sqlite_master WHERE type='trigger' AND name IN ($1, $2, $3)",
+		searchIndexTriggers[0], searchIndexTriggers[1], searchIndexTriggers[2],
+	).Scan(&triggerCount)
+	if err != nil {
+		return fmt.Errorf("failed to check message search index triggers: %w", err)
+	}
+	c.searchIndexEnabled = hasFTS5
+	if hasFTS5 && triggerCount == len(searchIndexTriggers) {
+		return nil
+	} else if !hasFTS5 && triggerCount == 0 {
+		c.log.Debugf("SQLite was built without FTS5, message search will not be indexed")
+		return nil
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	if hasFTS5 {
+		c.log.Infof("Building message search index")
+		err = createSearchIndex(tx)
+	} else {
+		c.log.Warnf("SQLite was built without FTS5, dropping message search index triggers")
+		err = dropSearchIndexTriggers(tx)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		c.searchIndexEnabled = false
+		return fmt.Errorf("failed to set up message search index: %w", err)
+	}
+	return tx.Commit()
+}
+
+func dropSearchIndexTriggers(tx *sql.Tx) error {
+	for _, trigger := range searchIndexTriggers {
+		_, err := tx.Exec("DROP TRIGGER IF EXISTS " + trigger)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createSearchIndex creates the FTS5 table and the triggers that keep it in sync with history_messages,
+// and fills it with the existing messages.
+//
+// The FTS table refers to messages by rowid. VACUUM may renumber the rowids of history_messages,
+// so the index must be rebuilt after vacuuming with INSERT INTO history_messages_fts(history_messages_fts) VALUES ('rebuild').
+func createSearchIndex(tx *sql.Tx) error {
+	err := dropSearchIndexTriggers(tx)
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"CREATE VIRTUAL TABLE IF NOT EXISTS history_messages_fts USING fts5(search_text, content='history_messages', content_rowid='rowid')", `
+		CREATE TRIGGER history_messages_fts_insert AFTER INSERT ON history_messages BEGIN
+			INSERT INTO history_messages_fts (rowid, search_text) VALUES (new.rowid, new.search_text);
+		END
+	`, `
+		CREATE TRIGGER history_messages_fts_delete AFTER DELETE ON history_messages BEGIN
+			INSERT INTO history_messages_fts (history_messages_fts, rowid, search_text) VALUES ('delete', old.rowid, old.search_text);
+		END
+	`, `
+		CREATE TRIGGER history_messages_fts_update AFTER UPDATE OF search_text ON history_messages BEGIN
+			INSERT INTO history_messages_fts (history_messages_fts, rowid, search_text) VALUES ('delete', old.rowid, old.search_text);
+			INSERT INTO history_messages_fts (rowid, search_text) VALUES (new.rowid, new.search_text);
+		END
+	`, "INSERT INTO history_messages_fts (history_messages_fts) VALUES ('rebuild')"} {
+		_, err = tx.Exec(query)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upgradeV12 adds timestamps to message secrets and prekeys for the retention policy.
+// Existing prekeys get the time of the upgrade, so they're only pruned once they're old enough counting from now.
+// Existing message secrets get the timestamp of their message if it's in the history, or the time of the upgrade otherwise.
+func upgradeV12(tx *sql.Tx, container *Container) error {
+	now := time.Now().Unix()
+	for _, table := range []string{"whatsmeow_message_secrets", "whatsmeow_pre_keys"} {
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN timestamp BIGINT NOT NULL DEFAULT 0", table))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET timestamp=$1", table), now)
+		if err != nil {
+			return err
+		}
+	}
+	return setMessageSecretTimestamps(tx)
+}
+
+// setMessageSecretTimestamps sets the timestamp of message secrets whose message is in the history
+// to the timestamp of the message, which is what the retention policy counts from.
+func setMessageSecretTimestamps(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		UPDATE whatsmeow_message_secrets SET timestamp=(
+			SELECT history_messages.message_timestamp FROM history_messages
+			WHERE history_messages.our_jid=whatsmeow_message_secrets.our_jid
+			  AND history_messages.chat_id=whatsmeow_message_secrets.chat_jid
+			  AND history_messages.message_id=whatsmeow_message_secrets.message_id
+			  AND history_messages.message_timestamp>0
+		)
+		WHERE EXISTS(
+			SELECT 1 FROM history_messages
+			WHERE history_messages.our_jid=whatsmeow_message_secrets.our_jid
+			  AND history_messages.chat_id=whatsmeow_message_secrets.chat_jid
+			  AND history_messages.message_id=whatsmeow_message_secrets.message_id
+			  AND history_messages.message_timestamp>0
+		)
+	`)
+	return err
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func countNullableKeyColumns(t *testing.T, container *Container) int {
+	t.Helper()
+	var count int
+	err := container.db.QueryRow(
+		`SELECT COUNT(*) FROM pragma_table_info('whatsmeow_device') WHERE name IN ('noise_key', 'identity_key', 'signed_pre_key') AND "notnull"=0`,
+	).Scan(&count)
+	if err != nil {
+		t.Fatalf("Failed to get column info: %v", err)
+	}
+	return count
+}
+
+func TestUpgrade_DeviceKeysNotNull(t *testing.T) {
+	container := newTestContainer(t)
+	if count := countNullableKeyColumns(t, container); count != 0 {
+		t.Fatalf("Expected all key columns to be NOT NULL after upgrade, found %d nullable columns", count)
+	}
+	device := newTestDevice(t, container, "1234")
+	_, err := container.db.Exec("UPDATE whatsmeow_device SET noise_key=NULL")
+	if err == nil {
+		t.Errorf("Expected NULL noise_key to be rejected")
+	}
+	loaded, err := container.GetDevice(*device.ID)
+	if err != nil {
+		t.Fatalf("Failed to load device: %v", err)
+	} else if loaded == nil || !bytes.Equal(loaded.NoiseKey.Priv[:], device.NoiseKey.Priv[:]) {
+		t.Errorf("Device keys weren't preserved")
+	}
+}
+
+func TestUpgrade_MessageSecretTimestamps(t *testing.T) {
+	container := newTestContainer(t)
+	device := newTestDevice(t, container, "1")
+	ourJID := device.ID.String()
+	const uploadTime, messageTime = 1700000000, 1600000000
+	for _, id := range []string{"SYNCED", "UNSYNCED"} {
+		_, err := container.db.Exec(
+			"INSERT INTO whatsmeow_message_secrets (our_jid, chat_jid, sender_jid, message_id, key, timestamp) VALUES ($1, $2, $2, $3, $4, $5)",
+			ourJID, "2@s.whatsapp.net", id, []byte("secret"), uploadTime,
+		)
+		if err != nil {
+			t.Fatalf("Failed to insert message secret: %v", err)
+		}
+	}
+	_, err := container.db.Exec(
+		"INSERT INTO history_messages (our_jid, chat_id, message_id, message_timestamp, message_data, message_status, status_timestamp) VALUES ($1, $2, $3, $4, '{}', 0, 0)",
+		ourJID, "2@s.whatsapp.net", "SYNCED", messageTime,
+	)
+	if err != nil {
+		t.Fatalf("Failed to insert history message: %v", err)
+	}
+
+	tx, err := container.db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to start transaction: %v", err)
+	}
+	if err = setMessageSecretTimestamps(tx); err != nil {
+		_ = tx.Rollback()
+		t.Fatalf("Failed to set message secret timestamps: %v", err)
+	} else if err = tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	for id, expected := range map[string]int64{"SYNCED": messageTime, "UNSYNCED": uploadTime} {
+		var ts int64
+		err = container.db.QueryRow("SELECT timestamp FROM whatsmeow_message_secrets WHERE message_id=$1", id).Scan(&ts)
+		if err != nil {
+			t.Fatalf("Failed to get timestamp of %s: %v", id, err)
+		} else if ts != expected {
+			t.Errorf("Expected timestamp of %s to be %d, got %d", id, expected, ts)
+		}
+	}
+}
@@ -5,11 +5,15 @@
 // file, You can obtain one at http://mozilla.org/MPL/2.0/.
 
 // Package store contains interfaces for storing data needed for WhatsApp multidevice.
+//
+// Every store method has a variant with a Context suffix that takes a context.Context as the first parameter.
+// Implementations pass the context to the underlying storage, so cancelling it aborts slow database work,
+// and the methods without the suffix are equivalent to calling the Context variants with context.Background().
 package store
 
 import (
+	"context"
 	"fmt"
-	"go.mau.fi/whatsmeow/webtest/properties"
 	"time"
 
 	waProto "go.mau.fi/whatsmeow/binary/proto"
@@ -23,6 +27,11 @@ type IdentityStore interface {
 	DeleteAllIdentities(phone string) error
 	DeleteIdentity(address string) error
 	IsTrustedIdentity(address string, key [32]byte) (bool, error)
+
+	PutIdentityContext(ctx context.Context, address string, key [32]byte) error
+	DeleteAllIdentitiesContext(ctx context.Context, phone string) error
+	DeleteIdentityContext(ctx context.Context, address string) error
+	IsTrustedIdentityContext(ctx context.Context, address string, key [32]byte) (bool, error)
 }
 
 type SessionStore interface {
@@ -31,6 +40,12 @@ type SessionStore interface {
 	PutSession(address string, session []byte) error
 	DeleteAllSessions(phone string) error
 	DeleteSession(address string) error
+
+	GetSessionContext(ctx context.Context, address string) ([]byte, error)
+	HasSessionContext(ctx context.Context, address string) (bool, error)
+	PutSessionContext(ctx context.Context, address string, session []byte) error
+	DeleteAllSessionsContext(ctx context.Context, phone string) error
+	DeleteSessionContext(ctx context.Context, address string) error
 }
 
 type PreKeyStore interface {
@@ -40,11 +55,21 @@ type PreKeyStore interface {
 	RemovePreKey(id uint32) error
 	MarkPreKeysAsUploaded(upToID uint32) error
 	UploadedPreKeyCount() (int, error)
+
+	GetOrGenPreKeysContext(ctx context.Context, count uint32) ([]*keys.PreKey, error)
+	GenOnePreKeyContext(ctx context.Context) (*keys.PreKey, error)
+	GetPreKeyContext(ctx context.Context, id uint32) (*keys.PreKey, error)
+	RemovePreKeyContext(ctx context.Context, id uint32) error
+	MarkPreKeysAsUploadedContext(ctx context.Context, upToID uint32) error
+	UploadedPreKeyCountContext(ctx context.Context) (int, error)
 }
 
 type SenderKeyStore interface {
 	PutSenderKey(group, user string, session []byte) error
 	GetSenderKey(group, user string) ([]byte, error)
+
+	PutSenderKeyContext(ctx context.Context, group, user string, session []byte) error
+	GetSenderKeyContext(ctx context.Context, group, user string) ([]byte, error)
 }
 
 type AppStateSyncKey struct {
@@ -57,6 +82,10 @@ type AppStateSyncKeyStore interface {
 	PutAppStateSyncKey(id []byte, key AppStateSyncKey) error
 	GetAppStateSyncKey(id []byte) (*AppStateSyncKey, error)
 	GetLatestAppStateSyncKeyID() ([]byte, error)
+
+	PutAppStateSyncKeyContext(ctx context.Context, id []byte, key AppStateSyncKey) error
+	GetAppStateSyncKeyContext(ctx context.Context, id []byte) (*AppStateSyncKey, error)
+	GetLatestAppStateSyncKeyIDContext(ctx context.Context) ([]byte, error)
 }
 
 type AppStateMutationMAC struct {
@@ -72,6 +101,13 @@ type AppStateStore interface {
 	PutAppStateMutationMACs(name string, version uint64, mutations []AppStateMutationMAC) error
 	DeleteAppStateMutationMACs(name string, indexMACs [][]byte) error
 	GetAppStateMutationMAC(name string, indexMAC []byte) (valueMAC []byte, err error)
+
+	PutAppStateVersionContext(ctx context.Context, name string, version uint64, hash [128]byte) error
+	GetAppStateVersionContext(ctx context.Context, name string) (uint64, [128]byte, error)
+	DeleteAppStateVersionContext(ctx context.Context, name string) error
+	PutAppStateMutationMACsContext(ctx context.Context, name string, version uint64, mutations []AppStateMutationMAC) error
+	DeleteAppStateMutationMACsContext(ctx context.Context, name string, indexMACs [][]byte) error
+	GetAppStateMutationMACContext(ctx context.Context, name string, indexMAC []byte) (valueMAC []byte, err error)
 }
 
 type ContactEntry struct {
@@ -87,6 +123,13 @@ type ContactStore interface {
 	PutAllContactNames(contacts []ContactEntry) error
 	GetContact(user types.JID) (types.ContactInfo, error)
 	GetAllContacts() (map[types.JID]types.ContactInfo, error)
+
+	PutPushNameContext(ctx context.Context, user types.JID, pushName string) (bool, string, error)
+	PutBusinessNameContext(ctx context.Context, user types.JID, businessName string) (bool, string, error)
+	PutContactNameContext(ctx context.Context, user types.JID, fullName, firstName string) error
+	PutAllContactNamesContext(ctx context.Context, contacts []ContactEntry) error
+	GetContactContext(ctx context.Context, user types.JID) (types.ContactInfo, error)
+	GetAllContactsContext(ctx context.Context) (map[types.JID]types.ContactInfo, error)
 }
 
 type ChatSettingsStore interface {
@@ -94,17 +137,152 @@ type ChatSettingsStore interface {
 	PutPinned(chat types.JID, pinned bool) error
 	PutArchived(chat types.JID, archived bool) error
 	GetChatSettings(chat types.JID) (types.LocalChatSettings, error)
+
+	PutMutedUntilContext(ctx context.Context, chat types.JID, mutedUntil time.Time) error
+	PutPinnedContext(ctx context.Context, chat types.JID, pinned bool) error
+	PutArchivedContext(ctx context.Context, chat types.JID, archived bool) error
+	GetChatSettingsContext(ctx context.Context, chat types.JID) (types.LocalChatSettings, error)
+}
+
+// ChatMessage is the last message of a chat in the chat list.
+type ChatMessage struct {
+	ID        types.MessageID
+	Timestamp time.Time
+	Preview   string
+	FromMe    bool
+}
+
+// Chat is an entry in the chat list of a device.
+type Chat struct {
+	JID         types.JID
+	Name        string
+	LastMessage ChatMessage
+
+	UnreadCount    int
+	MarkedAsUnread bool
+
+	EphemeralExpiration uint32
+
+	// The mute, pin and archive status of the chat from the ChatSettingsStore.
+	Settings types.LocalChatSettings
+}
+
+// ChatStore stores the chat list of a device. The client keeps it up to date based on
+// incoming and outgoing messages, read receipts, app state and history syncs.
+type ChatStore interface {
+	// PutChatMessage sets the last message of the chat if it's newer than the current one.
+	// If incrementUnread is true, the unread count is incremented as well.
+	PutChatMessage(chat types.JID, message ChatMessage, incrementUnread bool) error
+	// PutChatRead resets the unread count if read is true, or marks the chat as unread if it's false.
+	PutChatRead(chat types.JID, read bool) error
+	PutChatName(chat types.JID, name string) error
+	PutChatEphemeralExpiration(chat types.JID, expiration uint32) error
+	// PutChats stores chats from a history sync. The last message is only replaced if it's newer,
+	// the other fields are overwritten, except the name if it's empty.
+	PutChats(chats []Chat) error
+	// GetChat returns a single chat, or nil if it's not in the chat list.
+	GetChat(chat types.JID) (*Chat, error)
+	// GetAllChats returns all chats, ordered by the newest message first.
+	GetAllChats() ([]Chat, error)
+	DeleteChat(chat types.JID) error
+
+	PutChatMessageContext(ctx context.Context, chat types.JID, message ChatMessage, incrementUnread bool) error
+	PutChatReadContext(ctx context.Context, chat types.JID, read bool) error
+	PutChatNameContext(ctx context.Context, chat types.JID, name string) error
+	PutChatEphemeralExpirationContext(ctx context.Context, chat types.JID, expiration uint32) error
+	PutChatsContext(ctx context.Context, chats []Chat) error
+	GetChatContext(ctx context.Context, chat types.JID) (*Chat, error)
+	GetAllChatsContext(ctx context.Context) ([]Chat, error)
+	DeleteChatContext(ctx context.Context, chat types.JID) error
 }
 
 type DeviceContainer interface {
 	PutDevice(store *Device) error
 	DeleteDevice(store *Device) error
+
+	PutDeviceContext(ctx context.Context, store *Device) error
+	DeleteDeviceContext(ctx context.Context, store *Device) error
+}
+
+// HistoryMessage is a single message stored in the message history of a device.
+type HistoryMessage struct {
+	ChatId           string
+	MessageId        string
+	MessageTimestamp uint64
+	JsonData         string
+	MessageStatus    int32
+	StatusTimestamp  uint64
 }
 
+// IsHistoryStatusUpgrade returns true if a stored message status can be changed from old to new.
+//
+// Statuses only move forward (e.g. a late delivery receipt doesn't override a read receipt), except that
+// failed (types.MessageStatusFailed, 0) can only replace sent (types.MessageStatusSent, 1): once the server
+// has acknowledged the message, it can't fail anymore.
+func IsHistoryStatusUpgrade(old, new int32) bool {
+	if new == int32(types.MessageStatusFailed) {
+		return old == int32(types.MessageStatusSent)
+	}
+	return new > old
+}
+
+// HistoryCursor is a position in the history of a chat used for keyset pagination.
+// The zero value means the newest end of the history.
+type HistoryCursor struct {
+	MessageTimestamp uint64
+	MessageId        string
+}
+
+// IsZero returns true if the cursor points at the newest end of the history.
+func (cursor HistoryCursor) IsZero() bool {
+	return cursor.MessageTimestamp == 0 && cursor.MessageId == ""
+}
+
+// Cursor returns the cursor that can be used to fetch messages older than this message.
+func (msg *HistoryMessage) Cursor() HistoryCursor {
+	return HistoryCursor{MessageTimestamp: msg.MessageTimestamp, MessageId: msg.MessageId}
+}
+
+// HistoryChat is a chat in the message history along with its newest message.
+type HistoryChat struct {
+	ChatId       string
+	MessageCount int
+	LastMessage  HistoryMessage
+}
+
+// HistoryStore stores the message history of a single device.
 type HistoryStore interface {
-	DeviceHistorySync(messages []properties.DataMessage) error
+	// DeviceHistorySync inserts or updates the given messages.
+	// The status of an existing message is only replaced if the new status is higher.
+	DeviceHistorySync(messages []HistoryMessage) error
+	// DeleteDeviceHistory deletes all stored messages of the device.
 	DeleteDeviceHistory() error
-	DeviceUpdateStatusMessage(message properties.DataMessage) error
+	// DeviceUpdateStatusMessage updates the status of a stored message if IsHistoryStatusUpgrade allows it,
+	// so that status updates arriving out of order can't move the status backwards.
+	// If ChatId is empty, the message is only matched by its ID.
+	DeviceUpdateStatusMessage(message HistoryMessage) error
+
+	// GetChatHistory returns up to limit messages in the given chat that are older than the cursor,
+	// newest first. The cursor of the last returned message can be used to fetch the next page.
+	GetChatHistory(chat string, before HistoryCursor, limit int) ([]HistoryMessage, error)
+	// GetMessage returns a single stored message, or nil if it's not found.
+	GetMessage(chat, id string) (*HistoryMessage, error)
+	// ListChats returns all chats that have stored messages, ordered by the newest message first.
+	ListChats() ([]HistoryChat, error)
+	// SearchMessages returns up to limit messages whose text contains all words in the query, newest first.
+	// The search can be limited to a single chat and a time range. An empty chat searches all chats
+	// and zero times don't limit the range. See ExtractSearchText for the parts of messages that are searched.
+	// Whether terms must match whole words, word prefixes or any substring depends on the implementation.
+	SearchMessages(query, chat string, from, to time.Time, limit int) ([]HistoryMessage, error)
+
+	// Variants of the methods above that pass the given context to the underlying storage.
+	DeviceHistorySyncContext(ctx context.Context, messages []HistoryMessage) error
+	DeleteDeviceHistoryContext(ctx context.Context) error
+	DeviceUpdateStatusMessageContext(ctx context.Context, message HistoryMessage) error
+	GetChatHistoryContext(ctx context.Context, chat string, before HistoryCursor, limit int) ([]HistoryMessage, error)
+	GetMessageContext(ctx context.Context, chat, id string) (*HistoryMessage, error)
+	ListChatsContext(ctx context.Context) ([]HistoryChat, error)
+	SearchMessagesContext(ctx context.Context, query, chat string, from, to time.Time, limit int) ([]HistoryMessage, error)
 }
 
 type MessageSecretInsert struct {
@@ -112,12 +290,20 @@ type MessageSecretInsert struct {
 	Sender types.JID
 	ID     types.MessageID
 	Secret []byte
+	// Timestamp is the timestamp of the message the secret belongs to. It's used to prune old secrets.
+	Timestamp time.Time
 }
 
 type MsgSecretStore interface {
-	PutMessageSecrets([]MessageSecretInsert) error
+	PutMessageSecrets(inserts []MessageSecretInsert) error
 	PutMessageSecret(chat, sender types.JID, id types.MessageID, secret []byte) error
 	GetMessageSecret(chat, sender types.JID, id types.MessageID) ([]byte, error)
+
+	PutMessageSecretsContext(ctx context.Context, inserts []MessageSecretInsert) error
+	// PutMessageSecretContext stores the secret of a message. The timestamp is the timestamp of the message,
+	// or zero if it's unknown, in which case the secret is kept as if the message was sent now.
+	PutMessageSecretContext(ctx context.Context, chat, sender types.JID, id types.MessageID, secret []byte, timestamp time.Time) error
+	GetMessageSecretContext(ctx context.Context, chat, sender types.JID, id types.MessageID) ([]byte, error)
 }
 
 type PrivacyToken struct {
@@ -129,6 +315,24 @@ type PrivacyToken struct {
 type PrivacyTokenStore interface {
 	PutPrivacyTokens(tokens ...PrivacyToken) error
 	GetPrivacyToken(user types.JID) (*PrivacyToken, error)
+
+	PutPrivacyTokensContext(ctx context.Context, tokens ...PrivacyToken) error
+	GetPrivacyTokenContext(ctx context.Context, user types.JID) (*PrivacyToken, error)
+}
+
+// RecentMessageStore stores the plaintext of recently sent messages, so that retry receipts can be
+// handled after the in-memory cache has forgotten the message (e.g. after a restart).
+type RecentMessageStore interface {
+	// PutRecentMessage stores the given marshaled message until the expiry time.
+	PutRecentMessage(to types.JID, id types.MessageID, message []byte, expiry time.Time) error
+	// GetRecentMessage returns the marshaled message, or nil if it's not found or has expired.
+	GetRecentMessage(to types.JID, id types.MessageID) ([]byte, error)
+	// DeleteExpiredRecentMessages deletes all messages whose expiry time is before now.
+	DeleteExpiredRecentMessages(now time.Time) error
+
+	PutRecentMessageContext(ctx context.Context, to types.JID, id types.MessageID, message []byte, expiry time.Time) error
+	GetRecentMessageContext(ctx context.Context, to types.JID, id types.MessageID) ([]byte, error)
+	DeleteExpiredRecentMessagesContext(ctx context.Context, now time.Time) error
 }
 
 type Device struct {
@@ -146,19 +350,21 @@ type Device struct {
 	BusinessName string
 	PushName     string
 
-	Initialized   bool
-	Identities    IdentityStore
-	Sessions      SessionStore
-	PreKeys       PreKeyStore
-	SenderKeys    SenderKeyStore
-	AppStateKeys  AppStateSyncKeyStore
-	AppState      AppStateStore
-	Contacts      ContactStore
-	ChatSettings  ChatSettingsStore
-	MsgSecrets    MsgSecretStore
-	PrivacyTokens PrivacyTokenStore
-	Container     DeviceContainer
-	History       HistoryStore
+	Initialized    bool
+	Identities     IdentityStore
+	Sessions       SessionStore
+	PreKeys        PreKeyStore
+	SenderKeys     SenderKeyStore
+	AppStateKeys   AppStateSyncKeyStore
+	AppState       AppStateStore
+	Contacts       ContactStore
+	ChatSettings   ChatSettingsStore
+	Chats          ChatStore
+	MsgSecrets     MsgSecretStore
+	PrivacyTokens  PrivacyTokenStore
+	RecentMessages RecentMessageStore
+	Container      DeviceContainer
+	History        HistoryStore
 
 	DatabaseErrorHandler func(device *Device, action string, attemptIndex int, err error) (retry bool)
 }
@@ -172,16 +378,24 @@ func (device *Device) handleDatabaseError(attemptIndex int, err error, action st
 }
 
 func (device *Device) Save() error {
-	return device.Container.PutDevice(device)
+	return device.SaveContext(context.Background())
+}
+
+func (device *Device) SaveContext(ctx context.Context) error {
+	return device.Container.PutDeviceContext(ctx, device)
 }
 
 func (device *Device) Delete() error {
-	err := device.Container.DeleteDevice(device)
+	return device.DeleteContext(context.Background())
+}
+
+func (device *Device) DeleteContext(ctx context.Context) error {
+	err := device.Container.DeleteDeviceContext(ctx, device)
 	if err != nil {
 		return err
 	}
 	device.ID = nil
-	err = device.History.DeleteDeviceHistory()
+	err = device.History.DeleteDeviceHistoryContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -189,7 +403,7 @@ func (device *Device) Delete() error {
 }
 
 // HistorySync метод сохраняет историю
-func (device *Device) HistorySync(messages []properties.DataMessage) error {
+func (device *Device) HistorySync(messages []HistoryMessage) error {
 
 	// сохраняем историю
 	err := device.History.DeviceHistorySync(messages)
@@ -199,7 +413,7 @@ func (device *Device) HistorySync(messages []properties.DataMessage) error {
 }
 
 // UpdateStatusMessage метод обновляет статус сообщения
-func (device *Device) UpdateStatusMessage(message properties.DataMessage) error {
+func (device *Device) UpdateStatusMessage(message HistoryMessage) error {
 
 	// сохраняем историю
 	err := device.History.DeviceUpdateStatusMessage(message)
@@ -0,0 +1,891 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package storetest contains conformance tests for store implementations.
+//
+// The tests describe the semantics of sqlstore, so other implementations (like memstore) can be checked against them:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.RunDeviceStoreTests(t, func(t *testing.T) *store.Device {
+//			// Return a new saved device with empty stores
+//		})
+//	}
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// NewDeviceFunc returns a new saved device with empty stores. It's called at least once per test.
+type NewDeviceFunc func(t *testing.T) *store.Device
+
+// RunDeviceStoreTests runs all conformance tests as subtests of t.
+func RunDeviceStoreTests(t *testing.T, newDevice NewDeviceFunc) {
+	t.Run("Sessions", func(t *testing.T) { testSessions(t, newDevice) })
+	t.Run("Identities", func(t *testing.T) { testIdentities(t, newDevice) })
+	t.Run("PreKeys", func(t *testing.T) { testPreKeys(t, newDevice) })
+	t.Run("SenderKeys", func(t *testing.T) { testSenderKeys(t, newDevice) })
+	t.Run("AppStateSyncKeys", func(t *testing.T) { testAppStateSyncKeys(t, newDevice) })
+	t.Run("AppState", func(t *testing.T) { testAppState(t, newDevice) })
+	t.Run("Contacts", func(t *testing.T) { testContacts(t, newDevice) })
+	t.Run("ChatSettings", func(t *testing.T) { testChatSettings(t, newDevice) })
+	t.Run("UnitOfWork", func(t *testing.T) { testUnitOfWork(t, newDevice) })
+	t.Run("HistoryStatus", func(t *testing.T) { testHistoryStatus(t, newDevice) })
+	t.Run("HistoryPagination", func(t *testing.T) { testHistoryPagination(t, newDevice) })
+	t.Run("HistorySearch", func(t *testing.T) { testHistorySearch(t, newDevice) })
+	t.Run("Chats", func(t *testing.T) { testChats(t, newDevice) })
+	t.Run("MsgSecrets", func(t *testing.T) { testMsgSecrets(t, newDevice) })
+	t.Run("PrivacyTokens", func(t *testing.T) { testPrivacyTokens(t, newDevice) })
+	t.Run("RecentMessages", func(t *testing.T) { testRecentMessages(t, newDevice) })
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func testSessions(t *testing.T, newDevice NewDeviceFunc) {
+	device := newDevice(t)
+	sessions := device.Sessions
+
+	session, err := sessions.GetSession("1234:1")
+	must(t, err)
+	if session != nil {
+		t.Errorf("Expected nil for unknown session, got %X", session)
+	}
+	has, err := sessions.HasSession("1234:1")
+	must(t, err)
+	if has {
+		t.Errorf("Expected HasSession to be false for unknown session")
+	}
+
+	must(t, sessions.PutSession("1234:1", []byte("session 1")))
+	must(t, sessions.PutSession("1234:2", []byte("session 2")))
+	must(t, sessions.PutSession("12345:1", []byte("other user")))
+	must(t, sessions.PutSession("1234:1", []byte("session 1 updated")))
+	session, err = sessions.GetSession("1234:1")
+	must(t, err)
+	if !bytes.Equal(session, []byte("session 1 updated")) {
+		t.Errorf("Expected updated session, got %q", session)
+	}
+	has, err = sessions.HasSession("1234:1")
+	must(t, err)
+	if !has {
+		t.Errorf("Expected HasSession to be true after PutSession")
+	}
+
+	// Sessions are per device
+	otherSession, err := newDevice(t).Sessions.GetSession("1234:1")
+	must(t, err)
+	if otherSession != nil {
+		t.Errorf("Session of one device is visible to another device")
+	}
+
+	must(t, sessions.DeleteSession("1234:2"))
+	has, err = sessions.HasSession("1234:2")
+	must(t, err)
+	if has {
+		t.Errorf("Expected session to be deleted by DeleteSession")
+	}
+
+	// DeleteAllSessions only deletes the devices of the given user, not users with the same prefix
+	must(t, sessions.PutSession("1234:2", []byte("session 2")))
+	must(t, sessions.DeleteAllSessions("1234"))
+	for address, expected := range map[string]bool{"1234:1": false, "1234:2": false, "12345:1": true} {
+		has, err = sessions.HasSession(address)
+		must(t, err)
+		if has != expected {
+			t.Errorf("Expected HasSession(%s) to be %t after DeleteAllSessions, got %t", address, expected, has)
+		}
+	}
+}
+
+func testIdentities(t *testing.T, newDevice NewDeviceFunc) {
+	device := newDevice(t)
+	identities := device.Identities
+	key1 := [32]byte{1}
+	key2 := [32]byte{2}
+
+	trusted, err := identities.IsTrustedIdentity("1234:1", key1)
+	must(t, err)
+	if !trusted {
+		t.Errorf("Expected unknown identity to be trusted")
+	}
+
+	must(t, identities.PutIdentity("1234:1", key1))
+	must(t, identities.PutIdentity("1234:2", key1))
+	must(t, identities.PutIdentity("12345:1", key1))
+	trusted, err = identities.IsTrustedIdentity("1234:1", key1)
+	must(t, err)
+	if !trusted {
+		t.Errorf("Expected stored identity to be trusted")
+	}
+	trusted, err = identities.IsTrustedIdentity("1234:1", key2)
+	must(t, err)
+	if trusted {
+		t.Errorf("Expected different identity key to be untrusted")
+	}
+
+	// Identities are per device
+	trusted, err = newDevice(t).Identities.IsTrustedIdentity("1234:1", key2)
+	must(t, err)
+	if !trusted {
+		t.Errorf("Identity of one device is visible to another device")
+	}
+
+	must(t, identities.PutIdentity("1234:1", key2))
+	trusted, err = identities.IsTrustedIdentity("1234:1", key2)
+	must(t, err)
+	if !trusted {
+		t.Errorf("Expected PutIdentity to replace the stored identity")
+	}
+
+	must(t, identities.DeleteIdentity("1234:1"))
+	trusted, err = identities.IsTrustedIdentity("1234:1", key1)
+	must(t, err)
+	if !trusted {
+		t.Errorf("Expected identity to be deleted by DeleteIdentity")
+	}
+
+	must(t, identities.DeleteAllIdentities("1234"))
+	for address, expected := range map[string]bool{"1234:2": true, "12345:1": false} {
+		trusted, err = identities.IsTrustedIdentity(address, key2)
+		must(t, err)
+		if trusted != expected {
+			t.Errorf("Expected IsTrustedIdentity(%s) to be %t after DeleteAllIdentities, got %t", address, expected, trusted)
+		}
+	}
+}
+
+func testPreKeys(t *testing.T, newDevice NewDeviceFunc) {
+	device := newDevice(t)
+	preKeys := device.PreKeys
+
+	count, err := preKeys.UploadedPreKeyCount()
+	must(t, err)
+	if count != 0 {
+		t.Errorf("Expected no uploaded prekeys in a new store, got %d", count)
+	}
+	missing, err := preKeys.GetPreKey(1)
+	must(t, err)
+	if missing != nil {
+		t.Errorf("Expected nil for unknown prekey, got %d", missing.KeyID)
+	}
+
+	generated, err := preKeys.GetOrGenPreKeys(5)
+	must(t, err)
+	if len(generated) != 5 {
+		t.Fatalf("Expected 5 prekeys, got %d", len(generated))
+	}
+	for i, key := range generated {
+		if key.KeyID != uint32(i+1) {
+			t.Errorf("Expected prekey #%d to have ID %d, got %d", i, i+1, key.KeyID)
+		}
+	}
+
+	// Unuploaded keys are returned again, and missing ones are generated after the highest ID
+	again, err := preKeys.GetOrGenPreKeys(7)
+	must(t, err)
+	if len(again) != 7 {
+		t.Fatalf("Expected 7 prekeys, got %d", len(again))
+	}
+	for i, key := range again {
+		if key.KeyID != uint32(i+1) {
+			t.Errorf("Expected prekey #%d to have ID %d, got %d", i, i+1, key.KeyID)
+		} else if i < len(generated) && *key.Priv != *generated[i].Priv {
+			t.Errorf("Expected existing unuploaded prekey %d to be returned as-is", key.KeyID)
+		}
+	}
+
+	loaded, err := preKeys.GetPreKey(3)
+	must(t, err)
+	if loaded == nil || loaded.KeyID != 3 || *loaded.Priv != *generated[2].Priv || *loaded.Pub != *generated[2].Pub {
+		t.Errorf("GetPreKey didn't return the generated prekey")
+	}
+
+	must(t, preKeys.MarkPreKeysAsUploaded(5))
+	count, err = preKeys.UploadedPreKeyCount()
+	must(t, err)
+	if count != 5 {
+		t.Errorf("Expected 5 uploaded prekeys, got %d", count)
+	}
+	remaining, err := preKeys.GetOrGenPreKeys(3)
+	must(t, err)
+	if len(remaining) != 3 || remaining[0].KeyID != 6 || remaining[1].KeyID != 7 || remaining[2].KeyID != 8 {
+		t.Errorf("Expected prekeys 6, 7 and 8 after marking 1-5 as uploaded")
+	}
+
+	single, err := preKeys.GenOnePreKey()
+	must(t, err)
+	if single.KeyID != 9 {
+		t.Errorf("Expected GenOnePreKey to use ID 9, got %d", single.KeyID)
+	}
+	count, err = preKeys.UploadedPreKeyCount()
+	must(t, err)
+	if count != 6 {
+		t.Errorf("Expected GenOnePreKey to mark the key as uploaded (6 uploaded keys), got %d", count)
+	}
+
+	must(t, preKeys.RemovePreKey(3))
+	missing, err = preKeys.GetPreKey(3)
+	must(t, err)
+	if missing != nil {
+		t.Errorf("Expected prekey to be removed by RemovePreKey")
+	}
+	count, err = preKeys.UploadedPreKeyCount()
+	must(t, err)
+	if count != 5 {
+		t.Errorf("Expected 5 uploaded prekeys after removing one, got %d", count)
+	}
+
+	otherKey, err := newDevice(t).PreKeys.GetPreKey(1)
+	must(t, err)
+	if otherKey != nil {
+		t.Errorf("Prekey of one device is visible to another device")
+	}
+}
+
+func testSenderKeys(t *testing.T, newDevice NewDeviceFunc) {
+	device := newDevice(t)
+	senderKeys := device.SenderKeys
+
+	key, err := senderKeys.GetSenderKey("group@g.us", "1234:1")
+	must(t, err)
+	if key != nil {
+		t.Errorf("Expected nil for unknown sender key, got %X", key)
+	}
+	must(t, senderKeys.PutSenderKey("group@g.us", "1234:1", []byte("key 1")))
+	must(t, senderKeys.PutSenderKey("group@g.us", "1234:2", []byte("key 2")))
+	must(t, senderKeys.PutSenderKey("other@g.us", "1234:1", []byte("other group")))
+	must(t, senderKeys.PutSenderKey("group@g.us", "1234:1", []byte("key 1 updated")))
+	for _, test := range []struct{ group, user, expected string }{
+		{"group@g.us", "1234:1", "key 1 updated"},
+		{"group@g.us", "1234:2", "key 2"},
+		{"other@g.us", "1234:1", "other group"},
+	} {
+		key, err = senderKeys.GetSenderKey(test.group, test.user)
+		must(t, err)
+		if string(key) != test.expected {
+			t.Errorf("Expected sender key %q for %s in %s, got %q", test.expected, test.user, test.group, key)
+		}
+	}
+	key, err = newDevice(t).SenderKeys.GetSenderKey("group@g.us", "1234:1")
+	must(t, err)
+	if key != nil {
+		t.Errorf("Sender key of one device is visible to another device")
+	}
+}
+
+func testAppStateSyncKeys(t *testing.T, newDevice NewDeviceFunc) {
+	device := newDevice(t)
+	keyStore := device.AppStateKeys
+
+	latest, err := keyStore.GetLatestAppStateSyncKeyID()
+	must(t, err)
+	if latest != nil {
+		t.Errorf("Expected no latest key in a new store, got %X", latest)
+	}
+	key, err := keyStore.GetAppStateSyncKey([]byte{1})
+	must(t, err)
+	if key != nil {
+		t.Errorf("Expected nil for unknown app state sync key")
+	}
+
+	must(t, keyStore.PutAppStateSyncKey([]byte{1}, store.AppStateSyncKey{Data: []byte("data 1"), Fingerprint: []byte("fp 1"), Timestamp: 100}))
+	must(t, keyStore.PutAppStateSyncKey([]byte{2}, store.AppStateSyncKey{Data: []byte("data 2"), Fingerprint: []byte("fp 2"), Timestamp: 200}))
+	latest, err = keyStore.GetLatestAppStateSyncKeyID()
+	must(t, err)
+	if !bytes.Equal(latest, []byte{2}) {
+		t.Errorf("Expected latest key to be 02, got %X", latest)
+	}
+
+	// Keys are only replaced by keys with a newer timestamp
+	must(t, keyStore.PutAppStateSyncKey([]byte{1}, store.AppStateSyncKey{Data: []byte("older"), Fingerprint: []byte("fp"), Timestamp: 50}))
+	key, err = keyStore.GetAppStateSyncKey([]byte{1})
+	must(t, err)
+	if key == nil || string(key.Data) != "data 1" || string(key.Fingerprint) != "fp 1" || key.Timestamp != 100 {
+		t.Errorf("Expected older key not to replace the stored key, got %+v", key)
+	}
+	must(t, keyStore.PutAppStateSyncKey([]byte{1}, store.AppStateSyncKey{Data: []byte("newer"), Fingerprint: []byte("fp 3"), Timestamp: 300}))
+	key, err = keyStore.GetAppStateSyncKey([]byte{1})
+	must(t, err)
+	if key == nil || string(key.Data) != "newer" || key.Timestamp != 300 {
+		t.Errorf("Expected newer key to replace the stored key, got %+v", key)
+	}
+	latest, err = keyStore.GetLatestAppStateSyncKeyID()
+	must(t, err)
+	if !bytes.Equal(latest, []byte{1}) {
+		t.Errorf("Expected latest key to be 01 after updating it, got %X", latest)
+	}
+}
+
+func testAppState(t *testing.T, newDevice NewDeviceFunc) {
+	device := newDevice(t)
+	appState := device.AppState
+	const name = "regular_high"
+
+	version, hash, err := appState.GetAppStateVersion(name)
+	must(t, err)
+	if version != 0 || hash != [128]byte{} {
+		t.Errorf("Expected version 0 and empty hash for unknown app state, got %d", version)
+	}
+
+	hash = [128]byte{1, 2, 3}
+	must(t, appState.PutAppStateVersion(name, 5, hash))
+	storedVersion, storedHash, err := appState.GetAppStateVersion(name)
+	must(t, err)
+	if storedVersion != 5 || storedHash != hash {
+		t.Errorf("Expected stored version 5 and hash, got %d", storedVersion)
+	}
+
+	indexMAC1 := bytes.Repeat([]byte{1}, 32)
+	indexMAC2 := bytes.Repeat([]byte{2}, 32)
+	must(t, appState.PutAppStateMutationMACs(name, 5, []store.AppStateMutationMAC{
+		{IndexMAC: indexMAC1, ValueMAC: bytes.Repeat([]byte{0x10}, 32)},
+		{IndexMAC: indexMAC2, ValueMAC: bytes.Repeat([]byte{0x20}, 32)},
+	}))
+	must(t, appState.PutAppStateVersion(name, 6, hash))
+	must(t, appState.PutAppStateMutationMACs(name, 6, []store.AppStateMutationMAC{
+		{IndexMAC: indexMAC1, ValueMAC: bytes.Repeat([]byte{0x11}, 32)},
+	}))
+	valueMAC, err := appState.GetAppStateMutationMAC(name, indexMAC1)
+	must(t, err)
+	if !bytes.Equal(valueMAC, bytes.Repeat([]byte{0x11}, 32)) {
+		t.Errorf("Expected value MAC of the newest version, got %X", valueMAC)
+	}
+	valueMAC, err = appState.GetAppStateMutationMAC("critical_block", indexMAC1)
+	must(t, err)
+	if valueMAC != nil {
+		t.Errorf("Expected no value MAC for a different app state name, got %X", valueMAC)
+	}
+
+	must(t, appState.DeleteAppStateMutationMACs(name, [][]byte{indexMAC1}))
+	valueMAC, err = appState.GetAppStateMutationMAC(name, indexMAC1)
+	must(t, err)
+	if valueMAC != nil {
+		t.Errorf("Expected all versions of the value MAC to be deleted, got %X", valueMAC)
+	}
+	valueMAC, err = appState.GetAppStateMutationMAC(name, indexMAC2)
+	must(t, err)
+	if !bytes.Equal(valueMAC, bytes.Repeat([]byte{0x20}, 32)) {
+		t.Errorf("Expected other value MAC to stay, got %X", valueMAC)
+	}
+
+	// Deleting the version resets the app state, including the mutation MACs
+	must(t, appState.DeleteAppStateVersion(name))
+	version, hash, err = appState.GetAppStateVersion(name)
+	must(t, err)
+	if version != 0 || hash != [128]byte{} {
+		t.Errorf("Expected version 0 and empty hash after deleting the version, got %d", version)
+	}
+	valueMAC, err = appState.GetAppStateMutationMAC(name, indexMAC2)
+	must(t, err)
+	if valueMAC != nil {
+		t.Errorf("Expected mutation MACs to be deleted with the version, got %X", valueMAC)
+	}
+}
+
+func testContacts(t *testing.T, newDevice NewDeviceFunc) {
+	device := newDevice(t)
+	contacts := device.Contacts
+	user := types.NewJID("1234", types.DefaultUserServer)
+
+	info, err := contacts.GetContact(user)
+	must(t, err)
+	if info.Found {
+		t.Errorf("Expected unknown contact not to be found")
+	}
+
+	changed, previous, err := contacts.PutPushName(user, "Push")
+	must(t, err)
+	if !changed || previous != "" {
+		t.Errorf("Expected first push name to be a change from an empty name, got %t %q", changed, previous)
+	}
+	changed, _, err = contacts.PutPushName(user, "Push")
+	must(t, err)
+	if changed {
+		t.Errorf("Expected same push name not to be a change")
+	}
+	changed, previous, err = contacts.PutPushName(user, "New push")
+	must(t, err)
+	if !changed || previous != "Push" {
+		t.Errorf("Expected push name change from %q, got %t %q", "Push", changed, previous)
+	}
+	changed, _, err = contacts.PutBusinessName(user, "Business")
+	must(t, err)
+	if !changed {
+		t.Errorf("Expected first business name to be a change")
+	}
+	must(t, contacts.PutContactName(user, "First", "First Last"))
+
+	info, err = contacts.GetContact(user)
+	must(t, err)
+	expected := types.ContactInfo{Found: true, FirstName: "First", FullName: "First Last", PushName: "New push", BusinessName: "Business"}
+	if info != expected {
+		t.Errorf("Unexpected contact info:\nexpected: %+v\ngot:      %+v", expected, info)
+	}
+
+	other := types.NewJID("5678", types.DefaultUserServer)
+	must(t, contacts.PutAllContactNames([]store.ContactEntry{
+		{JID: user, FirstName: "Updated", FullName: "Updated Name"},
+		{JID: other, FirstName: "Other", FullName: "Other Name"},
+	}))
+	all, err := contacts.GetAllContacts()
+	must(t, err)
+	if len(all) != 2 {
+		t.Errorf("Expected 2 contacts, got %d", len(all))
+	}
+	expected.FirstName = "Updated"
+	expected.FullName = "Updated Name"
+	if all[user] != expected {
+		t.Errorf("Unexpected contact info after PutAllContactNames:\nexpected: %+v\ngot:      %+v", expected, all[user])
+	}
+	if all[other].FullName != "Other Name" || !all[other].Found {
+		t.Errorf("Unexpected contact info for new contact: %+v", all[other])
+	}
+}
+
+func testChatSettings(t *testing.T, newDevice NewDeviceFunc) {
+	device := newDevice(t)
+	settingsStore := device.ChatSettings
+	chat := types.NewJID("1234", types.DefaultUserServer)
+
+	settings, err := settingsStore.GetChatSettings(chat)
+	must(t, err)
+	if settings.Found {
+		t.Errorf("Expected unknown chat settings not to be found")
+	}
+
+	mutedUntil := time.Unix(2000000000, 0)
+	must(t, settingsStore.PutMutedUntil(chat, mutedUntil))
+	must(t, settingsStore.PutPinned(chat, true))
+	must(t, settingsStore.PutArchived(chat, true))
+	settings, err = settingsStore.GetChatSettings(chat)
+	must(t, err)
+	if !settings.Found || !settings.MutedUntil.Equal(mutedUntil) || !settings.Pinned || !settings.Archived {
+		t.Errorf("Unexpected chat settings: %+v", settings)
+	}
+
+	must(t, settingsStore.PutMutedUntil(chat, time.Time{}))
+	must(t, settingsStore.PutArchived(chat, false))
+	settings, err = settingsStore.GetChatSettings(chat)
+	must(t, err)
+	if !settings.MutedUntil.IsZero() || !settings.Pinned || settings.Archived {
+		t.Errorf("Unexpected chat settings after unmuting and unarchiving: %+v", settings)
+	}
+}
+
+func testHistoryStatus(t *testing.T, newDevice NewDeviceFunc) {
+	history := newDevice(t).History
+	const chat = "1234@s.whatsapp.net"
+	getStatus := func(id string) int32 {
+		t.Helper()
+		msg, err := history.GetMessage(chat, id)
+		must(t, err)
+		if msg == nil {
+			t.Fatalf("Message %s not found", id)
+		}
+		return msg.MessageStatus
+	}
+	update := func(id string, status types.MessageStatus) {
+		t.Helper()
+		must(t, history.DeviceUpdateStatusMessage(store.HistoryMessage{
+			ChatId: chat, MessageId: id, MessageStatus: int32(status), StatusTimestamp: uint64(time.Now().Unix()),
+		}))
+	}
+	put := func(id string, status types.MessageStatus) {
+		t.Helper()
+		must(t, history.DeviceHistorySync([]store.HistoryMessage{{
+			ChatId: chat, MessageId: id, MessageTimestamp: 1000, JsonData: "{}", MessageStatus: int32(status),
+		}}))
+	}
+
+	put("A", types.MessageStatusSent)
+	update("A", types.MessageStatusRead)
+	update("A", types.MessageStatusDelivered)
+	if status := getStatus("A"); status != int32(types.MessageStatusRead) {
+		t.Errorf("Expected a late delivery receipt not to override read status, got %d", status)
+	}
+	update("A", types.MessageStatusFailed)
+	if status := getStatus("A"); status != int32(types.MessageStatusRead) {
+		t.Errorf("Expected failed not to override read status, got %d", status)
+	}
+	// Inserting the message again keeps the higher status
+	put("A", types.MessageStatusServerAck)
+	if status := getStatus("A"); status != int32(types.MessageStatusRead) {
+		t.Errorf("Expected re-inserting not to lower the status, got %d", status)
+	}
+
+	put("B", types.MessageStatusSent)
+	update("B", types.MessageStatusFailed)
+	if status := getStatus("B"); status != int32(types.MessageStatusFailed) {
+		t.Errorf("Expected failed to replace sent status, got %d", status)
+	}
+	put("B", types.MessageStatusServerAck)
+	if status := getStatus("B"); status != int32(types.MessageStatusServerAck) {
+		t.Errorf("Expected re-inserting with a higher status to update it, got %d", status)
+	}
+}
+
+func historyMessageIDs(messages []store.HistoryMessage) []string {
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.MessageId
+	}
+	return ids
+}
+
+func testHistoryPagination(t *testing.T, newDevice NewDeviceFunc) {
+	history := newDevice(t).History
+	const chat = "1234@s.whatsapp.net"
+	const otherChat = "5678@s.whatsapp.net"
+	// Messages C and D have the same timestamp, so they're ordered by ID
+	must(t, history.DeviceHistorySync([]store.HistoryMessage{
+		{ChatId: chat, MessageId: "A", MessageTimestamp: 100, JsonData: "{}"},
+		{ChatId: chat, MessageId: "B", MessageTimestamp: 200, JsonData: "{}"},
+		{ChatId: chat, MessageId: "C", MessageTimestamp: 300, JsonData: "{}"},
+		{ChatId: chat, MessageId: "D", MessageTimestamp: 300, JsonData: "{}"},
+		{ChatId: chat, MessageId: "E", MessageTimestamp: 400, JsonData: `{"text":"E"}`},
+		{ChatId: otherChat, MessageId: "X", MessageTimestamp: 350, JsonData: "{}"},
+	}))
+
+	var pages [][]string
+	var cursor store.HistoryCursor
+	for {
+		page, err := history.GetChatHistory(chat, cursor, 2)
+		must(t, err)
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, historyMessageIDs(page))
+		cursor = page[len(page)-1].Cursor()
+		if len(pages) > 5 {
+			t.Fatalf("Pagination doesn't end: %v", pages)
+		}
+	}
+	expected := [][]string{{"E", "D"}, {"C", "B"}, {"A"}}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Errorf("Expected pages %v, got %v", expected, pages)
+	}
+
+	msg, err := history.GetMessage(chat, "E")
+	must(t, err)
+	if msg == nil || msg.ChatId != chat || msg.MessageTimestamp != 400 || msg.JsonData != `{"text":"E"}` {
+		t.Errorf("Unexpected message from GetMessage: %+v", msg)
+	}
+	msg, err = history.GetMessage(otherChat, "E")
+	must(t, err)
+	if msg != nil {
+		t.Errorf("Expected message not to be found in another chat, got %+v", msg)
+	}
+
+	chats, err := history.ListChats()
+	must(t, err)
+	if len(chats) != 2 {
+		t.Fatalf("Expected 2 chats, got %+v", chats)
+	}
+	if chats[0].ChatId != chat || chats[0].MessageCount != 5 || chats[0].LastMessage.MessageId != "E" {
+		t.Errorf("Unexpected first chat: %+v", chats[0])
+	}
+	if chats[1].ChatId != otherChat || chats[1].MessageCount != 1 || chats[1].LastMessage.MessageId != "X" {
+		t.Errorf("Unexpected second chat: %+v", chats[1])
+	}
+
+	// History is per device
+	page, err := newDevice(t).History.GetChatHistory(chat, store.HistoryCursor{}, 10)
+	must(t, err)
+	if len(page) != 0 {
+		t.Errorf("History of one device is visible to another device")
+	}
+
+	must(t, history.DeleteDeviceHistory())
+	chats, err = history.ListChats()
+	must(t, err)
+	if len(chats) != 0 {
+		t.Errorf("Expected no chats after DeleteDeviceHistory, got %+v", chats)
+	}
+}
+
+func testHistorySearch(t *testing.T, newDevice NewDeviceFunc) {
+	history := newDevice(t).History
+	const chat = "1234@s.whatsapp.net"
+	const otherChat = "5678@s.whatsapp.net"
+	put := func(chat, id string, timestamp uint64, text string) store.HistoryMessage {
+		return store.HistoryMessage{
+			ChatId: chat, MessageId: id, MessageTimestamp: timestamp,
+			JsonData: fmt.Sprintf(`{"Message":{"conversation":%q}}`, text),
+		}
+	}
+	must(t, history.DeviceHistorySync([]store.HistoryMessage{
+		put(chat, "A", 100, "Hello world"),
+		put(chat, "B", 200, "hello there"),
+		put(chat, "C", 300, "Goodbye world"),
+		put(otherChat, "D", 400, "HELLO from another chat"),
+	}))
+	search := func(query, chat string, from, to time.Time, limit int) []string {
+		t.Helper()
+		messages, err := history.SearchMessages(query, chat, from, to, limit)
+		must(t, err)
+		return historyMessageIDs(messages)
+	}
+
+	for _, test := range []struct {
+		name     string
+		query    string
+		chat     string
+		from, to time.Time
+		limit    int
+		expected []string
+	}{
+		{"case-insensitive", "hello", "", time.Time{}, time.Time{}, 10, []string{"D", "B", "A"}},
+		{"all terms", "hello world", "", time.Time{}, time.Time{}, 10, []string{"A"}},
+		{"chat", "hello", chat, time.Time{}, time.Time{}, 10, []string{"B", "A"}},
+		{"time range", "hello", "", time.Unix(150, 0), time.Unix(400, 0), 10, []string{"D", "B"}},
+		{"limit", "hello", "", time.Time{}, time.Time{}, 2, []string{"D", "B"}},
+		{"no match", "missing", "", time.Time{}, time.Time{}, 10, []string{}},
+		{"empty query", "  ", "", time.Time{}, time.Time{}, 10, []string{}},
+	} {
+		if ids := search(test.query, test.chat, test.from, test.to, test.limit); !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("Expected search with %s to return %v, got %v", test.name, test.expected, ids)
+		}
+	}
+
+	messages, err := newDevice(t).History.SearchMessages("hello", "", time.Time{}, time.Time{}, 10)
+	must(t, err)
+	if len(messages) != 0 {
+		t.Errorf("Search found messages of another device")
+	}
+}
+
+func testChats(t *testing.T, newDevice NewDeviceFunc) {
+	device := newDevice(t)
+	chats := device.Chats
+	chat := types.NewJID("1234", types.DefaultUserServer)
+	group := types.NewJID("123456789", types.GroupServer)
+
+	stored, err := chats.GetChat(chat)
+	must(t, err)
+	if stored != nil {
+		t.Errorf("Expected nil for unknown chat, got %+v", stored)
+	}
+
+	msg1 := store.ChatMessage{ID: "MSG1", Timestamp: time.Unix(1000, 0), Preview: "first"}
+	msg2 := store.ChatMessage{ID: "MSG2", Timestamp: time.Unix(2000, 0), Preview: "second", FromMe: true}
+	must(t, chats.PutChatMessage(chat, msg2, true))
+	// Older messages increment the unread count, but don't replace the last message
+	must(t, chats.PutChatMessage(chat, msg1, true))
+	must(t, chats.PutChatName(chat, "Name"))
+	must(t, chats.PutChatEphemeralExpiration(chat, 86400))
+	stored, err = chats.GetChat(chat)
+	must(t, err)
+	expected := store.Chat{JID: chat, Name: "Name", LastMessage: msg2, UnreadCount: 2, EphemeralExpiration: 86400}
+	if stored == nil || !reflect.DeepEqual(*stored, expected) {
+		t.Errorf("Unexpected chat:\nexpected: %+v\ngot:      %+v", expected, stored)
+	}
+
+	must(t, chats.PutChatRead(chat, false))
+	stored, err = chats.GetChat(chat)
+	must(t, err)
+	if stored == nil || !stored.MarkedAsUnread || stored.UnreadCount != 2 {
+		t.Errorf("Expected marking as unread to keep the unread count, got %+v", stored)
+	}
+	must(t, chats.PutChatRead(chat, true))
+	stored, err = chats.GetChat(chat)
+	must(t, err)
+	if stored == nil || stored.MarkedAsUnread || stored.UnreadCount != 0 {
+		t.Errorf("Expected reading to reset the unread count, got %+v", stored)
+	}
+
+	// History syncs overwrite everything except an empty name and an older last message
+	must(t, chats.PutChats([]store.Chat{
+		{JID: chat, LastMessage: msg1, UnreadCount: 5, MarkedAsUnread: true},
+		{JID: group, Name: "Group", LastMessage: store.ChatMessage{ID: "MSG3", Timestamp: time.Unix(3000, 0), Preview: "third"}},
+	}))
+	stored, err = chats.GetChat(chat)
+	must(t, err)
+	expected = store.Chat{JID: chat, Name: "Name", LastMessage: msg2, UnreadCount: 5, MarkedAsUnread: true}
+	if stored == nil || !reflect.DeepEqual(*stored, expected) {
+		t.Errorf("Unexpected chat after history sync:\nexpected: %+v\ngot:      %+v", expected, stored)
+	}
+
+	// Chats include their settings
+	mutedUntil := time.Unix(2000000000, 0)
+	must(t, device.ChatSettings.PutMutedUntil(group, mutedUntil))
+	must(t, device.ChatSettings.PutPinned(group, true))
+	all, err := chats.GetAllChats()
+	must(t, err)
+	if len(all) != 2 || all[0].JID != group || all[1].JID != chat {
+		t.Fatalf("Expected chats to be ordered by the newest message, got %+v", all)
+	}
+	if !all[0].Settings.Found || !all[0].Settings.MutedUntil.Equal(mutedUntil) || !all[0].Settings.Pinned || all[0].Settings.Archived {
+		t.Errorf("Unexpected chat settings: %+v", all[0].Settings)
+	}
+	if all[1].Settings.Found {
+		t.Errorf("Expected chat without settings not to have settings, got %+v", all[1].Settings)
+	}
+
+	otherChats, err := newDevice(t).Chats.GetAllChats()
+	must(t, err)
+	if len(otherChats) != 0 {
+		t.Errorf("Chats of one device are visible to another device")
+	}
+
+	must(t, chats.DeleteChat(chat))
+	stored, err = chats.GetChat(chat)
+	must(t, err)
+	if stored != nil {
+		t.Errorf("Expected chat to be deleted by DeleteChat, got %+v", stored)
+	}
+	all, err = chats.GetAllChats()
+	must(t, err)
+	if len(all) != 1 {
+		t.Errorf("Expected DeleteChat to only delete one chat, got %+v", all)
+	}
+}
+
+func testMsgSecrets(t *testing.T, newDevice NewDeviceFunc) {
+	device := newDevice(t)
+	secrets := device.MsgSecrets
+	chat := types.NewJID("123456789", types.GroupServer)
+	sender := types.NewJID("1234", types.DefaultUserServer)
+
+	secret, err := secrets.GetMessageSecret(chat, sender, "MSG1")
+	must(t, err)
+	if secret != nil {
+		t.Errorf("Expected nil for unknown message secret, got %X", secret)
+	}
+
+	must(t, secrets.PutMessageSecret(chat, sender, "MSG1", []byte("secret 1")))
+	must(t, secrets.PutMessageSecretContext(context.Background(), chat, sender, "MSG2", []byte("secret 2"), time.Unix(1000, 0)))
+	must(t, secrets.PutMessageSecrets([]store.MessageSecretInsert{
+		{Chat: chat, Sender: sender, ID: "MSG3", Secret: []byte("secret 3")},
+		// Existing secrets aren't replaced
+		{Chat: chat, Sender: sender, ID: "MSG1", Secret: []byte("replaced")},
+	}))
+	for id, expected := range map[types.MessageID]string{"MSG1": "secret 1", "MSG2": "secret 2", "MSG3": "secret 3"} {
+		secret, err = secrets.GetMessageSecret(chat, sender, id)
+		must(t, err)
+		if string(secret) != expected {
+			t.Errorf("Expected secret %q for %s, got %q", expected, id, secret)
+		}
+	}
+
+	// The device part of the sender is ignored
+	secret, err = secrets.GetMessageSecret(chat, types.NewADJID("1234", 0, 5), "MSG1")
+	must(t, err)
+	if string(secret) != "secret 1" {
+		t.Errorf("Expected secret to be found with the device JID of the sender, got %q", secret)
+	}
+	secret, err = secrets.GetMessageSecret(chat, types.NewJID("5678", types.DefaultUserServer), "MSG1")
+	must(t, err)
+	if secret != nil {
+		t.Errorf("Expected secret not to be found with another sender, got %q", secret)
+	}
+
+	secret, err = newDevice(t).MsgSecrets.GetMessageSecret(chat, sender, "MSG1")
+	must(t, err)
+	if secret != nil {
+		t.Errorf("Message secret of one device is visible to another device")
+	}
+}
+
+func testPrivacyTokens(t *testing.T, newDevice NewDeviceFunc) {
+	device := newDevice(t)
+	tokens := device.PrivacyTokens
+	user := types.NewJID("1234", types.DefaultUserServer)
+	other := types.NewJID("5678", types.DefaultUserServer)
+
+	token, err := tokens.GetPrivacyToken(user)
+	must(t, err)
+	if token != nil {
+		t.Errorf("Expected nil for unknown privacy token, got %+v", token)
+	}
+
+	must(t, tokens.PutPrivacyTokens(
+		store.PrivacyToken{User: user, Token: []byte("token 1"), Timestamp: time.Unix(1000, 0)},
+		store.PrivacyToken{User: other, Token: []byte("token 2"), Timestamp: time.Unix(2000, 0)},
+	))
+	// Tokens are replaced by newer ones, and the device part of the user is ignored
+	must(t, tokens.PutPrivacyTokens(store.PrivacyToken{User: types.NewADJID("1234", 0, 5), Token: []byte("updated"), Timestamp: time.Unix(3000, 0)}))
+	for jid, expected := range map[types.JID]store.PrivacyToken{
+		user:                         {User: user, Token: []byte("updated"), Timestamp: time.Unix(3000, 0)},
+		types.NewADJID("5678", 0, 2): {User: other, Token: []byte("token 2"), Timestamp: time.Unix(2000, 0)},
+	} {
+		token, err = tokens.GetPrivacyToken(jid)
+		must(t, err)
+		if token == nil || token.User != expected.User || !bytes.Equal(token.Token, expected.Token) || !token.Timestamp.Equal(expected.Timestamp) {
+			t.Errorf("Unexpected privacy token for %s:\nexpected: %+v\ngot:      %+v", jid, expected, token)
+		}
+	}
+
+	token, err = newDevice(t).PrivacyTokens.GetPrivacyToken(user)
+	must(t, err)
+	if token != nil {
+		t.Errorf("Privacy token of one device is visible to another device")
+	}
+}
+
+func testRecentMessages(t *testing.T, newDevice NewDeviceFunc) {
+	device := newDevice(t)
+	recent := device.RecentMessages
+	to := types.NewJID("1234", types.DefaultUserServer)
+	group := types.NewJID("123456789", types.GroupServer)
+	now := time.Now()
+
+	msg, err := recent.GetRecentMessage(to, "MSG1")
+	must(t, err)
+	if msg != nil {
+		t.Errorf("Expected nil for unknown recent message, got %X", msg)
+	}
+
+	must(t, recent.PutRecentMessage(to, "MSG1", []byte("message 1"), now.Add(time.Hour)))
+	must(t, recent.PutRecentMessage(group, "MSG1", []byte("group message"), now.Add(time.Hour)))
+	must(t, recent.PutRecentMessage(to, "EXPIRED", []byte("expired"), now.Add(-time.Hour)))
+	must(t, recent.PutRecentMessage(to, "MSG2", []byte("message 2"), now.Add(-time.Hour)))
+	// Storing a message again replaces it and its expiry time
+	must(t, recent.PutRecentMessage(to, "MSG2", []byte("message 2 updated"), now.Add(time.Hour)))
+	for _, test := range []struct {
+		to       types.JID
+		id       types.MessageID
+		expected []byte
+	}{
+		{to, "MSG1", []byte("message 1")},
+		{group, "MSG1", []byte("group message")},
+		{to, "MSG2", []byte("message 2 updated")},
+		// Expired messages aren't returned even if they haven't been deleted yet
+		{to, "EXPIRED", nil},
+	} {
+		msg, err = recent.GetRecentMessage(test.to, test.id)
+		must(t, err)
+		if !bytes.Equal(msg, test.expected) || (msg == nil) != (test.expected == nil) {
+			t.Errorf("Expected recent message %s to %s to be %q, got %q", test.id, test.to, test.expected, msg)
+		}
+	}
+
+	must(t, recent.DeleteExpiredRecentMessages(now.Add(2*time.Hour)))
+	msg, err = recent.GetRecentMessage(to, "MSG1")
+	must(t, err)
+	if msg != nil {
+		t.Errorf("Expected recent message to be deleted after it expired, got %q", msg)
+	}
+
+	must(t, recent.PutRecentMessage(to, "MSG3", []byte("message 3"), now.Add(time.Hour)))
+	msg, err = newDevice(t).RecentMessages.GetRecentMessage(to, "MSG3")
+	must(t, err)
+	if msg != nil {
+		t.Errorf("Recent message of one device is visible to another device")
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"go.mau.fi/libsignal/ecc"
+	"go.mau.fi/libsignal/keys/identity"
+	"go.mau.fi/libsignal/keys/prekey"
+	"go.mau.fi/libsignal/protocol"
+	"go.mau.fi/libsignal/session"
+	"go.mau.fi/libsignal/util/optional"
+
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/util/keys"
+)
+
+// newTestBundle creates a prekey bundle for a fake remote device.
+func newTestBundle() (*prekey.Bundle, *identity.Key) {
+	identityKeyPair := keys.NewKeyPair()
+	signedPreKey := identityKeyPair.CreateSignedPreKey(1)
+	preKey := keys.NewPreKey(1)
+	identityKey := identity.NewKey(ecc.NewDjbECPublicKey(*identityKeyPair.Pub))
+	return prekey.NewBundle(1, 1,
+		optional.NewOptionalUint32(preKey.KeyID), signedPreKey.KeyID,
+		ecc.NewDjbECPublicKey(*preKey.Pub), ecc.NewDjbECPublicKey(*signedPreKey.Pub), *signedPreKey.Signature,
+		identityKey), identityKey
+}
+
+// sessionStoreWithoutBatch hides the UnitOfWorkStore implementation of a session store,
+// so that UnitOfWork.Commit has to fall back to storing changes one by one.
+type sessionStoreWithoutBatch struct {
+	store.SessionStore
+}
+
+func testUnitOfWork(t *testing.T, newDevice NewDeviceFunc) {
+	t.Run("Batch", func(t *testing.T) {
+		device := newDevice(t)
+		if _, ok := device.Sessions.(store.UnitOfWorkStore); !ok {
+			t.Skip("Session store doesn't implement UnitOfWorkStore")
+		}
+		testUnitOfWorkWithDevice(t, device)
+	})
+	t.Run("Fallback", func(t *testing.T) {
+		device := newDevice(t)
+		device.Sessions = sessionStoreWithoutBatch{device.Sessions}
+		testUnitOfWorkWithDevice(t, device)
+	})
+}
+
+func testUnitOfWorkWithDevice(t *testing.T, device *store.Device) {
+	ctx := context.Background()
+	bundle, theirIdentity := newTestBundle()
+	address := protocol.NewSignalAddress("1234", 1)
+	addr := address.String()
+
+	uow := device.NewUnitOfWork(ctx)
+	builder := session.NewBuilderFromSignal(uow, address, store.SignalProtobufSerializer)
+	must(t, builder.ProcessBundle(bundle))
+	_, err := session.NewCipher(builder, address).Encrypt([]byte("hello"))
+	must(t, err)
+	if !uow.ContainsSession(address) {
+		t.Errorf("Expected buffered session to be visible in the unit of work")
+	}
+	has, err := device.Sessions.HasSession(addr)
+	must(t, err)
+	if has {
+		t.Errorf("Expected session not to be stored before Commit")
+	}
+	must(t, uow.Commit())
+	stored, err := device.Sessions.GetSession(addr)
+	must(t, err)
+	if stored == nil {
+		t.Fatalf("Expected session to be stored after Commit")
+	} else if !bytes.Equal(stored, uow.LoadSession(address).Serialize()) {
+		t.Errorf("Stored session doesn't match the buffered one")
+	}
+	trusted, err := device.Identities.IsTrustedIdentity(addr, theirIdentity.PublicKey().PublicKey())
+	must(t, err)
+	if !trusted {
+		t.Errorf("Expected identity to be stored after Commit")
+	}
+	otherIdentity := keys.NewKeyPair()
+	trusted, err = device.Identities.IsTrustedIdentity(addr, *otherIdentity.Pub)
+	must(t, err)
+	if trusted {
+		t.Errorf("Expected a different identity not to be trusted after Commit")
+	}
+	// The buffer is cleared after committing, so committing again is a no-op
+	must(t, uow.Commit())
+
+	uow = device.NewUnitOfWork(ctx)
+	uow.ClearIdentity(address)
+	if uow.ContainsSession(address) {
+		t.Errorf("Expected cleared session not to be visible in the unit of work")
+	} else if !uow.IsTrustedIdentity(address, identity.NewKey(ecc.NewDjbECPublicKey(*otherIdentity.Pub))) {
+		t.Errorf("Expected any identity to be trusted after ClearIdentity")
+	}
+	has, err = device.Sessions.HasSession(addr)
+	must(t, err)
+	if !has {
+		t.Errorf("Expected session to stay stored before Commit")
+	}
+	must(t, uow.Commit())
+	has, err = device.Sessions.HasSession(addr)
+	must(t, err)
+	if has {
+		t.Errorf("Expected session to be deleted after Commit")
+	}
+	trusted, err = device.Identities.IsTrustedIdentity(addr, *otherIdentity.Pub)
+	must(t, err)
+	if !trusted {
+		t.Errorf("Expected identity to be deleted after Commit")
+	}
+
+	// Changes that aren't committed are discarded
+	uow = device.NewUnitOfWork(ctx)
+	must(t, session.NewBuilderFromSignal(uow, address, store.SignalProtobufSerializer).ProcessBundle(bundle))
+	has, err = device.Sessions.HasSession(addr)
+	must(t, err)
+	if has {
+		t.Errorf("Expected uncommitted session not to be stored")
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.mau.fi/libsignal/keys/identity"
+	"go.mau.fi/libsignal/protocol"
+	"go.mau.fi/libsignal/state/record"
+	"go.mau.fi/libsignal/state/store"
+)
+
+// SignalChanges contains the session and identity changes collected by a UnitOfWork.
+//
+// An address is never in both the updated and deleted sets of the same type,
+// so implementations may apply the deletions and updates in any order.
+type SignalChanges struct {
+	Identities        map[string][32]byte
+	Sessions          map[string][]byte
+	DeletedIdentities map[string]struct{}
+	DeletedSessions   map[string]struct{}
+}
+
+func newSignalChanges() SignalChanges {
+	return SignalChanges{
+		Identities:        make(map[string][32]byte),
+		Sessions:          make(map[string][]byte),
+		DeletedIdentities: make(map[string]struct{}),
+		DeletedSessions:   make(map[string]struct{}),
+	}
+}
+
+// IsEmpty returns true if there are no changes to store.
+func (changes *SignalChanges) IsEmpty() bool {
+	return len(changes.Identities) == 0 && len(changes.Sessions) == 0 &&
+		len(changes.DeletedIdentities) == 0 && len(changes.DeletedSessions) == 0
+}
+
+// UnitOfWorkStore is an optional interface for session stores that can store all the changes
+// of a UnitOfWork atomically, e.g. in a single database transaction.
+//
+// If Device.Sessions doesn't implement this interface, UnitOfWork.Commit falls back to
+// storing the changes one by one using the IdentityStore and SessionStore methods.
+type UnitOfWorkStore interface {
+	CommitUnitOfWork(ctx context.Context, changes *SignalChanges) error
+}
+
+// UnitOfWork is a libsignal protocol store that buffers session and identity updates in memory
+// until Commit is called. It's used to store all the session changes of encrypting one message
+// for many devices (or decrypting one incoming message) together instead of writing each one separately.
+//
+// Reads of sessions and identities see the buffered changes. All other store calls, like prekeys
+// and sender keys, go directly to the underlying stores.
+type UnitOfWork struct {
+	*ContextSignalStore
+
+	lock    sync.Mutex
+	changes SignalChanges
+}
+
+var _ store.SignalProtocol = (*UnitOfWork)(nil)
+
+// NewUnitOfWork creates a new UnitOfWork that uses the given context for all database calls.
+// The buffered changes are lost unless Commit is called.
+func (device *Device) NewUnitOfWork(ctx context.Context) *UnitOfWork {
+	return &UnitOfWork{
+		ContextSignalStore: device.WithContext(ctx),
+		changes:            newSignalChanges(),
+	}
+}
+
+func (uow *UnitOfWork) SaveIdentity(address *protocol.SignalAddress, identityKey *identity.Key) {
+	uow.lock.Lock()
+	addr := address.String()
+	uow.changes.Identities[addr] = identityKey.PublicKey().PublicKey()
+	delete(uow.changes.DeletedIdentities, addr)
+	uow.lock.Unlock()
+}
+
+func (uow *UnitOfWork) IsTrustedIdentity(address *protocol.SignalAddress, identityKey *identity.Key) bool {
+	uow.lock.Lock()
+	addr := address.String()
+	buffered, ok := uow.changes.Identities[addr]
+	_, deleted := uow.changes.DeletedIdentities[addr]
+	uow.lock.Unlock()
+	if ok {
+		return buffered == identityKey.PublicKey().PublicKey()
+	} else if deleted {
+		// Trust if not known, it'll be saved automatically later
+		return true
+	}
+	return uow.ContextSignalStore.IsTrustedIdentity(address, identityKey)
+}
+
+func (uow *UnitOfWork) LoadSession(address *protocol.SignalAddress) *record.Session {
+	uow.lock.Lock()
+	addr := address.String()
+	rawSess, ok := uow.changes.Sessions[addr]
+	_, deleted := uow.changes.DeletedSessions[addr]
+	uow.lock.Unlock()
+	if !ok && !deleted {
+		return uow.ContextSignalStore.LoadSession(address)
+	} else if deleted {
+		return record.NewSession(SignalProtobufSerializer.Session, SignalProtobufSerializer.State)
+	}
+	sess, err := record.NewSessionFromBytes(rawSess, SignalProtobufSerializer.Session, SignalProtobufSerializer.State)
+	if err != nil {
+		uow.Log.Errorf("Failed to deserialize buffered session with %s: %v", addr, err)
+		return record.NewSession(SignalProtobufSerializer.Session, SignalProtobufSerializer.State)
+	}
+	return sess
+}
+
+func (uow *UnitOfWork) StoreSession(address *protocol.SignalAddress, record *record.Session) {
+	uow.lock.Lock()
+	addr := address.String()
+	uow.changes.Sessions[addr] = record.Serialize()
+	delete(uow.changes.DeletedSessions, addr)
+	uow.lock.Unlock()
+}
+
+func (uow *UnitOfWork) ContainsSession(remoteAddress *protocol.SignalAddress) bool {
+	uow.lock.Lock()
+	addr := remoteAddress.String()
+	_, ok := uow.changes.Sessions[addr]
+	_, deleted := uow.changes.DeletedSessions[addr]
+	uow.lock.Unlock()
+	if ok {
+		return true
+	} else if deleted {
+		return false
+	}
+	return uow.ContextSignalStore.ContainsSession(remoteAddress)
+}
+
+// ClearIdentity deletes the stored identity and session of the given address, e.g. after the identity has changed.
+func (uow *UnitOfWork) ClearIdentity(address *protocol.SignalAddress) {
+	uow.lock.Lock()
+	addr := address.String()
+	delete(uow.changes.Identities, addr)
+	delete(uow.changes.Sessions, addr)
+	uow.changes.DeletedIdentities[addr] = struct{}{}
+	uow.changes.DeletedSessions[addr] = struct{}{}
+	uow.lock.Unlock()
+}
+
+// Commit stores all the buffered changes. If the session store implements UnitOfWorkStore,
+// the changes are stored atomically.
+//
+// If any store call failed while the UnitOfWork was used, that error is returned and nothing is stored,
+// as libsignal may have operated on empty records instead of the real ones.
+//
+// The buffer is cleared after a successful commit, so the UnitOfWork can be reused afterwards.
+func (uow *UnitOfWork) Commit() error {
+	uow.lock.Lock()
+	defer uow.lock.Unlock()
+	if err := uow.Err(); err != nil {
+		return err
+	} else if uow.changes.IsEmpty() {
+		return nil
+	}
+	var err error
+	for i := 0; ; i++ {
+		err = uow.commit()
+		if err == nil || !uow.handleDatabaseError(i, err, "commit buffered session and identity changes") || uow.ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	uow.changes = newSignalChanges()
+	return nil
+}
+
+func (uow *UnitOfWork) commit() error {
+	if batchStore, ok := uow.Sessions.(UnitOfWorkStore); ok {
+		return batchStore.CommitUnitOfWork(uow.ctx, &uow.changes)
+	}
+	for addr := range uow.changes.DeletedIdentities {
+		err := uow.Identities.DeleteIdentityContext(uow.ctx, addr)
+		if err != nil {
+			return fmt.Errorf("failed to delete identity of %s: %w", addr, err)
+		}
+	}
+	for addr := range uow.changes.DeletedSessions {
+		err := uow.Sessions.DeleteSessionContext(uow.ctx, addr)
+		if err != nil {
+			return fmt.Errorf("failed to delete session with %s: %w", addr, err)
+		}
+	}
+	for addr, key := range uow.changes.Identities {
+		err := uow.Identities.PutIdentityContext(uow.ctx, addr, key)
+		if err != nil {
+			return fmt.Errorf("failed to save identity of %s: %w", addr, err)
+		}
+	}
+	for addr, session := range uow.changes.Sessions {
+		err := uow.Sessions.PutSessionContext(uow.ctx, addr, session)
+		if err != nil {
+			return fmt.Errorf("failed to store session with %s: %w", addr, err)
+		}
+	}
+	return nil
+}
@@ -196,8 +196,13 @@ type StreamError struct {
 type Disconnected struct{}
 
 // HistorySync is emitted when the phone has sent a blob of historical messages.
+//
+// The progress of the whole sync can be tracked with Data.GetChunkOrder() and Data.GetProgress().
 type HistorySync struct {
 	Data *waProto.HistorySync
+	// The number of messages that were saved to the history store before the event was dispatched.
+	// This is only set if Client.StoreHistorySyncMessages is enabled.
+	StoredMessages int
 }
 
 type DecryptFailMode string
@@ -328,6 +333,27 @@ type Receipt struct {
 	Type       ReceiptType
 }
 
+// MessageStatusChanged is emitted when the status of a message sent by the current device changes,
+// either because of the server response to Client.SendMessage or because of a Receipt from a recipient.
+//
+// Only messages sent since the client was created are tracked, see Client.GetMessageStatus.
+type MessageStatusChanged struct {
+	Chat types.JID
+	ID   types.MessageID
+
+	// The recipient device whose receipt caused the change and its new status.
+	// Recipient is empty if the change came from the server (sent, server ack or failure).
+	Recipient       types.JID
+	RecipientStatus types.MessageStatus
+
+	// The overall status of the message before and after the change. These are equal
+	// if only the status of one recipient device changed.
+	PreviousStatus types.MessageStatus
+	Status         types.MessageStatus
+
+	Timestamp time.Time
+}
+
 // ChatPresence is emitted when a chat state update (also known as typing notification) is received.
 //
 // Note that WhatsApp won't send you these updates unless you mark yourself as online:
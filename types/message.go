@@ -59,3 +59,55 @@ func (ms *MessageSource) SourceString() string {
 		return ms.Chat.String()
 	}
 }
+
+// MessageStatus is the delivery status of an outgoing message.
+//
+// The values other than MessageStatusPending match waProto.WebMessageInfo_Status,
+// so they can be compared with the statuses in history syncs.
+type MessageStatus int32
+
+const (
+	MessageStatusPending   MessageStatus = -1 // The message is still being encrypted and hasn't been sent to the server yet.
+	MessageStatusFailed    MessageStatus = 0  // Sending the message failed.
+	MessageStatusSent      MessageStatus = 1  // The message was sent to the server, but the server hasn't acknowledged it yet.
+	MessageStatusServerAck MessageStatus = 2  // The server acknowledged the message.
+	MessageStatusDelivered MessageStatus = 3  // The message was delivered to the recipient.
+	MessageStatusRead      MessageStatus = 4  // The recipient read the message.
+	MessageStatusPlayed    MessageStatus = 5  // The recipient played the voice message or opened the view-once media.
+)
+
+// String returns a human-readable name of the status.
+func (status MessageStatus) String() string {
+	switch status {
+	case MessageStatusPending:
+		return "pending"
+	case MessageStatusFailed:
+		return "failed"
+	case MessageStatusSent:
+		return "sent"
+	case MessageStatusServerAck:
+		return "server-ack"
+	case MessageStatusDelivered:
+		return "delivered"
+	case MessageStatusRead:
+		return "read"
+	case MessageStatusPlayed:
+		return "played"
+	default:
+		return fmt.Sprintf("MessageStatus(%d)", int32(status))
+	}
+}
+
+// OutgoingMessageStatus contains the tracked status of a message sent by the current device.
+type OutgoingMessageStatus struct {
+	Chat JID
+	ID   MessageID
+
+	// The overall status of the message. In groups, the message is only delivered or read once every
+	// participant has delivered or read it on at least one of their devices.
+	Status MessageStatus
+	// The statuses of the individual recipient devices that have sent receipts.
+	Recipients map[JID]MessageStatus
+	// When the overall status last changed.
+	Timestamp time.Time
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/webtest/wainstance"
+)
+
+// переменная окружения с паролем архива устройства
+const archivePassphraseEnv = "WEBTEST_ARCHIVE_PASSPHRASE"
+
+// Метод выполняет команду, переданную в аргументах запуска, вместо запуска сервера
+//
+//	webtest export-device <idInstance> <file>
+//	webtest import-device <idInstance> <file>
+//	webtest encrypt-keys
+//
+// Если задана переменная окружения WEBTEST_ARCHIVE_PASSPHRASE, то архив шифруется этим паролем.
+func runCommand(args []string) error {
+
+	switch args[0] {
+	case "export-device", "import-device":
+
+		// если не хватает аргументов
+		if len(args) != 3 {
+			return fmt.Errorf("usage: %s %s <idInstance> <file>", os.Args[0], args[0])
+		}
+
+		// парсим идентификатор инстанса
+		idInstance, err := strconv.ParseUint(args[1], 10, 64)
+
+		// если ошибка
+		if err != nil {
+			return fmt.Errorf("invalid instance ID %s: %w", args[1], err)
+		}
+
+		passphrase := os.Getenv(archivePassphraseEnv)
+
+		if args[0] == "export-device" {
+			return exportDevice(idInstance, args[2], passphrase)
+		}
+
+		return importDevice(idInstance, args[2], passphrase)
+	case "encrypt-keys":
+		return encryptKeys()
+	default:
+		return fmt.Errorf("unknown command %s, expected export-device, import-device or encrypt-keys", args[0])
+	}
+}
+
+// Метод шифрует ключи устройств в базе текущим ключом.
+// Используется для шифрования существующей базы и для смены ключа, в этом случае старый ключ
+// передается в WEBTEST_OLD_KEY_ENCRYPTION_KEYS. Сервер с этой базой должен быть остановлен.
+func encryptKeys() error {
+
+	// шифруем ключи
+	count, err := wainstance.App.Container.ReencryptKeys()
+
+	// если ключ шифрования не задан
+	if errors.Is(err, sqlstore.ErrKeyEncryptorRequired) {
+		return fmt.Errorf("encryption key is not set, use -key-file or %s", wainstance.KeyEncryptionKeyEnv)
+	}
+
+	// если ошибка
+	if err != nil {
+		return err
+	}
+
+	wainstance.App.Log.Infof("Encrypted %d keys", count)
+
+	return nil
+}
+
+// Метод выгружает устройство инстанса в архив
+func exportDevice(idInstance uint64, fileName, passphrase string) error {
+
+	// получаем инстанс
+	instance, err := wainstance.GetInstance(idInstance)
+
+	// если ошибка
+	if err != nil {
+		return err
+	}
+
+	// если инстанс не авторизован
+	if instance.GetJid() == "" {
+		return errors.New("instance is not authorized")
+	}
+
+	jid, err := types.ParseJID(instance.GetJid())
+
+	// если ошибка
+	if err != nil {
+		return fmt.Errorf("invalid instance JID: %w", err)
+	}
+
+	// если пароль не задан, то предупреждаем, что ключи будут в открытом виде
+	if passphrase == "" {
+		wainstance.App.Log.Warnf("%s is not set, the archive will contain unencrypted keys", archivePassphraseEnv)
+	}
+
+	// создаем файл архива, существующий файл не перезаписываем
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+
+	// если ошибка
+	if err != nil {
+		return err
+	}
+
+	// выгружаем устройство
+	err = wainstance.App.Container.ExportDeviceTo(jid, file, passphrase)
+
+	// закрываем файл
+	closeErr := file.Close()
+
+	// если ошибка
+	if err == nil {
+		err = closeErr
+	}
+
+	// если ошибка
+	if err != nil {
+
+		// удаляем недописанный архив
+		_ = os.Remove(fileName)
+
+		return fmt.Errorf("failed to export device: %w", err)
+	}
+
+	wainstance.App.Log.Infof("Exported device %s of instance %d to %s", jid, idInstance, fileName)
+
+	return nil
+}
+
+// Метод загружает устройство из архива и привязывает его к инстансу
+func importDevice(idInstance uint64, fileName, passphrase string) error {
+
+	// если инстанс уже есть и авторизован
+	if instance, err := wainstance.GetInstance(idInstance); err == nil && instance.GetJid() != "" {
+		return fmt.Errorf("instance %d already has device %s", idInstance, instance.GetJid())
+	}
+
+	// открываем файл архива
+	file, err := os.Open(fileName)
+
+	// если ошибка
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	// загружаем устройство
+	device, err := wainstance.App.Container.ImportDeviceFrom(file, passphrase)
+
+	// если ошибка
+	if err != nil {
+		return fmt.Errorf("failed to import device: %w", err)
+	}
+
+	// получаем или создаем инстанс
+	instance, err := wainstance.GetOrCreateInstance(idInstance)
+
+	// если ошибка
+	if err != nil {
+		return err
+	}
+
+	// привязываем устройство к инстансу
+	instance.SetJid(device.ID)
+
+	wainstance.App.Log.Infof("Imported device %s to instance %d", device.ID, idInstance)
+
+	return nil
+}
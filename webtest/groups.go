@@ -0,0 +1,830 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/webtest/properties"
+	"go.mau.fi/whatsmeow/webtest/wainstance"
+	"go.mau.fi/whatsmeow/webtest/webhook"
+)
+
+// префикс ссылки приглашения в группу
+const groupInviteLinkPrefix = "https://chat.whatsapp.com/"
+
+// Метод регистрирует маршруты управления группами
+func addGroupRoutes(engine *gin.Engine) {
+
+	// создание группы
+	engine.POST("/createGroup", createGroup)
+
+	// данные группы
+	engine.POST("/getGroupInfo", getGroupInfo)
+
+	// список групп, в которых состоит инстанс
+	engine.GET("/getGroups", getGroups)
+
+	// изменение участников группы
+	engine.POST("/addGroupParticipants", updateGroupParticipants(whatsmeow.ParticipantChangeAdd))
+	engine.POST("/removeGroupParticipants", updateGroupParticipants(whatsmeow.ParticipantChangeRemove))
+	engine.POST("/promoteGroupParticipants", updateGroupParticipants(whatsmeow.ParticipantChangePromote))
+	engine.POST("/demoteGroupParticipants", updateGroupParticipants(whatsmeow.ParticipantChangeDemote))
+
+	// изменение данных группы
+	engine.POST("/setGroupName", setGroupName)
+	engine.POST("/setGroupTopic", setGroupTopic)
+	engine.POST("/setGroupPhoto", setGroupPhoto)
+	engine.POST("/setGroupSettings", setGroupSettings)
+
+	// приглашения
+	engine.POST("/getGroupInviteLink", getGroupInviteLink)
+	engine.POST("/joinGroup", joinGroup)
+
+	// выход из группы
+	engine.POST("/leaveGroup", leaveGroup)
+
+	// сообщества
+	engine.POST("/linkGroup", linkGroup)
+	engine.POST("/unlinkGroup", unlinkGroup)
+}
+
+// Метод отдает подключенный и авторизованный инстанс запроса, либо пишет ответ с ошибкой
+func getAuthInstance(ctx *gin.Context) (*wainstance.Instance, bool) {
+
+	// если запрос не валиден
+	if !isValidRequest(ctx) {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request header",
+		})
+
+		// не продолжаем
+		return nil, false
+	}
+
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return nil, false
+	}
+
+	// если инстнанс не подключен, либо не авторизован
+	if !instance.IsConnectAndAuth() {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Instance not connected or not auth",
+		})
+
+		// не продолжаем
+		return nil, false
+	}
+
+	return instance, true
+}
+
+// Метод считывает JSON тело запроса, либо пишет ответ с ошибкой
+func readJsonRequest(ctx *gin.Context, instance *wainstance.Instance, request interface{}) bool {
+
+	// считываем тело запроса
+	content, err := io.ReadAll(ctx.Request.Body)
+
+	// если есть ошибка
+	if err == nil {
+
+		// лесериализуем из JSON
+		err = json.Unmarshal(content, request)
+	}
+
+	// если есть ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error read request %T: %v", request, err)
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request data",
+		})
+
+		// не продолжаем
+		return false
+	}
+
+	return true
+}
+
+// Метод получает идентификатор группы, либо пишет ответ с ошибкой
+func parseGroupJID(ctx *gin.Context, chatId string) (types.JID, bool) {
+
+	jid, ok := wainstance.ParseJID(chatId)
+
+	// если не группа
+	if !ok || jid.Server != types.GroupServer {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad group chatId",
+		})
+
+		// не продолжаем
+		return jid, false
+	}
+
+	return jid, true
+}
+
+// Метод получает список участников, либо пишет ответ с ошибкой
+func parseParticipants(ctx *gin.Context, participants []string) ([]types.JID, bool) {
+
+	jids := make([]types.JID, 0, len(participants))
+
+	// обходим участников
+	for _, participant := range participants {
+
+		jid, ok := wainstance.ParseJID(participant)
+
+		// если не ок
+		if !ok {
+
+			// отдаем ответ
+			ctx.JSON(400, gin.H{
+				"reason": "Bad participant " + participant,
+			})
+
+			// не продолжаем
+			return nil, false
+		}
+
+		jids = append(jids, jid)
+	}
+
+	return jids, true
+}
+
+// Метод отвечает ошибкой запроса к WhatsApp
+func groupError(ctx *gin.Context, instance *wainstance.Instance, action string, err error) {
+
+	// логируем ошибку
+	instance.Log.Errorf("Error %s: %v", action, err)
+
+	status := 500
+
+	// если WhatsApp отклонил запрос
+	var iqErr *whatsmeow.IQError
+	if errors.As(err, &iqErr) || errors.Is(err, whatsmeow.ErrGroupNotFound) || errors.Is(err, whatsmeow.ErrNotInGroup) ||
+		errors.Is(err, whatsmeow.ErrInviteLinkInvalid) || errors.Is(err, whatsmeow.ErrInviteLinkRevoked) {
+		status = 400
+	}
+
+	// отдаем ответ
+	ctx.JSON(status, gin.H{
+		"reason": "Error " + action + ": " + err.Error(),
+	})
+}
+
+// Метод создает объект ответа с данными группы
+func newResponseGroupInfo(group *types.GroupInfo) properties.ResponseGroupInfo {
+
+	response := properties.ResponseGroupInfo{
+		ChatId:       group.JID.String(),
+		Name:         group.Name,
+		Topic:        group.Topic,
+		Created:      group.GroupCreated.Unix(),
+		IsLocked:     group.IsLocked,
+		IsAnnounce:   group.IsAnnounce,
+		IsCommunity:  group.IsParent,
+		Participants: make([]properties.ResponseGroupParticipant, 0, len(group.Participants)),
+	}
+
+	// если владелец известен
+	if !group.OwnerJID.IsEmpty() {
+		response.Owner = webhook.FormatChatId(group.OwnerJID)
+	}
+
+	// если группа в сообществе
+	if !group.LinkedParentJID.IsEmpty() {
+		response.CommunityId = group.LinkedParentJID.String()
+	}
+
+	// обходим участников
+	for _, participant := range group.Participants {
+		response.Participants = append(response.Participants, properties.ResponseGroupParticipant{
+			Id:           webhook.FormatChatId(participant.JID),
+			IsAdmin:      participant.IsAdmin,
+			IsSuperAdmin: participant.IsSuperAdmin,
+		})
+	}
+
+	return response
+}
+
+// Метод создает группу или сообщество
+func createGroup(ctx *gin.Context) {
+
+	// получаем инстанс
+	instance, ok := getAuthInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+		return
+	}
+
+	var request properties.RequestCreateGroup
+
+	// считываем запрос
+	if !readJsonRequest(ctx, instance, &request) {
+		return
+	}
+
+	// если название не указано
+	if request.Name == "" {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Missing group name",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем участников
+	participants, ok := parseParticipants(ctx, request.Participants)
+
+	// если не ок
+	if !ok {
+		return
+	}
+
+	req := whatsmeow.ReqCreateGroup{
+		Name:         request.Name,
+		Participants: participants,
+	}
+
+	req.IsParent = request.IsCommunity
+
+	// если группа создается в сообществе
+	if request.CommunityId != "" {
+
+		req.LinkedParentJID, ok = parseGroupJID(ctx, request.CommunityId)
+
+		// если не ок
+		if !ok {
+			return
+		}
+	}
+
+	// создаем группу
+	group, err := instance.Client.CreateGroup(req)
+
+	// если ошибка
+	if err != nil {
+		groupError(ctx, instance, "create group", err)
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, newResponseGroupInfo(group))
+}
+
+// Метод отдает данные группы
+func getGroupInfo(ctx *gin.Context) {
+
+	// получаем инстанс
+	instance, ok := getAuthInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+		return
+	}
+
+	var request properties.RequestGroup
+
+	// считываем запрос
+	if !readJsonRequest(ctx, instance, &request) {
+		return
+	}
+
+	// получаем идентификатор группы
+	jid, ok := parseGroupJID(ctx, request.ChatId)
+
+	// если не ок
+	if !ok {
+		return
+	}
+
+	// получаем данные группы
+	group, err := instance.Client.GetGroupInfo(jid)
+
+	// если ошибка
+	if err != nil {
+		groupError(ctx, instance, "get group info", err)
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, newResponseGroupInfo(group))
+}
+
+// Метод отдает список групп, в которых состоит инстанс
+func getGroups(ctx *gin.Context) {
+
+	// получаем инстанс
+	instance, ok := getAuthInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+		return
+	}
+
+	// получаем группы
+	groups, err := instance.Client.GetJoinedGroups()
+
+	// если ошибка
+	if err != nil {
+		groupError(ctx, instance, "get joined groups", err)
+		return
+	}
+
+	response := make([]properties.ResponseGroupInfo, 0, len(groups))
+
+	// обходим группы
+	for _, group := range groups {
+		response = append(response, newResponseGroupInfo(group))
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, response)
+}
+
+// Метод создает обработчик изменения участников группы
+func updateGroupParticipants(change whatsmeow.ParticipantChange) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+
+		// получаем инстанс
+		instance, ok := getAuthInstance(ctx)
+
+		// если инстанс не получен
+		if !ok {
+			return
+		}
+
+		var request properties.RequestUpdateGroupParticipants
+
+		// считываем запрос
+		if !readJsonRequest(ctx, instance, &request) {
+			return
+		}
+
+		// получаем идентификатор группы
+		jid, ok := parseGroupJID(ctx, request.ChatId)
+
+		// если не ок
+		if !ok {
+			return
+		}
+
+		// получаем участников
+		participants, ok := parseParticipants(ctx, request.Participants)
+
+		// если участники не указаны
+		if ok && len(participants) == 0 {
+
+			// отдаем ответ
+			ctx.JSON(400, gin.H{
+				"reason": "Missing participants",
+			})
+
+			// не продолжаем
+			return
+		} else if !ok {
+			return
+		}
+
+		changes := make(map[types.JID]whatsmeow.ParticipantChange, len(participants))
+
+		for _, participant := range participants {
+			changes[participant] = change
+		}
+
+		// изменяем участников
+		resp, err := instance.Client.UpdateGroupParticipants(jid, changes)
+
+		// если ошибка
+		if err != nil {
+			groupError(ctx, instance, string(change)+" group participants", err)
+			return
+		}
+
+		// отдаем ответ с результатом по каждому участнику
+		ctx.JSON(200, newResponseGroupParticipantResults(resp))
+	}
+}
+
+// Метод разбирает ответ на изменение участников группы в результаты по каждому участнику
+func newResponseGroupParticipantResults(resp *waBinary.Node) []properties.ResponseGroupParticipantResult {
+
+	results := whatsmeow.ParseGroupParticipantResults(resp)
+
+	response := make([]properties.ResponseGroupParticipantResult, 0, len(results))
+
+	// обходим результаты
+	for _, result := range results {
+
+		participantResult := properties.ResponseGroupParticipantResult{
+			Participant: webhook.FormatChatId(result.JID),
+			Success:     result.Error == 0,
+			Error:       result.Error,
+		}
+
+		// если пользователя можно пригласить
+		if result.AddRequest != nil {
+			participantResult.AddRequestCode = result.AddRequest.Code
+			participantResult.AddRequestExpiration = result.AddRequest.Expiration.Unix()
+		}
+
+		response = append(response, participantResult)
+	}
+
+	return response
+}
+
+// Метод изменяет название группы
+func setGroupName(ctx *gin.Context) {
+
+	// получаем инстанс
+	instance, ok := getAuthInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+		return
+	}
+
+	var request properties.RequestSetGroupName
+
+	// считываем запрос
+	if !readJsonRequest(ctx, instance, &request) {
+		return
+	}
+
+	// получаем идентификатор группы
+	jid, ok := parseGroupJID(ctx, request.ChatId)
+
+	// если не ок
+	if !ok {
+		return
+	}
+
+	// изменяем название
+	if err := instance.Client.SetGroupName(jid, request.Name); err != nil {
+		groupError(ctx, instance, "set group name", err)
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, gin.H{
+		"success": true,
+	})
+}
+
+// Метод изменяет описание группы
+func setGroupTopic(ctx *gin.Context) {
+
+	// получаем инстанс
+	instance, ok := getAuthInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+		return
+	}
+
+	var request properties.RequestSetGroupTopic
+
+	// считываем запрос
+	if !readJsonRequest(ctx, instance, &request) {
+		return
+	}
+
+	// получаем идентификатор группы
+	jid, ok := parseGroupJID(ctx, request.ChatId)
+
+	// если не ок
+	if !ok {
+		return
+	}
+
+	// изменяем описание
+	if err := instance.Client.SetGroupTopic(jid, "", "", request.Topic); err != nil {
+		groupError(ctx, instance, "set group topic", err)
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, gin.H{
+		"success": true,
+	})
+}
+
+// Метод изменяет фото группы. Фото передается так же, как медиафайлы: multipart полем file или ссылкой url.
+func setGroupPhoto(ctx *gin.Context) {
+
+	// получаем инстанс
+	instance, ok := getAuthInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+		return
+	}
+
+	// считываем запрос и файл
+	request, file, err := readMediaRequest(ctx)
+
+	// если есть ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error read set group photo request: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request data: " + err.Error(),
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем идентификатор группы
+	jid, ok := parseGroupJID(ctx, request.ChatId)
+
+	// если не ок
+	if !ok {
+		return
+	}
+
+	// изменяем фото
+	pictureId, err := instance.Client.SetGroupPhoto(jid, file.Data)
+
+	// если ошибка
+	if err != nil {
+		groupError(ctx, instance, "set group photo", err)
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, gin.H{
+		"success":   true,
+		"pictureId": pictureId,
+	})
+}
+
+// Метод изменяет настройки группы
+func setGroupSettings(ctx *gin.Context) {
+
+	// получаем инстанс
+	instance, ok := getAuthInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+		return
+	}
+
+	var request properties.RequestSetGroupSettings
+
+	// считываем запрос
+	if !readJsonRequest(ctx, instance, &request) {
+		return
+	}
+
+	// получаем идентификатор группы
+	jid, ok := parseGroupJID(ctx, request.ChatId)
+
+	// если не ок
+	if !ok {
+		return
+	}
+
+	// если указано, кто может менять данные группы
+	if request.Locked != nil {
+		if err := instance.Client.SetGroupLocked(jid, *request.Locked); err != nil {
+			groupError(ctx, instance, "set group locked", err)
+			return
+		}
+	}
+
+	// если указано, кто может писать в группу
+	if request.Announce != nil {
+		if err := instance.Client.SetGroupAnnounce(jid, *request.Announce); err != nil {
+			groupError(ctx, instance, "set group announce", err)
+			return
+		}
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, gin.H{
+		"success": true,
+	})
+}
+
+// Метод отдает ссылку приглашения в группу
+func getGroupInviteLink(ctx *gin.Context) {
+
+	// получаем инстанс
+	instance, ok := getAuthInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+		return
+	}
+
+	var request properties.RequestGetGroupInviteLink
+
+	// считываем запрос
+	if !readJsonRequest(ctx, instance, &request) {
+		return
+	}
+
+	// получаем идентификатор группы
+	jid, ok := parseGroupJID(ctx, request.ChatId)
+
+	// если не ок
+	if !ok {
+		return
+	}
+
+	// получаем ссылку
+	inviteLink, err := instance.Client.GetGroupInviteLink(jid, request.Reset)
+
+	// если ошибка
+	if err != nil {
+		groupError(ctx, instance, "get group invite link", err)
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, gin.H{
+		"inviteLink": inviteLink,
+	})
+}
+
+// Метод вступает в группу по ссылке приглашения
+func joinGroup(ctx *gin.Context) {
+
+	// получаем инстанс
+	instance, ok := getAuthInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+		return
+	}
+
+	var request properties.RequestJoinGroup
+
+	// считываем запрос
+	if !readJsonRequest(ctx, instance, &request) {
+		return
+	}
+
+	// принимаем как ссылку, так и код приглашения
+	code := strings.TrimPrefix(request.InviteLink, groupInviteLinkPrefix)
+
+	// если код не указан
+	if code == "" {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Missing inviteLink",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// вступаем в группу
+	jid, err := instance.Client.JoinGroupWithLink(code)
+
+	// если ошибка
+	if err != nil {
+		groupError(ctx, instance, "join group", err)
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, gin.H{
+		"chatId": jid.String(),
+	})
+}
+
+// Метод выходит из группы
+func leaveGroup(ctx *gin.Context) {
+
+	// получаем инстанс
+	instance, ok := getAuthInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+		return
+	}
+
+	var request properties.RequestGroup
+
+	// считываем запрос
+	if !readJsonRequest(ctx, instance, &request) {
+		return
+	}
+
+	// получаем идентификатор группы
+	jid, ok := parseGroupJID(ctx, request.ChatId)
+
+	// если не ок
+	if !ok {
+		return
+	}
+
+	// выходим из группы
+	if err := instance.Client.LeaveGroup(jid); err != nil {
+		groupError(ctx, instance, "leave group", err)
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, gin.H{
+		"success": true,
+	})
+}
+
+// Метод привязывает группу к сообществу
+func linkGroup(ctx *gin.Context) {
+	linkOrUnlinkGroup(ctx, true)
+}
+
+// Метод отвязывает группу от сообщества
+func unlinkGroup(ctx *gin.Context) {
+	linkOrUnlinkGroup(ctx, false)
+}
+
+// Метод привязывает группу к сообществу или отвязывает от него
+func linkOrUnlinkGroup(ctx *gin.Context, link bool) {
+
+	// получаем инстанс
+	instance, ok := getAuthInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+		return
+	}
+
+	var request properties.RequestLinkGroup
+
+	// считываем запрос
+	if !readJsonRequest(ctx, instance, &request) {
+		return
+	}
+
+	// получаем идентификатор сообщества
+	community, ok := parseGroupJID(ctx, request.CommunityId)
+
+	// если не ок
+	if !ok {
+		return
+	}
+
+	// получаем идентификатор группы
+	jid, ok := parseGroupJID(ctx, request.ChatId)
+
+	// если не ок
+	if !ok {
+		return
+	}
+
+	var err error
+
+	if link {
+		err = instance.Client.LinkGroup(community, jid)
+	} else {
+		err = instance.Client.UnlinkGroup(community, jid)
+	}
+
+	// если ошибка
+	if err != nil {
+		groupError(ctx, instance, "link group", err)
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, gin.H{
+		"success": true,
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/webtest/properties"
+)
+
+// Метод создает ответ сервера на изменение участников группы
+func participantResultIQ(change string, participants ...waBinary.Node) *waBinary.Node {
+	return &waBinary.Node{
+		Tag:   "iq",
+		Attrs: waBinary.Attrs{"from": types.NewJID("123456", types.GroupServer), "type": "result"},
+		Content: []waBinary.Node{{
+			Tag:     change,
+			Content: participants,
+		}},
+	}
+}
+
+// Метод создает результат изменения одного участника
+func participantResult(user, errorCode string, content ...waBinary.Node) waBinary.Node {
+
+	node := waBinary.Node{
+		Tag:   "participant",
+		Attrs: waBinary.Attrs{"jid": types.NewJID(user, types.DefaultUserServer)},
+	}
+
+	// если изменить участника не удалось
+	if errorCode != "" {
+		node.Attrs["error"] = errorCode
+	}
+
+	if len(content) > 0 {
+		node.Content = content
+	}
+
+	return node
+}
+
+func TestNewResponseGroupParticipantResults(t *testing.T) {
+
+	for _, test := range []struct {
+		name     string
+		resp     *waBinary.Node
+		expected []properties.ResponseGroupParticipantResult
+	}{{
+		name: "add",
+		resp: participantResultIQ("add",
+			participantResult("1111", ""),
+			participantResult("2222", "403", waBinary.Node{
+				Tag:   "add_request",
+				Attrs: waBinary.Attrs{"code": "INVITECODE", "expiration": "1700000000"},
+			}),
+			participantResult("3333", "409"),
+		),
+		expected: []properties.ResponseGroupParticipantResult{
+			{Participant: "1111@c.us", Success: true},
+			{Participant: "2222@c.us", Error: 403, AddRequestCode: "INVITECODE", AddRequestExpiration: 1700000000},
+			{Participant: "3333@c.us", Error: 409},
+		},
+	}, {
+		name: "remove",
+		resp: participantResultIQ("remove", participantResult("1111", ""), participantResult("2222", "404")),
+		expected: []properties.ResponseGroupParticipantResult{
+			{Participant: "1111@c.us", Success: true},
+			{Participant: "2222@c.us", Error: 404},
+		},
+	}, {
+		name: "promote",
+		resp: participantResultIQ("promote", participantResult("1111", ""), participantResult("2222", "404")),
+		expected: []properties.ResponseGroupParticipantResult{
+			{Participant: "1111@c.us", Success: true},
+			{Participant: "2222@c.us", Error: 404},
+		},
+	}, {
+		name: "demote",
+		resp: participantResultIQ("demote", participantResult("1111", ""), participantResult("2222", "406")),
+		expected: []properties.ResponseGroupParticipantResult{
+			{Participant: "1111@c.us", Success: true},
+			{Participant: "2222@c.us", Error: 406},
+		},
+	}, {
+		// пустой ответ отдается как пустой список, а не null
+		name:     "empty",
+		resp:     &waBinary.Node{Tag: "iq", Attrs: waBinary.Attrs{"type": "result"}},
+		expected: []properties.ResponseGroupParticipantResult{},
+	}} {
+		if response := newResponseGroupParticipantResults(test.resp); !reflect.DeepEqual(response, test.expected) {
+			t.Errorf("Unexpected %s response:\n got: %+v\nwant: %+v", test.name, response, test.expected)
+		}
+	}
+}
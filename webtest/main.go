@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/webtest/formats"
@@ -12,10 +14,15 @@ import (
 	"go.mau.fi/whatsmeow/webtest/webhook"
 	"go.mau.fi/whatsmeow/webtest/ws"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -24,22 +31,22 @@ import (
 	waBinary "go.mau.fi/whatsmeow/binary"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
 	waLog "go.mau.fi/whatsmeow/util/log"
 )
 
 // Стартовый метод
 func main() {
 
-	// создаем instance
-	wainstance.InstanceWa = wainstance.Instance{
+	// заполняем общие данные сервиса
+	wainstance.App = wainstance.Application{
 		Log:             waLog.Stdout("Main", "DEBUG", true),
 		DbLog:           waLog.Stdout("Database", "DEBUG", true),
 		DebugLogs:       flag.Bool("debug", true, "Enable debug logs?"),
 		DbDialect:       flag.String("db-dialect", "sqlite3", "Database dialect (sqlite3 or postgres)"),
 		DbAddress:       flag.String("db-address", "file:data/webtest.db?_foreign_keys=on", "Database address"),
 		RequestFullSync: flag.Bool("request-full-sync", false, "Request full (1 year) history sync when logging in?"),
-		PairRejectChan:  make(chan bool, 1),
-		HistorySyncID:   0,
+		KeyFile:         flag.String("key-file", "", "File with the key for encrypting device keys in the database (hex or base64)"),
 		StartupTime:     time.Now().Unix(),
 	}
 
@@ -47,14 +54,14 @@ func main() {
 
 	flag.Parse()
 
-	if *wainstance.InstanceWa.RequestFullSync {
+	if *wainstance.App.RequestFullSync {
 
 		store.DeviceProps.RequireFullSync = proto.Bool(true)
 	}
 
 	osType := runtime.GOOS
 
-	wainstance.InstanceWa.Log.Infof("Run app on: %s", osType)
+	wainstance.App.Log.Infof("Run app on: %s", osType)
 
 	// считываем файл кофигурации
 	content, err := os.ReadFile("config.json")
@@ -63,25 +70,82 @@ func main() {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error when opening config file: %v", err)
+		wainstance.App.Log.Errorf("Error when opening config file: %v", err)
 
 		// не продолжаем
 		return
 	}
 
 	// лесериализуем из JSON
-	err = json.Unmarshal(content, &wainstance.InstanceWa.Config)
+	err = json.Unmarshal(content, &wainstance.App.Config)
 
 	// если есть ошибка
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error during parse Configuration: %v", err)
+		wainstance.App.Log.Errorf("Error during parse Configuration: %v", err)
 
 		// не продолжаем
 		return
 	}
 
+	// открываем базу данных и загружаем инстансы
+	err = wainstance.InitStorage()
+
+	// если есть ошибка
+	if err != nil {
+
+		// логируем ошибку
+		wainstance.App.Log.Errorf("Failed to init storage: %v", err)
+
+		// не продолжаем
+		return
+	}
+
+	// если передана команда, то выполняем ее вместо запуска сервера
+	if flag.NArg() > 0 {
+
+		// выполняем команду
+		err = runCommand(flag.Args())
+
+		// если есть ошибка
+		if err != nil {
+
+			// логируем ошибку
+			wainstance.App.Log.Errorf("%v", err)
+
+			os.Exit(1)
+		}
+
+		// не продолжаем
+		return
+	}
+
+	// создаем очередь доставки вебхуков
+	webhook.DeliveryQueue, err = webhook.NewQueue(wainstance.App.Db, *wainstance.App.DbDialect, wainstance.App.Config, wainstance.App.Log.Sub("Webhook"))
+
+	// если есть ошибка
+	if err != nil {
+
+		// логируем ошибку
+		wainstance.App.Log.Errorf("Failed to init webhook queue: %v", err)
+
+		// не продолжаем
+		return
+	}
+
+	// запускаем доставку вебхуков
+	go webhook.DeliveryQueue.Run(context.Background())
+
+	// запускаем авторизованные инстансы
+	startSavedInstances()
+
+	// читаем команды из консоли
+	go wainstance.RunConsole()
+
+	// останавливаем инстансы при завершении процесса
+	go handleSignals()
+
 	// создаем экземпляр Engine
 	engine := gin.Default()
 
@@ -100,6 +164,13 @@ func main() {
 	// маршрутизация отправки сообщения
 	engine.POST("/sendMessage", sendMessage)
 
+	// отправка медиафайлов
+	engine.POST("/sendImage", sendMedia(wainstance.MediaKindImage))
+	engine.POST("/sendVideo", sendMedia(wainstance.MediaKindVideo))
+	engine.POST("/sendVoice", sendMedia(wainstance.MediaKindVoice))
+	engine.POST("/sendDocument", sendMedia(wainstance.MediaKindDocument))
+	engine.POST("/sendSticker", sendMedia(wainstance.MediaKindSticker))
+
 	// получение контактов
 	engine.GET("/getContacts", getContacts)
 
@@ -121,47 +192,219 @@ func main() {
 	// установка webhook URL
 	engine.POST("/setWebhookUrl", setWebhookUrl)
 
+	// выбор типов вебхуков
+	engine.POST("/setWebhookTypes", setWebhookTypes)
+
+	// список инстансов
+	engine.GET("/getInstances", getInstances)
+
+	// получение истории чата
+	engine.POST("/getChatHistory", getChatHistory)
+
+	// получение сообщения из истории
+	engine.POST("/getMessage", getMessage)
+
+	// поиск сообщений в истории
+	engine.POST("/searchMessages", searchMessages)
+
+	// получение списка чатов из истории
+	engine.GET("/listChats", listChats)
+
+	// получение списка чатов с непрочитанными сообщениями
+	engine.GET("/getChats", getChats)
+
+	// удаление инстанса
+	engine.GET("/deleteInstance", deleteInstance)
+
+	// управление группами
+	addGroupRoutes(engine)
+
+	// список недоставленных вебхуков
+	engine.GET("/getFailedWebhooks", getFailedWebhooks)
+
+	// повторная отправка недоставленных вебхуков
+	engine.POST("/replayFailedWebhooks", replayFailedWebhooks)
+
 	// если os windows
 	if osType == "windows" {
 
 		// запускаем сервер
-		err = engine.Run("127.0.0.1:" + wainstance.InstanceWa.Config.Port)
+		err = engine.Run("127.0.0.1:" + wainstance.App.Config.Port)
 	} else {
 
 		// запускаем сервер
-		err = engine.Run("0.0.0.0:" + wainstance.InstanceWa.Config.Port)
+		err = engine.Run("0.0.0.0:" + wainstance.App.Config.Port)
 	}
 
 	// если есть ошибка
 	if err != nil {
 
 		// выводим лог
-		wainstance.InstanceWa.Log.Errorf("Failed to start server: %v", err)
+		wainstance.App.Log.Errorf("Failed to start server: %v", err)
 
 		//не продолжаем
 		return
 	}
 }
 
-// Метод проверяет подключен ли инстанс и авторизован
-func isConnectAndAuth() bool {
+// Метод запускает сохраненные авторизованные инстансы
+func startSavedInstances() {
 
-	// если клиент nil или не установлено сокет соединение с Whatsapp или инстанс не авторизован
-	if wainstance.InstanceWa.Client == nil || !wainstance.InstanceWa.Client.IsConnected() || !wainstance.InstanceWa.Client.IsLoggedIn() {
+	// обходим инстансы
+	for _, instance := range wainstance.GetAllInstances() {
 
-		// отдаем инстанс не подключен
-		return false
+		// если инстанс не авторизован или нет прокси
+		if instance.Jid == "" || instance.Proxy == "" {
+
+			// пропускаем
+			continue
+		}
+
+		// получаем прокси из строки
+		proxy, err := properties.GetProxy(instance.Proxy)
+
+		// если есть ошибка
+		if err != nil {
+
+			// логируем ошибку
+			instance.Log.Errorf("Error get proxy from string: %v", err)
+
+			// пропускаем
+			continue
+		}
+
+		// запускаем инстанс
+		if err = instance.Start(proxy, true, nil); err != nil {
+
+			// логируем ошибку
+			instance.Log.Errorf("Error start instance: %v", err)
+		}
+	}
+}
+
+// Метод останавливает все инстансы при получении сигнала завершения
+func handleSignals() {
+
+	c := make(chan os.Signal, 1)
+
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	<-c
+
+	wainstance.App.Log.Infof("Interrupt received, exiting")
+
+	// обходим инстансы
+	for _, instance := range wainstance.GetAllInstances() {
+
+		// останавливаем инстанс
+		instance.Stop()
+	}
+
+	os.Exit(0)
+}
+
+// Метод парсит идентификатор инстанса из параметра запроса idInstance
+func parseIdInstance(ctx *gin.Context) (uint64, bool) {
+
+	// получаем параметр
+	queryIdInstance, ok := ctx.GetQuery("idInstance")
+
+	// если нет параметра
+	if !ok || queryIdInstance == "" {
+
+		// отдаем false
+		return 0, false
+	}
+
+	// парсим идентификатор
+	idInstance, err := strconv.ParseUint(queryIdInstance, 10, 64)
+
+	// отдаем результат
+	return idInstance, err == nil
+}
+
+// Метод отдает инстанс по параметру запроса idInstance, при ошибке сам отдает ответ
+func getInstance(ctx *gin.Context) (*wainstance.Instance, bool) {
+
+	// парсим идентификатор инстанса
+	idInstance, ok := parseIdInstance(ctx)
+
+	// если не ок
+	if !ok {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Missing or bad idInstance",
+		})
+
+		// не продолжаем
+		return nil, false
+	}
+
+	// получаем инстанс
+	instance, err := wainstance.GetInstance(idInstance)
+
+	// если ошибка
+	if err != nil {
+
+		// отдаем ответ
+		ctx.JSON(404, gin.H{
+			"reason": err.Error(),
+		})
+
+		// не продолжаем
+		return nil, false
+	}
+
+	// отдаем инстанс
+	return instance, true
+}
+
+// Метод отдает инстанс по параметру запроса idInstance, создавая его при необходимости
+func getOrCreateInstance(ctx *gin.Context) (*wainstance.Instance, bool) {
+
+	// парсим идентификатор инстанса
+	idInstance, ok := parseIdInstance(ctx)
+
+	// если не ок
+	if !ok {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Missing or bad idInstance",
+		})
+
+		// не продолжаем
+		return nil, false
+	}
+
+	// получаем или создаем инстанс
+	instance, err := wainstance.GetOrCreateInstance(idInstance)
+
+	// если ошибка
+	if err != nil {
+
+		// логируем ошибку
+		wainstance.App.Log.Errorf("Error create instance: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(500, gin.H{
+			"reason": "Error create instance",
+		})
+
+		// не продолжаем
+		return nil, false
 	}
 
-	// отдаем инстанс подключен и авторизован
-	return true
+	// отдаем инстанс
+	return instance, true
 }
 
 // Метод проверяет валидность запроса
 func isValidRequest(ctx *gin.Context) bool {
 
 	// если не проверяем секретный заголовок
-	if !wainstance.InstanceWa.Config.CheckSecret {
+	if !wainstance.App.Config.CheckSecret {
 
 		// отдаем что щапрос валиден
 		return true
@@ -178,7 +421,7 @@ func isValidRequest(ctx *gin.Context) bool {
 	}
 
 	// отдаем сравнение заголовков
-	return appSecret[0] == wainstance.InstanceWa.Config.AppSecret
+	return appSecret[0] == wainstance.App.Config.AppSecret
 }
 
 // Метод запускает инстанс
@@ -196,6 +439,16 @@ func startInstance(ctx *gin.Context) {
 		return
 	}
 
+	// получаем инстанс
+	instance, ok := getOrCreateInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
 	// считываем тело запроса
 	content, err := io.ReadAll(ctx.Request.Body)
 
@@ -203,7 +456,7 @@ func startInstance(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error read body request: %v", err)
+		instance.Log.Errorf("Error read body request: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -224,7 +477,7 @@ func startInstance(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error during parse RequestRunInstance: %v", err)
+		instance.Log.Errorf("Error during parse RequestRunInstance: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -239,7 +492,7 @@ func startInstance(ctx *gin.Context) {
 	if requestRunInstance.Proxy == "" {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Missing proxy RequestRunInstance: %v", err)
+		instance.Log.Errorf("Missing proxy RequestRunInstance: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -250,9 +503,6 @@ func startInstance(ctx *gin.Context) {
 		return
 	}
 
-	//пишем webhook URL
-	wainstance.InstanceWa.WebhookUrl = requestRunInstance.WebhookUrl
-
 	// получаем прокси из строки
 	proxy, err := properties.GetProxy(requestRunInstance.Proxy)
 
@@ -260,7 +510,7 @@ func startInstance(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error get proxy from string: %v", err)
+		instance.Log.Errorf("Error get proxy from string: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -271,8 +521,14 @@ func startInstance(ctx *gin.Context) {
 		return
 	}
 
-	// если клиент не nil и установлено сокет соединение с Whatsapp
-	if wainstance.InstanceWa.Client != nil && wainstance.InstanceWa.Client.IsConnected() {
+	// запускаем инстанс, webhook URL и прокси сохраняются, только если инстанс еще не подключен
+	err = instance.Start(proxy, true, &wainstance.StartSettings{
+		WebhookUrl: &requestRunInstance.WebhookUrl,
+		Proxy:      requestRunInstance.Proxy,
+	})
+
+	// если инстанс уже подключен
+	if errors.Is(err, wainstance.ErrAlreadyConnected) {
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -281,10 +537,19 @@ func startInstance(ctx *gin.Context) {
 
 		// не продолжаем
 		return
-	}
+	} else if err != nil {
 
-	// запускаем инстанс в отдельном потоке
-	go wainstance.StartInstance(proxy, true)
+		// логируем ошибку
+		instance.Log.Errorf("Error save instance: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(500, gin.H{
+			"reason": "Error save instance",
+		})
+
+		// не продолжаем
+		return
+	}
 
 	// отдаем ответ
 	ctx.JSON(200, gin.H{
@@ -307,8 +572,18 @@ func stopInstance(ctx *gin.Context) {
 		return
 	}
 
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
 	// запускаем инстанс в отдельном потоке
-	go wainstance.StopInstance()
+	go instance.Stop()
 
 	// отдаем ответ
 	ctx.JSON(200, gin.H{
@@ -335,45 +610,82 @@ func wsHandle(ctx *gin.Context) {
 	// создаем клиент ws
 	clientWs := &ws.ClientWs{
 		Socket: conn,
-		Log:    wainstance.InstanceWa.Log,
+		Log:    wainstance.App.Log,
 	}
 
-	// пишем клиента в инстанс
-	wainstance.InstanceWa.WsQrClient = clientWs
-
 	// если нужно проверять секретный заголовок
-	if wainstance.InstanceWa.Config.CheckSecret {
+	if wainstance.App.Config.CheckSecret {
 
 		// получаем параметр прокси
 		queryAppSecret, ok := ctx.GetQuery("app_secret")
 
 		//если не ок или нет параметра
-		if !ok || queryAppSecret == "" || queryAppSecret != wainstance.InstanceWa.Config.AppSecret {
+		if !ok || queryAppSecret == "" || queryAppSecret != wainstance.App.Config.AppSecret {
 
-			wainstance.InstanceWa.WsQrClient.Send(ws.AuthMessage{
+			clientWs.Send(ws.AuthMessage{
 				Type:   "error",
 				Reason: "Bad app secret",
 			})
 
-			wainstance.InstanceWa.WsQrClient.Close()
+			clientWs.Close()
 
 			//не продолжаем
 			return
 		}
 	}
 
+	// парсим идентификатор инстанса
+	idInstance, ok := parseIdInstance(ctx)
+
+	//если не ок
+	if !ok {
+
+		clientWs.Send(ws.AuthMessage{
+			Type:   "error",
+			Reason: "Missing or bad idInstance",
+		})
+
+		clientWs.Close()
+
+		//не продолжаем
+		return
+	}
+
+	// получаем или создаем инстанс
+	instance, err := wainstance.GetOrCreateInstance(idInstance)
+
+	// если есть ошибка
+	if err != nil {
+
+		clientWs.Send(ws.AuthMessage{
+			Type:   "error",
+			Reason: "Error create instance",
+		})
+
+		clientWs.Close()
+
+		//не продолжаем
+		return
+	}
+
+	// пишем логгер инстанса
+	clientWs.Log = instance.Log
+
+	// пишем клиента в инстанс
+	instance.WsQrClient = clientWs
+
 	// получаем параметр прокси
 	queryProxy, ok := ctx.GetQuery("proxy")
 
 	//если не ок или нет параметра
 	if !ok || queryProxy == "" {
 
-		wainstance.InstanceWa.WsQrClient.Send(ws.AuthMessage{
+		instance.WsQrClient.Send(ws.AuthMessage{
 			Type:   "error",
 			Reason: "Missing proxy",
 		})
 
-		wainstance.InstanceWa.WsQrClient.Close()
+		instance.WsQrClient.Close()
 
 		//не продолжаем
 		return
@@ -385,36 +697,47 @@ func wsHandle(ctx *gin.Context) {
 	// если есть ошибка
 	if err != nil {
 
-		wainstance.InstanceWa.WsQrClient.Send(ws.AuthMessage{
+		instance.WsQrClient.Send(ws.AuthMessage{
 			Type:   "error",
 			Reason: "Error get proxy from string",
 		})
 
-		wainstance.InstanceWa.WsQrClient.Close()
+		instance.WsQrClient.Close()
 
 		//не продолжаем
 		return
 	}
 
-	// если клиент не nil и установлено сокет соединение с Whatsapp
-	if wainstance.InstanceWa.Client != nil && wainstance.InstanceWa.Client.IsConnected() {
+	// запускаем инстанс, прокси сохраняется, только если инстанс еще не подключен
+	err = instance.Start(proxy, false, &wainstance.StartSettings{Proxy: queryProxy})
+
+	// если есть ошибка
+	if err != nil {
+
+		reason := "Error save instance"
+
+		// если инстанс уже подключен
+		if errors.Is(err, wainstance.ErrAlreadyConnected) {
+			reason = "Instance already connected"
+		} else {
+
+			// логируем ошибку
+			instance.Log.Errorf("Error save instance: %v", err)
+		}
 
-		wainstance.InstanceWa.WsQrClient.Send(ws.AuthMessage{
+		instance.WsQrClient.Send(ws.AuthMessage{
 			Type:   "error",
-			Reason: "Instance already connected",
+			Reason: reason,
 		})
 
-		wainstance.InstanceWa.WsQrClient.Close()
+		instance.WsQrClient.Close()
 
 		// не продолжаем
 		return
 	}
 
 	// запускаем чтение ws
-	go wainstance.InstanceWa.WsQrClient.Read() //статичный метод
-
-	// запускаем инстанс в отдельном потоке
-	go wainstance.StartInstance(proxy, false)
+	go instance.WsQrClient.Read() //статичный метод
 }
 
 // Метод получает QR код авторизации GET запросом
@@ -432,6 +755,16 @@ func getQrCode(ctx *gin.Context) {
 		return
 	}
 
+	// получаем инстанс
+	instance, ok := getOrCreateInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
 	// считываем тело запроса
 	content, err := io.ReadAll(ctx.Request.Body)
 
@@ -439,7 +772,7 @@ func getQrCode(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error read body request: %v", err)
+		instance.Log.Errorf("Error read body request: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -460,7 +793,7 @@ func getQrCode(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error during parse RequestRunInstance: %v", err)
+		instance.Log.Errorf("Error during parse RequestRunInstance: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -475,7 +808,7 @@ func getQrCode(ctx *gin.Context) {
 	if requestRunInstance.Proxy == "" {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Missing proxy RequestRunInstance: %v", err)
+		instance.Log.Errorf("Missing proxy RequestRunInstance: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -493,7 +826,7 @@ func getQrCode(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error get proxy from string: %v", err)
+		instance.Log.Errorf("Error get proxy from string: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -505,24 +838,27 @@ func getQrCode(ctx *gin.Context) {
 	}
 
 	// если еще нет сообщения авторизации
-	if wainstance.InstanceWa.Client != nil && wainstance.InstanceWa.Client.AuthMessage != nil {
+	if instance.Client != nil && instance.Client.AuthMessage != nil {
 
 		// отдаем ответ
-		ctx.JSON(200, wainstance.InstanceWa.Client.AuthMessage)
+		ctx.JSON(200, instance.Client.AuthMessage)
 
 		// если тип сообщения ошибка ил данные аккаунта
-		if wainstance.InstanceWa.Client.AuthMessage.Type == "error" || wainstance.InstanceWa.Client.AuthMessage.Type == "account" {
+		if instance.Client.AuthMessage.Type == "error" || instance.Client.AuthMessage.Type == "account" {
 
 			// пишем nil сообщению авторизации
-			wainstance.InstanceWa.Client.AuthMessage = nil
+			instance.Client.AuthMessage = nil
 		}
 
 		// не продолжаем
 		return
 	}
 
-	// если клиент не nil и установлено сокет соединение с Whatsapp
-	if wainstance.InstanceWa.Client != nil && wainstance.InstanceWa.Client.IsConnected() {
+	// запускаем инстанс, прокси сохраняется, только если инстанс еще не подключен
+	err = instance.Start(proxy, false, &wainstance.StartSettings{Proxy: requestRunInstance.Proxy})
+
+	// если инстанс уже подключен
+	if errors.Is(err, wainstance.ErrAlreadyConnected) {
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -531,10 +867,19 @@ func getQrCode(ctx *gin.Context) {
 
 		// не продолжаем
 		return
-	}
+	} else if err != nil {
 
-	// запускаем инстанс в отдельном потоке
-	go wainstance.StartInstance(proxy, false)
+		// логируем ошибку
+		instance.Log.Errorf("Error save instance: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(500, gin.H{
+			"reason": "Error save instance",
+		})
+
+		// не продолжаем
+		return
+	}
 
 	// счетчик итераций
 	ePoch := 0
@@ -542,7 +887,7 @@ func getQrCode(ctx *gin.Context) {
 	for {
 
 		// если еще нет сообщения авторизации
-		if wainstance.InstanceWa.Client == nil || wainstance.InstanceWa.Client.AuthMessage == nil {
+		if instance.Client == nil || instance.Client.AuthMessage == nil {
 
 			// делаем задержку
 			time.Sleep(500 * time.Millisecond)
@@ -553,7 +898,7 @@ func getQrCode(ctx *gin.Context) {
 		} else {
 
 			// отдаем ответ
-			ctx.JSON(200, wainstance.InstanceWa.Client.AuthMessage)
+			ctx.JSON(200, instance.Client.AuthMessage)
 
 			// прерываем цикл
 			return
@@ -576,6 +921,16 @@ func sendMessage(ctx *gin.Context) {
 		return
 	}
 
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
 	// считываем тело запроса
 	content, err := io.ReadAll(ctx.Request.Body)
 
@@ -583,7 +938,7 @@ func sendMessage(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error read body request: %v", err)
+		instance.Log.Errorf("Error read body request: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -604,7 +959,7 @@ func sendMessage(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error during parse RequestSendMessage: %v", err)
+		instance.Log.Errorf("Error during parse RequestSendMessage: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -618,7 +973,7 @@ func sendMessage(ctx *gin.Context) {
 	//TODO проверять валидность данных
 
 	// проверяем клиента
-	if wainstance.InstanceWa.Client == nil {
+	if instance.Client == nil {
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -630,7 +985,7 @@ func sendMessage(ctx *gin.Context) {
 	}
 
 	// парсим идентифкатор Whatsapp, если chatId то его
-	recipient, ok := wainstance.ParseJID(strconv.FormatInt(requestSendMessage.Phone, 10))
+	recipient, ok := parseRecipient(requestSendMessage.ChatId, requestSendMessage.Phone)
 
 	// если не ок
 	if !ok {
@@ -644,10 +999,38 @@ func sendMessage(ctx *gin.Context) {
 		return
 	}
 
+	// создаем контекст ответа и пересылки
+	contextInfo, err := instance.BuildContextInfo(recipient, requestSendMessage.QuotedMessageId, requestSendMessage.IsForwarded)
+
+	// если сообщение не найдено
+	if errors.Is(err, wainstance.ErrQuotedMessageNotFound) {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": err.Error(),
+		})
+
+		// не продолжаем
+		return
+	} else if err != nil {
+
+		// выводим ошибку
+		instance.Log.Errorf("Error get quoted message: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(500, gin.H{
+			"reason": "Error get quoted message",
+		})
+
+		// не продолжаем
+		return
+	}
+
 	// кодируем сообщение
 	msg := &waProto.Message{
 		ExtendedTextMessage: &waProto.ExtendedTextMessage{
-			Text: proto.String(requestSendMessage.Message),
+			Text:        proto.String(requestSendMessage.Message),
+			ContextInfo: contextInfo,
 		},
 	}
 
@@ -657,13 +1040,13 @@ func sendMessage(ctx *gin.Context) {
 	}
 
 	// отправляем сообщение
-	resp, err := wainstance.InstanceWa.Client.SendMessage(context.Background(), recipient, msg, extra)
+	resp, err := instance.Client.SendMessage(context.Background(), recipient, msg, extra)
 
 	// если есть ошибка
 	if err != nil {
 
 		// выводим ошибку
-		wainstance.InstanceWa.Log.Errorf("Error sending message: %v", err)
+		instance.Log.Errorf("Error sending message: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(500, gin.H{
@@ -673,63 +1056,417 @@ func sendMessage(ctx *gin.Context) {
 	} else {
 
 		// выводим лог
-		wainstance.InstanceWa.Log.Infof("Message sent (server timestamp: %s)", resp.Timestamp)
+		instance.Log.Infof("Message sent (server timestamp: %s)", resp.Timestamp)
 
 		// отдаем ответ
 		ctx.JSON(200, gin.H{
 			"id": resp.ID,
 		})
 
-		// сериализуем сообщение
-		jsonData, err := json.Marshal(msg)
-
-		// создаем объект сообщения
-		dataMessage := properties.DataMessage{
-			ChatId:           recipient.String(),
-			MessageId:        resp.ID,
-			MessageTimestamp: uint64(resp.Timestamp.Unix()),
-			JsonData:         string(jsonData),
-			MessageStatus:    1,
-			StatusTimestamp:  uint64(resp.Timestamp.Unix()),
-		}
+		// сохраняем сообщение в историю и отправляем вебхук
+		instance.SaveSentMessage(recipient, msg, resp)
+	}
+}
 
-		// сохраняем сообщение в историю
-		err = wainstance.InstanceWa.Client.HistorySync([]properties.DataMessage{dataMessage})
+// максимальный размер отправляемого медиафайла
+const maxMediaSize = 100 * 1024 * 1024
 
-		// если ошибка
-		if err != nil {
+// таймаут скачивания медиафайла по ссылке
+const mediaDownloadTimeout = 2 * time.Minute
 
-			// выводим ошибку
-			wainstance.InstanceWa.Log.Errorf("error HistorySync %v", err)
-		}
+// максимальное количество редиректов при скачивании медиафайла по ссылке
+const maxMediaRedirects = 5
 
-		// создаем структуру вебхук о статусе сообщения
-		statusMessageWebhook := webhook.StatusMessageWebhook{
-			TypeWebhook:     "statusMessage",
-			WebhookUrl:      wainstance.InstanceWa.WebhookUrl,
-			CountTrySending: 0,
-			InstanceWhatsapp: webhook.InstanceWhatsappWebhook{
-				IdInstance: 0,
-				Wid:        wainstance.InstanceWa.Client.Store.ID.User + "@c.us",
-			},
-			Timestamp: time.Now().Unix(),
-			StatusMessage: webhook.DataStatusMessage{
-				IdMessage:       resp.ID,
-				TimestampStatus: resp.Timestamp.Unix(),
-				Status:          "sent",
-			},
-		}
+// сеть CGNAT (100.64.0.0/10), которую net.IP не считает приватной
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
 
-		// отправляем вебхук
-		statusMessageWebhook.SendStatusMessageWebhook(wainstance.InstanceWa.Log)
-	}
+// Метод проверяет, что адрес доступен из интернета, а не указывает на локальную
+// или внутреннюю сеть (loopback, приватные сети, link-local с адресами метаданных облака и т.д.)
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() && !sharedAddressSpace.Contains(ip)
 }
 
-// Метод отдает контакты инстанса
-func getContacts(ctx *gin.Context) {
+// Метод вызывается перед каждым подключением, уже после резолва DNS, поэтому проверяет
+// реальный адрес, к которому идет подключение, в том числе при редиректах
+func checkMediaDialAddress(network, address string, _ syscall.RawConn) error {
 
-	// если запрос не валиден
-	if !isValidRequest(ctx) {
+	host, _, err := net.SplitHostPort(address)
+
+	// если ошибка
+	if err != nil {
+		return err
+	}
+
+	// если адрес не публичный
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("downloading from non-public address %s is not allowed", host)
+	}
+
+	return nil
+}
+
+// Отдельный клиент для скачивания медиафайлов по ссылкам от пользователя,
+// который не ходит в локальную сеть и не следует за редиректами бесконечно
+var mediaDownloadClient = &http.Client{
+	Timeout: mediaDownloadTimeout,
+	Transport: &http.Transport{
+		// прокси из окружения не используется, иначе проверялся бы только адрес прокси
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: checkMediaDialAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+
+		// если слишком много редиректов
+		if len(via) >= maxMediaRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxMediaRedirects)
+		}
+
+		// если редирект не на http
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to unsupported url scheme %q", req.URL.Scheme)
+		}
+
+		return nil
+	},
+}
+
+// Метод создает обработчик отправки медиафайла
+func sendMedia(kind wainstance.MediaKind) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+
+		// если запрос не валиден
+		if !isValidRequest(ctx) {
+
+			// отдаем ответ
+			ctx.JSON(400, gin.H{
+				"reason": "Bad request header",
+			})
+
+			// не продолжаем
+			return
+		}
+
+		// получаем инстанс
+		instance, ok := getInstance(ctx)
+
+		// если инстанс не получен
+		if !ok {
+
+			// не продолжаем
+			return
+		}
+
+		// если инстнанс не подключен, либо не авторизован
+		if !instance.IsConnectAndAuth() {
+
+			// отдаем ответ
+			ctx.JSON(400, gin.H{
+				"reason": "Instance not connected or not auth",
+			})
+
+			// не продолжаем
+			return
+		}
+
+		// ограничиваем размер запроса
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxMediaSize+1024*1024)
+
+		// считываем запрос и файл
+		requestSendMedia, file, err := readMediaRequest(ctx)
+
+		// если есть ошибка
+		if err != nil {
+
+			// логируем ошибку
+			instance.Log.Errorf("Error read send %s request: %v", kind, err)
+
+			// отдаем ответ
+			ctx.JSON(400, gin.H{
+				"reason": "Bad request data: " + err.Error(),
+			})
+
+			// не продолжаем
+			return
+		}
+
+		// получаем получателя
+		recipient, ok := parseRecipient(requestSendMedia.ChatId, requestSendMedia.Phone)
+
+		// если не ок
+		if !ok {
+
+			// отдаем ответ
+			ctx.JSON(400, gin.H{
+				"reason": "Bad request data",
+			})
+
+			// не продолжаем
+			return
+		}
+
+		// создаем контекст ответа и пересылки
+		contextInfo, err := instance.BuildContextInfo(recipient, requestSendMedia.QuotedMessageId, requestSendMedia.IsForwarded)
+
+		// если сообщение не найдено
+		if errors.Is(err, wainstance.ErrQuotedMessageNotFound) {
+
+			// отдаем ответ
+			ctx.JSON(400, gin.H{
+				"reason": err.Error(),
+			})
+
+			// не продолжаем
+			return
+		} else if err != nil {
+
+			// выводим ошибку
+			instance.Log.Errorf("Error get quoted message: %v", err)
+
+			// отдаем ответ
+			ctx.JSON(500, gin.H{
+				"reason": "Error get quoted message",
+			})
+
+			// не продолжаем
+			return
+		}
+
+		// загружаем файл и создаем сообщение
+		msg, err := instance.BuildMediaMessage(ctx.Request.Context(), kind, file, contextInfo)
+
+		// если есть ошибка
+		if err != nil {
+
+			// выводим ошибку
+			instance.Log.Errorf("Error upload media: %v", err)
+
+			// отдаем ответ
+			ctx.JSON(500, gin.H{
+				"reason": "Error upload media: " + err.Error(),
+			})
+
+			// не продолжаем
+			return
+		}
+
+		// отправляем сообщение
+		resp, err := instance.Client.SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{
+			ID: requestSendMedia.Id,
+		})
+
+		// если есть ошибка
+		if err != nil {
+
+			// выводим ошибку
+			instance.Log.Errorf("Error sending %s message: %v", kind, err)
+
+			// отдаем ответ
+			ctx.JSON(500, gin.H{
+				"reason": "Error sending message: " + err.Error(),
+			})
+
+			// не продолжаем
+			return
+		}
+
+		// выводим лог
+		instance.Log.Infof("%s message sent (server timestamp: %s)", kind, resp.Timestamp)
+
+		// отдаем ответ
+		ctx.JSON(200, gin.H{
+			"id": resp.ID,
+		})
+
+		// сохраняем сообщение в историю и отправляем вебхук
+		instance.SaveSentMessage(recipient, msg, resp)
+	}
+}
+
+// Метод считывает запрос отправки медиафайла из multipart формы или JSON со ссылкой на файл
+func readMediaRequest(ctx *gin.Context) (properties.RequestSendMedia, wainstance.MediaFile, error) {
+
+	var requestSendMedia properties.RequestSendMedia
+
+	var file wainstance.MediaFile
+
+	// если файл загружен формой
+	if ctx.ContentType() == "multipart/form-data" {
+
+		// считываем поля формы
+		if err := ctx.ShouldBind(&requestSendMedia); err != nil {
+			return requestSendMedia, file, err
+		}
+
+		fileHeader, err := ctx.FormFile("file")
+
+		// если файла нет
+		if err != nil {
+			return requestSendMedia, file, fmt.Errorf("missing file: %w", err)
+		}
+
+		// если файл слишком большой
+		if fileHeader.Size > maxMediaSize {
+			return requestSendMedia, file, fmt.Errorf("file is larger than %d bytes", maxMediaSize)
+		}
+
+		formFile, err := fileHeader.Open()
+
+		// если ошибка
+		if err != nil {
+			return requestSendMedia, file, err
+		}
+
+		defer formFile.Close()
+
+		file.Data, err = io.ReadAll(formFile)
+
+		// если ошибка
+		if err != nil {
+			return requestSendMedia, file, err
+		}
+
+		file.FileName = fileHeader.Filename
+
+		// если тип файла указан в форме
+		if contentType := fileHeader.Header.Get("Content-Type"); contentType != "" && contentType != "application/octet-stream" {
+			file.Mimetype = contentType
+		}
+	} else {
+
+		// считываем тело запроса
+		content, err := io.ReadAll(ctx.Request.Body)
+
+		// если ошибка
+		if err != nil {
+			return requestSendMedia, file, err
+		}
+
+		// лесериализуем из JSON
+		if err = json.Unmarshal(content, &requestSendMedia); err != nil {
+			return requestSendMedia, file, err
+		}
+
+		// если ссылка не указана
+		if requestSendMedia.Url == "" {
+			return requestSendMedia, file, errors.New("missing file or url")
+		}
+
+		// скачиваем файл
+		file, err = downloadMedia(ctx.Request.Context(), requestSendMedia.Url)
+
+		// если ошибка
+		if err != nil {
+			return requestSendMedia, file, err
+		}
+	}
+
+	// если файл пустой
+	if len(file.Data) == 0 {
+		return requestSendMedia, file, errors.New("file is empty")
+	}
+
+	// поля запроса заменяют данные файла
+	if requestSendMedia.FileName != "" {
+		file.FileName = requestSendMedia.FileName
+	}
+	if requestSendMedia.Mimetype != "" {
+		file.Mimetype = requestSendMedia.Mimetype
+	}
+
+	file.Caption = requestSendMedia.Caption
+
+	return requestSendMedia, file, nil
+}
+
+// Метод скачивает медиафайл по ссылке
+func downloadMedia(ctx context.Context, mediaUrl string) (wainstance.MediaFile, error) {
+
+	var file wainstance.MediaFile
+
+	ctx, cancel := context.WithTimeout(ctx, mediaDownloadTimeout)
+
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaUrl, nil)
+
+	// если ошибка
+	if err != nil {
+		return file, fmt.Errorf("bad url: %w", err)
+	}
+
+	// если ссылка не http
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return file, fmt.Errorf("unsupported url scheme %q", req.URL.Scheme)
+	}
+
+	res, err := mediaDownloadClient.Do(req)
+
+	// если ошибка
+	if err != nil {
+		return file, fmt.Errorf("failed to download file: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	// если файл не получен
+	if res.StatusCode != http.StatusOK {
+		return file, fmt.Errorf("failed to download file: unexpected response status %d", res.StatusCode)
+	}
+
+	file.Data, err = io.ReadAll(io.LimitReader(res.Body, maxMediaSize+1))
+
+	// если ошибка
+	if err != nil {
+		return file, fmt.Errorf("failed to download file: %w", err)
+	} else if len(file.Data) > maxMediaSize {
+		return file, fmt.Errorf("file is larger than %d bytes", maxMediaSize)
+	}
+
+	// если тип файла указан сервером
+	if contentType := res.Header.Get("Content-Type"); contentType != "" && contentType != "application/octet-stream" {
+		file.Mimetype = contentType
+	}
+
+	file.FileName = path.Base(req.URL.Path)
+
+	// если имя файла не удалось получить
+	if file.FileName == "/" || file.FileName == "." {
+		file.FileName = ""
+	}
+
+	return file, nil
+}
+
+// Метод получает получателя по идентификатору чата или номеру телефона
+func parseRecipient(chatId string, phone int64) (types.JID, bool) {
+
+	// если указан идентификатор чата
+	if chatId != "" {
+		return wainstance.ParseJID(chatId)
+	}
+
+	// если номер не указан
+	if phone == 0 {
+		return types.EmptyJID, false
+	}
+
+	return wainstance.ParseJID(strconv.FormatInt(phone, 10))
+}
+
+// Метод отдает контакты инстанса
+func getContacts(ctx *gin.Context) {
+
+	// если запрос не валиден
+	if !isValidRequest(ctx) {
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -740,8 +1477,18 @@ func getContacts(ctx *gin.Context) {
 		return
 	}
 
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
 	// если инстнанс не подключен, либо не авторизован
-	if !isConnectAndAuth() {
+	if !instance.IsConnectAndAuth() {
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -753,12 +1500,12 @@ func getContacts(ctx *gin.Context) {
 	}
 
 	// получаем контакты
-	contacts, err := wainstance.InstanceWa.Client.Store.Contacts.GetAllContacts()
+	contacts, err := instance.Client.Store.Contacts.GetAllContacts()
 
 	//если ошибка
 	if err != nil {
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error get contacts: %v", err)
+		instance.Log.Errorf("Error get contacts: %v", err)
 	}
 
 	// отдаем ответ
@@ -780,8 +1527,18 @@ func checkWhatsapp(ctx *gin.Context) {
 		return
 	}
 
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
 	// если инстнанс не подключен, либо не авторизован
-	if !isConnectAndAuth() {
+	if !instance.IsConnectAndAuth() {
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -799,7 +1556,7 @@ func checkWhatsapp(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error read body request: %v", err)
+		instance.Log.Errorf("Error read body request: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -820,7 +1577,7 @@ func checkWhatsapp(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error during parse RequestSendMessage: %v", err)
+		instance.Log.Errorf("Error during parse RequestSendMessage: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -832,7 +1589,7 @@ func checkWhatsapp(ctx *gin.Context) {
 	}
 
 	// проверяем на Whatsapp
-	resp, err := wainstance.InstanceWa.Client.IsOnWhatsApp([]string{requestWithPhoneNumber.Phone})
+	resp, err := instance.Client.IsOnWhatsApp([]string{requestWithPhoneNumber.Phone})
 
 	// если ошибка
 	if err != nil {
@@ -854,13 +1611,13 @@ func checkWhatsapp(ctx *gin.Context) {
 
 				responseCheckWhatsapp.IsBusiness = true
 
-				wainstance.InstanceWa.Log.Infof("%s: on whatsapp: %t, JID: %s, business name: %s", item.Query, item.IsIn, item.JID, item.VerifiedName.Details.GetVerifiedName())
+				instance.Log.Infof("%s: on whatsapp: %t, JID: %s, business name: %s", item.Query, item.IsIn, item.JID, item.VerifiedName.Details.GetVerifiedName())
 
 			} else {
 
 				responseCheckWhatsapp.WhatsappOnPhone = item.IsIn
 
-				wainstance.InstanceWa.Log.Infof("%s: on whatsapp: %t, JID: %s", item.Query, item.IsIn, item.JID)
+				instance.Log.Infof("%s: on whatsapp: %t, JID: %s", item.Query, item.IsIn, item.JID)
 			}
 		}
 
@@ -884,8 +1641,18 @@ func logoutInstance(ctx *gin.Context) {
 		return
 	}
 
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
 	// если инстнанс не подключен, либо не авторизован
-	if !isConnectAndAuth() {
+	if !instance.IsConnectAndAuth() {
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -897,7 +1664,7 @@ func logoutInstance(ctx *gin.Context) {
 	}
 
 	// разлогиваем инстанс
-	err := wainstance.InstanceWa.Client.Logout()
+	err := instance.Client.Logout()
 
 	// если ошибка
 	if err != nil {
@@ -932,8 +1699,18 @@ func getProfilePicture(ctx *gin.Context) {
 		return
 	}
 
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
 	// если инстнанс не подключен, либо не авторизован
-	if !isConnectAndAuth() {
+	if !instance.IsConnectAndAuth() {
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -951,7 +1728,7 @@ func getProfilePicture(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error read body request: %v", err)
+		instance.Log.Errorf("Error read body request: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -972,7 +1749,7 @@ func getProfilePicture(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error during parse RequestSendMessage: %v", err)
+		instance.Log.Errorf("Error during parse RequestSendMessage: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -999,7 +1776,7 @@ func getProfilePicture(ctx *gin.Context) {
 	}
 
 	// получаем профиль
-	pic, err := wainstance.InstanceWa.Client.GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{
+	pic, err := instance.Client.GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{
 		Preview:     false,
 		IsCommunity: false,
 		ExistingID:  "",
@@ -1007,7 +1784,7 @@ func getProfilePicture(ctx *gin.Context) {
 
 	if err != nil {
 
-		wainstance.InstanceWa.Log.Errorf("Failed to get avatar: %v", err)
+		instance.Log.Errorf("Failed to get avatar: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1045,8 +1822,18 @@ func getStatusAccount(ctx *gin.Context) {
 		return
 	}
 
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
 	// если инстнанс не подключен, либо не авторизован
-	if !isConnectAndAuth() {
+	if !instance.IsConnectAndAuth() {
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1064,7 +1851,7 @@ func getStatusAccount(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error read body request: %v", err)
+		instance.Log.Errorf("Error read body request: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1085,7 +1872,7 @@ func getStatusAccount(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error during parse RequestSendMessage: %v", err)
+		instance.Log.Errorf("Error during parse RequestSendMessage: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1097,16 +1884,16 @@ func getStatusAccount(ctx *gin.Context) {
 	}
 
 	// создаем канал связки потоков
-	wainstance.InstanceWa.ChainResponseGetStatusAccount = make(chan properties.ResponseGetStatusAccount)
+	instance.ChainResponseGetStatusAccount = make(chan properties.ResponseGetStatusAccount)
 
 	// делаем себя недоступным
-	err = wainstance.SetPresence("unavailable")
+	err = instance.SetPresence("unavailable")
 
 	// если ошибка
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error SetPresence: %v", err)
+		instance.Log.Errorf("Error SetPresence: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1121,13 +1908,13 @@ func getStatusAccount(ctx *gin.Context) {
 	time.Sleep(300 * time.Millisecond)
 
 	//делаем себя доступным
-	err = wainstance.SetPresence("available")
+	err = instance.SetPresence("available")
 
 	// если ошибка
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error SetPresence: %v", err)
+		instance.Log.Errorf("Error SetPresence: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1139,13 +1926,13 @@ func getStatusAccount(ctx *gin.Context) {
 	}
 
 	// подписываемся на пользователя
-	err = wainstance.SubscribePresence(requestWithPhoneNumber.Phone)
+	err = instance.SubscribePresence(requestWithPhoneNumber.Phone)
 
 	// если ошибка
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error SubscribePresence: %v", err)
+		instance.Log.Errorf("Error SubscribePresence: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1157,19 +1944,19 @@ func getStatusAccount(ctx *gin.Context) {
 	}
 
 	// получаем из канала данные о пользователе
-	responseGetStatusAccount := <-wainstance.InstanceWa.ChainResponseGetStatusAccount
+	responseGetStatusAccount := <-instance.ChainResponseGetStatusAccount
 
 	// ставим nil каналу
-	wainstance.InstanceWa.ChainResponseGetStatusAccount = nil
+	instance.ChainResponseGetStatusAccount = nil
 
 	// получаем данные пользователя
-	resp, err := wainstance.GetUser(requestWithPhoneNumber.Phone)
+	resp, err := instance.GetUser(requestWithPhoneNumber.Phone)
 
 	// делаем себя недоступным
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error GetUser: %v", err)
+		instance.Log.Errorf("Error GetUser: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1209,8 +1996,18 @@ func setStatusAccount(ctx *gin.Context) {
 		return
 	}
 
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
 	// если инстнанс не подключен, либо не авторизован
-	if !isConnectAndAuth() {
+	if !instance.IsConnectAndAuth() {
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1228,7 +2025,7 @@ func setStatusAccount(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error read body request: %v", err)
+		instance.Log.Errorf("Error read body request: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1249,7 +2046,7 @@ func setStatusAccount(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error during parse RequestSendMessage: %v", err)
+		instance.Log.Errorf("Error during parse RequestSendMessage: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1261,13 +2058,13 @@ func setStatusAccount(ctx *gin.Context) {
 	}
 
 	// получаем из канала данные о пользователе
-	err = wainstance.InstanceWa.Client.SetStatusMessage(requestSetStatus.Status)
+	err = instance.Client.SetStatusMessage(requestSetStatus.Status)
 
 	// если есть ошибка
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error during parse RequestSendMessage: %v", err)
+		instance.Log.Errorf("Error during parse RequestSendMessage: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1299,8 +2096,18 @@ func setWebhookUrl(ctx *gin.Context) {
 		return
 	}
 
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
 	// если инстнанс не подключен, либо не авторизован
-	if !isConnectAndAuth() {
+	if !instance.IsConnectAndAuth() {
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1318,7 +2125,7 @@ func setWebhookUrl(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error read body request: %v", err)
+		instance.Log.Errorf("Error read body request: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1339,7 +2146,7 @@ func setWebhookUrl(ctx *gin.Context) {
 	if err != nil {
 
 		// логируем ошибку
-		wainstance.InstanceWa.Log.Errorf("Error during parse RequestSendMessage: %v", err)
+		instance.Log.Errorf("Error during parse RequestSendMessage: %v", err)
 
 		// отдаем ответ
 		ctx.JSON(400, gin.H{
@@ -1351,10 +2158,975 @@ func setWebhookUrl(ctx *gin.Context) {
 	}
 
 	//пишем webhook URL
-	wainstance.InstanceWa.WebhookUrl = requestSetWebhookUrl.WebhookUrl
+	err = instance.SetWebhookUrl(requestSetWebhookUrl.WebhookUrl)
 
-	// отдаем ответ
-	ctx.JSON(200, gin.H{
-		"success": true,
+	// если есть ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error save instance: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(500, gin.H{
+			"reason": "Error save instance",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, gin.H{
+		"success": true,
+	})
+}
+
+// Метод выбирает типы вебхуков, которые получает инстанс
+func setWebhookTypes(ctx *gin.Context) {
+
+	// если запрос не валиден
+	if !isValidRequest(ctx) {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request header",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
+	// считываем тело запроса
+	content, err := io.ReadAll(ctx.Request.Body)
+
+	// если есть ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error read body request: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request data",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// объявляем структуру запроса выбора типов вебхуков
+	var requestSetWebhookTypes properties.RequestSetWebhookTypes
+
+	// лесериализуем из JSON
+	err = json.Unmarshal(content, &requestSetWebhookTypes)
+
+	// если есть ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error during parse RequestSetWebhookTypes: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request data",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// пишем типы вебхуков
+	err = instance.SetWebhookTypes(requestSetWebhookTypes.WebhookTypes)
+
+	// если неизвестный тип
+	if errors.Is(err, wainstance.ErrUnknownWebhookType) {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason":       err.Error(),
+			"webhookTypes": webhook.Types,
+		})
+
+		// не продолжаем
+		return
+	} else if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error save instance: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(500, gin.H{
+			"reason": "Error save instance",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, gin.H{
+		"success": true,
+	})
+}
+
+// Метод отдает список инстансов
+func getInstances(ctx *gin.Context) {
+
+	// если запрос не валиден
+	if !isValidRequest(ctx) {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request header",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем инстансы
+	instances := wainstance.GetAllInstances()
+
+	// создаем ответ
+	response := make([]properties.ResponseInstance, 0, len(instances))
+
+	// обходим инстансы
+	for _, instance := range instances {
+
+		// добавляем данные инстанса
+		response = append(response, properties.ResponseInstance{
+			IdInstance:   instance.IdInstance,
+			Jid:          instance.GetJid(),
+			WebhookUrl:   instance.GetWebhookUrl(),
+			WebhookTypes: instance.GetWebhookTypes(),
+			IsConnected:  instance.Client != nil && instance.Client.IsConnected(),
+			IsLoggedIn:   instance.Client != nil && instance.Client.IsLoggedIn(),
+		})
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, response)
+}
+
+// Метод останавливает и удаляет инстанс, не разлогинивая его
+func deleteInstance(ctx *gin.Context) {
+
+	// если запрос не валиден
+	if !isValidRequest(ctx) {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request header",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// парсим идентификатор инстанса
+	idInstance, ok := parseIdInstance(ctx)
+
+	// если не ок
+	if !ok {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Missing or bad idInstance",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// удаляем инстанс
+	err := wainstance.DeleteInstance(idInstance)
+
+	// если ошибка
+	if err != nil {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": err.Error(),
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, gin.H{
+		"success": true,
+	})
+}
+
+// максимальное количество сообщений на странице истории
+const maxChatHistoryCount = 1000
+
+// количество сообщений на странице истории по умолчанию
+const defaultChatHistoryCount = 100
+
+// Метод отдает страницу истории чата
+func getChatHistory(ctx *gin.Context) {
+
+	// если запрос не валиден
+	if !isValidRequest(ctx) {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request header",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
+	// если инстнанс не подключен, либо не авторизован
+	if !instance.IsConnectAndAuth() {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Instance not connected or not auth",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// считываем тело запроса
+	content, err := io.ReadAll(ctx.Request.Body)
+
+	// если есть ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error read body request: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request data",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// объявляем структуру запроса истории чата
+	var requestGetChatHistory properties.RequestGetChatHistory
+
+	// лесериализуем из JSON
+	err = json.Unmarshal(content, &requestGetChatHistory)
+
+	// если есть ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error during parse RequestGetChatHistory: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request data",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// парсим идентификатор чата
+	chat, ok := wainstance.ParseJID(requestGetChatHistory.ChatId)
+
+	// если не ок
+	if !ok {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Error parse chatId",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// количество сообщений на странице
+	count := requestGetChatHistory.Count
+
+	// если количество не указано
+	if count <= 0 {
+		count = defaultChatHistoryCount
+	} else if count > maxChatHistoryCount {
+		count = maxChatHistoryCount
+	}
+
+	// получаем историю чата
+	messages, err := instance.Client.Store.History.GetChatHistory(chat.String(), store.HistoryCursor{
+		MessageTimestamp: requestGetChatHistory.BeforeTimestamp,
+		MessageId:        requestGetChatHistory.BeforeIdMessage,
+	}, count)
+
+	// если ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error get chat history: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(500, gin.H{
+			"reason": "Error get chat history",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// создаем ответ
+	response := properties.ResponseChatHistory{
+		Messages: make([]properties.ResponseHistoryMessage, 0, len(messages)),
+	}
+
+	// обходим сообщения
+	for _, message := range messages {
+		response.Messages = append(response.Messages, properties.NewResponseHistoryMessage(message))
+	}
+
+	// если страница заполнена, то может быть следующая
+	if len(messages) == count {
+
+		// пишем курсор следующей страницы
+		cursor := messages[len(messages)-1].Cursor()
+		response.NextBeforeTimestamp = cursor.MessageTimestamp
+		response.NextBeforeIdMessage = cursor.MessageId
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, response)
+}
+
+// Метод отдает сообщение из истории
+func getMessage(ctx *gin.Context) {
+
+	// если запрос не валиден
+	if !isValidRequest(ctx) {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request header",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
+	// если инстнанс не подключен, либо не авторизован
+	if !instance.IsConnectAndAuth() {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Instance not connected or not auth",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// считываем тело запроса
+	content, err := io.ReadAll(ctx.Request.Body)
+
+	// если есть ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error read body request: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request data",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// объявляем структуру запроса сообщения
+	var requestGetMessage properties.RequestGetMessage
+
+	// лесериализуем из JSON
+	err = json.Unmarshal(content, &requestGetMessage)
+
+	// если есть ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error during parse RequestGetMessage: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request data",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// парсим идентификатор чата
+	chat, ok := wainstance.ParseJID(requestGetMessage.ChatId)
+
+	// если не ок
+	if !ok || requestGetMessage.IdMessage == "" {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request data",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем сообщение
+	message, err := instance.Client.Store.History.GetMessage(chat.String(), requestGetMessage.IdMessage)
+
+	// если ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error get message: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(500, gin.H{
+			"reason": "Error get message",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// если сообщение не найдено
+	if message == nil {
+
+		// отдаем ответ
+		ctx.JSON(404, gin.H{
+			"reason": "Message not found",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, properties.NewResponseHistoryMessage(*message))
+}
+
+// Метод ищет сообщения в истории по тексту
+func searchMessages(ctx *gin.Context) {
+
+	// если запрос не валиден
+	if !isValidRequest(ctx) {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request header",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
+	// если инстнанс не подключен, либо не авторизован
+	if !instance.IsConnectAndAuth() {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Instance not connected or not auth",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// считываем тело запроса
+	content, err := io.ReadAll(ctx.Request.Body)
+
+	// если есть ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error read body request: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request data",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// объявляем структуру запроса поиска
+	var requestSearchMessages properties.RequestSearchMessages
+
+	// лесериализуем из JSON
+	err = json.Unmarshal(content, &requestSearchMessages)
+
+	// если есть ошибка, либо не указан текст поиска
+	if err != nil || strings.TrimSpace(requestSearchMessages.Query) == "" {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error during parse RequestSearchMessages: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request data",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// чат поиска, пустой - поиск по всем чатам
+	chatId := ""
+
+	// если чат указан
+	if requestSearchMessages.ChatId != "" {
+
+		// парсим идентификатор чата
+		chat, ok := wainstance.ParseJID(requestSearchMessages.ChatId)
+
+		// если не ок
+		if !ok {
+
+			// отдаем ответ
+			ctx.JSON(400, gin.H{
+				"reason": "Error parse chatId",
+			})
+
+			// не продолжаем
+			return
+		}
+
+		// запоминаем чат
+		chatId = chat.String()
+	}
+
+	// границы периода поиска, нулевое время - без ограничения
+	var from, to time.Time
+
+	// если указано начало периода
+	if requestSearchMessages.FromTimestamp > 0 {
+		from = time.Unix(requestSearchMessages.FromTimestamp, 0)
+	}
+
+	// если указан конец периода
+	if requestSearchMessages.ToTimestamp > 0 {
+		to = time.Unix(requestSearchMessages.ToTimestamp, 0)
+	}
+
+	// количество найденных сообщений
+	count := requestSearchMessages.Count
+
+	// если количество не указано
+	if count <= 0 {
+		count = defaultChatHistoryCount
+	} else if count > maxChatHistoryCount {
+		count = maxChatHistoryCount
+	}
+
+	// ищем сообщения
+	messages, err := instance.Client.Store.History.SearchMessages(requestSearchMessages.Query, chatId, from, to, count)
+
+	// если ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error search messages: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(500, gin.H{
+			"reason": "Error search messages",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// создаем ответ
+	response := properties.ResponseSearchMessages{
+		Messages: make([]properties.ResponseHistoryMessage, 0, len(messages)),
+	}
+
+	// обходим сообщения
+	for _, message := range messages {
+		response.Messages = append(response.Messages, properties.NewResponseHistoryMessage(message))
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, response)
+}
+
+// Метод отдает список чатов из истории с последним сообщением
+func listChats(ctx *gin.Context) {
+
+	// если запрос не валиден
+	if !isValidRequest(ctx) {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request header",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
+	// если инстнанс не подключен, либо не авторизован
+	if !instance.IsConnectAndAuth() {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Instance not connected or not auth",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем чаты
+	chats, err := instance.Client.Store.History.ListChats()
+
+	// если ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error list chats: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(500, gin.H{
+			"reason": "Error list chats",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// создаем ответ
+	response := make([]properties.ResponseHistoryChat, 0, len(chats))
+
+	// обходим чаты
+	for _, chat := range chats {
+
+		// добавляем чат
+		response = append(response, properties.ResponseHistoryChat{
+			ChatId:       chat.ChatId,
+			MessageCount: chat.MessageCount,
+			LastMessage:  properties.NewResponseHistoryMessage(chat.LastMessage),
+		})
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, response)
+}
+
+// Метод отдает список чатов со счетчиками непрочитанных сообщений
+func getChats(ctx *gin.Context) {
+
+	// если запрос не валиден
+	if !isValidRequest(ctx) {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request header",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
+	// если инстнанс не подключен, либо не авторизован
+	if !instance.IsConnectAndAuth() {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Instance not connected or not auth",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем чаты
+	chats, err := instance.Client.GetChats()
+
+	// если ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error get chats: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(500, gin.H{
+			"reason": "Error get chats",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// создаем ответ
+	response := make([]properties.ResponseChat, 0, len(chats))
+
+	// обходим чаты
+	for _, chat := range chats {
+
+		// добавляем чат
+		response = append(response, properties.NewResponseChat(chat))
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, response)
+}
+
+// максимальное количество недоставленных вебхуков в ответе
+const maxFailedWebhooksCount = 1000
+
+// Метод отдает вебхуки инстанса, которые не удалось доставить за все попытки
+func getFailedWebhooks(ctx *gin.Context) {
+
+	// если запрос не валиден
+	if !isValidRequest(ctx) {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request header",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
+	count := maxFailedWebhooksCount
+
+	// если указано количество
+	if countParam := ctx.Query("count"); countParam != "" {
+
+		parsed, err := strconv.Atoi(countParam)
+
+		// если количество не валидно
+		if err != nil || parsed <= 0 {
+
+			// отдаем ответ
+			ctx.JSON(400, gin.H{
+				"reason": "Bad count",
+			})
+
+			// не продолжаем
+			return
+		}
+
+		// ограничиваем количество
+		if parsed < count {
+			count = parsed
+		}
+	}
+
+	// получаем недоставленные вебхуки
+	deadLetters, err := webhook.DeliveryQueue.GetDeadLetters(instance.IdInstance, count)
+
+	// если ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error get failed webhooks: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(500, gin.H{
+			"reason": "Error get failed webhooks",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// создаем ответ
+	response := make([]properties.ResponseFailedWebhook, 0, len(deadLetters))
+
+	// обходим вебхуки
+	for _, deadLetter := range deadLetters {
+
+		// добавляем данные вебхука
+		response = append(response, properties.ResponseFailedWebhook{
+			Id:          deadLetter.Id,
+			WebhookUrl:  deadLetter.WebhookUrl,
+			TypeWebhook: deadLetter.TypeWebhook,
+			Attempts:    deadLetter.Attempts,
+			LastError:   deadLetter.LastError,
+			CreatedAt:   deadLetter.CreatedAt,
+			FailedAt:    deadLetter.FailedAt,
+			Body:        json.RawMessage(deadLetter.Body),
+		})
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, response)
+}
+
+// Метод возвращает недоставленные вебхуки инстанса в очередь доставки
+func replayFailedWebhooks(ctx *gin.Context) {
+
+	// если запрос не валиден
+	if !isValidRequest(ctx) {
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request header",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// получаем инстанс
+	instance, ok := getInstance(ctx)
+
+	// если инстанс не получен
+	if !ok {
+
+		// не продолжаем
+		return
+	}
+
+	// считываем тело запроса
+	content, err := io.ReadAll(ctx.Request.Body)
+
+	// если есть ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error read body request: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(400, gin.H{
+			"reason": "Bad request data",
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// объявляем структуру запроса
+	var requestReplay properties.RequestReplayFailedWebhooks
+
+	// если тело не пустое, то это список вебхуков, иначе повторяем все
+	if len(content) > 0 {
+
+		// лесериализуем из JSON
+		err = json.Unmarshal(content, &requestReplay)
+
+		// если есть ошибка
+		if err != nil {
+
+			// логируем ошибку
+			instance.Log.Errorf("Error during parse RequestReplayFailedWebhooks: %v", err)
+
+			// отдаем ответ
+			ctx.JSON(400, gin.H{
+				"reason": "Bad request data",
+			})
+
+			// не продолжаем
+			return
+		}
+	}
+
+	// возвращаем вебхуки в очередь на текущий webhook URL инстанса
+	replayed, err := webhook.DeliveryQueue.ReplayDeadLetters(instance.IdInstance, requestReplay.Ids, instance.GetWebhookUrl())
+
+	// если ошибка
+	if err != nil {
+
+		// логируем ошибку
+		instance.Log.Errorf("Error replay failed webhooks: %v", err)
+
+		// отдаем ответ
+		ctx.JSON(500, gin.H{
+			"reason":   "Error replay failed webhooks",
+			"replayed": replayed,
+		})
+
+		// не продолжаем
+		return
+	}
+
+	// отдаем ответ
+	ctx.JSON(200, gin.H{
+		"success":  true,
+		"replayed": replayed,
 	})
 }
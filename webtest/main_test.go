@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+
+	for _, test := range []struct {
+		ip     string
+		public bool
+	}{
+		// loopback
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"::1", false},
+
+		// приватные сети RFC1918 и ULA
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+
+		// link-local, в том числе адрес метаданных облака
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+
+		// IPv4 адреса, записанные как IPv6
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+
+		// CGNAT, неуказанные и multicast адреса
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+
+		// публичные адреса
+		{"8.8.8.8", true},
+		{"172.32.0.1", true},
+		{"100.128.0.1", true},
+		{"::ffff:8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+	} {
+		ip := net.ParseIP(test.ip)
+
+		if ip == nil {
+			t.Fatalf("Failed to parse %s", test.ip)
+		}
+
+		if public := isPublicIP(ip); public != test.public {
+			t.Errorf("Expected %s to be public: %t, got %t", test.ip, test.public, public)
+		}
+	}
+}
+
+func TestCheckMediaDialAddress(t *testing.T) {
+
+	for _, test := range []struct {
+		address string
+		allowed bool
+	}{
+		{"8.8.8.8:443", true},
+		{"[2001:4860:4860::8888]:80", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"192.168.0.1:443", false},
+		{"169.254.169.254:80", false},
+
+		// адрес должен быть уже резолвнут, имя хоста не пропускается
+		{"example.com:80", false},
+
+		// адрес без порта
+		{"8.8.8.8", false},
+	} {
+		if err := checkMediaDialAddress("tcp", test.address, nil); (err == nil) != test.allowed {
+			t.Errorf("Expected %s to be allowed: %t, got error %v", test.address, test.allowed, err)
+		}
+	}
+}
+
+func TestMediaDownloadClient_PrivateAddress(t *testing.T) {
+
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+
+	defer server.Close()
+
+	serverUrl, err := url.Parse(server.URL)
+
+	if err != nil {
+		t.Fatalf("Failed to parse server URL: %v", err)
+	}
+
+	// имя хоста, которое резолвится в локальный адрес, как при DNS rebinding:
+	// проверка делается при подключении по реальному адресу, а не по имени из ссылки
+	for _, host := range []string{serverUrl.Host, "localhost:" + serverUrl.Port()} {
+
+		res, err := mediaDownloadClient.Get("http://" + host + "/file.jpg")
+
+		if err == nil {
+			_ = res.Body.Close()
+			t.Errorf("Expected download from %s to be rejected", host)
+		}
+	}
+
+	if count := atomic.LoadInt32(&requests); count != 0 {
+		t.Errorf("Expected no requests to reach the local server, got %d", count)
+	}
+}
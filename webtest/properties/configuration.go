@@ -3,6 +3,7 @@ package properties
 import (
 	"fmt"
 	"go.mau.fi/whatsmeow/socket"
+	"go.mau.fi/whatsmeow/store"
 	"net/http"
 	"net/url"
 	"strings"
@@ -13,6 +14,65 @@ type Configuration struct {
 	Port        string `json:"port"`
 	AppSecret   string `json:"appSecret"`
 	CheckSecret bool   `json:"checkSecret"`
+
+	// максимальное количество попыток доставки вебхука, после которых
+	// он переносится в таблицу недоставленных (по умолчанию 10)
+	WebhookMaxAttempts int `json:"webhookMaxAttempts"`
+
+	// User-Agent и дополнительные заголовки вебхуков для всех инстансов
+	WebhookUserAgent string            `json:"webhookUserAgent"`
+	WebhookHeaders   map[string]string `json:"webhookHeaders"`
+
+	// настройки отдельных инстансов по идентификатору
+	Instances map[uint64]InstanceConfiguration `json:"instances"`
+}
+
+// InstanceConfiguration Структура конфигурации отдельного инстанса
+type InstanceConfiguration struct {
+
+	// User-Agent вебхуков инстанса, заменяет общий
+	WebhookUserAgent string `json:"webhookUserAgent"`
+
+	// дополнительные заголовки вебхуков инстанса, дополняют и заменяют общие
+	WebhookHeaders map[string]string `json:"webhookHeaders"`
+}
+
+// User-Agent вебхуков по умолчанию
+const defaultWebhookUserAgent = "PostmanRuntime/7.32.3"
+
+// GetWebhookUserAgent Метод отдает User-Agent вебхуков инстанса
+func (config *Configuration) GetWebhookUserAgent(idInstance uint64) string {
+
+	// если задан User-Agent инстанса
+	if userAgent := config.Instances[idInstance].WebhookUserAgent; userAgent != "" {
+		return userAgent
+	}
+
+	// если задан общий User-Agent
+	if config.WebhookUserAgent != "" {
+		return config.WebhookUserAgent
+	}
+
+	return defaultWebhookUserAgent
+}
+
+// GetWebhookHeaders Метод отдает дополнительные заголовки вебхуков инстанса
+func (config *Configuration) GetWebhookHeaders(idInstance uint64) map[string]string {
+
+	instanceHeaders := config.Instances[idInstance].WebhookHeaders
+
+	headers := make(map[string]string, len(config.WebhookHeaders)+len(instanceHeaders))
+
+	for name, value := range config.WebhookHeaders {
+		headers[name] = value
+	}
+
+	// заголовки инстанса заменяют общие
+	for name, value := range instanceHeaders {
+		headers[name] = value
+	}
+
+	return headers
 }
 
 // GetProxy метод получает прокси из строки
@@ -47,11 +107,4 @@ func GetProxy(proxy string) (socket.Proxy, error) {
 }
 
 // DataMessage данные о сообщении
-type DataMessage struct {
-	ChatId           string
-	MessageId        string
-	MessageTimestamp uint64
-	JsonData         string
-	MessageStatus    int32
-	StatusTimestamp  uint64
-}
+type DataMessage = store.HistoryMessage
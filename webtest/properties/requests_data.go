@@ -21,12 +21,114 @@ type RequestWithPhoneNumber struct {
 	Phone string `json:"phone"`
 }
 
+// RequestSendMedia Структура отправки медиафайла.
+// Файл передается либо multipart полем file с остальными полями в форме, либо ссылкой url в JSON.
+type RequestSendMedia struct {
+	Id              string `json:"id" form:"id"`
+	ChatId          string `json:"chatId" form:"chatId"`
+	Phone           int64  `json:"phone" form:"phone"`
+	Url             string `json:"url" form:"url"`
+	Caption         string `json:"caption" form:"caption"`
+	FileName        string `json:"fileName" form:"fileName"`
+	Mimetype        string `json:"mimetype" form:"mimetype"`
+	QuotedMessageId string `json:"quotedMessageId" form:"quotedMessageId"`
+	IsForwarded     bool   `json:"isForwarded" form:"isForwarded"`
+}
+
 // RequestSetWebhookUrl Структура запроса установки Webhook URL
 type RequestSetWebhookUrl struct {
 	WebhookUrl string `json:"webhookUrl"`
 }
 
+// RequestSetWebhookTypes Структура запроса выбора типов вебхуков, пустой список включает все типы
+type RequestSetWebhookTypes struct {
+	WebhookTypes []string `json:"webhookTypes"`
+}
+
 // RequestSetWebhookUrl Структура запроса установки статуса
 type RequestSetStatus struct {
 	Status string `json:"status"`
 }
+
+// RequestGetChatHistory Структура запроса истории чата
+type RequestGetChatHistory struct {
+	ChatId          string `json:"chatId"`
+	Count           int    `json:"count"`
+	BeforeTimestamp uint64 `json:"beforeTimestamp"`
+	BeforeIdMessage string `json:"beforeIdMessage"`
+}
+
+// RequestGetMessage Структура запроса сообщения из истории
+type RequestGetMessage struct {
+	ChatId    string `json:"chatId"`
+	IdMessage string `json:"idMessage"`
+}
+
+// RequestSearchMessages Структура запроса поиска сообщений в истории
+type RequestSearchMessages struct {
+	Query         string `json:"query"`
+	ChatId        string `json:"chatId"`
+	FromTimestamp int64  `json:"fromTimestamp"`
+	ToTimestamp   int64  `json:"toTimestamp"`
+	Count         int    `json:"count"`
+}
+
+// RequestReplayFailedWebhooks Структура запроса повторной отправки недоставленных вебхуков
+type RequestReplayFailedWebhooks struct {
+	Ids []int64 `json:"ids"`
+}
+
+// RequestCreateGroup Структура запроса создания группы
+type RequestCreateGroup struct {
+	Name         string   `json:"name"`
+	Participants []string `json:"participants"`
+	CommunityId  string   `json:"communityId"`
+	IsCommunity  bool     `json:"isCommunity"`
+}
+
+// RequestGroup Структура запроса с идентификатором группы
+type RequestGroup struct {
+	ChatId string `json:"chatId"`
+}
+
+// RequestUpdateGroupParticipants Структура запроса изменения участников группы
+type RequestUpdateGroupParticipants struct {
+	ChatId       string   `json:"chatId"`
+	Participants []string `json:"participants"`
+}
+
+// RequestSetGroupName Структура запроса изменения названия группы
+type RequestSetGroupName struct {
+	ChatId string `json:"chatId"`
+	Name   string `json:"name"`
+}
+
+// RequestSetGroupTopic Структура запроса изменения описания группы, пустое описание удаляет его
+type RequestSetGroupTopic struct {
+	ChatId string `json:"chatId"`
+	Topic  string `json:"topic"`
+}
+
+// RequestSetGroupSettings Структура запроса изменения настроек группы, не указанные настройки не меняются
+type RequestSetGroupSettings struct {
+	ChatId   string `json:"chatId"`
+	Locked   *bool  `json:"locked"`
+	Announce *bool  `json:"announce"`
+}
+
+// RequestGetGroupInviteLink Структура запроса ссылки приглашения в группу
+type RequestGetGroupInviteLink struct {
+	ChatId string `json:"chatId"`
+	Reset  bool   `json:"reset"`
+}
+
+// RequestJoinGroup Структура запроса вступления в группу по ссылке
+type RequestJoinGroup struct {
+	InviteLink string `json:"inviteLink"`
+}
+
+// RequestLinkGroup Структура запроса привязки группы к сообществу и отвязки от него
+type RequestLinkGroup struct {
+	CommunityId string `json:"communityId"`
+	ChatId      string `json:"chatId"`
+}
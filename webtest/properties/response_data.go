@@ -1,5 +1,11 @@
 package properties
 
+import (
+	"encoding/json"
+
+	"go.mau.fi/whatsmeow/store"
+)
+
 // ResponseCheckWhatsapp объект ответа на проверку аккаунта Whatsapp
 type ResponseCheckWhatsapp struct {
 	WhatsappOnPhone bool `json:"whatsappOnPhone"`
@@ -13,3 +19,153 @@ type ResponseGetStatusAccount struct {
 	StatusAccount   string `json:"statusAccount"`
 	TimeStatusSet   uint64 `json:"timeStatusSet"`
 }
+
+// ResponseInstance объект ответа с данными инстанса
+type ResponseInstance struct {
+	IdInstance   uint64   `json:"idInstance"`
+	Jid          string   `json:"jid"`
+	WebhookUrl   string   `json:"webhookUrl"`
+	WebhookTypes []string `json:"webhookTypes"`
+	IsConnected  bool     `json:"isConnected"`
+	IsLoggedIn   bool     `json:"isLoggedIn"`
+}
+
+// ResponseHistoryMessage объект ответа с сообщением из истории
+type ResponseHistoryMessage struct {
+	ChatId          string          `json:"chatId"`
+	IdMessage       string          `json:"idMessage"`
+	Timestamp       uint64          `json:"timestamp"`
+	Status          int32           `json:"status"`
+	StatusTimestamp uint64          `json:"statusTimestamp"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// ResponseChatHistory объект ответа со страницей истории чата
+type ResponseChatHistory struct {
+	Messages            []ResponseHistoryMessage `json:"messages"`
+	NextBeforeTimestamp uint64                   `json:"nextBeforeTimestamp,omitempty"`
+	NextBeforeIdMessage string                   `json:"nextBeforeIdMessage,omitempty"`
+}
+
+// ResponseSearchMessages объект ответа с найденными сообщениями
+type ResponseSearchMessages struct {
+	Messages []ResponseHistoryMessage `json:"messages"`
+}
+
+// ResponseHistoryChat объект ответа с чатом из истории
+type ResponseHistoryChat struct {
+	ChatId       string                 `json:"chatId"`
+	MessageCount int                    `json:"messageCount"`
+	LastMessage  ResponseHistoryMessage `json:"lastMessage"`
+}
+
+// ResponseChat объект ответа с чатом из списка чатов
+type ResponseChat struct {
+	ChatId              string `json:"chatId"`
+	Name                string `json:"name"`
+	IdLastMessage       string `json:"idLastMessage"`
+	LastMessageTime     int64  `json:"lastMessageTime"`
+	LastMessagePreview  string `json:"lastMessagePreview"`
+	LastMessageFromMe   bool   `json:"lastMessageFromMe"`
+	UnreadCount         int    `json:"unreadCount"`
+	MarkedAsUnread      bool   `json:"markedAsUnread"`
+	EphemeralExpiration uint32 `json:"ephemeralExpiration"`
+	MutedUntil          int64  `json:"mutedUntil"`
+	Pinned              bool   `json:"pinned"`
+	Archived            bool   `json:"archived"`
+}
+
+// NewResponseChat Метод создает объект ответа из чата
+func NewResponseChat(chat store.Chat) ResponseChat {
+
+	response := ResponseChat{
+		ChatId:              chat.JID.String(),
+		Name:                chat.Name,
+		IdLastMessage:       chat.LastMessage.ID,
+		LastMessagePreview:  chat.LastMessage.Preview,
+		LastMessageFromMe:   chat.LastMessage.FromMe,
+		UnreadCount:         chat.UnreadCount,
+		MarkedAsUnread:      chat.MarkedAsUnread,
+		EphemeralExpiration: chat.EphemeralExpiration,
+		Pinned:              chat.Settings.Pinned,
+		Archived:            chat.Settings.Archived,
+	}
+
+	// если время последнего сообщения известно
+	if !chat.LastMessage.Timestamp.IsZero() {
+		response.LastMessageTime = chat.LastMessage.Timestamp.Unix()
+	}
+
+	// если чат заглушен
+	if !chat.Settings.MutedUntil.IsZero() {
+		response.MutedUntil = chat.Settings.MutedUntil.Unix()
+	}
+
+	return response
+}
+
+// ResponseFailedWebhook объект ответа с недоставленным вебхуком
+type ResponseFailedWebhook struct {
+	Id          int64           `json:"id"`
+	WebhookUrl  string          `json:"webhookUrl"`
+	TypeWebhook string          `json:"typeWebhook"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"lastError"`
+	CreatedAt   int64           `json:"createdAt"`
+	FailedAt    int64           `json:"failedAt"`
+	Body        json.RawMessage `json:"body"`
+}
+
+// NewResponseHistoryMessage Метод создает объект ответа из сохраненного сообщения
+func NewResponseHistoryMessage(message store.HistoryMessage) ResponseHistoryMessage {
+
+	response := ResponseHistoryMessage{
+		ChatId:          message.ChatId,
+		IdMessage:       message.MessageId,
+		Timestamp:       message.MessageTimestamp,
+		Status:          message.MessageStatus,
+		StatusTimestamp: message.StatusTimestamp,
+		Data:            json.RawMessage("null"),
+	}
+
+	// если данные сообщения валидный JSON
+	if json.Valid([]byte(message.JsonData)) {
+
+		// отдаем их как есть
+		response.Data = json.RawMessage(message.JsonData)
+	}
+
+	return response
+}
+
+// ResponseGroupParticipant объект ответа с участником группы
+type ResponseGroupParticipant struct {
+	Id           string `json:"id"`
+	IsAdmin      bool   `json:"isAdmin"`
+	IsSuperAdmin bool   `json:"isSuperAdmin"`
+}
+
+// ResponseGroupInfo объект ответа с данными группы
+type ResponseGroupInfo struct {
+	ChatId       string                     `json:"chatId"`
+	Name         string                     `json:"name"`
+	Topic        string                     `json:"topic"`
+	Owner        string                     `json:"owner"`
+	Created      int64                      `json:"created"`
+	IsLocked     bool                       `json:"isLocked"`
+	IsAnnounce   bool                       `json:"isAnnounce"`
+	IsCommunity  bool                       `json:"isCommunity"`
+	CommunityId  string                     `json:"communityId,omitempty"`
+	Participants []ResponseGroupParticipant `json:"participants"`
+}
+
+// ResponseGroupParticipantResult объект ответа с результатом изменения участника группы
+type ResponseGroupParticipantResult struct {
+	Participant string `json:"participant"`
+	Success     bool   `json:"success"`
+	Error       int    `json:"error,omitempty"`
+
+	// если пользователя нельзя добавить напрямую, то его можно пригласить по этому коду
+	AddRequestCode       string `json:"addRequestCode,omitempty"`
+	AddRequestExpiration int64  `json:"addRequestExpiration,omitempty"`
+}
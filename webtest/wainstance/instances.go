@@ -0,0 +1,477 @@
+package wainstance
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	waLog "go.mau.fi/whatsmeow/util/log"
+	"go.mau.fi/whatsmeow/webtest/properties"
+	"go.mau.fi/whatsmeow/webtest/webhook"
+)
+
+// App общие данные сервиса, разделяемые всеми инстансами
+var App Application
+
+// Application общие данные сервиса
+type Application struct {
+	Log             waLog.Logger
+	DbLog           waLog.Logger
+	DebugLogs       *bool
+	DbDialect       *string
+	DbAddress       *string
+	RequestFullSync *bool
+	KeyFile         *string
+	StartupTime     int64
+	Config          properties.Configuration
+	Db              *sql.DB
+	Container       *sqlstore.Container
+}
+
+var (
+	// список инстансов по идентификатору
+	instances = make(map[uint64]*Instance)
+
+	// блокировка списка инстансов
+	instancesLock sync.RWMutex
+)
+
+// ErrInstanceNotFound ошибка инстанс не найден
+var ErrInstanceNotFound = errors.New("instance not found")
+
+const (
+	// KeyEncryptionKeyEnv переменная окружения с ключом шифрования ключей устройств в hex или base64
+	KeyEncryptionKeyEnv = "WEBTEST_KEY_ENCRYPTION_KEY"
+
+	// OldKeyEncryptionKeysEnv переменная окружения со старыми ключами через запятую, используется при смене ключа
+	OldKeyEncryptionKeysEnv = "WEBTEST_OLD_KEY_ENCRYPTION_KEYS"
+)
+
+// ErrUnknownWebhookType ошибка неизвестный тип вебхука
+var ErrUnknownWebhookType = errors.New("unknown webhook type")
+
+const (
+	createInstancesTable = `CREATE TABLE IF NOT EXISTS webtest_instances (
+		id_instance BIGINT PRIMARY KEY,
+		jid         TEXT   NOT NULL DEFAULT '',
+		webhook_url TEXT   NOT NULL DEFAULT '',
+		proxy       TEXT   NOT NULL DEFAULT ''
+	)`
+	checkWebhookTypesColumn = `SELECT webhook_types FROM webtest_instances LIMIT 1`
+	addWebhookTypesColumn   = `ALTER TABLE webtest_instances ADD COLUMN webhook_types TEXT NOT NULL DEFAULT ''`
+	getAllInstancesQuery    = `SELECT id_instance, jid, webhook_url, proxy, webhook_types FROM webtest_instances`
+	putInstanceQuery        = `
+		INSERT INTO webtest_instances (id_instance, jid, webhook_url, proxy, webhook_types) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id_instance) DO UPDATE
+			SET jid=excluded.jid, webhook_url=excluded.webhook_url, proxy=excluded.proxy, webhook_types=excluded.webhook_types
+	`
+	deleteInstanceQuery = `DELETE FROM webtest_instances WHERE id_instance=$1`
+)
+
+// InitStorage Метод открывает базу данных и загружает сохраненные инстансы
+func InitStorage() error {
+
+	// открываем базу данных
+	db, err := sql.Open(*App.DbDialect, *App.DbAddress)
+
+	// если ошибка
+	if err != nil {
+
+		// отдаем ошибку
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+
+	var opts []sqlstore.ContainerOption
+
+	// получаем ключ шифрования ключей устройств
+	keyEncryptor, err := newKeyEncryptor()
+
+	// если ошибка
+	if err != nil {
+
+		// отдаем ошибку
+		return err
+	}
+
+	// если ключ задан, то ключи устройств шифруются в базе
+	if keyEncryptor != nil {
+		opts = append(opts, sqlstore.WithKeyEncryptor(keyEncryptor))
+	}
+
+	// создаем хранилище устройств
+	container := sqlstore.NewWithDB(db, *App.DbDialect, App.DbLog, opts...)
+
+	// обновляем схему базы данных
+	err = container.Upgrade()
+
+	// если ошибка
+	if err != nil {
+
+		// отдаем ошибку
+		return fmt.Errorf("failed to upgrade database: %w", err)
+	}
+
+	// создаем таблицу инстансов
+	_, err = db.Exec(createInstancesTable)
+
+	// если ошибка
+	if err != nil {
+
+		// отдаем ошибку
+		return fmt.Errorf("failed to create instances table: %w", err)
+	}
+
+	// если в таблице нет колонки типов вебхуков, то добавляем ее
+	if _, err = db.Exec(checkWebhookTypesColumn); err != nil {
+
+		_, err = db.Exec(addWebhookTypesColumn)
+
+		// если ошибка
+		if err != nil {
+
+			// отдаем ошибку
+			return fmt.Errorf("failed to add webhook_types column: %w", err)
+		}
+	}
+
+	App.Db = db
+	App.Container = container
+
+	// получаем сохраненные инстансы
+	rows, err := db.Query(getAllInstancesQuery)
+
+	// если ошибка
+	if err != nil {
+
+		// отдаем ошибку
+		return fmt.Errorf("failed to query instances: %w", err)
+	}
+
+	defer rows.Close()
+
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+
+	// обходим инстансы
+	for rows.Next() {
+
+		instance := &Instance{}
+
+		var webhookTypes string
+
+		// считываем инстанс
+		err = rows.Scan(&instance.IdInstance, &instance.Jid, &instance.WebhookUrl, &instance.Proxy, &webhookTypes)
+
+		// если ошибка
+		if err != nil {
+
+			// отдаем ошибку
+			return fmt.Errorf("failed to scan instance: %w", err)
+		}
+
+		// если выбраны типы вебхуков
+		if webhookTypes != "" {
+			instance.WebhookTypes = strings.Split(webhookTypes, ",")
+		}
+
+		instance.init()
+
+		instances[instance.IdInstance] = instance
+	}
+
+	return rows.Err()
+}
+
+// Метод создает шифратор ключей устройств из файла ключа или переменной окружения.
+// Если ключ не задан, то отдается nil и ключи хранятся в открытом виде.
+func newKeyEncryptor() (sqlstore.KeyEncryptor, error) {
+
+	var key []byte
+	var err error
+
+	// если задан файл ключа
+	if App.KeyFile != nil && *App.KeyFile != "" {
+		key, err = sqlstore.EncryptionKeyFromFile(*App.KeyFile)
+	} else if os.Getenv(KeyEncryptionKeyEnv) != "" {
+		key, err = sqlstore.EncryptionKeyFromEnv(KeyEncryptionKeyEnv)
+	} else {
+		return nil, nil
+	}
+
+	// если ошибка
+	if err != nil {
+		return nil, err
+	}
+
+	var oldKeys [][]byte
+
+	// старые ключи нужны только для расшифровки при смене ключа
+	for _, encoded := range strings.Split(os.Getenv(OldKeyEncryptionKeysEnv), ",") {
+
+		// пропускаем пустые значения
+		if strings.TrimSpace(encoded) == "" {
+			continue
+		}
+
+		oldKey, err := sqlstore.ParseEncryptionKey(encoded)
+
+		// если ошибка
+		if err != nil {
+			return nil, fmt.Errorf("invalid key in %s: %w", OldKeyEncryptionKeysEnv, err)
+		}
+
+		oldKeys = append(oldKeys, oldKey)
+	}
+
+	return sqlstore.NewAESGCMKeyEncryptor(key, oldKeys...)
+}
+
+// GetInstance Метод отдает инстанс по идентификатору
+func GetInstance(idInstance uint64) (*Instance, error) {
+
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
+
+	instance, ok := instances[idInstance]
+
+	// если инстанс не найден
+	if !ok {
+
+		// отдаем ошибку
+		return nil, ErrInstanceNotFound
+	}
+
+	return instance, nil
+}
+
+// GetOrCreateInstance Метод отдает инстанс по идентификатору, создавая его при необходимости
+func GetOrCreateInstance(idInstance uint64) (*Instance, error) {
+
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+
+	instance, ok := instances[idInstance]
+
+	// если инстанс уже есть
+	if ok {
+
+		// отдаем его
+		return instance, nil
+	}
+
+	instance = &Instance{IdInstance: idInstance}
+
+	instance.init()
+
+	// сохраняем инстанс
+	err := instance.Save()
+
+	// если ошибка
+	if err != nil {
+
+		// отдаем ошибку
+		return nil, err
+	}
+
+	instances[idInstance] = instance
+
+	return instance, nil
+}
+
+// GetAllInstances Метод отдает все инстансы, отсортированные по идентификатору
+func GetAllInstances() []*Instance {
+
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
+
+	list := make([]*Instance, 0, len(instances))
+
+	for _, instance := range instances {
+		list = append(list, instance)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].IdInstance < list[j].IdInstance
+	})
+
+	return list
+}
+
+// DeleteInstance Метод останавливает и удаляет инстанс
+func DeleteInstance(idInstance uint64) error {
+
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+
+	instance, ok := instances[idInstance]
+
+	// если инстанс не найден
+	if !ok {
+
+		// отдаем ошибку
+		return ErrInstanceNotFound
+	}
+
+	instance.Stop()
+
+	// удаляем инстанс из базы
+	_, err := App.Db.Exec(deleteInstanceQuery, idInstance)
+
+	// если ошибка
+	if err != nil {
+
+		// отдаем ошибку
+		return fmt.Errorf("failed to delete instance: %w", err)
+	}
+
+	delete(instances, idInstance)
+
+	return nil
+}
+
+// Save Метод сохраняет данные инстанса в базу
+func (instance *Instance) Save() error {
+
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+
+	return instance.saveLocked()
+}
+
+// Метод сохраняет данные инстанса в базу. Вызывается под instance.lock
+func (instance *Instance) saveLocked() error {
+
+	webhookTypes := strings.Join(instance.WebhookTypes, ",")
+
+	_, err := App.Db.Exec(putInstanceQuery, instance.IdInstance, instance.Jid, instance.WebhookUrl, instance.Proxy, webhookTypes)
+
+	// если ошибка
+	if err != nil {
+
+		// отдаем ошибку
+		return fmt.Errorf("failed to save instance %d: %w", instance.IdInstance, err)
+	}
+
+	return nil
+}
+
+// SetJid Метод запоминает JID устройства инстанса
+func (instance *Instance) SetJid(jid *types.JID) {
+
+	instance.lock.Lock()
+
+	// если устройства нет
+	if jid == nil {
+		instance.Jid = ""
+	} else {
+		instance.Jid = jid.String()
+	}
+
+	instance.lock.Unlock()
+
+	// сохраняем инстанс
+	if err := instance.Save(); err != nil {
+		instance.Log.Errorf("%v", err)
+	}
+}
+
+// SetWebhookUrl Метод устанавливает webhook URL инстанса
+func (instance *Instance) SetWebhookUrl(webhookUrl string) error {
+
+	instance.lock.Lock()
+	instance.WebhookUrl = webhookUrl
+	instance.lock.Unlock()
+
+	return instance.Save()
+}
+
+// SetProxy Метод устанавливает прокси инстанса
+func (instance *Instance) SetProxy(proxy string) error {
+
+	instance.lock.Lock()
+	instance.Proxy = proxy
+	instance.lock.Unlock()
+
+	return instance.Save()
+}
+
+// SetWebhookTypes Метод устанавливает типы вебхуков, которые получает инстанс.
+// Пустой список включает все типы.
+func (instance *Instance) SetWebhookTypes(webhookTypes []string) error {
+
+	// проверяем типы
+	for _, typeWebhook := range webhookTypes {
+
+		// если тип не существует
+		if !webhook.IsKnownType(typeWebhook) {
+
+			// отдаем ошибку
+			return fmt.Errorf("%w: %s", ErrUnknownWebhookType, typeWebhook)
+		}
+	}
+
+	instance.lock.Lock()
+	instance.WebhookTypes = append([]string(nil), webhookTypes...)
+	instance.lock.Unlock()
+
+	return instance.Save()
+}
+
+// GetWebhookTypes Метод отдает выбранные типы вебхуков инстанса
+func (instance *Instance) GetWebhookTypes() []string {
+
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+
+	return append([]string(nil), instance.WebhookTypes...)
+}
+
+// IsWebhookTypeEnabled Метод проверяет, получает ли инстанс вебхуки этого типа
+func (instance *Instance) IsWebhookTypeEnabled(typeWebhook string) bool {
+
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+
+	// если типы не выбраны, то включены все
+	if len(instance.WebhookTypes) == 0 {
+		return true
+	}
+
+	for _, enabledType := range instance.WebhookTypes {
+		if enabledType == typeWebhook {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetWebhookUrl Метод отдает webhook URL инстанса
+func (instance *Instance) GetWebhookUrl() string {
+
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+
+	return instance.WebhookUrl
+}
+
+// GetJid Метод отдает JID устройства инстанса
+func (instance *Instance) GetJid() string {
+
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+
+	return instance.Jid
+}
+
+// Метод инициализирует служебные поля инстанса
+func (instance *Instance) init() {
+	instance.Log = App.Log.Sub(fmt.Sprintf("Instance%d", instance.IdInstance))
+	instance.PairRejectChan = make(chan bool, 1)
+}
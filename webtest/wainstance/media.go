@@ -0,0 +1,148 @@
+package wainstance
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// MediaKind вид отправляемого медиафайла
+type MediaKind string
+
+const (
+	MediaKindImage    MediaKind = "image"
+	MediaKindVideo    MediaKind = "video"
+	MediaKindVoice    MediaKind = "voice"
+	MediaKindDocument MediaKind = "document"
+	MediaKindSticker  MediaKind = "sticker"
+)
+
+// MediaFile медиафайл для отправки
+type MediaFile struct {
+	Data     []byte
+	Mimetype string
+	FileName string
+	Caption  string
+}
+
+// BuildMediaMessage Метод загружает медиафайл на сервер WhatsApp и создает сообщение с ним
+func (instance *Instance) BuildMediaMessage(ctx context.Context, kind MediaKind, file MediaFile, contextInfo *waProto.ContextInfo) (*waProto.Message, error) {
+
+	// если тип не указан, то определяем его по содержимому
+	if file.Mimetype == "" {
+		file.Mimetype = defaultMediaMimetype(kind, file.Data)
+	}
+
+	var mediaType whatsmeow.MediaType
+
+	switch kind {
+	case MediaKindImage, MediaKindSticker:
+		mediaType = whatsmeow.MediaImage
+	case MediaKindVideo:
+		mediaType = whatsmeow.MediaVideo
+	case MediaKindVoice:
+		mediaType = whatsmeow.MediaAudio
+	case MediaKindDocument:
+		mediaType = whatsmeow.MediaDocument
+	default:
+		return nil, fmt.Errorf("unknown media kind %q", kind)
+	}
+
+	// загружаем файл
+	uploaded, err := instance.Client.Upload(ctx, file.Data, mediaType)
+
+	// если ошибка
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload %s: %w", kind, err)
+	}
+
+	switch kind {
+	case MediaKindImage:
+		return &waProto.Message{ImageMessage: &waProto.ImageMessage{
+			Caption:       optionalString(file.Caption),
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(file.Mimetype),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			ContextInfo:   contextInfo,
+		}}, nil
+	case MediaKindVideo:
+		return &waProto.Message{VideoMessage: &waProto.VideoMessage{
+			Caption:       optionalString(file.Caption),
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(file.Mimetype),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			ContextInfo:   contextInfo,
+		}}, nil
+	case MediaKindVoice:
+		return &waProto.Message{AudioMessage: &waProto.AudioMessage{
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(file.Mimetype),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			Ptt:           proto.Bool(true),
+			ContextInfo:   contextInfo,
+		}}, nil
+	case MediaKindDocument:
+		return &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+			Caption:       optionalString(file.Caption),
+			Title:         optionalString(file.FileName),
+			FileName:      optionalString(file.FileName),
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(file.Mimetype),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			ContextInfo:   contextInfo,
+		}}, nil
+	default:
+		return &waProto.Message{StickerMessage: &waProto.StickerMessage{
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(file.Mimetype),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			ContextInfo:   contextInfo,
+		}}, nil
+	}
+}
+
+// Метод отдает тип медиафайла по умолчанию
+func defaultMediaMimetype(kind MediaKind, data []byte) string {
+	switch kind {
+	case MediaKindVoice:
+		// голосовые сообщения WhatsApp воспроизводит только в ogg/opus
+		return "audio/ogg; codecs=opus"
+	case MediaKindSticker:
+		return "image/webp"
+	default:
+		return http.DetectContentType(data)
+	}
+}
+
+// Метод отдает указатель на строку или nil, если строка пустая
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return proto.String(value)
+}
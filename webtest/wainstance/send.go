@@ -0,0 +1,239 @@
+package wainstance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"go.mau.fi/whatsmeow/webtest/properties"
+	"go.mau.fi/whatsmeow/webtest/webhook"
+)
+
+// ErrQuotedMessageNotFound ошибка цитируемое сообщение не найдено в истории
+var ErrQuotedMessageNotFound = errors.New("quoted message not found")
+
+// BuildContextInfo Метод создает контекст сообщения для ответа на сообщение из истории и пересылки.
+// Если сообщение не является ни ответом, ни пересылкой, отдается nil.
+func (instance *Instance) BuildContextInfo(chat types.JID, quotedMessageId string, isForwarded bool) (*waProto.ContextInfo, error) {
+
+	var contextInfo *waProto.ContextInfo
+
+	// если это ответ на сообщение
+	if quotedMessageId != "" {
+
+		var err error
+
+		// создаем контекст ответа
+		contextInfo, err = instance.GetQuotedContext(chat, quotedMessageId)
+
+		// если ошибка
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// если это пересылка
+	if isForwarded {
+
+		if contextInfo == nil {
+			contextInfo = &waProto.ContextInfo{}
+		}
+
+		contextInfo.IsForwarded = proto.Bool(true)
+		contextInfo.ForwardingScore = proto.Uint32(1)
+	}
+
+	return contextInfo, nil
+}
+
+// GetQuotedContext Метод создает контекст ответа на сообщение из истории чата
+func (instance *Instance) GetQuotedContext(chat types.JID, quotedMessageId string) (*waProto.ContextInfo, error) {
+
+	// получаем сообщение из истории
+	message, err := instance.Client.Store.History.GetMessage(chat.String(), quotedMessageId)
+
+	// если ошибка
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quoted message: %w", err)
+	} else if message == nil {
+		return nil, fmt.Errorf("%w: %s", ErrQuotedMessageNotFound, quotedMessageId)
+	}
+
+	sender, quoted, err := parseStoredMessage(message.JsonData)
+
+	// если ошибка
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse quoted message %s: %w", quotedMessageId, err)
+	}
+
+	// если отправитель неизвестен, то это наше сообщение
+	if sender.IsEmpty() {
+		sender = *instance.Client.Store.ID
+	}
+
+	return &waProto.ContextInfo{
+		StanzaId:      proto.String(quotedMessageId),
+		Participant:   proto.String(sender.ToNonAD().String()),
+		QuotedMessage: quoted,
+	}, nil
+}
+
+// Метод разбирает сообщение, сохраненное в истории.
+// Входящие сообщения сохраняются как events.Message, исходящие раньше сохранялись как waProto.Message.
+func parseStoredMessage(jsonData string) (types.JID, *waProto.Message, error) {
+
+	var stored struct {
+		Info    *types.MessageInfo
+		Message json.RawMessage
+	}
+
+	// если данные не удалось разобрать
+	if err := json.Unmarshal([]byte(jsonData), &stored); err != nil {
+		return types.EmptyJID, nil, err
+	}
+
+	var sender types.JID
+
+	rawMessage := []byte(jsonData)
+
+	// если сохранено событие сообщения
+	if stored.Info != nil && len(stored.Message) > 0 {
+
+		rawMessage = stored.Message
+
+		// если сообщение не наше
+		if !stored.Info.IsFromMe {
+			sender = stored.Info.Sender
+		}
+	}
+
+	msg := &waProto.Message{}
+
+	// json поля сообщения совпадают с protojson, поэтому разбираем его как protojson
+	err := protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(rawMessage, msg)
+
+	// если ошибка
+	if err != nil {
+		return types.EmptyJID, nil, err
+	}
+
+	return sender, msg, nil
+}
+
+// SaveSentMessage Метод сохраняет отправленное сообщение в историю и отправляет вебхук о статусе sent
+func (instance *Instance) SaveSentMessage(chat types.JID, msg *waProto.Message, resp whatsmeow.SendResponse) {
+
+	// сохраняем сообщение в формате входящих сообщений
+	evt := &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{
+				Chat:     chat,
+				Sender:   instance.Client.Store.ID.ToNonAD(),
+				IsFromMe: true,
+				IsGroup:  chat.Server == types.GroupServer,
+			},
+			ID:        resp.ID,
+			Timestamp: resp.Timestamp,
+		},
+		Message:    msg,
+		RawMessage: msg,
+	}
+
+	// сериализуем сообщение
+	jsonData, err := json.Marshal(evt)
+
+	// если ошибка
+	if err != nil {
+		instance.Log.Errorf("Error serialize sent message %s: %v", resp.ID, err)
+	}
+
+	// создаем объект сообщения. SendMessage возвращает ответ только после подтверждения сервера, и событие
+	// о статусе server ack обрабатывается, когда сообщения еще нет в истории, поэтому этот статус сохраняется
+	// здесь. Если сообщение уже есть в истории, хранилище оставляет более высокий статус
+	dataMessage := properties.DataMessage{
+		ChatId:           chat.String(),
+		MessageId:        resp.ID,
+		MessageTimestamp: uint64(resp.Timestamp.Unix()),
+		JsonData:         string(jsonData),
+		MessageStatus:    int32(types.MessageStatusServerAck),
+		StatusTimestamp:  uint64(resp.Timestamp.Unix()),
+	}
+
+	// сохраняем сообщение в историю
+	err = instance.Client.HistorySync([]properties.DataMessage{dataMessage})
+
+	// если ошибка
+	if err != nil {
+
+		// выводим ошибку
+		instance.Log.Errorf("error HistorySync %v", err)
+	}
+
+	// отправляем вебхук
+	instance.SendStatusMessageWebhook(resp.ID, resp.Timestamp.Unix(), "sent")
+}
+
+// SendStatusMessageWebhook Метод отправляет вебхук о статусе сообщения, если инстанс получает такие вебхуки
+func (instance *Instance) SendStatusMessageWebhook(idMessage string, timestampStatus int64, status string) {
+
+	// если инстанс не получает вебхуки о статусах сообщений
+	if !instance.IsWebhookTypeEnabled(webhook.TypeStatusMessage) {
+
+		// не продолжаем
+		return
+	}
+
+	// создаем структуру вебхук о статусе сообщения
+	statusMessageWebhook := webhook.StatusMessageWebhook{
+		TypeWebhook:      webhook.TypeStatusMessage,
+		WebhookUrl:       instance.GetWebhookUrl(),
+		CountTrySending:  0,
+		InstanceWhatsapp: instance.webhookInstanceData(),
+		Timestamp:        time.Now().Unix(),
+		StatusMessage: webhook.DataStatusMessage{
+			IdMessage:       idMessage,
+			TimestampStatus: timestampStatus,
+			Status:          status,
+		},
+	}
+
+	// отправляем вебхук
+	statusMessageWebhook.SendStatusMessageWebhook(instance.Log)
+}
+
+// updateMessageStatus метод сохраняет статус сообщения в историю и отправляет вебхук о статусе
+func (instance *Instance) updateMessageStatus(chat types.JID, idMessage types.MessageID, status types.MessageStatus, timestamp time.Time) {
+
+	// создаем объект сообщения
+	dataMessage := properties.DataMessage{
+		ChatId:          chat.String(),
+		MessageId:       idMessage,
+		MessageStatus:   int32(status),
+		StatusTimestamp: uint64(timestamp.Unix()),
+	}
+
+	// сохраняем статус сообщения в историю
+	err := instance.Client.UpdateStatusMessage(dataMessage)
+
+	// если ошибка
+	if err != nil {
+
+		// выводим ошибку
+		instance.Log.Errorf("error UpdateStatusMessage %v", err)
+	}
+
+	// если сообщение доставлено, прочитано или воспроизведено
+	if status >= types.MessageStatusDelivered {
+
+		// отправляем вебхук о статусе сообщения
+		instance.SendStatusMessageWebhook(idMessage, timestamp.Unix(), status.String())
+	}
+}
@@ -0,0 +1,122 @@
+package wainstance
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// сообщения с текстом, медиа и enum полями, которые должны сохраниться без изменений
+var storedMessages = map[string]*waProto.Message{
+	"text": {
+		Conversation: proto.String("Привет"),
+	},
+	"extendedText": {
+		ExtendedTextMessage: &waProto.ExtendedTextMessage{
+			Text:        proto.String("https://example.com"),
+			Font:        waProto.ExtendedTextMessage_FB_SCRIPT.Enum(),
+			PreviewType: waProto.ExtendedTextMessage_VIDEO.Enum(),
+			ContextInfo: &waProto.ContextInfo{
+				StanzaId:      proto.String("QUOTED"),
+				Participant:   proto.String("1111@s.whatsapp.net"),
+				QuotedMessage: &waProto.Message{Conversation: proto.String("quoted")},
+			},
+		},
+	},
+	"image": {
+		ImageMessage: &waProto.ImageMessage{
+			Url:               proto.String("https://mmg.whatsapp.net/image"),
+			Mimetype:          proto.String("image/jpeg"),
+			Caption:           proto.String("caption"),
+			FileSha256:        []byte{0, 1, 2, 0xfe, 0xff},
+			FileLength:        proto.Uint64(1<<53 + 1),
+			Height:            proto.Uint32(720),
+			Width:             proto.Uint32(1280),
+			MediaKey:          []byte("media key with / and + in base64"),
+			MediaKeyTimestamp: proto.Int64(1700000000),
+			JpegThumbnail:     []byte{0xff, 0xd8, 0xff},
+		},
+	},
+}
+
+func TestParseStoredMessage(t *testing.T) {
+
+	sender := types.NewJID("1111", types.DefaultUserServer)
+	chat := types.NewJID("123456", types.GroupServer)
+
+	for name, msg := range storedMessages {
+
+		// входящее сообщение сохраняется как events.Message
+		incoming, err := json.Marshal(&events.Message{
+			Info: types.MessageInfo{
+				MessageSource: types.MessageSource{Chat: chat, Sender: sender, IsGroup: true},
+				ID:            "INCOMING",
+				Timestamp:     time.Unix(1700000000, 0),
+			},
+			Message: msg,
+		})
+
+		if err != nil {
+			t.Fatalf("Failed to marshal %s event: %v", name, err)
+		}
+
+		// исходящее сообщение сохраняется как events.Message с IsFromMe
+		outgoing, err := json.Marshal(&events.Message{
+			Info: types.MessageInfo{
+				MessageSource: types.MessageSource{Chat: chat, Sender: types.NewJID("2222", types.DefaultUserServer), IsFromMe: true, IsGroup: true},
+				ID:            "OUTGOING",
+			},
+			Message: msg,
+		})
+
+		if err != nil {
+			t.Fatalf("Failed to marshal %s event: %v", name, err)
+		}
+
+		// раньше исходящие сообщения сохранялись как waProto.Message
+		raw, err := json.Marshal(msg)
+
+		if err != nil {
+			t.Fatalf("Failed to marshal %s message: %v", name, err)
+		}
+
+		for format, test := range map[string]struct {
+			jsonData []byte
+			sender   types.JID
+		}{
+			"incoming": {incoming, sender},
+			"outgoing": {outgoing, types.EmptyJID},
+			"raw":      {raw, types.EmptyJID},
+		} {
+			parsedSender, parsed, err := parseStoredMessage(string(test.jsonData))
+
+			if err != nil {
+				t.Errorf("Failed to parse %s %s message: %v", format, name, err)
+				continue
+			}
+
+			if parsedSender != test.sender {
+				t.Errorf("Expected sender of %s %s message to be %s, got %s", format, name, test.sender, parsedSender)
+			}
+
+			if !proto.Equal(parsed, msg) {
+				t.Errorf("Parsed %s %s message doesn't match the original:\n%v\n%v", format, name, parsed, msg)
+			}
+		}
+	}
+}
+
+func TestParseStoredMessage_Invalid(t *testing.T) {
+
+	for _, jsonData := range []string{"", "not json", `{"Info":{},"Message":"text"}`, `{"conversation":1}`} {
+		if _, _, err := parseStoredMessage(jsonData); err == nil {
+			t.Errorf("Expected parsing %q to fail", jsonData)
+		}
+	}
+}
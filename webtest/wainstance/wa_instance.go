@@ -15,11 +15,10 @@ import (
 	"mime"
 	"net/http"
 	"os"
-	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -30,55 +29,108 @@ import (
 	"go.mau.fi/whatsmeow/appstate"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/store"
-	"go.mau.fi/whatsmeow/store/sqlstore"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
 	waLog "go.mau.fi/whatsmeow/util/log"
 )
 
-var InstanceWa Instance
-
+// Instance данные одного инстанса Whatsapp
 type Instance struct {
+	IdInstance                    uint64
+	Jid                           string
+	WebhookUrl                    string
+	Proxy                         string
+	WebhookTypes                  []string
 	Client                        *whatsmeow.Client
 	Log                           waLog.Logger
-	DbLog                         waLog.Logger
-	DebugLogs                     *bool
-	DbDialect                     *string
-	DbAddress                     *string
-	RequestFullSync               *bool
 	PairRejectChan                chan bool
 	HistorySyncID                 int32
-	StartupTime                   int64
-	Config                        properties.Configuration
-	WebhookUrl                    string
 	WsQrClient                    *ws.ClientWs
 	ChainResponseGetStatusAccount chan properties.ResponseGetStatusAccount
+
+	isWaitingForPair atomic.Bool
+	lock             sync.Mutex
 }
 
-// StartInstance Метод запускает инстанс
-func StartInstance(proxy socket.Proxy, onlyIfAuth bool) {
+// ErrAlreadyConnected ошибка запуска инстанса, клиент которого уже подключен к Whatsapp
+var ErrAlreadyConnected = errors.New("instance already connected")
 
-	// создаем хранилище инстанса
-	storeContainer, err := sqlstore.New(*InstanceWa.DbDialect, *InstanceWa.DbAddress, InstanceWa.DbLog)
+// StartSettings настройки инстанса, которые Start сохраняет только после проверки, что инстанс еще не подключен
+type StartSettings struct {
+	// WebhookUrl новый webhook URL, nil оставляет текущий
+	WebhookUrl *string
+	// Proxy прокси в виде строки, в том же виде, в каком он хранится в базе
+	Proxy string
+}
 
-	// если ошибка
-	if err != nil {
+// Start Метод запускает инстанс. Подключение выполняется в отдельном потоке, а метод сразу отдает результат проверок.
+//
+// Проверка подключения, сохранение настроек, отключение старого клиента и подключение нового выполняются
+// под instance.lock, который отпускается только после завершения подключения. Поэтому одновременные запросы
+// не могут запустить два клиента на одном устройстве: второй запрос дождется подключения первого и получит
+// ErrAlreadyConnected, ничего не сохранив.
+func (instance *Instance) Start(proxy socket.Proxy, onlyIfAuth bool, settings *StartSettings) error {
 
-		// выводим ошибку
-		InstanceWa.Log.Errorf("Failed to connect to database: %v", err)
+	instance.lock.Lock()
 
-		// не продолжаем
-		return
+	// если клиент уже подключен
+	if instance.Client != nil && instance.Client.IsConnected() {
+
+		instance.lock.Unlock()
+
+		// отдаем ошибку
+		return ErrAlreadyConnected
+	}
+
+	// если переданы настройки
+	if settings != nil {
+
+		// запоминаем старые настройки, чтобы вернуть их при ошибке сохранения
+		oldWebhookUrl, oldProxy := instance.WebhookUrl, instance.Proxy
+
+		if settings.WebhookUrl != nil {
+			instance.WebhookUrl = *settings.WebhookUrl
+		}
+		instance.Proxy = settings.Proxy
+
+		// сохраняем инстанс
+		if err := instance.saveLocked(); err != nil {
+
+			instance.WebhookUrl, instance.Proxy = oldWebhookUrl, oldProxy
+
+			instance.lock.Unlock()
+
+			// отдаем ошибку
+			return err
+		}
+	}
+
+	// подключаемся в отдельном потоке, блокировка снимается после подключения
+	go func() {
+		defer instance.lock.Unlock()
+		instance.start(proxy, onlyIfAuth)
+	}()
+
+	return nil
+}
+
+// Метод создает и подключает нового клиента инстанса. Вызывается под instance.lock
+func (instance *Instance) start(proxy socket.Proxy, onlyIfAuth bool) {
+
+	// отключаем старого клиента, чтобы он не перехватывал поток у нового
+	if instance.Client != nil {
+		instance.Client.RemoveEventHandlers()
+		instance.Client.Disconnect()
 	}
 
 	// получаем данные устройства
-	device, err := storeContainer.GetFirstDevice()
+	device, err := instance.getDevice()
 
 	// если ощшибка
 	if err != nil {
 
 		// выводим ошибку
-		InstanceWa.Log.Errorf("Failed to get device: %v", err)
+		instance.Log.Errorf("Failed to get device: %v", err)
 
 		// не продолжаем
 		return
@@ -87,46 +139,48 @@ func StartInstance(proxy socket.Proxy, onlyIfAuth bool) {
 	if (device.ID == nil || device.ID.User == "") && onlyIfAuth {
 
 		// выводим ошибку
-		InstanceWa.Log.Infof("Instance not authorized")
+		instance.Log.Infof("Instance not authorized")
 
 		// не продолжаем
 		return
 	}
 
 	// создаем клиента
-	InstanceWa.Client = whatsmeow.NewClient(device, waLog.Stdout("ClientWs", "DEBUG", true))
+	client := whatsmeow.NewClient(device, instance.Log.Sub("Client"))
+	instance.Client = client
 
 	//передаем ссылку на WsClient
-	InstanceWa.Client.WsQrClient = InstanceWa.WsQrClient
+	client.WsQrClient = instance.WsQrClient
 
-	var isWaitingForPair atomic.Bool
+	// сохраняем историю сообщений из синхронизации
+	client.StoreHistorySyncMessages = true
 
-	InstanceWa.Client.PrePairCallback = func(jid types.JID, platform, businessName string) bool {
+	client.PrePairCallback = func(jid types.JID, platform, businessName string) bool {
 
-		isWaitingForPair.Store(true)
+		instance.isWaitingForPair.Store(true)
 
-		defer isWaitingForPair.Store(false)
+		defer instance.isWaitingForPair.Store(false)
 
-		InstanceWa.Log.Infof("Pairing %s (platform: %q, business name: %q). Type r within 3 seconds to reject pair", jid, platform, businessName)
+		instance.Log.Infof("Pairing %s (platform: %q, business name: %q). Type %d r within 3 seconds to reject pair", jid, platform, businessName, instance.IdInstance)
 
 		select {
-		case reject := <-InstanceWa.PairRejectChan:
+		case reject := <-instance.PairRejectChan:
 
 			if reject {
 
-				InstanceWa.Log.Infof("Rejecting pair")
+				instance.Log.Infof("Rejecting pair")
 
 				return false
 			}
 		case <-time.After(3 * time.Second):
 		}
 
-		InstanceWa.Log.Infof("Accepting pair")
+		instance.Log.Infof("Accepting pair")
 
 		return true
 	}
 
-	ch, err := InstanceWa.Client.GetQRChannel(context.Background())
+	ch, err := client.GetQRChannel(context.Background())
 
 	if err != nil {
 
@@ -134,30 +188,30 @@ func StartInstance(proxy socket.Proxy, onlyIfAuth bool) {
 		if device.ID.User != "" {
 
 			// создаем структу ws сообщения
-			InstanceWa.Client.AuthMessage = &ws.AuthMessage{
+			client.AuthMessage = &ws.AuthMessage{
 				Type:   "error",
 				Reason: "Instance already authorized",
 			}
 
 			// если есть сокет сообщение
-			if InstanceWa.WsQrClient != nil && InstanceWa.WsQrClient.Socket != nil {
+			if instance.WsQrClient != nil && instance.WsQrClient.Socket != nil {
 
 				// отправляем QR код в ws
-				if !InstanceWa.WsQrClient.Send(*InstanceWa.Client.AuthMessage) {
+				if !instance.WsQrClient.Send(*client.AuthMessage) {
 
 					// выводим ошибку
-					InstanceWa.Log.Errorf("Error send QR code to websocket")
+					instance.Log.Errorf("Error send QR code to websocket")
 				}
 
 				// закрываем сокет соединение
-				InstanceWa.WsQrClient.Close()
+				instance.WsQrClient.Close()
 			}
 		}
 
 		// This error means that we're already logged in, so ignore it.
 		if !errors.Is(err, whatsmeow.ErrQRStoreContainsID) {
 
-			InstanceWa.Log.Errorf("Failed to get QR channel: %v", err)
+			instance.Log.Errorf("Failed to get QR channel: %v", err)
 		}
 	} else {
 
@@ -177,26 +231,26 @@ func StartInstance(proxy socket.Proxy, onlyIfAuth bool) {
 					if err != nil {
 
 						// выводим ошитбку
-						InstanceWa.Log.Errorf("QR string: %v", err)
+						instance.Log.Errorf("QR string: %v", err)
 
 						// не продолжаем
 						return
 					}
 
 					// создаем структу ws сообщения
-					InstanceWa.Client.AuthMessage = &ws.AuthMessage{
+					client.AuthMessage = &ws.AuthMessage{
 						Type:        "qr",
 						ImageQrCode: "data:image/png;base64, " + base64.StdEncoding.EncodeToString(png),
 					}
 
 					// если инциализировано сокет соединение
-					if InstanceWa.WsQrClient != nil {
+					if instance.WsQrClient != nil {
 
 						// отправляем QR код в ws
-						if !InstanceWa.WsQrClient.Send(*InstanceWa.Client.AuthMessage) {
+						if !instance.WsQrClient.Send(*client.AuthMessage) {
 
 							// выводим ошитбку
-							InstanceWa.Log.Errorf("Error send QR code to websocket")
+							instance.Log.Errorf("Error send QR code to websocket")
 
 							// не продолжаем
 							return
@@ -206,144 +260,137 @@ func StartInstance(proxy socket.Proxy, onlyIfAuth bool) {
 				} else if evt.Event == "timeout" {
 
 					// создаем структу ws сообщения
-					InstanceWa.Client.AuthMessage = &ws.AuthMessage{
+					client.AuthMessage = &ws.AuthMessage{
 						Type:   "error",
 						Reason: "QR code was not scanned in the required time",
 					}
 
 					// если инциализировано сокет соединение
-					if InstanceWa.WsQrClient != nil {
+					if instance.WsQrClient != nil {
 
 						// отправляем QR код в ws
-						if !InstanceWa.WsQrClient.Send(*InstanceWa.Client.AuthMessage) {
+						if !instance.WsQrClient.Send(*client.AuthMessage) {
 
 							// выводим ошибку
-							InstanceWa.Log.Errorf("Error send QR code to websocket")
+							instance.Log.Errorf("Error send QR code to websocket")
 
 							// не продолжаем
 							return
 						}
 
 						// закрываем сокет соединение
-						InstanceWa.WsQrClient.Close()
+						instance.WsQrClient.Close()
 					}
 
 				} else {
 
 					// выводим лог
-					InstanceWa.Log.Infof("QR channel result: %s", evt.Event)
+					instance.Log.Infof("QR channel result: %s", evt.Event)
 				}
 			}
 		}()
 	}
 
-	InstanceWa.Client.AddEventHandler(handler)
+	client.AddEventHandler(instance.handler)
 
 	// устанавливаем прокси
-	InstanceWa.Client.SetProxy(proxy)
+	client.SetProxy(proxy)
 
-	err = InstanceWa.Client.Connect()
+	err = client.Connect()
 
 	if err != nil {
 
-		InstanceWa.Log.Errorf("Failed to connect: %v", err)
+		instance.Log.Errorf("Failed to connect: %v", err)
 
 		return
 	}
+}
 
-	c := make(chan os.Signal)
-
-	input := make(chan string)
-
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-
-	go func() {
-
-		defer close(input)
-
-		scan := bufio.NewScanner(os.Stdin)
-
-		for scan.Scan() {
-
-			line := strings.TrimSpace(scan.Text())
-
-			if len(line) > 0 {
-
-				input <- line
-			}
-		}
-	}()
+// Метод получает устройство инстанса из хранилища, либо создает новое. Вызывается под instance.lock
+func (instance *Instance) getDevice() (*store.Device, error) {
 
-	for {
-		select {
-		case <-c:
+	jidString := instance.Jid
 
-			InstanceWa.Log.Infof("Interrupt received, exiting")
+	// если инстанс еще не авторизован
+	if jidString == "" {
 
-			InstanceWa.Client.Disconnect()
+		// создаем новое устройство
+		return App.Container.NewDevice(), nil
+	}
 
-			return
-		case cmd := <-input:
+	// парсим JID устройства
+	jid, err := types.ParseJID(jidString)
 
-			if len(cmd) == 0 {
+	// если ошибка
+	if err != nil {
 
-				//log.Infof("Stdin closed, exiting")
-				//
-				//cli.Disconnect()
+		// отдаем ошибку
+		return nil, fmt.Errorf("failed to parse device JID %s: %w", jidString, err)
+	}
 
-				return
-			}
-			if isWaitingForPair.Load() {
+	// получаем устройство
+	device, err := App.Container.GetDevice(jid)
 
-				if cmd == "r" {
+	// если ошибка
+	if err != nil {
 
-					InstanceWa.PairRejectChan <- true
+		// отдаем ошибку
+		return nil, err
+	}
 
-				} else if cmd == "a" {
+	// если устройство было удалено
+	if device == nil {
 
-					InstanceWa.PairRejectChan <- false
-				}
+		// выводим лог
+		instance.Log.Warnf("Device %s not found in store, creating new device", jid)
 
-				continue
-			}
+		// создаем новое устройство
+		return App.Container.NewDevice(), nil
+	}
 
-			args := strings.Fields(cmd)
+	return device, nil
+}
 
-			cmd = args[0]
+// Stop Метод останавливает инстанс
+func (instance *Instance) Stop() {
 
-			args = args[1:]
+	instance.lock.Lock()
+	client := instance.Client
+	instance.lock.Unlock()
 
-			go handleCmd(strings.ToLower(cmd), args)
-		}
+	if client == nil {
+		return
 	}
+
+	client.Disconnect()
 }
 
-// StopInstance Метод останавливает инстанс
-func StopInstance() {
+// IsConnectAndAuth Метод проверяет подключен ли инстанс и авторизован
+func (instance *Instance) IsConnectAndAuth() bool {
 
-	if InstanceWa.Client == nil {
-		return
-	}
+	instance.lock.Lock()
+	client := instance.Client
+	instance.lock.Unlock()
 
-	InstanceWa.Client.Disconnect()
+	return client != nil && client.IsConnected() && client.IsLoggedIn()
 }
 
 // SetPresence устанавливает доступность себя
-func SetPresence(presence string) error {
-	return InstanceWa.Client.SendPresence(types.Presence(presence))
+func (instance *Instance) SetPresence(presence string) error {
+	return instance.Client.SendPresence(types.Presence(presence))
 }
 
 // SubscribePresence метод подписывается на пользователя
-func SubscribePresence(phone string) error {
+func (instance *Instance) SubscribePresence(phone string) error {
 	jid, ok := ParseJID(phone)
 	if !ok {
 		return errors.New("error parse JID")
 	}
-	return InstanceWa.Client.SubscribePresence(jid)
+	return instance.Client.SubscribePresence(jid)
 }
 
 // GetUser метод отдает данные пользователя
-func GetUser(phone string) (map[types.JID]types.UserInfo, error) {
+func (instance *Instance) GetUser(phone string) (map[types.JID]types.UserInfo, error) {
 
 	jid, ok := ParseJID(phone)
 
@@ -351,11 +398,14 @@ func GetUser(phone string) (map[types.JID]types.UserInfo, error) {
 		return nil, errors.New("error parse JID")
 	}
 
-	return InstanceWa.Client.GetUserInfo([]types.JID{jid})
+	return instance.Client.GetUserInfo([]types.JID{jid})
 }
 
 // ParseJID Метод парсит идентификатор Whatsapp
 func ParseJID(arg string) (types.JID, bool) {
+	if arg == "" {
+		return types.EmptyJID, false
+	}
 	if arg[0] == '+' {
 		arg = arg[1:]
 	}
@@ -364,35 +414,100 @@ func ParseJID(arg string) (types.JID, bool) {
 	} else {
 		recipient, err := types.ParseJID(arg)
 		if err != nil {
-			InstanceWa.Log.Errorf("Invalid JID %s: %v", arg, err)
+			App.Log.Errorf("Invalid JID %s: %v", arg, err)
 			return recipient, false
 		} else if recipient.User == "" {
-			InstanceWa.Log.Errorf("Invalid JID %s: no server specified", arg)
+			App.Log.Errorf("Invalid JID %s: no server specified", arg)
 			return recipient, false
 		}
+		// идентификаторы чатов в вебхуках имеют вид <номер>@c.us
+		if recipient.Server == types.LegacyUserServer {
+			recipient.Server = types.DefaultUserServer
+		}
 		return recipient, true
 	}
 }
 
+// RunConsole Метод читает команды из stdin в формате "<idInstance> <команда> [аргументы...]"
+func RunConsole() {
+
+	scan := bufio.NewScanner(os.Stdin)
+
+	for scan.Scan() {
+
+		args := strings.Fields(scan.Text())
+
+		if len(args) < 2 {
+
+			App.Log.Errorf("Usage: <idInstance> <command> [args...]")
+
+			continue
+		}
+
+		// парсим идентификатор инстанса
+		idInstance, err := strconv.ParseUint(args[0], 10, 64)
+
+		if err != nil {
+
+			App.Log.Errorf("Invalid instance ID %s: %v", args[0], err)
+
+			continue
+		}
+
+		// получаем инстанс
+		instance, err := GetInstance(idInstance)
+
+		if err != nil {
+
+			App.Log.Errorf("Instance %d: %v", idInstance, err)
+
+			continue
+		}
+
+		if instance.isWaitingForPair.Load() {
+
+			if args[1] == "r" {
+
+				instance.PairRejectChan <- true
+
+			} else if args[1] == "a" {
+
+				instance.PairRejectChan <- false
+			}
+
+			continue
+		}
+
+		if instance.Client == nil {
+
+			instance.Log.Errorf("Instance not running")
+
+			continue
+		}
+
+		go instance.handleCmd(strings.ToLower(args[1]), args[2:])
+	}
+}
+
 // Метод обрабатывает команду
-func handleCmd(cmd string, args []string) {
+func (instance *Instance) handleCmd(cmd string, args []string) {
 	switch cmd {
 	case "reconnect":
-		InstanceWa.Client.Disconnect()
-		err := InstanceWa.Client.Connect()
+		instance.Client.Disconnect()
+		err := instance.Client.Connect()
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to connect: %v", err)
+			instance.Log.Errorf("Failed to connect: %v", err)
 		}
 	case "logout": //Сделал в API
-		err := InstanceWa.Client.Logout()
+		err := instance.Client.Logout()
 		if err != nil {
-			InstanceWa.Log.Errorf("Error logging out: %v", err)
+			instance.Log.Errorf("Error logging out: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Successfully logged out")
+			instance.Log.Infof("Successfully logged out")
 		}
 	case "appstate":
 		if len(args) < 1 {
-			InstanceWa.Log.Errorf("Usage: appstate <types...>")
+			instance.Log.Errorf("Usage: appstate <types...>")
 			return
 		}
 		names := []appstate.WAPatchName{appstate.WAPatchName(args[0])}
@@ -401,87 +516,87 @@ func handleCmd(cmd string, args []string) {
 		}
 		resync := len(args) > 1 && args[1] == "resync"
 		for _, name := range names {
-			err := InstanceWa.Client.FetchAppState(name, resync, false)
+			err := instance.Client.FetchAppState(name, resync, false)
 			if err != nil {
-				InstanceWa.Log.Errorf("Failed to sync app state: %v", err)
+				instance.Log.Errorf("Failed to sync app state: %v", err)
 			}
 		}
 	case "request-appstate-key":
 		if len(args) < 1 {
-			InstanceWa.Log.Errorf("Usage: request-appstate-key <ids...>")
+			instance.Log.Errorf("Usage: request-appstate-key <ids...>")
 			return
 		}
 		var keyIDs = make([][]byte, len(args))
 		for i, id := range args {
 			decoded, err := hex.DecodeString(id)
 			if err != nil {
-				InstanceWa.Log.Errorf("Failed to decode %s as hex: %v", id, err)
+				instance.Log.Errorf("Failed to decode %s as hex: %v", id, err)
 				return
 			}
 			keyIDs[i] = decoded
 		}
-		InstanceWa.Client.DangerousInternals().RequestAppStateKeys(context.Background(), keyIDs)
+		instance.Client.DangerousInternals().RequestAppStateKeys(context.Background(), keyIDs)
 	case "checkuser": //Сделал в API
 		if len(args) < 1 {
-			InstanceWa.Log.Errorf("Usage: checkuser <phone numbers...>")
+			instance.Log.Errorf("Usage: checkuser <phone numbers...>")
 			return
 		}
-		resp, err := InstanceWa.Client.IsOnWhatsApp(args)
+		resp, err := instance.Client.IsOnWhatsApp(args)
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to check if users are on WhatsApp:", err)
+			instance.Log.Errorf("Failed to check if users are on WhatsApp:", err)
 		} else {
 			for _, item := range resp {
 				if item.VerifiedName != nil {
-					InstanceWa.Log.Infof("%s: on whatsapp: %t, JID: %s, business name: %s", item.Query, item.IsIn, item.JID, item.VerifiedName.Details.GetVerifiedName())
+					instance.Log.Infof("%s: on whatsapp: %t, JID: %s, business name: %s", item.Query, item.IsIn, item.JID, item.VerifiedName.Details.GetVerifiedName())
 				} else {
-					InstanceWa.Log.Infof("%s: on whatsapp: %t, JID: %s", item.Query, item.IsIn, item.JID)
+					instance.Log.Infof("%s: on whatsapp: %t, JID: %s", item.Query, item.IsIn, item.JID)
 				}
 			}
 		}
 	case "checkupdate":
-		resp, err := InstanceWa.Client.CheckUpdate()
+		resp, err := instance.Client.CheckUpdate()
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to check for updates: %v", err)
+			instance.Log.Errorf("Failed to check for updates: %v", err)
 		} else {
-			InstanceWa.Log.Debugf("Version data: %#v", resp)
+			instance.Log.Debugf("Version data: %#v", resp)
 			if resp.ParsedVersion == store.GetWAVersion() {
-				InstanceWa.Log.Infof("ClientWs is up to date")
+				instance.Log.Infof("ClientWs is up to date")
 			} else if store.GetWAVersion().LessThan(resp.ParsedVersion) {
-				InstanceWa.Log.Warnf("ClientWs is outdated")
+				instance.Log.Warnf("ClientWs is outdated")
 			} else {
-				InstanceWa.Log.Infof("ClientWs is newer than latest")
+				instance.Log.Infof("ClientWs is newer than latest")
 			}
 		}
 	case "subscribepresence": //Сделал в API
 		if len(args) < 1 {
-			InstanceWa.Log.Errorf("Usage: subscribepresence <jid>")
+			instance.Log.Errorf("Usage: subscribepresence <jid>")
 			return
 		}
 		jid, ok := ParseJID(args[0])
 		if !ok {
 			return
 		}
-		err := InstanceWa.Client.SubscribePresence(jid)
+		err := instance.Client.SubscribePresence(jid)
 		if err != nil {
 			fmt.Println(err)
 		}
 	case "presence": //Сделал в API
 		if len(args) == 0 {
-			InstanceWa.Log.Errorf("Usage: presence <available/unavailable>")
+			instance.Log.Errorf("Usage: presence <available/unavailable>")
 			return
 		}
-		fmt.Println(InstanceWa.Client.SendPresence(types.Presence(args[0])))
+		fmt.Println(instance.Client.SendPresence(types.Presence(args[0])))
 	case "chatpresence":
 		if len(args) == 2 {
 			args = append(args, "")
 		} else if len(args) < 2 {
-			InstanceWa.Log.Errorf("Usage: chatpresence <jid> <composing/paused> [audio]")
+			instance.Log.Errorf("Usage: chatpresence <jid> <composing/paused> [audio]")
 			return
 		}
 		jid, _ := types.ParseJID(args[0])
-		fmt.Println(InstanceWa.Client.SendChatPresence(jid, types.ChatPresence(args[1]), types.ChatPresenceMedia(args[2])))
+		fmt.Println(instance.Client.SendChatPresence(jid, types.ChatPresence(args[1]), types.ChatPresenceMedia(args[2])))
 	case "privacysettings":
-		resp, err := InstanceWa.Client.TryFetchPrivacySettings(false)
+		resp, err := instance.Client.TryFetchPrivacySettings(false)
 		if err != nil {
 			fmt.Println(err)
 		} else {
@@ -489,7 +604,7 @@ func handleCmd(cmd string, args []string) {
 		}
 	case "getuser": //Сделал в API
 		if len(args) < 1 {
-			InstanceWa.Log.Errorf("Usage: getuser <jids...>")
+			instance.Log.Errorf("Usage: getuser <jids...>")
 			return
 		}
 		var jids []types.JID
@@ -500,24 +615,24 @@ func handleCmd(cmd string, args []string) {
 			}
 			jids = append(jids, jid)
 		}
-		resp, err := InstanceWa.Client.GetUserInfo(jids)
+		resp, err := instance.Client.GetUserInfo(jids)
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to get user info: %v", err)
+			instance.Log.Errorf("Failed to get user info: %v", err)
 		} else {
 			for jid, info := range resp {
-				InstanceWa.Log.Infof("%s: %+v", jid, info)
+				instance.Log.Infof("%s: %+v", jid, info)
 			}
 		}
 	case "mediaconn":
-		conn, err := InstanceWa.Client.DangerousInternals().RefreshMediaConn(false)
+		conn, err := instance.Client.DangerousInternals().RefreshMediaConn(false)
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to get media connection: %v", err)
+			instance.Log.Errorf("Failed to get media connection: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Media connection: %+v", conn)
+			instance.Log.Infof("Media connection: %+v", conn)
 		}
 	case "getavatar": //Сделал в API
 		if len(args) < 1 {
-			InstanceWa.Log.Errorf("Usage: getavatar <jid> [existing ID] [--preview] [--community]")
+			instance.Log.Errorf("Usage: getavatar <jid> [existing ID] [--preview] [--community]")
 			return
 		}
 		jid, ok := ParseJID(args[0])
@@ -536,159 +651,159 @@ func handleCmd(cmd string, args []string) {
 				isCommunity = true
 			}
 		}
-		pic, err := InstanceWa.Client.GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{
+		pic, err := instance.Client.GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{
 			Preview:     preview,
 			IsCommunity: isCommunity,
 			ExistingID:  existingID,
 		})
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to get avatar: %v", err)
+			instance.Log.Errorf("Failed to get avatar: %v", err)
 		} else if pic != nil {
-			InstanceWa.Log.Infof("Got avatar ID %s: %s", pic.ID, pic.URL)
+			instance.Log.Infof("Got avatar ID %s: %s", pic.ID, pic.URL)
 		} else {
-			InstanceWa.Log.Infof("No avatar found")
+			instance.Log.Infof("No avatar found")
 		}
 	case "getgroup":
 		if len(args) < 1 {
-			InstanceWa.Log.Errorf("Usage: getgroup <jid>")
+			instance.Log.Errorf("Usage: getgroup <jid>")
 			return
 		}
 		group, ok := ParseJID(args[0])
 		if !ok {
 			return
 		} else if group.Server != types.GroupServer {
-			InstanceWa.Log.Errorf("Input must be a group JID (@%s)", types.GroupServer)
+			instance.Log.Errorf("Input must be a group JID (@%s)", types.GroupServer)
 			return
 		}
-		resp, err := InstanceWa.Client.GetGroupInfo(group)
+		resp, err := instance.Client.GetGroupInfo(group)
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to get group info: %v", err)
+			instance.Log.Errorf("Failed to get group info: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Group info: %+v", resp)
+			instance.Log.Infof("Group info: %+v", resp)
 		}
 	case "subgroups":
 		if len(args) < 1 {
-			InstanceWa.Log.Errorf("Usage: subgroups <jid>")
+			instance.Log.Errorf("Usage: subgroups <jid>")
 			return
 		}
 		group, ok := ParseJID(args[0])
 		if !ok {
 			return
 		} else if group.Server != types.GroupServer {
-			InstanceWa.Log.Errorf("Input must be a group JID (@%s)", types.GroupServer)
+			instance.Log.Errorf("Input must be a group JID (@%s)", types.GroupServer)
 			return
 		}
-		resp, err := InstanceWa.Client.GetSubGroups(group)
+		resp, err := instance.Client.GetSubGroups(group)
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to get subgroups: %v", err)
+			instance.Log.Errorf("Failed to get subgroups: %v", err)
 		} else {
 			for _, sub := range resp {
-				InstanceWa.Log.Infof("Subgroup: %+v", sub)
+				instance.Log.Infof("Subgroup: %+v", sub)
 			}
 		}
 	case "communityparticipants":
 		if len(args) < 1 {
-			InstanceWa.Log.Errorf("Usage: communityparticipants <jid>")
+			instance.Log.Errorf("Usage: communityparticipants <jid>")
 			return
 		}
 		group, ok := ParseJID(args[0])
 		if !ok {
 			return
 		} else if group.Server != types.GroupServer {
-			InstanceWa.Log.Errorf("Input must be a group JID (@%s)", types.GroupServer)
+			instance.Log.Errorf("Input must be a group JID (@%s)", types.GroupServer)
 			return
 		}
-		resp, err := InstanceWa.Client.GetLinkedGroupsParticipants(group)
+		resp, err := instance.Client.GetLinkedGroupsParticipants(group)
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to get community participants: %v", err)
+			instance.Log.Errorf("Failed to get community participants: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Community participants: %+v", resp)
+			instance.Log.Infof("Community participants: %+v", resp)
 		}
 	case "listgroups":
-		groups, err := InstanceWa.Client.GetJoinedGroups()
+		groups, err := instance.Client.GetJoinedGroups()
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to get group list: %v", err)
+			instance.Log.Errorf("Failed to get group list: %v", err)
 		} else {
 			for _, group := range groups {
-				InstanceWa.Log.Infof("%+v", group)
+				instance.Log.Infof("%+v", group)
 			}
 		}
 	case "getinvitelink":
 		if len(args) < 1 {
-			InstanceWa.Log.Errorf("Usage: getinvitelink <jid> [--reset]")
+			instance.Log.Errorf("Usage: getinvitelink <jid> [--reset]")
 			return
 		}
 		group, ok := ParseJID(args[0])
 		if !ok {
 			return
 		} else if group.Server != types.GroupServer {
-			InstanceWa.Log.Errorf("Input must be a group JID (@%s)", types.GroupServer)
+			instance.Log.Errorf("Input must be a group JID (@%s)", types.GroupServer)
 			return
 		}
-		resp, err := InstanceWa.Client.GetGroupInviteLink(group, len(args) > 1 && args[1] == "--reset")
+		resp, err := instance.Client.GetGroupInviteLink(group, len(args) > 1 && args[1] == "--reset")
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to get group invite link: %v", err)
+			instance.Log.Errorf("Failed to get group invite link: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Group invite link: %s", resp)
+			instance.Log.Infof("Group invite link: %s", resp)
 		}
 	case "queryinvitelink":
 		if len(args) < 1 {
-			InstanceWa.Log.Errorf("Usage: queryinvitelink <link>")
+			instance.Log.Errorf("Usage: queryinvitelink <link>")
 			return
 		}
-		resp, err := InstanceWa.Client.GetGroupInfoFromLink(args[0])
+		resp, err := instance.Client.GetGroupInfoFromLink(args[0])
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to resolve group invite link: %v", err)
+			instance.Log.Errorf("Failed to resolve group invite link: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Group info: %+v", resp)
+			instance.Log.Infof("Group info: %+v", resp)
 		}
 	case "querybusinesslink":
 		if len(args) < 1 {
-			InstanceWa.Log.Errorf("Usage: querybusinesslink <link>")
+			instance.Log.Errorf("Usage: querybusinesslink <link>")
 			return
 		}
-		resp, err := InstanceWa.Client.ResolveBusinessMessageLink(args[0])
+		resp, err := instance.Client.ResolveBusinessMessageLink(args[0])
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to resolve business message link: %v", err)
+			instance.Log.Errorf("Failed to resolve business message link: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Business info: %+v", resp)
+			instance.Log.Infof("Business info: %+v", resp)
 		}
 	case "joininvitelink":
 		if len(args) < 1 {
-			InstanceWa.Log.Errorf("Usage: acceptinvitelink <link>")
+			instance.Log.Errorf("Usage: acceptinvitelink <link>")
 			return
 		}
-		groupID, err := InstanceWa.Client.JoinGroupWithLink(args[0])
+		groupID, err := instance.Client.JoinGroupWithLink(args[0])
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to join group via invite link: %v", err)
+			instance.Log.Errorf("Failed to join group via invite link: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Joined %s", groupID)
+			instance.Log.Infof("Joined %s", groupID)
 		}
 	case "getstatusprivacy":
-		resp, err := InstanceWa.Client.GetStatusPrivacy()
+		resp, err := instance.Client.GetStatusPrivacy()
 		fmt.Println(err)
 		fmt.Println(resp)
 	case "setdisappeartimer":
 		if len(args) < 2 {
-			InstanceWa.Log.Errorf("Usage: setdisappeartimer <jid> <days>")
+			instance.Log.Errorf("Usage: setdisappeartimer <jid> <days>")
 			return
 		}
 		days, err := strconv.Atoi(args[1])
 		if err != nil {
-			InstanceWa.Log.Errorf("Invalid duration: %v", err)
+			instance.Log.Errorf("Invalid duration: %v", err)
 			return
 		}
 		recipient, ok := ParseJID(args[0])
 		if !ok {
 			return
 		}
-		err = InstanceWa.Client.SetDisappearingTimer(recipient, time.Duration(days)*24*time.Hour)
+		err = instance.Client.SetDisappearingTimer(recipient, time.Duration(days)*24*time.Hour)
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to set disappearing timer: %v", err)
+			instance.Log.Errorf("Failed to set disappearing timer: %v", err)
 		}
 	case "send":
 		if len(args) < 2 {
-			InstanceWa.Log.Errorf("Usage: send <jid> <text>")
+			instance.Log.Errorf("Usage: send <jid> <text>")
 			return
 		}
 		recipient, ok := ParseJID(args[0])
@@ -696,15 +811,15 @@ func handleCmd(cmd string, args []string) {
 			return
 		}
 		msg := &waProto.Message{Conversation: proto.String(strings.Join(args[1:], " "))}
-		resp, err := InstanceWa.Client.SendMessage(context.Background(), recipient, msg)
+		resp, err := instance.Client.SendMessage(context.Background(), recipient, msg)
 		if err != nil {
-			InstanceWa.Log.Errorf("Error sending message: %v", err)
+			instance.Log.Errorf("Error sending message: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Message sent (server timestamp: %s)", resp.Timestamp)
+			instance.Log.Infof("Message sent (server timestamp: %s)", resp.Timestamp)
 		}
 	case "sendpoll":
 		if len(args) < 7 {
-			InstanceWa.Log.Errorf("Usage: sendpoll <jid> <max answers> <question> -- <option 1> / <option 2> / ...")
+			instance.Log.Errorf("Usage: sendpoll <jid> <max answers> <question> -- <option 1> / <option 2> / ...")
 			return
 		}
 		recipient, ok := ParseJID(args[0])
@@ -713,7 +828,7 @@ func handleCmd(cmd string, args []string) {
 		}
 		maxAnswers, err := strconv.Atoi(args[1])
 		if err != nil {
-			InstanceWa.Log.Errorf("Number of max answers must be an integer")
+			instance.Log.Errorf("Number of max answers must be an integer")
 			return
 		}
 		remainingArgs := strings.Join(args[2:], " ")
@@ -723,15 +838,15 @@ func handleCmd(cmd string, args []string) {
 		for i, opt := range options {
 			options[i] = strings.TrimSpace(opt)
 		}
-		resp, err := InstanceWa.Client.SendMessage(context.Background(), recipient, InstanceWa.Client.BuildPollCreation(question, options, maxAnswers))
+		resp, err := instance.Client.SendMessage(context.Background(), recipient, instance.Client.BuildPollCreation(question, options, maxAnswers))
 		if err != nil {
-			InstanceWa.Log.Errorf("Error sending message: %v", err)
+			instance.Log.Errorf("Error sending message: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Message sent (server timestamp: %s)", resp.Timestamp)
+			instance.Log.Infof("Message sent (server timestamp: %s)", resp.Timestamp)
 		}
 	case "multisend":
 		if len(args) < 3 {
-			InstanceWa.Log.Errorf("Usage: multisend <jids...> -- <text>")
+			instance.Log.Errorf("Usage: multisend <jids...> -- <text>")
 			return
 		}
 		var recipients []types.JID
@@ -744,23 +859,23 @@ func handleCmd(cmd string, args []string) {
 			recipients = append(recipients, recipient)
 		}
 		if len(args) == 0 {
-			InstanceWa.Log.Errorf("Usage: multisend <jids...> -- <text> (the -- is required)")
+			instance.Log.Errorf("Usage: multisend <jids...> -- <text> (the -- is required)")
 			return
 		}
 		msg := &waProto.Message{Conversation: proto.String(strings.Join(args[1:], " "))}
 		for _, recipient := range recipients {
 			go func(recipient types.JID) {
-				resp, err := InstanceWa.Client.SendMessage(context.Background(), recipient, msg)
+				resp, err := instance.Client.SendMessage(context.Background(), recipient, msg)
 				if err != nil {
-					InstanceWa.Log.Errorf("Error sending message to %s: %v", recipient, err)
+					instance.Log.Errorf("Error sending message to %s: %v", recipient, err)
 				} else {
-					InstanceWa.Log.Infof("Message sent to %s (server timestamp: %s)", recipient, resp.Timestamp)
+					instance.Log.Infof("Message sent to %s (server timestamp: %s)", recipient, resp.Timestamp)
 				}
 			}(recipient)
 		}
 	case "react":
 		if len(args) < 3 {
-			InstanceWa.Log.Errorf("Usage: react <jid> <message ID> <reaction>")
+			instance.Log.Errorf("Usage: react <jid> <message ID> <reaction>")
 			return
 		}
 		recipient, ok := ParseJID(args[0])
@@ -788,15 +903,15 @@ func handleCmd(cmd string, args []string) {
 				SenderTimestampMs: proto.Int64(time.Now().UnixMilli()),
 			},
 		}
-		resp, err := InstanceWa.Client.SendMessage(context.Background(), recipient, msg)
+		resp, err := instance.Client.SendMessage(context.Background(), recipient, msg)
 		if err != nil {
-			InstanceWa.Log.Errorf("Error sending reaction: %v", err)
+			instance.Log.Errorf("Error sending reaction: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Reaction sent (server timestamp: %s)", resp.Timestamp)
+			instance.Log.Infof("Reaction sent (server timestamp: %s)", resp.Timestamp)
 		}
 	case "revoke":
 		if len(args) < 2 {
-			InstanceWa.Log.Errorf("Usage: revoke <jid> <message ID>")
+			instance.Log.Errorf("Usage: revoke <jid> <message ID>")
 			return
 		}
 		recipient, ok := ParseJID(args[0])
@@ -804,15 +919,15 @@ func handleCmd(cmd string, args []string) {
 			return
 		}
 		messageID := args[1]
-		resp, err := InstanceWa.Client.SendMessage(context.Background(), recipient, InstanceWa.Client.BuildRevoke(recipient, types.EmptyJID, messageID))
+		resp, err := instance.Client.SendMessage(context.Background(), recipient, instance.Client.BuildRevoke(recipient, types.EmptyJID, messageID))
 		if err != nil {
-			InstanceWa.Log.Errorf("Error sending revocation: %v", err)
+			instance.Log.Errorf("Error sending revocation: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Revocation sent (server timestamp: %s)", resp.Timestamp)
+			instance.Log.Infof("Revocation sent (server timestamp: %s)", resp.Timestamp)
 		}
 	case "sendimg":
 		if len(args) < 2 {
-			InstanceWa.Log.Errorf("Usage: sendimg <jid> <image path> [caption]")
+			instance.Log.Errorf("Usage: sendimg <jid> <image path> [caption]")
 			return
 		}
 		recipient, ok := ParseJID(args[0])
@@ -821,12 +936,12 @@ func handleCmd(cmd string, args []string) {
 		}
 		data, err := os.ReadFile(args[1])
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to read %s: %v", args[0], err)
+			instance.Log.Errorf("Failed to read %s: %v", args[0], err)
 			return
 		}
-		uploaded, err := InstanceWa.Client.Upload(context.Background(), data, whatsmeow.MediaImage)
+		uploaded, err := instance.Client.Upload(context.Background(), data, whatsmeow.MediaImage)
 		if err != nil {
-			InstanceWa.Log.Errorf("Failed to upload file: %v", err)
+			instance.Log.Errorf("Failed to upload file: %v", err)
 			return
 		}
 		msg := &waProto.Message{ImageMessage: &waProto.ImageMessage{
@@ -839,26 +954,26 @@ func handleCmd(cmd string, args []string) {
 			FileSha256:    uploaded.FileSHA256,
 			FileLength:    proto.Uint64(uint64(len(data))),
 		}}
-		resp, err := InstanceWa.Client.SendMessage(context.Background(), recipient, msg)
+		resp, err := instance.Client.SendMessage(context.Background(), recipient, msg)
 		if err != nil {
-			InstanceWa.Log.Errorf("Error sending image message: %v", err)
+			instance.Log.Errorf("Error sending image message: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Image message sent (server timestamp: %s)", resp.Timestamp)
+			instance.Log.Infof("Image message sent (server timestamp: %s)", resp.Timestamp)
 		}
 	case "setstatus":
 		if len(args) == 0 {
-			InstanceWa.Log.Errorf("Usage: setstatus <message>")
+			instance.Log.Errorf("Usage: setstatus <message>")
 			return
 		}
-		err := InstanceWa.Client.SetStatusMessage(strings.Join(args, " "))
+		err := instance.Client.SetStatusMessage(strings.Join(args, " "))
 		if err != nil {
-			InstanceWa.Log.Errorf("Error setting status message: %v", err)
+			instance.Log.Errorf("Error setting status message: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Status updated")
+			instance.Log.Infof("Status updated")
 		}
 	case "archive":
 		if len(args) < 2 {
-			InstanceWa.Log.Errorf("Usage: archive <jid> <action>")
+			instance.Log.Errorf("Usage: archive <jid> <action>")
 			return
 		}
 		target, ok := ParseJID(args[0])
@@ -867,17 +982,17 @@ func handleCmd(cmd string, args []string) {
 		}
 		action, err := strconv.ParseBool(args[1])
 		if err != nil {
-			InstanceWa.Log.Errorf("invalid second argument: %v", err)
+			instance.Log.Errorf("invalid second argument: %v", err)
 			return
 		}
 
-		err = InstanceWa.Client.SendAppState(appstate.BuildArchive(target, action, time.Time{}, nil))
+		err = instance.Client.SendAppState(appstate.BuildArchive(target, action, time.Time{}, nil))
 		if err != nil {
-			InstanceWa.Log.Errorf("Error changing chat's archive state: %v", err)
+			instance.Log.Errorf("Error changing chat's archive state: %v", err)
 		}
 	case "mute":
 		if len(args) < 2 {
-			InstanceWa.Log.Errorf("Usage: mute <jid> <action>")
+			instance.Log.Errorf("Usage: mute <jid> <action>")
 			return
 		}
 		target, ok := ParseJID(args[0])
@@ -886,17 +1001,17 @@ func handleCmd(cmd string, args []string) {
 		}
 		action, err := strconv.ParseBool(args[1])
 		if err != nil {
-			InstanceWa.Log.Errorf("invalid second argument: %v", err)
+			instance.Log.Errorf("invalid second argument: %v", err)
 			return
 		}
 
-		err = InstanceWa.Client.SendAppState(appstate.BuildMute(target, action, 1*time.Hour))
+		err = instance.Client.SendAppState(appstate.BuildMute(target, action, 1*time.Hour))
 		if err != nil {
-			InstanceWa.Log.Errorf("Error changing chat's mute state: %v", err)
+			instance.Log.Errorf("Error changing chat's mute state: %v", err)
 		}
 	case "pin":
 		if len(args) < 2 {
-			InstanceWa.Log.Errorf("Usage: pin <jid> <action>")
+			instance.Log.Errorf("Usage: pin <jid> <action>")
 			return
 		}
 		target, ok := ParseJID(args[0])
@@ -905,43 +1020,63 @@ func handleCmd(cmd string, args []string) {
 		}
 		action, err := strconv.ParseBool(args[1])
 		if err != nil {
-			InstanceWa.Log.Errorf("invalid second argument: %v", err)
+			instance.Log.Errorf("invalid second argument: %v", err)
 			return
 		}
 
-		err = InstanceWa.Client.SendAppState(appstate.BuildPin(target, action))
+		err = instance.Client.SendAppState(appstate.BuildPin(target, action))
 		if err != nil {
-			InstanceWa.Log.Errorf("Error changing chat's pin state: %v", err)
+			instance.Log.Errorf("Error changing chat's pin state: %v", err)
 		}
 	}
 }
 
 // Метод обрабатывает callback
-func handler(rawEvt interface{}) {
+func (instance *Instance) handler(rawEvt interface{}) {
+
+	// расшифровываем реакции и голоса в опросах один раз для логов и вебхуков
+	var addon decryptedMessageAddon
+	if evt, ok := rawEvt.(*events.Message); ok {
+		addon = instance.decryptMessageAddon(evt)
+	}
+
+	// отправляем вебхуки о событиях
+	instance.handleEventWebhooks(rawEvt, addon)
+
 	switch evt := rawEvt.(type) {
 	case *events.AppStateSyncComplete:
-		if len(InstanceWa.Client.Store.PushName) > 0 && evt.Name == appstate.WAPatchCriticalBlock {
-			err := InstanceWa.Client.SendPresence(types.PresenceAvailable)
+		if len(instance.Client.Store.PushName) > 0 && evt.Name == appstate.WAPatchCriticalBlock {
+			err := instance.Client.SendPresence(types.PresenceAvailable)
 			if err != nil {
-				InstanceWa.Log.Warnf("Failed to send available presence: %v", err)
+				instance.Log.Warnf("Failed to send available presence: %v", err)
 			} else {
-				InstanceWa.Log.Infof("Marked self as available")
+				instance.Log.Infof("Marked self as available")
 			}
 		}
 	case *events.Connected, *events.PushNameSetting:
-		if len(InstanceWa.Client.Store.PushName) == 0 {
+		if len(instance.Client.Store.PushName) == 0 {
 			return
 		}
 		// Send presence available when connecting and when the pushname is changed.
 		// This makes sure that outgoing messages always have the right pushname.
-		err := InstanceWa.Client.SendPresence(types.PresenceAvailable)
+		err := instance.Client.SendPresence(types.PresenceAvailable)
 		if err != nil {
-			InstanceWa.Log.Warnf("Failed to send available presence: %v", err)
+			instance.Log.Warnf("Failed to send available presence: %v", err)
 		} else {
-			InstanceWa.Log.Infof("Marked self as available")
+			instance.Log.Infof("Marked self as available")
 		}
+	case *events.PairSuccess:
+
+		// запоминаем устройство инстанса
+		instance.SetJid(&evt.ID)
+	case *events.LoggedOut:
+
+		// забываем устройство инстанса
+		instance.SetJid(nil)
 	case *events.StreamReplaced:
-		os.Exit(0)
+
+		// останавливаем только этот инстанс
+		instance.Stop()
 	case *events.Message:
 		metaParts := []string{fmt.Sprintf("pushname: %s", evt.Info.PushName), fmt.Sprintf("timestamp: %s", evt.Info.Timestamp)}
 		if evt.Info.Type != "" {
@@ -966,10 +1101,11 @@ func handler(rawEvt interface{}) {
 			metaParts = append(metaParts, "edit")
 		}
 
-		InstanceWa.Log.Infof("Received message %s from %s (%s): %+v", evt.Info.ID, evt.Info.SourceString(), strings.Join(metaParts, ", "), evt.Message)
+		instance.Log.Infof("Received message %s from %s (%s): %+v", evt.Info.ID, evt.Info.SourceString(), strings.Join(metaParts, ", "), evt.Message)
 
-		// если текстовое сообщение
-		if evt.Info.Type == "text" && evt.Info.Category != "peer" {
+		// если текстовое сообщение, медиафайл или опрос
+		if (evt.Info.Type == "text" || evt.Info.Type == "media" || evt.Message.GetPollCreationMessage() != nil ||
+			evt.Message.GetPollCreationMessageV2() != nil || evt.Message.GetPollCreationMessageV3() != nil) && evt.Info.Category != "peer" {
 
 			// сериализуем сообщение
 			jsonData, err := json.Marshal(evt)
@@ -980,35 +1116,32 @@ func handler(rawEvt interface{}) {
 				MessageId:        evt.Info.ID,
 				MessageTimestamp: uint64(evt.Info.Timestamp.Unix()),
 				JsonData:         string(jsonData),
-				MessageStatus:    3,
+				MessageStatus:    int32(types.MessageStatusDelivered),
 				StatusTimestamp:  uint64(evt.Info.Timestamp.Unix()),
 			}
 
 			// сохраняем сообщение в историю
-			err = InstanceWa.Client.HistorySync([]properties.DataMessage{dataMessage})
+			err = instance.Client.HistorySync([]properties.DataMessage{dataMessage})
 
 			// если ошибка
 			if err != nil {
 
 				// выводим ошибку
-				fmt.Errorf("error HistorySync %v", err)
+				instance.Log.Errorf("error HistorySync %v", err)
 			}
 
-			// текст сообщения
-			var textMessage string
+			// получаем текст сообщения или данные медиафайла
+			messageData, ok := getWebhookMessageData(evt.Message)
 
-			// если обычный текст
-			if evt.Message.Conversation != nil {
-
-				//пишем текст сообщения
-				textMessage = *evt.Message.Conversation
+			// если это не текст и не медиафайл
+			if !ok {
 
-			} else if evt.Message.ExtendedTextMessage != nil { //если расширенное текстовое сообщение
+				// не продолжаем
+				return
+			}
 
-				// пишем текст сообщения
-				textMessage = *evt.Message.ExtendedTextMessage.Text
-
-			} else {
+			// если инстанс не получает вебхуки о новых сообщениях
+			if !instance.IsWebhookTypeEnabled(webhook.TypeNewMessage) {
 
 				// не продолжаем
 				return
@@ -1026,167 +1159,112 @@ func handler(rawEvt interface{}) {
 				status = "delivered"
 			}
 
+			chat := webhook.ChatDataWhatsappMessage{
+				ChatId:    webhook.FormatChatId(evt.Info.Chat),
+				FromMe:    evt.Info.IsFromMe,
+				IdMessage: evt.Info.ID,
+			}
+
+			// если группа, то указываем отправителя
+			if evt.Info.IsGroup {
+				chat.Sender = webhook.FormatChatId(evt.Info.Sender)
+			}
+
 			newMessageWebhook := webhook.NewMessageWebhook{
-				TypeWebhook:     "newMessage",
-				WebhookUrl:      InstanceWa.WebhookUrl,
-				CountTrySending: 0,
-				InstanceWhatsapp: webhook.InstanceWhatsappWebhook{
-					IdInstance: 0,
-					Wid:        InstanceWa.Client.Store.ID.User + "@c.us",
-				},
-				Timestamp: time.Now().Unix(),
+				TypeWebhook:      webhook.TypeNewMessage,
+				WebhookUrl:       instance.GetWebhookUrl(),
+				CountTrySending:  0,
+				InstanceWhatsapp: instance.webhookInstanceData(),
+				Timestamp:        time.Now().Unix(),
 				NewMessage: webhook.NewMessage{
-					Chat: webhook.ChatDataWhatsappMessage{
-						ChatId:    evt.Info.Chat.User + "@c.us",
-						FromMe:    evt.Info.IsFromMe,
-						IdMessage: evt.Info.ID,
-					},
-					Message: webhook.DataWhatsappMessage{
-						TypeMessage: "textMessage",
-						Text:        textMessage,
-					},
+					Chat:             chat,
+					Message:          messageData,
 					MessageTimestamp: evt.Info.Timestamp.Unix(),
 					Status:           status,
 				},
 			}
 
 			// отправляем вебхук
-			newMessageWebhook.SendNewMessageWebhook(InstanceWa.Log)
+			newMessageWebhook.SendNewMessageWebhook(instance.Log)
 		}
 
 		if evt.Message.GetPollUpdateMessage() != nil {
-			decrypted, err := InstanceWa.Client.DecryptPollVote(evt)
-			if err != nil {
-				InstanceWa.Log.Errorf("Failed to decrypt vote: %v", err)
+			if addon.err != nil {
+				instance.Log.Errorf("Failed to decrypt vote: %v", addon.err)
 			} else {
-				InstanceWa.Log.Infof("Selected options in decrypted vote:")
-				for _, option := range decrypted.SelectedOptions {
-					InstanceWa.Log.Infof("- %X", option)
+				instance.Log.Infof("Selected options in decrypted vote:")
+				for _, option := range addon.pollVote.SelectedOptions {
+					instance.Log.Infof("- %X", option)
 				}
 			}
 		} else if evt.Message.GetEncReactionMessage() != nil {
-			decrypted, err := InstanceWa.Client.DecryptReaction(evt)
-			if err != nil {
-				InstanceWa.Log.Errorf("Failed to decrypt encrypted reaction: %v", err)
+			if addon.err != nil {
+				instance.Log.Errorf("Failed to decrypt encrypted reaction: %v", addon.err)
 			} else {
-				InstanceWa.Log.Infof("Decrypted reaction: %+v", decrypted)
+				instance.Log.Infof("Decrypted reaction: %+v", addon.reaction)
 			}
 		}
 
 		img := evt.Message.GetImageMessage()
 		if img != nil {
-			data, err := InstanceWa.Client.Download(img)
+			data, err := instance.Client.Download(img)
 			if err != nil {
-				InstanceWa.Log.Errorf("Failed to download image: %v", err)
+				instance.Log.Errorf("Failed to download image: %v", err)
 				return
 			}
 			exts, _ := mime.ExtensionsByType(img.GetMimetype())
 			path := fmt.Sprintf("%s%s", evt.Info.ID, exts[0])
 			err = os.WriteFile(path, data, 0600)
 			if err != nil {
-				InstanceWa.Log.Errorf("Failed to save image: %v", err)
+				instance.Log.Errorf("Failed to save image: %v", err)
 				return
 			}
-			InstanceWa.Log.Infof("Saved image in message to %s", path)
+			instance.Log.Infof("Saved image in message to %s", path)
 		}
-	case *events.Receipt:
-
-		if evt.Type == events.ReceiptTypeRead || evt.Type == events.ReceiptTypeReadSelf {
-
-			// выводим лог
-			InstanceWa.Log.Infof("%v was read by %s at %s", evt.MessageIDs, evt.SourceString(), evt.Timestamp)
-
-			// обходим массив идентифкаторов сообщений
-			for _, idMessage := range evt.MessageIDs {
-
-				// создаем объект сообщения
-				dataMessage := properties.DataMessage{
-					MessageId:       idMessage,
-					MessageStatus:   4,
-					StatusTimestamp: uint64(evt.Timestamp.Unix()),
-				}
-
-				// сохраняем сообщение в историю
-				err := InstanceWa.Client.UpdateStatusMessage(dataMessage)
+	case *events.MessageStatusChanged:
 
-				// если ошибка
-				if err != nil {
+		// если общий статус сообщения не изменился
+		if evt.Status == evt.PreviousStatus {
 
-					// выводим ошибку
-					fmt.Errorf("error UpdateStatusMessage %v", err)
-				}
+			// не продолжаем
+			return
+		}
 
-				//создаем структуру вебхук о статусе сообщения
-				statusMessageWebhook := webhook.StatusMessageWebhook{
-					TypeWebhook:     "statusMessage",
-					WebhookUrl:      InstanceWa.WebhookUrl,
-					CountTrySending: 0,
-					InstanceWhatsapp: webhook.InstanceWhatsappWebhook{
-						IdInstance: 0,
-						Wid:        InstanceWa.Client.Store.ID.User + "@c.us",
-					},
-					Timestamp: time.Now().Unix(),
-					StatusMessage: webhook.DataStatusMessage{
-						IdMessage:       idMessage,
-						TimestampStatus: evt.Timestamp.Unix(),
-						Status:          "read",
-					},
-				}
+		// выводим лог
+		instance.Log.Infof("Status of %s in %s changed from %s to %s", evt.ID, evt.Chat, evt.PreviousStatus, evt.Status)
 
-				//отправляем вебхук
-				statusMessageWebhook.SendStatusMessageWebhook(InstanceWa.Log)
-			}
+		// сохраняем статус сообщения в историю
+		instance.updateMessageStatus(evt.Chat, evt.ID, evt.Status, evt.Timestamp)
+	case *events.Receipt:
 
+		// получаем статус из квитанции
+		var status types.MessageStatus
+		if evt.Type == events.ReceiptTypeRead || evt.Type == events.ReceiptTypeReadSelf {
+			status = types.MessageStatusRead
 		} else if evt.Type == events.ReceiptTypeDelivered {
+			status = types.MessageStatusDelivered
+		} else {
+			return
+		}
 
-			//выводим лог
-			InstanceWa.Log.Infof("%s was delivered to %s at %s", evt.MessageIDs[0], evt.SourceString(), evt.Timestamp)
-
-			// обходим массив идентифкаторов сообщений
-			for _, idMessage := range evt.MessageIDs {
-
-				// создаем объект сообщения
-				dataMessage := properties.DataMessage{
-					MessageId:       idMessage,
-					MessageStatus:   3,
-					StatusTimestamp: uint64(evt.Timestamp.Unix()),
-				}
-
-				// сохраняем сообщение в историю
-				err := InstanceWa.Client.UpdateStatusMessage(dataMessage)
-
-				// если ошибка
-				if err != nil {
-
-					// выводим ошибку
-					fmt.Errorf("error UpdateStatusMessage %v", err)
-				}
+		// выводим лог
+		instance.Log.Infof("%v was %s by %s at %s", evt.MessageIDs, status, evt.SourceString(), evt.Timestamp)
 
-				//создаем структуру вебхук о статусе сообщения
-				statusMessageWebhook := webhook.StatusMessageWebhook{
-					TypeWebhook:     "statusMessage",
-					WebhookUrl:      InstanceWa.WebhookUrl,
-					CountTrySending: 0,
-					InstanceWhatsapp: webhook.InstanceWhatsappWebhook{
-						IdInstance: 0,
-						Wid:        InstanceWa.Client.Store.ID.User + "@c.us",
-					},
-					Timestamp: time.Now().Unix(),
-					StatusMessage: webhook.DataStatusMessage{
-						IdMessage:       idMessage,
-						TimestampStatus: evt.Timestamp.Unix(),
-						Status:          "delivered",
-					},
-				}
+		// обходим массив идентифкаторов сообщений
+		for _, idMessage := range evt.MessageIDs {
 
-				//отправляем вебхук
-				statusMessageWebhook.SendStatusMessageWebhook(InstanceWa.Log)
+			// если статус сообщения отслеживается клиентом, он придет в событии MessageStatusChanged
+			if evt.Type != events.ReceiptTypeReadSelf && instance.Client.GetMessageStatus(evt.Chat, idMessage) != nil {
+				continue
 			}
+
+			// сохраняем статус сообщения в историю
+			instance.updateMessageStatus(evt.Chat, idMessage, status, evt.Timestamp)
 		}
 	case *events.Presence:
 
 		// если канал не инициализирован
-		if InstanceWa.ChainResponseGetStatusAccount != nil {
+		if instance.ChainResponseGetStatusAccount != nil {
 
 			// инициализируем объект ответа на получение информации о пользователе
 			responseGetStatusAccount := properties.ResponseGetStatusAccount{}
@@ -1198,18 +1276,18 @@ func handler(rawEvt interface{}) {
 				if evt.LastSeen.IsZero() {
 
 					// выводим лог
-					InstanceWa.Log.Infof("%s is now offline", evt.From)
+					instance.Log.Infof("%s is now offline", evt.From)
 
 					// пишем что пользователь offline
 					responseGetStatusAccount.StatusAvailable = "offline"
 
 					// передаем объект ответа на получение информации о пользователе в канал
-					InstanceWa.ChainResponseGetStatusAccount <- responseGetStatusAccount
+					instance.ChainResponseGetStatusAccount <- responseGetStatusAccount
 
 				} else {
 
 					// выводим лог
-					InstanceWa.Log.Infof("%s is now offline (last seen: %s)", evt.From, evt.LastSeen)
+					instance.Log.Infof("%s is now offline (last seen: %s)", evt.From, evt.LastSeen)
 
 					// пишем что пользователь offline
 					responseGetStatusAccount.StatusAvailable = "offline"
@@ -1218,74 +1296,30 @@ func handler(rawEvt interface{}) {
 					responseGetStatusAccount.LastVisit = evt.UnixLastSeen
 
 					// передаем объект ответа на получение информации о пользователе в канал
-					InstanceWa.ChainResponseGetStatusAccount <- responseGetStatusAccount
+					instance.ChainResponseGetStatusAccount <- responseGetStatusAccount
 				}
 			} else {
 
 				// выводим лог
-				InstanceWa.Log.Infof("%s is now online", evt.From)
+				instance.Log.Infof("%s is now online", evt.From)
 
 				// пишем что пользователь online
 				responseGetStatusAccount.StatusAvailable = "online"
 
 				// передаем объект ответа на получение информации о пользователе в канал
-				InstanceWa.ChainResponseGetStatusAccount <- responseGetStatusAccount
+				instance.ChainResponseGetStatusAccount <- responseGetStatusAccount
 			}
 		}
 	case *events.HistorySync:
 
-		var messages []properties.DataMessage
-
-		// если есть данные сообщений
-		if evt.Data.Conversations != nil {
-
-			// обходим данные сообщений
-			for _, conversation := range evt.Data.Conversations {
-
-				// если есть данные сообщений
-				if conversation != nil {
-
-					//обходим сообщения
-					for _, message := range conversation.Messages {
-
-						jsonData, err := json.Marshal(message)
-
-						if err != nil {
-
-							fmt.Errorf("error marshal message %v", err)
-						} else {
-
-							dataMessage := properties.DataMessage{
-								ChatId:           *conversation.Id,
-								MessageId:        *message.Message.Key.Id,
-								MessageTimestamp: *message.Message.MessageTimestamp,
-								JsonData:         string(jsonData),
-								MessageStatus:    0,
-								StatusTimestamp:  *message.Message.MessageTimestamp,
-							}
-
-							if message.Message.Status != nil {
-								dataMessage.MessageStatus = int32(*message.Message.Status)
-							}
-
-							messages = append(messages, dataMessage)
-						}
-					}
-				}
-			}
-		}
-
-		err := InstanceWa.Client.HistorySync(messages)
-
-		if err != nil {
-
-			fmt.Errorf("error saveOrUpdateMessage %v", err)
-		}
+		// сообщения сохраняются клиентом, выводим прогресс синхронизации
+		instance.Log.Infof("History sync chunk %d (type %s) stored %d messages, progress %d%%",
+			evt.Data.GetChunkOrder(), evt.Data.GetSyncType(), evt.StoredMessages, evt.Data.GetProgress())
 	case *events.AppState:
-		InstanceWa.Log.Debugf("App state event: %+v / %+v", evt.Index, evt.SyncActionValue)
+		instance.Log.Debugf("App state event: %+v / %+v", evt.Index, evt.SyncActionValue)
 	case *events.KeepAliveTimeout:
-		InstanceWa.Log.Debugf("Keepalive timeout event: %+v", evt)
+		instance.Log.Debugf("Keepalive timeout event: %+v", evt)
 	case *events.KeepAliveRestored:
-		InstanceWa.Log.Debugf("Keepalive restored")
+		instance.Log.Debugf("Keepalive restored")
 	}
 }
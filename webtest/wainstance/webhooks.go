@@ -0,0 +1,378 @@
+package wainstance
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"go.mau.fi/whatsmeow/webtest/webhook"
+)
+
+// Метод отдает данные инстанса для вебхука
+func (instance *Instance) webhookInstanceData() webhook.InstanceWhatsappWebhook {
+
+	instanceData := webhook.InstanceWhatsappWebhook{
+		IdInstance: instance.IdInstance,
+	}
+
+	// если устройство авторизовано
+	if instance.Client != nil && instance.Client.Store.ID != nil {
+		instanceData.Wid = instance.Client.Store.ID.User + "@c.us"
+	}
+
+	return instanceData
+}
+
+// Метод ставит в очередь вебхук о событии, если инстанс получает вебхуки этого типа
+func (instance *Instance) sendEventWebhook(typeWebhook string, data interface{}) {
+
+	// если тип вебхука не выбран
+	if !instance.IsWebhookTypeEnabled(typeWebhook) {
+
+		// не продолжаем
+		return
+	}
+
+	eventWebhook := webhook.EventWebhook{
+		TypeWebhook:      typeWebhook,
+		WebhookUrl:       instance.GetWebhookUrl(),
+		InstanceWhatsapp: instance.webhookInstanceData(),
+		Timestamp:        time.Now().Unix(),
+		Data:             data,
+	}
+
+	// отправляем вебхук
+	eventWebhook.SendEventWebhook(instance.Log)
+}
+
+// Расшифрованная зашифрованная реакция или голос в опросе из сообщения
+type decryptedMessageAddon struct {
+	reaction *waProto.ReactionMessage
+	pollVote *waProto.PollVoteMessage
+	err      error
+}
+
+// Метод расшифровывает зашифрованную реакцию или голос в опросе, если они есть в сообщении.
+// Расшифровка делается один раз на событие, результат используется и для логов, и для вебхуков
+func (instance *Instance) decryptMessageAddon(evt *events.Message) (addon decryptedMessageAddon) {
+	switch {
+	case evt.Message.GetPollUpdateMessage() != nil:
+		addon.pollVote, addon.err = instance.Client.DecryptPollVote(evt)
+	case evt.Message.GetEncReactionMessage() != nil:
+		addon.reaction, addon.err = instance.Client.DecryptReaction(evt)
+	}
+	return
+}
+
+// Метод отправляет вебхуки о событиях, кроме newMessage и statusMessage
+func (instance *Instance) handleEventWebhooks(rawEvt interface{}, addon decryptedMessageAddon) {
+	switch evt := rawEvt.(type) {
+	case *events.Message:
+		instance.handleMessageEventWebhooks(evt, addon)
+	case *events.GroupInfo:
+		data := webhook.DataGroupInfo{
+			ChatId:     webhook.FormatChatId(evt.JID),
+			Timestamp:  evt.Timestamp.Unix(),
+			InviteLink: evt.NewInviteLink,
+			JoinReason: evt.JoinReason,
+			Join:       webhook.FormatChatIds(evt.Join),
+			Leave:      webhook.FormatChatIds(evt.Leave),
+			Promote:    webhook.FormatChatIds(evt.Promote),
+			Demote:     webhook.FormatChatIds(evt.Demote),
+		}
+		if evt.Sender != nil {
+			data.Sender = webhook.FormatChatId(*evt.Sender)
+		}
+		if evt.Name != nil {
+			data.Name = &evt.Name.Name
+		}
+		if evt.Topic != nil {
+			data.Topic = &evt.Topic.Topic
+		}
+		if evt.Locked != nil {
+			data.Locked = &evt.Locked.IsLocked
+		}
+		if evt.Announce != nil {
+			data.Announce = &evt.Announce.IsAnnounce
+		}
+		if evt.Ephemeral != nil {
+			data.EphemeralTimer = &evt.Ephemeral.DisappearingTimer
+		}
+		if evt.Delete != nil {
+			data.Deleted = evt.Delete.Deleted
+		}
+		instance.sendEventWebhook(webhook.TypeGroupInfo, data)
+	case *events.JoinedGroup:
+		data := webhook.DataJoinedGroup{
+			ChatId:       webhook.FormatChatId(evt.JID),
+			Reason:       evt.Reason,
+			Type:         evt.Type,
+			Name:         evt.Name,
+			Topic:        evt.Topic,
+			Created:      evt.GroupCreated.Unix(),
+			Participants: make([]webhook.DataGroupParticipant, 0, len(evt.Participants)),
+		}
+		if !evt.OwnerJID.IsEmpty() {
+			data.Owner = webhook.FormatChatId(evt.OwnerJID)
+		}
+		for _, participant := range evt.Participants {
+			data.Participants = append(data.Participants, webhook.DataGroupParticipant{
+				Id:           webhook.FormatChatId(participant.JID),
+				IsAdmin:      participant.IsAdmin,
+				IsSuperAdmin: participant.IsSuperAdmin,
+			})
+		}
+		instance.sendEventWebhook(webhook.TypeJoinedGroup, data)
+	case *events.CallOffer:
+		data := webhook.DataIncomingCall{
+			IdCall:    evt.CallID,
+			From:      webhook.FormatChatId(evt.CallCreator),
+			Platform:  evt.RemotePlatform,
+			Version:   evt.RemoteVersion,
+			Timestamp: evt.Timestamp.Unix(),
+		}
+		if evt.Data != nil {
+			_, data.IsVideo = evt.Data.GetOptionalChildByTag("video")
+		}
+		instance.sendEventWebhook(webhook.TypeIncomingCall, data)
+	case *events.Presence:
+		data := webhook.DataPresence{
+			ChatId: webhook.FormatChatId(evt.From),
+			Status: "online",
+		}
+		if evt.Unavailable {
+			data.Status = "offline"
+			if !evt.LastSeen.IsZero() {
+				data.LastVisit = evt.LastSeen.Unix()
+			}
+		}
+		instance.sendEventWebhook(webhook.TypePresence, data)
+	case *events.ChatPresence:
+		instance.sendEventWebhook(webhook.TypeChatPresence, webhook.DataChatPresence{
+			ChatId: webhook.FormatChatId(evt.Chat),
+			Sender: webhook.FormatChatId(evt.Sender),
+			State:  string(evt.State),
+			Media:  string(evt.Media),
+		})
+	case *events.LoggedOut:
+		data := webhook.DataLoggedOut{
+			OnConnect: evt.OnConnect,
+		}
+		if evt.OnConnect {
+			data.Code = int(evt.Reason)
+			data.Reason = evt.Reason.String()
+		}
+		instance.sendEventWebhook(webhook.TypeLoggedOut, data)
+	case *events.StreamReplaced:
+		instance.sendEventWebhook(webhook.TypeStreamReplaced, webhook.DataInstanceState{State: "streamReplaced"})
+	case *events.TemporaryBan:
+		instance.sendEventWebhook(webhook.TypeTemporaryBan, webhook.DataTemporaryBan{
+			Code:          int(evt.Code),
+			Reason:        evt.Code.String(),
+			ExpireSeconds: int64(evt.Expire / time.Second),
+		})
+	case *events.Connected:
+		instance.sendEventWebhook(webhook.TypeConnected, webhook.DataInstanceState{State: "connected"})
+	case *events.Disconnected:
+		instance.sendEventWebhook(webhook.TypeDisconnected, webhook.DataInstanceState{State: "disconnected"})
+	}
+}
+
+// Метод отправляет вебхуки о реакциях, голосах в опросах, редактировании и удалении сообщений
+func (instance *Instance) handleMessageEventWebhooks(evt *events.Message, addon decryptedMessageAddon) {
+
+	chat := webhook.ChatDataWhatsappMessage{
+		ChatId:    webhook.FormatChatId(evt.Info.Chat),
+		FromMe:    evt.Info.IsFromMe,
+		IdMessage: evt.Info.ID,
+	}
+
+	// если группа, то указываем отправителя
+	if evt.Info.IsGroup {
+		chat.Sender = webhook.FormatChatId(evt.Info.Sender)
+	}
+
+	timestamp := evt.Info.Timestamp.Unix()
+
+	switch {
+	case evt.Message.GetReactionMessage() != nil:
+		reaction := evt.Message.GetReactionMessage()
+		instance.sendEventWebhook(webhook.TypeReaction, webhook.DataReaction{
+			Chat:            chat,
+			TargetIdMessage: reaction.GetKey().GetId(),
+			Text:            reaction.GetText(),
+			Timestamp:       timestamp,
+		})
+	case evt.Message.GetEncReactionMessage() != nil:
+		reaction := addon.reaction
+		if addon.err != nil {
+			return
+		}
+		instance.sendEventWebhook(webhook.TypeReaction, webhook.DataReaction{
+			Chat:            chat,
+			TargetIdMessage: evt.Message.GetEncReactionMessage().GetTargetMessageKey().GetId(),
+			Text:            reaction.GetText(),
+			Timestamp:       timestamp,
+		})
+	case evt.Message.GetPollUpdateMessage() != nil:
+		vote := addon.pollVote
+		if addon.err != nil {
+			return
+		}
+		pollIdMessage := evt.Message.GetPollUpdateMessage().GetPollCreationMessageKey().GetId()
+		data := webhook.DataPollVote{
+			Chat:                 chat,
+			PollIdMessage:        pollIdMessage,
+			SelectedOptions:      instance.resolvePollOptions(evt.Info.Chat, pollIdMessage, vote.GetSelectedOptions()),
+			SelectedOptionHashes: make([]string, 0, len(vote.GetSelectedOptions())),
+			Timestamp:            timestamp,
+		}
+		for _, optionHash := range vote.GetSelectedOptions() {
+			data.SelectedOptionHashes = append(data.SelectedOptionHashes, hex.EncodeToString(optionHash))
+		}
+		instance.sendEventWebhook(webhook.TypePollVote, data)
+	case evt.Message.GetProtocolMessage().GetType() == waProto.ProtocolMessage_MESSAGE_EDIT:
+		protocolMessage := evt.Message.GetProtocolMessage()
+		data := webhook.DataMessageEdited{
+			Chat:            chat,
+			EditedIdMessage: protocolMessage.GetKey().GetId(),
+			Timestamp:       timestamp,
+		}
+		data.Message, _ = getWebhookMessageData(protocolMessage.GetEditedMessage())
+		instance.sendEventWebhook(webhook.TypeMessageEdited, data)
+	case evt.Message.GetProtocolMessage().GetType() == waProto.ProtocolMessage_REVOKE:
+		instance.sendEventWebhook(webhook.TypeMessageRevoked, webhook.DataMessageRevoked{
+			Chat:             chat,
+			RevokedIdMessage: evt.Message.GetProtocolMessage().GetKey().GetId(),
+			Timestamp:        timestamp,
+		})
+	}
+}
+
+// Метод отдает данные текстового сообщения или медиафайла для вебхука
+func getWebhookMessageData(msg *waProto.Message) (webhook.DataWhatsappMessage, bool) {
+
+	mediaData := func(mediaType, url, directPath string, mediaKey, fileSha256, fileEncSha256 []byte, fileLength uint64, mimetype string) *webhook.DataMediaMessage {
+		return &webhook.DataMediaMessage{
+			MediaType:     mediaType,
+			Url:           url,
+			DirectPath:    directPath,
+			MediaKey:      mediaKey,
+			FileSha256:    fileSha256,
+			FileEncSha256: fileEncSha256,
+			FileLength:    fileLength,
+			Mimetype:      mimetype,
+		}
+	}
+
+	switch {
+	case msg.Conversation != nil:
+		return webhook.DataWhatsappMessage{TypeMessage: "textMessage", Text: msg.GetConversation()}, true
+	case msg.ExtendedTextMessage != nil:
+		return webhook.DataWhatsappMessage{TypeMessage: "textMessage", Text: msg.GetExtendedTextMessage().GetText()}, true
+	case msg.ImageMessage != nil:
+		img := msg.GetImageMessage()
+		media := mediaData("image", img.GetUrl(), img.GetDirectPath(), img.GetMediaKey(), img.GetFileSha256(), img.GetFileEncSha256(), img.GetFileLength(), img.GetMimetype())
+		media.Width, media.Height = img.GetWidth(), img.GetHeight()
+		return webhook.DataWhatsappMessage{TypeMessage: "imageMessage", Text: img.GetCaption(), Media: media}, true
+	case msg.VideoMessage != nil:
+		video := msg.GetVideoMessage()
+		media := mediaData("video", video.GetUrl(), video.GetDirectPath(), video.GetMediaKey(), video.GetFileSha256(), video.GetFileEncSha256(), video.GetFileLength(), video.GetMimetype())
+		media.Width, media.Height, media.Seconds = video.GetWidth(), video.GetHeight(), video.GetSeconds()
+		media.IsAnimated = video.GetGifPlayback()
+		return webhook.DataWhatsappMessage{TypeMessage: "videoMessage", Text: video.GetCaption(), Media: media}, true
+	case msg.AudioMessage != nil:
+		audio := msg.GetAudioMessage()
+		media := mediaData("audio", audio.GetUrl(), audio.GetDirectPath(), audio.GetMediaKey(), audio.GetFileSha256(), audio.GetFileEncSha256(), audio.GetFileLength(), audio.GetMimetype())
+		media.Seconds, media.Ptt = audio.GetSeconds(), audio.GetPtt()
+		return webhook.DataWhatsappMessage{TypeMessage: "audioMessage", Media: media}, true
+	case msg.DocumentMessage != nil:
+		document := msg.GetDocumentMessage()
+		media := mediaData("document", document.GetUrl(), document.GetDirectPath(), document.GetMediaKey(), document.GetFileSha256(), document.GetFileEncSha256(), document.GetFileLength(), document.GetMimetype())
+		media.FileName = document.GetFileName()
+		return webhook.DataWhatsappMessage{TypeMessage: "documentMessage", Text: document.GetCaption(), Media: media}, true
+	case msg.StickerMessage != nil:
+		sticker := msg.GetStickerMessage()
+		media := mediaData("sticker", sticker.GetUrl(), sticker.GetDirectPath(), sticker.GetMediaKey(), sticker.GetFileSha256(), sticker.GetFileEncSha256(), sticker.GetFileLength(), sticker.GetMimetype())
+		media.Width, media.Height, media.IsAnimated = sticker.GetWidth(), sticker.GetHeight(), sticker.GetIsAnimated()
+		return webhook.DataWhatsappMessage{TypeMessage: "stickerMessage", Media: media}, true
+	default:
+		return webhook.DataWhatsappMessage{}, false
+	}
+}
+
+// Метод находит названия выбранных вариантов опроса по их хешам.
+// Названия берутся из сообщения с опросом в истории, если его там нет, то отдается пустой список.
+func (instance *Instance) resolvePollOptions(chat types.JID, pollIdMessage string, optionHashes [][]byte) []string {
+
+	options := make([]string, 0, len(optionHashes))
+
+	// получаем сообщение с опросом из истории
+	message, err := instance.Client.Store.History.GetMessage(chat.String(), pollIdMessage)
+
+	// если ошибка или сообщения нет
+	if err != nil || message == nil {
+
+		// если ошибка
+		if err != nil {
+			instance.Log.Warnf("Failed to get poll %s from history: %v", pollIdMessage, err)
+		}
+
+		return options
+	}
+
+	type pollCreation struct {
+		Options []*struct {
+			OptionName string `json:"optionName"`
+		} `json:"options"`
+	}
+
+	var storedMessage struct {
+		Message struct {
+			PollCreationMessage   *pollCreation `json:"pollCreationMessage"`
+			PollCreationMessageV2 *pollCreation `json:"pollCreationMessageV2"`
+			PollCreationMessageV3 *pollCreation `json:"pollCreationMessageV3"`
+		}
+	}
+
+	// если сообщение не удалось разобрать
+	if err = json.Unmarshal([]byte(message.JsonData), &storedMessage); err != nil {
+		return options
+	}
+
+	poll := storedMessage.Message.PollCreationMessage
+	if poll == nil {
+		poll = storedMessage.Message.PollCreationMessageV2
+	}
+	if poll == nil {
+		poll = storedMessage.Message.PollCreationMessageV3
+	}
+	if poll == nil {
+		return options
+	}
+
+	names := make([]string, 0, len(poll.Options))
+	for _, option := range poll.Options {
+		if option != nil {
+			names = append(names, option.OptionName)
+		}
+	}
+
+	// хешируем названия вариантов
+	optionNames := make(map[string]string, len(names))
+	for i, optionHash := range whatsmeow.HashPollOptions(names) {
+		optionNames[string(optionHash)] = names[i]
+	}
+
+	for _, optionHash := range optionHashes {
+		if name, ok := optionNames[string(optionHash)]; ok {
+			options = append(options, name)
+		}
+	}
+
+	return options
+}
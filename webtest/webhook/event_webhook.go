@@ -0,0 +1,263 @@
+package webhook
+
+import (
+	"encoding/json"
+
+	"go.mau.fi/whatsmeow/types"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Типы вебхуков, схема данных каждого типа описана в WEBHOOKS.md
+const (
+	TypeNewMessage     = "newMessage"
+	TypeStatusMessage  = "statusMessage"
+	TypeReaction       = "reaction"
+	TypePollVote       = "pollVote"
+	TypeMessageEdited  = "messageEdited"
+	TypeMessageRevoked = "messageRevoked"
+	TypeGroupInfo      = "groupInfo"
+	TypeJoinedGroup    = "joinedGroup"
+	TypeIncomingCall   = "incomingCall"
+	TypePresence       = "presence"
+	TypeChatPresence   = "chatPresence"
+	TypeLoggedOut      = "loggedOut"
+	TypeStreamReplaced = "streamReplaced"
+	TypeTemporaryBan   = "temporaryBan"
+	TypeConnected      = "connected"
+	TypeDisconnected   = "disconnected"
+)
+
+// Types список всех типов вебхуков
+var Types = []string{
+	TypeNewMessage, TypeStatusMessage, TypeReaction, TypePollVote, TypeMessageEdited, TypeMessageRevoked,
+	TypeGroupInfo, TypeJoinedGroup, TypeIncomingCall, TypePresence, TypeChatPresence,
+	TypeLoggedOut, TypeStreamReplaced, TypeTemporaryBan, TypeConnected, TypeDisconnected,
+}
+
+// IsKnownType Метод проверяет, что тип вебхука существует
+func IsKnownType(typeWebhook string) bool {
+
+	for _, knownType := range Types {
+		if knownType == typeWebhook {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FormatChatId Метод приводит JID к формату идентификатора чата вебхуков
+func FormatChatId(jid types.JID) string {
+
+	// если пользователь
+	if jid.Server == types.DefaultUserServer {
+		return jid.User + "@c.us"
+	}
+
+	return jid.ToNonAD().String()
+}
+
+// FormatChatIds Метод приводит список JID к формату идентификаторов чатов вебхуков
+func FormatChatIds(jids []types.JID) []string {
+
+	if len(jids) == 0 {
+		return nil
+	}
+
+	chatIds := make([]string, len(jids))
+
+	for i, jid := range jids {
+		chatIds[i] = FormatChatId(jid)
+	}
+
+	return chatIds
+}
+
+// EventWebhook объект данных webhook о событии.
+// Данные события сериализуются в поле с названием типа вебхука, как у newMessage и statusMessage.
+type EventWebhook struct {
+	TypeWebhook      string
+	WebhookUrl       string
+	CountTrySending  uint32
+	InstanceWhatsapp InstanceWhatsappWebhook
+	Timestamp        int64
+	Data             interface{}
+}
+
+// MarshalJSON Метод сериализует вебхук, помещая данные события в поле с названием типа
+func (eventWebhook *EventWebhook) MarshalJSON() ([]byte, error) {
+
+	data, err := json.Marshal(eventWebhook.Data)
+
+	// если ошибка
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"type":                   eventWebhook.TypeWebhook,
+		"instanceWhatsapp":       eventWebhook.InstanceWhatsapp,
+		"timestamp":              eventWebhook.Timestamp,
+		eventWebhook.TypeWebhook: json.RawMessage(data),
+	})
+}
+
+// SendEventWebhook Метод ставит в очередь доставки вебхук о событии
+func (eventWebhook *EventWebhook) SendEventWebhook(log waLog.Logger) {
+
+	// если вебхук не установлен
+	if eventWebhook.WebhookUrl == "" {
+
+		// не продолжаем
+		return
+	}
+
+	// сериализуем в JSON
+	postBody, err := json.Marshal(eventWebhook)
+
+	// если ошибка
+	if err != nil {
+
+		// выводим лог
+		log.Errorf("Error serialize %s webhook %v", eventWebhook.TypeWebhook, err)
+
+		// не продолжаем
+		return
+	}
+
+	// добавляем вебхук в очередь доставки
+	enqueueWebhook(log, eventWebhook.InstanceWhatsapp.IdInstance, eventWebhook.WebhookUrl, eventWebhook.TypeWebhook, eventWebhook.CountTrySending, postBody)
+}
+
+// DataMediaMessage объект данных медиафайла сообщения, достаточных для его скачивания
+type DataMediaMessage struct {
+	MediaType     string `json:"mediaType"`
+	Url           string `json:"url"`
+	DirectPath    string `json:"directPath"`
+	MediaKey      []byte `json:"mediaKey"`
+	FileSha256    []byte `json:"fileSha256"`
+	FileEncSha256 []byte `json:"fileEncSha256"`
+	FileLength    uint64 `json:"fileLength"`
+	Mimetype      string `json:"mimetype"`
+	FileName      string `json:"fileName,omitempty"`
+	Seconds       uint32 `json:"seconds,omitempty"`
+	Ptt           bool   `json:"ptt,omitempty"`
+	Width         uint32 `json:"width,omitempty"`
+	Height        uint32 `json:"height,omitempty"`
+	IsAnimated    bool   `json:"isAnimated,omitempty"`
+}
+
+// DataReaction объект данных вебхука о реакции
+type DataReaction struct {
+	Chat            ChatDataWhatsappMessage `json:"chat"`
+	TargetIdMessage string                  `json:"targetIdMessage"`
+	Text            string                  `json:"text"`
+	Timestamp       int64                   `json:"timestamp"`
+}
+
+// DataPollVote объект данных вебхука о голосе в опросе
+type DataPollVote struct {
+	Chat                 ChatDataWhatsappMessage `json:"chat"`
+	PollIdMessage        string                  `json:"pollIdMessage"`
+	SelectedOptions      []string                `json:"selectedOptions"`
+	SelectedOptionHashes []string                `json:"selectedOptionHashes"`
+	Timestamp            int64                   `json:"timestamp"`
+}
+
+// DataMessageEdited объект данных вебхука о редактировании сообщения
+type DataMessageEdited struct {
+	Chat            ChatDataWhatsappMessage `json:"chat"`
+	EditedIdMessage string                  `json:"editedIdMessage"`
+	Message         DataWhatsappMessage     `json:"message"`
+	Timestamp       int64                   `json:"timestamp"`
+}
+
+// DataMessageRevoked объект данных вебхука об удалении сообщения
+type DataMessageRevoked struct {
+	Chat             ChatDataWhatsappMessage `json:"chat"`
+	RevokedIdMessage string                  `json:"revokedIdMessage"`
+	Timestamp        int64                   `json:"timestamp"`
+}
+
+// DataGroupInfo объект данных вебхука об изменении группы, пустые поля не изменились
+type DataGroupInfo struct {
+	ChatId         string   `json:"chatId"`
+	Sender         string   `json:"sender,omitempty"`
+	Timestamp      int64    `json:"timestamp"`
+	Name           *string  `json:"name,omitempty"`
+	Topic          *string  `json:"topic,omitempty"`
+	Locked         *bool    `json:"locked,omitempty"`
+	Announce       *bool    `json:"announce,omitempty"`
+	EphemeralTimer *uint32  `json:"ephemeralTimer,omitempty"`
+	Deleted        bool     `json:"deleted,omitempty"`
+	InviteLink     *string  `json:"inviteLink,omitempty"`
+	JoinReason     string   `json:"joinReason,omitempty"`
+	Join           []string `json:"join,omitempty"`
+	Leave          []string `json:"leave,omitempty"`
+	Promote        []string `json:"promote,omitempty"`
+	Demote         []string `json:"demote,omitempty"`
+}
+
+// DataGroupParticipant объект данных участника группы
+type DataGroupParticipant struct {
+	Id           string `json:"id"`
+	IsAdmin      bool   `json:"isAdmin"`
+	IsSuperAdmin bool   `json:"isSuperAdmin"`
+}
+
+// DataJoinedGroup объект данных вебхука о вступлении в группу
+type DataJoinedGroup struct {
+	ChatId       string                 `json:"chatId"`
+	Reason       string                 `json:"reason,omitempty"`
+	Type         string                 `json:"type,omitempty"`
+	Name         string                 `json:"name"`
+	Topic        string                 `json:"topic"`
+	Owner        string                 `json:"owner"`
+	Created      int64                  `json:"created"`
+	Participants []DataGroupParticipant `json:"participants"`
+}
+
+// DataIncomingCall объект данных вебхука о входящем звонке
+type DataIncomingCall struct {
+	IdCall    string `json:"idCall"`
+	From      string `json:"from"`
+	IsVideo   bool   `json:"isVideo"`
+	Platform  string `json:"platform"`
+	Version   string `json:"version"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// DataPresence объект данных вебхука о присутствии пользователя
+type DataPresence struct {
+	ChatId    string `json:"chatId"`
+	Status    string `json:"status"`
+	LastVisit int64  `json:"lastVisit,omitempty"`
+}
+
+// DataChatPresence объект данных вебхука о наборе сообщения в чате
+type DataChatPresence struct {
+	ChatId string `json:"chatId"`
+	Sender string `json:"sender"`
+	State  string `json:"state"`
+	Media  string `json:"media,omitempty"`
+}
+
+// DataLoggedOut объект данных вебхука о разлогинивании инстанса
+type DataLoggedOut struct {
+	OnConnect bool   `json:"onConnect"`
+	Code      int    `json:"code,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// DataTemporaryBan объект данных вебхука о временной блокировке аккаунта
+type DataTemporaryBan struct {
+	Code          int    `json:"code"`
+	Reason        string `json:"reason"`
+	ExpireSeconds int64  `json:"expireSeconds"`
+}
+
+// DataInstanceState объект данных вебхуков о состоянии инстанса
+// (streamReplaced, connected, disconnected)
+type DataInstanceState struct {
+	State string `json:"state"`
+}
@@ -1,10 +1,9 @@
 package webhook
 
 import (
-	"bytes"
 	"encoding/json"
+
 	waLog "go.mau.fi/whatsmeow/util/log"
-	"net/http"
 )
 
 // NewMessageWebhook объект данных webhook о новом сообщении
@@ -28,17 +27,19 @@ type NewMessage struct {
 // ChatDataWhatsappMessage объект данных о чате сообщения
 type ChatDataWhatsappMessage struct {
 	ChatId    string `json:"chatId"`
+	Sender    string `json:"sender,omitempty"`
 	FromMe    bool   `json:"fromMe"`
 	IdMessage string `json:"idMessage"`
 }
 
 // DataWhatsappMessage объект данных сообщения Whatsapp
 type DataWhatsappMessage struct {
-	TypeMessage string `json:"typeMessage"`
-	Text        string `json:"text"`
+	TypeMessage string            `json:"typeMessage"`
+	Text        string            `json:"text"`
+	Media       *DataMediaMessage `json:"media,omitempty"`
 }
 
-// SendNewMessageWebhook Метод отправляет вебхук о новом входящем сообщении
+// SendNewMessageWebhook Метод ставит в очередь доставки вебхук о новом входящем сообщении
 func (newMessageWebhook *NewMessageWebhook) SendNewMessageWebhook(log waLog.Logger) {
 
 	// если вебхук не установлен
@@ -61,32 +62,6 @@ func (newMessageWebhook *NewMessageWebhook) SendNewMessageWebhook(log waLog.Logg
 		return
 	}
 
-	// создаем тело запроса
-	responseBody := bytes.NewBuffer(postBody)
-
-	req, err := http.NewRequest("POST", newMessageWebhook.WebhookUrl, responseBody)
-
-	if err != nil {
-
-		// выводим лог
-		log.Errorf("Error NewRequest %v", err)
-
-		return
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "PostmanRuntime/7.32.3")
-
-	client := http.Client{}
-
-	res, err := client.Do(req)
-
-	// если ошибка
-	if err != nil {
-
-		// выводим лог
-		log.Errorf("Error send status message webhook %v", err)
-	}
-
-	log.Infof("Response status: %d", res.StatusCode)
+	// добавляем вебхук в очередь доставки
+	enqueueWebhook(log, newMessageWebhook.InstanceWhatsapp.IdInstance, newMessageWebhook.WebhookUrl, newMessageWebhook.TypeWebhook, newMessageWebhook.CountTrySending, postBody)
 }
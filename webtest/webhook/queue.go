@@ -0,0 +1,636 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+	"go.mau.fi/whatsmeow/webtest/properties"
+)
+
+// DeliveryQueue очередь доставки вебхуков, общая для всех инстансов
+var DeliveryQueue *Queue
+
+// ErrQueueNotInitialized ошибка очередь доставки не инициализирована
+var ErrQueueNotInitialized = errors.New("webhook delivery queue not initialized")
+
+const (
+	// максимальное количество попыток доставки по умолчанию
+	defaultMaxAttempts = 10
+
+	// задержка перед первой повторной попыткой
+	baseRetryDelay = 5 * time.Second
+
+	// максимальная задержка между попытками
+	maxRetryDelay = time.Hour
+
+	// интервал проверки очереди
+	pollInterval = time.Second
+
+	// количество вебхуков, забираемых из очереди за раз
+	deliveryBatchSize = 50
+
+	// количество одновременных доставок
+	deliveryConcurrency = 8
+
+	// максимальная длина сохраняемой ошибки
+	maxErrorLength = 500
+)
+
+const (
+	createQueueTableSQLite = `CREATE TABLE IF NOT EXISTS webtest_webhook_queue (
+		id              INTEGER PRIMARY KEY AUTOINCREMENT,
+		id_instance     BIGINT  NOT NULL,
+		webhook_url     TEXT    NOT NULL,
+		type_webhook    TEXT    NOT NULL,
+		body            TEXT    NOT NULL,
+		attempts        INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at BIGINT  NOT NULL,
+		last_error      TEXT    NOT NULL DEFAULT '',
+		created_at      BIGINT  NOT NULL
+	)`
+	createQueueTablePostgres = `CREATE TABLE IF NOT EXISTS webtest_webhook_queue (
+		id              BIGSERIAL PRIMARY KEY,
+		id_instance     BIGINT    NOT NULL,
+		webhook_url     TEXT      NOT NULL,
+		type_webhook    TEXT      NOT NULL,
+		body            TEXT      NOT NULL,
+		attempts        INTEGER   NOT NULL DEFAULT 0,
+		next_attempt_at BIGINT    NOT NULL,
+		last_error      TEXT      NOT NULL DEFAULT '',
+		created_at      BIGINT    NOT NULL
+	)`
+	createQueueIndex            = `CREATE INDEX IF NOT EXISTS webtest_webhook_queue_next_attempt_idx ON webtest_webhook_queue (next_attempt_at)`
+	createDeadLetterTableSQLite = `CREATE TABLE IF NOT EXISTS webtest_webhook_dead_letters (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		id_instance BIGINT  NOT NULL,
+		webhook_url TEXT    NOT NULL,
+		type_webhook TEXT   NOT NULL,
+		body        TEXT    NOT NULL,
+		attempts    INTEGER NOT NULL,
+		last_error  TEXT    NOT NULL,
+		created_at  BIGINT  NOT NULL,
+		failed_at   BIGINT  NOT NULL
+	)`
+	createDeadLetterTablePostgres = `CREATE TABLE IF NOT EXISTS webtest_webhook_dead_letters (
+		id          BIGSERIAL PRIMARY KEY,
+		id_instance BIGINT    NOT NULL,
+		webhook_url TEXT      NOT NULL,
+		type_webhook TEXT     NOT NULL,
+		body        TEXT      NOT NULL,
+		attempts    INTEGER   NOT NULL,
+		last_error  TEXT      NOT NULL,
+		created_at  BIGINT    NOT NULL,
+		failed_at   BIGINT    NOT NULL
+	)`
+
+	enqueueQuery = `
+		INSERT INTO webtest_webhook_queue (id_instance, webhook_url, type_webhook, body, attempts, next_attempt_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	getDueDeliveriesQuery = `
+		SELECT id, id_instance, webhook_url, type_webhook, body, attempts, created_at FROM webtest_webhook_queue
+		WHERE next_attempt_at <= $1 ORDER BY next_attempt_at, id LIMIT $2
+	`
+	deleteDeliveryQuery     = `DELETE FROM webtest_webhook_queue WHERE id=$1`
+	rescheduleDeliveryQuery = `UPDATE webtest_webhook_queue SET attempts=$1, next_attempt_at=$2, last_error=$3 WHERE id=$4`
+	insertDeadLetterQuery   = `
+		INSERT INTO webtest_webhook_dead_letters (id_instance, webhook_url, type_webhook, body, attempts, last_error, created_at, failed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	getDeadLettersQuery = `
+		SELECT id, id_instance, webhook_url, type_webhook, body, attempts, last_error, created_at, failed_at
+		FROM webtest_webhook_dead_letters WHERE id_instance=$1 ORDER BY id LIMIT $2
+	`
+	getDeadLetterQuery    = `SELECT id_instance, webhook_url, type_webhook, body, created_at FROM webtest_webhook_dead_letters WHERE id=$1`
+	deleteDeadLetterQuery = `DELETE FROM webtest_webhook_dead_letters WHERE id=$1`
+	getDeadLetterIDsQuery = `SELECT id FROM webtest_webhook_dead_letters WHERE id_instance=$1 ORDER BY id`
+)
+
+// Queue персистентная очередь доставки вебхуков с повторными попытками
+type Queue struct {
+	db          *sql.DB
+	log         waLog.Logger
+	client      *http.Client
+	maxAttempts int
+	config      properties.Configuration
+	wake        chan struct{}
+}
+
+// Delivery вебхук в очереди доставки
+type Delivery struct {
+	Id          int64
+	IdInstance  uint64
+	WebhookUrl  string
+	TypeWebhook string
+	Body        string
+	Attempts    int
+	CreatedAt   int64
+}
+
+// DeadLetter вебхук, который не удалось доставить за все попытки
+type DeadLetter struct {
+	Id          int64
+	IdInstance  uint64
+	WebhookUrl  string
+	TypeWebhook string
+	Body        string
+	Attempts    int
+	LastError   string
+	CreatedAt   int64
+	FailedAt    int64
+}
+
+// NewQueue Метод создает очередь доставки и ее таблицы в базе данных
+func NewQueue(db *sql.DB, dialect string, config properties.Configuration, log waLog.Logger) (*Queue, error) {
+
+	maxAttempts := config.WebhookMaxAttempts
+
+	// если количество попыток не указано
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	createQueries := []string{createQueueTableSQLite, createQueueIndex, createDeadLetterTableSQLite}
+
+	// если postgres
+	if dialect == "postgres" || dialect == "pgx" {
+		createQueries = []string{createQueueTablePostgres, createQueueIndex, createDeadLetterTablePostgres}
+	}
+
+	// создаем таблицы
+	for _, query := range createQueries {
+
+		_, err := db.Exec(query)
+
+		// если ошибка
+		if err != nil {
+
+			// отдаем ошибку
+			return nil, fmt.Errorf("failed to create webhook queue tables: %w", err)
+		}
+	}
+
+	return &Queue{
+		db:          db,
+		log:         log,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		maxAttempts: maxAttempts,
+		config:      config,
+		wake:        make(chan struct{}, 1),
+	}, nil
+}
+
+// Enqueue Метод добавляет вебхук в очередь доставки
+func (queue *Queue) Enqueue(idInstance uint64, webhookUrl, typeWebhook string, body []byte, attempts uint32) error {
+
+	now := time.Now().UnixMilli()
+
+	_, err := queue.db.Exec(enqueueQuery, idInstance, webhookUrl, typeWebhook, string(body), attempts, now, now)
+
+	// если ошибка
+	if err != nil {
+
+		// отдаем ошибку
+		return fmt.Errorf("failed to enqueue webhook: %w", err)
+	}
+
+	// будим обработчик очереди
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Run Метод обрабатывает очередь доставки, пока не будет отменен контекст
+func (queue *Queue) Run(ctx context.Context) {
+
+	ticker := time.NewTicker(pollInterval)
+
+	defer ticker.Stop()
+
+	for {
+
+		// доставляем вебхуки, пока они есть и пока база данных работает без ошибок,
+		// иначе те же вебхуки снова выбираются сразу же и отправляются повторно без задержки
+		for queue.processBatch() {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-queue.wake:
+		}
+	}
+}
+
+// Метод доставляет одну пачку вебхуков и отдает true, если стоит сразу обработать следующую пачку:
+// пачка была полной и состояние всех вебхуков в ней успешно обновлено в базе данных
+func (queue *Queue) processBatch() bool {
+
+	// получаем вебхуки, которые пора доставить
+	rows, err := queue.db.Query(getDueDeliveriesQuery, time.Now().UnixMilli(), deliveryBatchSize)
+
+	// если ошибка
+	if err != nil {
+
+		// выводим лог
+		queue.log.Errorf("Failed to query webhook queue: %v", err)
+
+		return false
+	}
+
+	var deliveries []Delivery
+
+	scanFailed := false
+
+	for rows.Next() {
+
+		var delivery Delivery
+
+		err = rows.Scan(&delivery.Id, &delivery.IdInstance, &delivery.WebhookUrl, &delivery.TypeWebhook, &delivery.Body, &delivery.Attempts, &delivery.CreatedAt)
+
+		// если ошибка
+		if err != nil {
+
+			// выводим лог
+			queue.log.Errorf("Failed to scan webhook queue row: %v", err)
+
+			scanFailed = true
+
+			break
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	// если чтение строк прервалось ошибкой
+	if err = rows.Err(); !scanFailed && err != nil {
+
+		// выводим лог
+		queue.log.Errorf("Failed to read webhook queue rows: %v", err)
+
+		scanFailed = true
+	}
+
+	_ = rows.Close()
+
+	var wg sync.WaitGroup
+
+	var failedUpdates int32
+
+	semaphore := make(chan struct{}, deliveryConcurrency)
+
+	// доставляем вебхуки
+	for _, delivery := range deliveries {
+
+		wg.Add(1)
+
+		semaphore <- struct{}{}
+
+		go func(delivery Delivery) {
+
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			if !queue.handleDelivery(delivery) {
+				atomic.AddInt32(&failedUpdates, 1)
+			}
+		}(delivery)
+	}
+
+	wg.Wait()
+
+	return !scanFailed && failedUpdates == 0 && len(deliveries) == deliveryBatchSize
+}
+
+// Метод делает попытку доставки и обновляет очередь по ее результату.
+// Отдает false, если обновить состояние вебхука в базе данных не удалось
+func (queue *Queue) handleDelivery(delivery Delivery) bool {
+
+	delivery.Attempts++
+
+	// отправляем вебхук
+	err := queue.send(delivery)
+
+	// если доставлено
+	if err == nil {
+
+		// удаляем вебхук из очереди
+		if _, err = queue.db.Exec(deleteDeliveryQuery, delivery.Id); err != nil {
+			queue.log.Errorf("Failed to delete delivered webhook %d: %v", delivery.Id, err)
+
+			return false
+		}
+
+		return true
+	}
+
+	lastError := err.Error()
+
+	// обрезаем слишком длинную ошибку
+	if len(lastError) > maxErrorLength {
+		lastError = lastError[:maxErrorLength]
+	}
+
+	// если попытки закончились
+	if delivery.Attempts >= queue.maxAttempts {
+
+		// выводим лог
+		queue.log.Errorf("Giving up on %s webhook %d to %s after %d attempts: %v", delivery.TypeWebhook, delivery.Id, delivery.WebhookUrl, delivery.Attempts, err)
+
+		// переносим вебхук в таблицу недоставленных
+		if err = queue.moveToDeadLetters(delivery, lastError); err != nil {
+			queue.log.Errorf("Failed to move webhook %d to dead letters: %v", delivery.Id, err)
+
+			return false
+		}
+
+		return true
+	}
+
+	delay := retryDelay(delivery.Attempts)
+
+	// выводим лог
+	queue.log.Warnf("Failed to send %s webhook %d to %s (attempt %d/%d), retrying in %s: %v", delivery.TypeWebhook, delivery.Id, delivery.WebhookUrl, delivery.Attempts, queue.maxAttempts, delay, err)
+
+	// планируем следующую попытку
+	_, err = queue.db.Exec(rescheduleDeliveryQuery, delivery.Attempts, time.Now().Add(delay).UnixMilli(), lastError, delivery.Id)
+
+	// если ошибка
+	if err != nil {
+		queue.log.Errorf("Failed to reschedule webhook %d: %v", delivery.Id, err)
+
+		return false
+	}
+
+	return true
+}
+
+// Метод отправляет вебхук получателю
+func (queue *Queue) send(delivery Delivery) error {
+
+	req, err := http.NewRequest(http.MethodPost, delivery.WebhookUrl, strings.NewReader(delivery.Body))
+
+	// если ошибка
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// дополнительные заголовки из конфигурации
+	for name, value := range queue.config.GetWebhookHeaders(delivery.IdInstance) {
+		req.Header.Set(name, value)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", queue.config.GetWebhookUserAgent(delivery.IdInstance))
+	req.Header.Set("X-Webhook-Id", strconv.FormatInt(delivery.Id, 10))
+	req.Header.Set("X-Webhook-Attempt", strconv.Itoa(delivery.Attempts))
+
+	// если задан секрет, то подписываем тело вебхука
+	if queue.config.AppSecret != "" {
+
+		timestamp := time.Now().Unix()
+
+		req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(SignatureHeader, SignPayload(queue.config.AppSecret, timestamp, []byte(delivery.Body)))
+	}
+
+	res, err := queue.client.Do(req)
+
+	// если ошибка
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	// дочитываем тело, чтобы переиспользовать соединение
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	// если получатель не принял вебхук
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status %d", res.StatusCode)
+	}
+
+	queue.log.Debugf("Delivered %s webhook %d (status %d)", delivery.TypeWebhook, delivery.Id, res.StatusCode)
+
+	return nil
+}
+
+// Метод переносит вебхук из очереди в таблицу недоставленных
+func (queue *Queue) moveToDeadLetters(delivery Delivery, lastError string) error {
+
+	tx, err := queue.db.Begin()
+
+	// если ошибка
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	_, err = tx.Exec(insertDeadLetterQuery, delivery.IdInstance, delivery.WebhookUrl, delivery.TypeWebhook, delivery.Body, delivery.Attempts, lastError, delivery.CreatedAt, time.Now().UnixMilli())
+
+	// если ошибка
+	if err == nil {
+		_, err = tx.Exec(deleteDeliveryQuery, delivery.Id)
+	}
+
+	// если ошибка
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetDeadLetters Метод отдает недоставленные вебхуки инстанса
+func (queue *Queue) GetDeadLetters(idInstance uint64, limit int) ([]DeadLetter, error) {
+
+	rows, err := queue.db.Query(getDeadLettersQuery, idInstance, limit)
+
+	// если ошибка
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dead letters: %w", err)
+	}
+
+	defer rows.Close()
+
+	deadLetters := make([]DeadLetter, 0)
+
+	for rows.Next() {
+
+		var deadLetter DeadLetter
+
+		err = rows.Scan(&deadLetter.Id, &deadLetter.IdInstance, &deadLetter.WebhookUrl, &deadLetter.TypeWebhook, &deadLetter.Body,
+			&deadLetter.Attempts, &deadLetter.LastError, &deadLetter.CreatedAt, &deadLetter.FailedAt)
+
+		// если ошибка
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan dead letter: %w", err)
+		}
+
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	return deadLetters, rows.Err()
+}
+
+// ReplayDeadLetters Метод возвращает недоставленные вебхуки инстанса в очередь.
+// Если список идентификаторов пустой, возвращаются все недоставленные вебхуки инстанса.
+// Вебхуки отправляются на текущий webhook URL, если он указан, иначе на исходный.
+func (queue *Queue) ReplayDeadLetters(idInstance uint64, ids []int64, webhookUrl string) (int, error) {
+
+	// если идентификаторы не указаны
+	if len(ids) == 0 {
+
+		rows, err := queue.db.Query(getDeadLetterIDsQuery, idInstance)
+
+		// если ошибка
+		if err != nil {
+			return 0, fmt.Errorf("failed to query dead letters: %w", err)
+		}
+
+		for rows.Next() {
+
+			var id int64
+
+			if err = rows.Scan(&id); err != nil {
+				_ = rows.Close()
+				return 0, fmt.Errorf("failed to scan dead letter: %w", err)
+			}
+
+			ids = append(ids, id)
+		}
+
+		// если чтение строк прервалось ошибкой
+		if err = rows.Err(); err != nil {
+			_ = rows.Close()
+			return 0, fmt.Errorf("failed to read dead letters: %w", err)
+		}
+
+		_ = rows.Close()
+	}
+
+	replayed := 0
+
+	for _, id := range ids {
+
+		ok, err := queue.replayDeadLetter(idInstance, id, webhookUrl)
+
+		// если ошибка
+		if err != nil {
+			return replayed, err
+		}
+
+		if ok {
+			replayed++
+		}
+	}
+
+	// будим обработчик очереди
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+
+	return replayed, nil
+}
+
+// Метод возвращает один недоставленный вебхук в очередь
+func (queue *Queue) replayDeadLetter(idInstance uint64, id int64, webhookUrl string) (bool, error) {
+
+	tx, err := queue.db.Begin()
+
+	// если ошибка
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	var delivery Delivery
+
+	err = tx.QueryRow(getDeadLetterQuery, id).Scan(&delivery.IdInstance, &delivery.WebhookUrl, &delivery.TypeWebhook, &delivery.Body, &delivery.CreatedAt)
+
+	// если вебхук не найден или принадлежит другому инстансу
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && delivery.IdInstance != idInstance) {
+		_ = tx.Rollback()
+		return false, nil
+	} else if err != nil {
+		_ = tx.Rollback()
+		return false, fmt.Errorf("failed to get dead letter %d: %w", id, err)
+	}
+
+	// если указан новый webhook URL
+	if webhookUrl != "" {
+		delivery.WebhookUrl = webhookUrl
+	}
+
+	_, err = tx.Exec(enqueueQuery, delivery.IdInstance, delivery.WebhookUrl, delivery.TypeWebhook, delivery.Body, 0, time.Now().UnixMilli(), delivery.CreatedAt)
+
+	// если ошибка
+	if err == nil {
+		_, err = tx.Exec(deleteDeadLetterQuery, id)
+	}
+
+	// если ошибка
+	if err != nil {
+		_ = tx.Rollback()
+		return false, fmt.Errorf("failed to replay dead letter %d: %w", id, err)
+	}
+
+	return true, tx.Commit()
+}
+
+// Метод считает задержку перед следующей попыткой с экспоненциальным ростом
+func retryDelay(attempts int) time.Duration {
+
+	delay := baseRetryDelay
+
+	for i := 1; i < attempts; i++ {
+
+		delay *= 2
+
+		if delay >= maxRetryDelay {
+			return maxRetryDelay
+		}
+	}
+
+	return delay
+}
+
+// Метод сериализует вебхук и добавляет его в очередь доставки
+func enqueueWebhook(log waLog.Logger, idInstance uint64, webhookUrl, typeWebhook string, countTrySending uint32, postBody []byte) {
+
+	// если очередь не инициализирована
+	if DeliveryQueue == nil {
+
+		// выводим лог
+		log.Errorf("Failed to send %s webhook: %v", typeWebhook, ErrQueueNotInitialized)
+
+		return
+	}
+
+	// добавляем вебхук в очередь
+	err := DeliveryQueue.Enqueue(idInstance, webhookUrl, typeWebhook, postBody, countTrySending)
+
+	// если ошибка
+	if err != nil {
+
+		// выводим лог
+		log.Errorf("Failed to enqueue %s webhook: %v", typeWebhook, err)
+	}
+}
@@ -0,0 +1,385 @@
+package webhook
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+	"go.mau.fi/whatsmeow/webtest/properties"
+)
+
+// счетчик баз данных, чтобы у каждого теста была своя база
+var testDBCounter uint32
+
+// запрос, полученный тестовым получателем вебхуков
+type receivedWebhook struct {
+	Header http.Header
+	Body   string
+}
+
+// тестовый получатель вебхуков, отвечающий заданным статусом
+type testReceiver struct {
+	*httptest.Server
+	lock     sync.Mutex
+	status   int
+	received []receivedWebhook
+}
+
+// Метод создает тестовый получатель вебхуков, который закрывается в конце теста
+func newTestReceiver(t *testing.T, status int) *testReceiver {
+
+	receiver := &testReceiver{status: status}
+
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		body, _ := io.ReadAll(r.Body)
+
+		receiver.lock.Lock()
+		receiver.received = append(receiver.received, receivedWebhook{Header: r.Header.Clone(), Body: string(body)})
+		status := receiver.status
+		receiver.lock.Unlock()
+
+		w.WriteHeader(status)
+	}))
+
+	t.Cleanup(receiver.Close)
+
+	return receiver
+}
+
+// Метод отдает полученные вебхуки
+func (receiver *testReceiver) Received() []receivedWebhook {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	return append([]receivedWebhook{}, receiver.received...)
+}
+
+// Метод создает очередь доставки в новой базе SQLite в памяти
+func newTestQueue(t *testing.T, config properties.Configuration) *Queue {
+
+	t.Helper()
+
+	name := fmt.Sprintf("file:webhook-queue-test-%d?mode=memory&cache=shared", atomic.AddUint32(&testDBCounter, 1))
+
+	db, err := sql.Open("sqlite3", name)
+
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	// одно соединение, чтобы параллельные доставки не получали ошибку блокировки таблицы
+	db.SetMaxOpenConns(1)
+
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	queue, err := NewQueue(db, "sqlite3", config, waLog.Noop)
+
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+
+	return queue
+}
+
+// Метод отдает вебхуки в очереди, включая еще не готовые к доставке
+func getQueued(t *testing.T, queue *Queue) []Delivery {
+
+	t.Helper()
+
+	rows, err := queue.db.Query("SELECT id, id_instance, webhook_url, type_webhook, body, attempts, created_at FROM webtest_webhook_queue ORDER BY id")
+
+	if err != nil {
+		t.Fatalf("Failed to query queue: %v", err)
+	}
+
+	defer rows.Close()
+
+	var deliveries []Delivery
+
+	for rows.Next() {
+
+		var delivery Delivery
+
+		if err = rows.Scan(&delivery.Id, &delivery.IdInstance, &delivery.WebhookUrl, &delivery.TypeWebhook, &delivery.Body, &delivery.Attempts, &delivery.CreatedAt); err != nil {
+			t.Fatalf("Failed to scan queue row: %v", err)
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		t.Fatalf("Failed to read queue: %v", err)
+	}
+
+	return deliveries
+}
+
+// Метод делает все вебхуки в очереди готовыми к доставке
+func makeDue(t *testing.T, queue *Queue) {
+
+	t.Helper()
+
+	if _, err := queue.db.Exec("UPDATE webtest_webhook_queue SET next_attempt_at=0"); err != nil {
+		t.Fatalf("Failed to update queue: %v", err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+
+	for attempts, expected := range map[int]time.Duration{
+		0:   baseRetryDelay,
+		1:   baseRetryDelay,
+		2:   2 * baseRetryDelay,
+		3:   4 * baseRetryDelay,
+		10:  512 * baseRetryDelay,
+		11:  maxRetryDelay,
+		100: maxRetryDelay,
+	} {
+		if delay := retryDelay(attempts); delay != expected {
+			t.Errorf("Expected delay after %d attempts to be %s, got %s", attempts, expected, delay)
+		}
+	}
+
+	// задержка не убывает и не превышает максимальную
+	for attempts := 2; attempts < 20; attempts++ {
+		if delay := retryDelay(attempts); delay < retryDelay(attempts-1) || delay > maxRetryDelay {
+			t.Errorf("Unexpected delay %s after %d attempts", delay, attempts)
+		}
+	}
+}
+
+func TestQueue_Deliver(t *testing.T) {
+
+	receiver := newTestReceiver(t, http.StatusOK)
+
+	queue := newTestQueue(t, properties.Configuration{AppSecret: "secret"})
+
+	if err := queue.Enqueue(1, receiver.URL, "incomingMessageReceived", []byte(`{"a":1}`), 0); err != nil {
+		t.Fatalf("Failed to enqueue webhook: %v", err)
+	}
+
+	if queue.processBatch() {
+		t.Errorf("Expected incomplete batch not to request another batch")
+	}
+
+	received := receiver.Received()
+
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 webhook to be delivered, got %d", len(received))
+	}
+
+	if received[0].Body != `{"a":1}` {
+		t.Errorf("Unexpected webhook body %q", received[0].Body)
+	}
+
+	if attempt := received[0].Header.Get("X-Webhook-Attempt"); attempt != "1" {
+		t.Errorf("Expected attempt header to be 1, got %q", attempt)
+	}
+
+	timestamp, err := strconv.ParseInt(received[0].Header.Get(TimestampHeader), 10, 64)
+
+	if err != nil {
+		t.Errorf("Failed to parse signature timestamp: %v", err)
+	} else if !VerifySignature("secret", received[0].Header.Get(SignatureHeader), timestamp, []byte(received[0].Body), time.Minute) {
+		t.Errorf("Webhook signature is invalid")
+	}
+
+	if queued := getQueued(t, queue); len(queued) != 0 {
+		t.Errorf("Expected delivered webhook to be deleted from the queue, got %v", queued)
+	}
+}
+
+func TestQueue_Reschedule(t *testing.T) {
+
+	receiver := newTestReceiver(t, http.StatusInternalServerError)
+
+	queue := newTestQueue(t, properties.Configuration{})
+
+	if err := queue.Enqueue(1, receiver.URL, "incomingMessageReceived", []byte(`{}`), 0); err != nil {
+		t.Fatalf("Failed to enqueue webhook: %v", err)
+	}
+
+	// время попыток хранится в миллисекундах
+	before := time.Now().Truncate(time.Millisecond)
+
+	queue.processBatch()
+
+	var attempts int
+	var nextAttemptAt int64
+	var lastError string
+
+	err := queue.db.QueryRow("SELECT attempts, next_attempt_at, last_error FROM webtest_webhook_queue").Scan(&attempts, &nextAttemptAt, &lastError)
+
+	if err != nil {
+		t.Fatalf("Expected failed webhook to stay in the queue: %v", err)
+	}
+
+	if attempts != 1 {
+		t.Errorf("Expected 1 attempt, got %d", attempts)
+	}
+
+	// следующая попытка запланирована через задержку после первой попытки
+	if next := time.UnixMilli(nextAttemptAt); next.Before(before.Add(retryDelay(1))) || next.After(time.Now().Add(retryDelay(1))) {
+		t.Errorf("Expected next attempt in %s, got %s", retryDelay(1), next.Sub(before))
+	}
+
+	if !strings.Contains(lastError, "500") {
+		t.Errorf("Expected last error to contain the response status, got %q", lastError)
+	}
+
+	// вебхук не доставляется повторно до следующей попытки
+	queue.processBatch()
+
+	if received := receiver.Received(); len(received) != 1 {
+		t.Errorf("Expected webhook not to be retried before the delay, got %d requests", len(received))
+	}
+
+	makeDue(t, queue)
+
+	queue.processBatch()
+
+	received := receiver.Received()
+
+	if len(received) != 2 {
+		t.Fatalf("Expected webhook to be retried, got %d requests", len(received))
+	}
+
+	if attempt := received[1].Header.Get("X-Webhook-Attempt"); attempt != "2" {
+		t.Errorf("Expected attempt header to be 2, got %q", attempt)
+	}
+}
+
+func TestQueue_DeadLetters(t *testing.T) {
+
+	receiver := newTestReceiver(t, http.StatusBadGateway)
+
+	queue := newTestQueue(t, properties.Configuration{WebhookMaxAttempts: 2})
+
+	if err := queue.Enqueue(1, receiver.URL, "outgoingMessageStatus", []byte(`{"b":2}`), 0); err != nil {
+		t.Fatalf("Failed to enqueue webhook: %v", err)
+	}
+
+	queue.processBatch()
+
+	if queued := getQueued(t, queue); len(queued) != 1 {
+		t.Fatalf("Expected webhook to stay in the queue after the first attempt, got %v", queued)
+	}
+
+	makeDue(t, queue)
+
+	queue.processBatch()
+
+	if queued := getQueued(t, queue); len(queued) != 0 {
+		t.Errorf("Expected webhook to be removed from the queue after the last attempt, got %v", queued)
+	}
+
+	deadLetters, err := queue.GetDeadLetters(1, 10)
+
+	if err != nil {
+		t.Fatalf("Failed to get dead letters: %v", err)
+	}
+
+	if len(deadLetters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(deadLetters))
+	}
+
+	deadLetter := deadLetters[0]
+
+	if deadLetter.Attempts != 2 || deadLetter.WebhookUrl != receiver.URL || deadLetter.TypeWebhook != "outgoingMessageStatus" || deadLetter.Body != `{"b":2}` {
+		t.Errorf("Unexpected dead letter %+v", deadLetter)
+	}
+
+	if !strings.Contains(deadLetter.LastError, "502") {
+		t.Errorf("Expected last error to contain the response status, got %q", deadLetter.LastError)
+	}
+
+	// недоставленные вебхуки не видны другим инстансам
+	if deadLetters, err = queue.GetDeadLetters(2, 10); err != nil || len(deadLetters) != 0 {
+		t.Errorf("Expected no dead letters for another instance, got %v (%v)", deadLetters, err)
+	}
+}
+
+func TestQueue_ReplayDeadLetters(t *testing.T) {
+
+	queue := newTestQueue(t, properties.Configuration{})
+
+	now := time.Now().UnixMilli()
+
+	// недоставленные вебхуки двух инстансов
+	var ids []int64
+
+	for _, idInstance := range []uint64{1, 1, 2} {
+
+		res, err := queue.db.Exec(insertDeadLetterQuery, idInstance, "http://old.example", "incomingMessageReceived", "{}", 10, "error", now, now)
+
+		if err != nil {
+			t.Fatalf("Failed to insert dead letter: %v", err)
+		}
+
+		id, _ := res.LastInsertId()
+
+		ids = append(ids, id)
+	}
+
+	// вебхук другого инстанса и несуществующий вебхук не возвращаются в очередь
+	replayed, err := queue.ReplayDeadLetters(1, []int64{ids[2], ids[2] + 100}, "")
+
+	if err != nil {
+		t.Fatalf("Failed to replay dead letters: %v", err)
+	} else if replayed != 0 {
+		t.Errorf("Expected dead letters of another instance not to be replayed, replayed %d", replayed)
+	}
+
+	if deadLetters, _ := queue.GetDeadLetters(2, 10); len(deadLetters) != 1 {
+		t.Errorf("Expected dead letter of another instance to be kept, got %v", deadLetters)
+	}
+
+	// без идентификаторов возвращаются все вебхуки инстанса на новый URL
+	replayed, err = queue.ReplayDeadLetters(1, nil, "http://new.example")
+
+	if err != nil {
+		t.Fatalf("Failed to replay dead letters: %v", err)
+	} else if replayed != 2 {
+		t.Errorf("Expected 2 replayed dead letters, got %d", replayed)
+	}
+
+	queued := getQueued(t, queue)
+
+	if len(queued) != 2 {
+		t.Fatalf("Expected 2 webhooks in the queue, got %v", queued)
+	}
+
+	for _, delivery := range queued {
+		if delivery.IdInstance != 1 || delivery.WebhookUrl != "http://new.example" || delivery.Attempts != 0 || delivery.CreatedAt != now {
+			t.Errorf("Unexpected replayed webhook %+v", delivery)
+		}
+	}
+
+	if deadLetters, _ := queue.GetDeadLetters(1, 10); len(deadLetters) != 0 {
+		t.Errorf("Expected replayed dead letters to be deleted, got %v", deadLetters)
+	}
+
+	// вебхук другого инстанса возвращается на исходный URL
+	replayed, err = queue.ReplayDeadLetters(2, []int64{ids[2]}, "")
+
+	if err != nil || replayed != 1 {
+		t.Fatalf("Expected dead letter to be replayed, replayed %d (%v)", replayed, err)
+	}
+
+	if queued = getQueued(t, queue); len(queued) != 3 || queued[2].WebhookUrl != "http://old.example" {
+		t.Errorf("Expected webhook to be replayed to the original URL, got %v", queued)
+	}
+}
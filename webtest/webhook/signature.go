@@ -0,0 +1,46 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+const (
+	// SignatureHeader заголовок с подписью тела вебхука
+	SignatureHeader = "X-Signature"
+
+	// TimestampHeader заголовок со временем подписи вебхука в секундах
+	TimestampHeader = "X-Signature-Timestamp"
+
+	// префикс подписи с названием алгоритма
+	signaturePrefix = "sha256="
+)
+
+// SignPayload Метод подписывает тело вебхука секретом приложения.
+// Подписывается строка "<timestamp>.<body>", подпись отдается в виде "sha256=<hex>".
+// Получатель должен проверить подпись и отклонить вебхук, если время подписи слишком старое.
+func SignPayload(secret string, timestamp int64, body []byte) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature Метод проверяет подпись тела вебхука и время подписи
+func VerifySignature(secret, signature string, timestamp int64, body []byte, maxAge time.Duration) bool {
+
+	// если подпись слишком старая или из будущего
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > maxAge || age < -maxAge {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(SignPayload(secret, timestamp, body)))
+}
@@ -0,0 +1,69 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignPayload(t *testing.T) {
+
+	// подписи посчитаны независимо: HMAC-SHA256 от "<timestamp>.<body>"
+	for _, test := range []struct {
+		secret    string
+		timestamp int64
+		body      string
+		expected  string
+	}{
+		{"secret", 1700000000, `{"typeWebhook":"incomingMessageReceived"}`, "sha256=bea146c12111287156ad93f932ef0fa4131bd7cc7de51aeff650f627f413878f"},
+		{"key", 1, "", "sha256=53123bc365c2fe4bee48bc5cc6cd6c19699147d43513154ed34277c7c063e80f"},
+	} {
+		if signature := SignPayload(test.secret, test.timestamp, []byte(test.body)); signature != test.expected {
+			t.Errorf("Expected signature of %q at %d to be %s, got %s", test.body, test.timestamp, test.expected, signature)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+
+	const secret = "secret"
+	const maxAge = 5 * time.Minute
+
+	body := []byte(`{"typeWebhook":"incomingMessageReceived"}`)
+	now := time.Now().Unix()
+	signature := SignPayload(secret, now, body)
+
+	if !VerifySignature(secret, signature, now, body, maxAge) {
+		t.Errorf("Expected valid signature to be accepted")
+	}
+
+	for name, valid := range map[string]bool{
+		"wrong secret":    VerifySignature("other", signature, now, body, maxAge),
+		"changed body":    VerifySignature(secret, signature, now, []byte(`{}`), maxAge),
+		"other timestamp": VerifySignature(secret, signature, now-1, body, maxAge),
+		"no prefix":       VerifySignature(secret, signature[len(signaturePrefix):], now, body, maxAge),
+	} {
+		if valid {
+			t.Errorf("Expected signature with %s to be rejected", name)
+		}
+	}
+
+	// подпись с истекшим временем или из будущего отклоняется, даже если она верная
+	for name, timestamp := range map[string]int64{
+		"expired": now - int64(maxAge/time.Second) - 60,
+		"future":  now + int64(maxAge/time.Second) + 60,
+	} {
+		if VerifySignature(secret, SignPayload(secret, timestamp, body), timestamp, body, maxAge) {
+			t.Errorf("Expected %s signature to be rejected", name)
+		}
+	}
+
+	// подпись в пределах допустимого расхождения часов принимается
+	for name, timestamp := range map[string]int64{
+		"old":    now - int64(maxAge/time.Second) + 60,
+		"future": now + int64(maxAge/time.Second) - 60,
+	} {
+		if !VerifySignature(secret, SignPayload(secret, timestamp, body), timestamp, body, maxAge) {
+			t.Errorf("Expected %s signature within the allowed age to be accepted", name)
+		}
+	}
+}
@@ -1,10 +1,9 @@
 package webhook
 
 import (
-	"bytes"
 	"encoding/json"
+
 	waLog "go.mau.fi/whatsmeow/util/log"
-	"net/http"
 )
 
 // StatusMessageWebhook объект данных webhook о статусе сообщения
@@ -24,7 +23,7 @@ type DataStatusMessage struct {
 	Status          string `json:"status"`
 }
 
-// SendStatusMessageWebhook Метод отправляет вебхук о статусе сообщения
+// SendStatusMessageWebhook Метод ставит в очередь доставки вебхук о статусе сообщения
 func (statusMessageWebhook *StatusMessageWebhook) SendStatusMessageWebhook(log waLog.Logger) {
 
 	// если вебхук не установлен
@@ -47,32 +46,6 @@ func (statusMessageWebhook *StatusMessageWebhook) SendStatusMessageWebhook(log w
 		return
 	}
 
-	// создаем тело запроса
-	responseBody := bytes.NewBuffer(postBody)
-
-	req, err := http.NewRequest("POST", statusMessageWebhook.WebhookUrl, responseBody)
-
-	if err != nil {
-
-		// выводим лог
-		log.Errorf("Error NewRequest %v", err)
-
-		return
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "PostmanRuntime/7.32.3")
-
-	client := http.Client{}
-
-	res, err := client.Do(req)
-
-	// если ошибка
-	if err != nil {
-
-		// выводим лог
-		log.Errorf("Error send status message webhook %v", err)
-	}
-
-	log.Infof("Response status: %d", res.StatusCode)
+	// добавляем вебхук в очередь доставки
+	enqueueWebhook(log, statusMessageWebhook.InstanceWhatsapp.IdInstance, statusMessageWebhook.WebhookUrl, statusMessageWebhook.TypeWebhook, statusMessageWebhook.CountTrySending, postBody)
 }
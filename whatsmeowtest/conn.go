@@ -0,0 +1,262 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeowtest
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/socket"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/util/keys"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// serverConn is the server end of a single client connection.
+type serverConn struct {
+	srv *Server
+	ws  *websocket.Conn
+	log waLog.Logger
+
+	clientID types.JID
+
+	writeKey     cipher.AEAD
+	readKey      cipher.AEAD
+	writeCounter uint32
+	readCounter  uint32
+	writeLock    sync.Mutex
+
+	headerRead bool
+	buf        []byte
+	frames     [][]byte
+}
+
+// readFrame returns the next length-prefixed frame sent by the client. The first websocket message
+// from the client also contains the connection header, which is stripped off here.
+func (conn *serverConn) readFrame() ([]byte, error) {
+	for len(conn.frames) == 0 {
+		msgType, data, err := conn.ws.ReadMessage()
+		if err != nil {
+			return nil, err
+		} else if msgType != websocket.BinaryMessage {
+			continue
+		}
+		conn.buf = append(conn.buf, data...)
+		if !conn.headerRead {
+			if len(conn.buf) < len(socket.WAConnHeader) {
+				continue
+			} else if !bytes.Equal(conn.buf[:len(socket.WAConnHeader)], socket.WAConnHeader) {
+				return nil, fmt.Errorf("unexpected connection header %X", conn.buf[:len(socket.WAConnHeader)])
+			}
+			conn.buf = conn.buf[len(socket.WAConnHeader):]
+			conn.headerRead = true
+		}
+		for len(conn.buf) >= socket.FrameLengthSize {
+			length := int(conn.buf[0])<<16 | int(conn.buf[1])<<8 | int(conn.buf[2])
+			if len(conn.buf) < socket.FrameLengthSize+length {
+				break
+			}
+			frame := make([]byte, length)
+			copy(frame, conn.buf[socket.FrameLengthSize:])
+			conn.frames = append(conn.frames, frame)
+			conn.buf = conn.buf[socket.FrameLengthSize+length:]
+		}
+	}
+	frame := conn.frames[0]
+	conn.frames = conn.frames[1:]
+	return frame, nil
+}
+
+func (conn *serverConn) writeFrame(data []byte) error {
+	if len(data) >= socket.FrameMaxSize {
+		return socket.ErrFrameTooLarge
+	}
+	wholeFrame := make([]byte, socket.FrameLengthSize+len(data))
+	wholeFrame[0] = byte(len(data) >> 16)
+	wholeFrame[1] = byte(len(data) >> 8)
+	wholeFrame[2] = byte(len(data))
+	copy(wholeFrame[socket.FrameLengthSize:], data)
+	return conn.ws.WriteMessage(websocket.BinaryMessage, wholeFrame)
+}
+
+// handshake implements the responder side of the Noise_XX_25519_AESGCM_SHA256 handshake done by Client.doHandshake.
+func (conn *serverConn) handshake() error {
+	_ = conn.ws.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.ws.SetReadDeadline(time.Time{})
+
+	data, err := conn.readFrame()
+	if err != nil {
+		return fmt.Errorf("failed to read client hello: %w", err)
+	}
+	var hello waProto.HandshakeMessage
+	err = proto.Unmarshal(data, &hello)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal client hello: %w", err)
+	}
+	clientEphemeral := hello.GetClientHello().GetEphemeral()
+	if len(clientEphemeral) != 32 {
+		return fmt.Errorf("missing client ephemeral key")
+	}
+	clientEphemeralArr := *(*[32]byte)(clientEphemeral)
+
+	nh := socket.NewNoiseHandshake()
+	nh.Start(socket.NoiseStartPattern, socket.WAConnHeader)
+	nh.Authenticate(clientEphemeral)
+
+	ephemeralKP := keys.NewKeyPair()
+	nh.Authenticate(ephemeralKP.Pub[:])
+	err = nh.MixSharedSecretIntoKey(*ephemeralKP.Priv, clientEphemeralArr)
+	if err != nil {
+		return fmt.Errorf("failed to mix client ephemeral key in: %w", err)
+	}
+	encryptedStatic := nh.Encrypt(conn.srv.staticKey.Pub[:])
+	err = nh.MixSharedSecretIntoKey(*conn.srv.staticKey.Priv, clientEphemeralArr)
+	if err != nil {
+		return fmt.Errorf("failed to mix server static key in: %w", err)
+	}
+	certDetails, err := proto.Marshal(&waProto.NoiseCertificate_Details{
+		Serial: proto.Uint32(0),
+		Issuer: proto.String("WhatsAppLongTerm1"),
+		Key:    conn.srv.staticKey.Pub[:],
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal noise certificate details: %w", err)
+	}
+	// The client doesn't check the certificate signature, so it doesn't need to be valid
+	cert, err := proto.Marshal(&waProto.NoiseCertificate{
+		Details:   certDetails,
+		Signature: make([]byte, 64),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal noise certificate: %w", err)
+	}
+	data, err = proto.Marshal(&waProto.HandshakeMessage{
+		ServerHello: &waProto.HandshakeServerHello{
+			Ephemeral: ephemeralKP.Pub[:],
+			Static:    encryptedStatic,
+			Payload:   nh.Encrypt(cert),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal server hello: %w", err)
+	}
+	err = conn.writeFrame(data)
+	if err != nil {
+		return fmt.Errorf("failed to send server hello: %w", err)
+	}
+
+	data, err = conn.readFrame()
+	if err != nil {
+		return fmt.Errorf("failed to read client finish: %w", err)
+	}
+	var finish waProto.HandshakeMessage
+	err = proto.Unmarshal(data, &finish)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal client finish: %w", err)
+	}
+	clientStatic, err := nh.Decrypt(finish.GetClientFinish().GetStatic())
+	if err != nil {
+		return fmt.Errorf("failed to decrypt client static key: %w", err)
+	} else if len(clientStatic) != 32 {
+		return fmt.Errorf("unexpected length of client static key %d (expected 32)", len(clientStatic))
+	}
+	err = nh.MixSharedSecretIntoKey(*ephemeralKP.Priv, *(*[32]byte)(clientStatic))
+	if err != nil {
+		return fmt.Errorf("failed to mix client static key in: %w", err)
+	}
+	payloadBytes, err := nh.Decrypt(finish.GetClientFinish().GetPayload())
+	if err != nil {
+		return fmt.Errorf("failed to decrypt client payload: %w", err)
+	}
+	var payload waProto.ClientPayload
+	err = proto.Unmarshal(payloadBytes, &payload)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal client payload: %w", err)
+	} else if payload.DevicePairingData != nil || payload.Username == nil {
+		return errors.New("pairing new devices is not supported")
+	}
+	conn.clientID = types.NewADJID(fmt.Sprintf("%d", payload.GetUsername()), 0, uint8(payload.GetDevice()))
+
+	// The keys are the other way around than on the client
+	conn.readKey, conn.writeKey, err = nh.FinalCiphers()
+	if err != nil {
+		return err
+	}
+	conn.log.Debugf("Handshake with %s complete", conn.clientID)
+	return nil
+}
+
+func generateIV(count uint32) []byte {
+	iv := make([]byte, 12)
+	binary.BigEndian.PutUint32(iv[8:], count)
+	return iv
+}
+
+func (conn *serverConn) sendNode(node waBinary.Node) error {
+	payload, err := waBinary.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("failed to marshal node: %w", err)
+	}
+	conn.log.Debugf("Sending %s", node.XMLString())
+	return conn.sendPayload(payload)
+}
+
+// sendPayload encrypts and sends a marshaled node, including the leading flag byte.
+func (conn *serverConn) sendPayload(payload []byte) error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	ciphertext := conn.writeKey.Seal(nil, generateIV(conn.writeCounter), payload, nil)
+	conn.writeCounter++
+	return conn.writeFrame(ciphertext)
+}
+
+func (conn *serverConn) readLoop() {
+	for {
+		frame, err := conn.readFrame()
+		if err != nil {
+			conn.log.Debugf("Stopped reading from client: %v", err)
+			return
+		}
+		plaintext, err := conn.readKey.Open(nil, generateIV(conn.readCounter), frame, nil)
+		conn.readCounter++
+		if err != nil {
+			conn.log.Warnf("Failed to decrypt frame: %v", err)
+			continue
+		}
+		data, err := waBinary.Unpack(plaintext)
+		if err != nil {
+			conn.log.Warnf("Failed to decompress frame: %v", err)
+			continue
+		}
+		node, err := waBinary.Unmarshal(data)
+		if err != nil {
+			conn.log.Warnf("Failed to decode node in frame: %v", err)
+			continue
+		}
+		conn.log.Debugf("Received %s", node.XMLString())
+		conn.srv.handleNode(conn, node)
+	}
+}
+
+func (conn *serverConn) close() {
+	conn.writeLock.Lock()
+	_ = conn.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.writeLock.Unlock()
+	_ = conn.ws.Close()
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeowtest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"go.mau.fi/whatsmeow/whatsmeowtest"
+)
+
+var errSessionStoreFailed = errors.New("session store failed")
+
+// failingSessionStore hides the UnitOfWorkStore implementation of a session store and fails to store sessions,
+// so that committing the session changes after decrypting a message fails.
+type failingSessionStore struct {
+	store.SessionStore
+}
+
+func (failingSessionStore) PutSession(address string, session []byte) error {
+	return errSessionStoreFailed
+}
+
+func (failingSessionStore) PutSessionContext(ctx context.Context, address string, session []byte) error {
+	return errSessionStoreFailed
+}
+
+// receiveWithSecret sends a message with a message secret from a fake user to the client
+// and returns the event dispatched for it, which is either a Message or an UndecryptableMessage.
+func receiveWithSecret(ctx context.Context, t *testing.T, failCommit bool) (*whatsmeow.Client, *whatsmeowtest.User, types.MessageID, interface{}) {
+	t.Helper()
+	srv := whatsmeowtest.NewServer(nil)
+	t.Cleanup(srv.Close)
+	alice := srv.AddUser(types.NewJID("1111", types.DefaultUserServer), "Alice")
+	device := srv.NewClientDevice(types.NewADJID("2222", 0, 1))
+	if failCommit {
+		device.Sessions = failingSessionStore{device.Sessions}
+	}
+	cli := whatsmeow.NewClient(device, nil)
+	cli.SetWebsocketURL(srv.URL())
+	evts := make(chan interface{}, 10)
+	cli.AddEventHandler(func(evt interface{}) {
+		switch evt.(type) {
+		case *events.Message, *events.UndecryptableMessage:
+			evts <- evt
+		}
+	})
+	err := cli.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(cli.Disconnect)
+	_, err = srv.WaitForNode(ctx, func(node *waBinary.Node) bool {
+		_, ok := node.GetOptionalChildByTag("registration")
+		return node.Tag == "iq" && ok
+	})
+	if err != nil {
+		t.Fatalf("Client didn't upload prekeys: %v", err)
+	}
+	id, err := alice.SendMessage(&waProto.Message{
+		Conversation:       proto.String("Hello"),
+		MessageContextInfo: &waProto.MessageContextInfo{MessageSecret: []byte("0123456789abcdef0123456789abcdef")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	select {
+	case evt := <-evts:
+		return cli, alice, id, evt
+	case <-ctx.Done():
+		t.Fatalf("Client didn't dispatch an event for the message")
+		return nil, nil, "", nil
+	}
+}
+
+func TestDecryptMessages_StoresMessageSecret(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cli, alice, id, evt := receiveWithSecret(ctx, t, false)
+	if _, ok := evt.(*events.Message); !ok {
+		t.Fatalf("Expected a message event, got %T", evt)
+	}
+	secret, err := cli.Store.MsgSecrets.GetMessageSecret(alice.JID, alice.JID, id)
+	if err != nil {
+		t.Fatalf("Failed to get message secret: %v", err)
+	} else if secret == nil {
+		t.Errorf("Expected message secret to be stored")
+	}
+}
+
+func TestDecryptMessages_CommitFailed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cli, alice, id, evt := receiveWithSecret(ctx, t, true)
+	undecryptable, ok := evt.(*events.UndecryptableMessage)
+	if !ok {
+		t.Fatalf("Expected an undecryptable message event, got %T", evt)
+	} else if undecryptable.Info.ID != id {
+		t.Errorf("Expected undecryptable message event for %s, got %s", id, undecryptable.Info.ID)
+	}
+	// The message will be retried, so none of its side effects should be applied yet
+	secret, err := cli.Store.MsgSecrets.GetMessageSecret(alice.JID, alice.JID, id)
+	if err != nil {
+		t.Fatalf("Failed to get message secret: %v", err)
+	} else if secret != nil {
+		t.Errorf("Expected message secret not to be stored when storing the session failed")
+	}
+}
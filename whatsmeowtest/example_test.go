@@ -0,0 +1,78 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeowtest_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"go.mau.fi/whatsmeow/whatsmeowtest"
+)
+
+func Example() {
+	srv := whatsmeowtest.NewServer(nil)
+	defer srv.Close()
+	alice := srv.AddUser(types.NewJID("1111", types.DefaultUserServer), "Alice")
+
+	cli := whatsmeow.NewClient(srv.NewClientDevice(types.NewADJID("2222", 0, 1)), nil)
+	cli.SetWebsocketURL(srv.URL())
+	messages := make(chan *events.Message, 1)
+	cli.AddEventHandler(func(evt interface{}) {
+		if msg, ok := evt.(*events.Message); ok {
+			messages <- msg
+		}
+	})
+	err := cli.Connect()
+	if err != nil {
+		panic(err)
+	}
+	defer cli.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Wait for the client to upload its prekeys, so that users can start sessions with it
+	_, err = srv.WaitForNode(ctx, func(node *waBinary.Node) bool {
+		_, ok := node.GetOptionalChildByTag("registration")
+		return node.Tag == "iq" && ok
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = alice.SendMessage(&waProto.Message{Conversation: proto.String("Hello from Alice")})
+	if err != nil {
+		panic(err)
+	}
+	select {
+	case msg := <-messages:
+		fmt.Println(msg.Info.PushName+":", msg.Message.GetConversation())
+	case <-ctx.Done():
+		panic(ctx.Err())
+	}
+
+	_, err = cli.SendMessage(ctx, alice.JID, &waProto.Message{Conversation: proto.String("Hello from the client")})
+	if err != nil {
+		panic(err)
+	}
+	sent, err := srv.WaitForMessage(ctx)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Alice received:", sent.Messages[alice.JID].GetConversation())
+
+	// Output:
+	// Alice: Hello from Alice
+	// Alice received: Hello from the client
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeowtest
+
+import (
+	"encoding/binary"
+	"strconv"
+
+	"go.mau.fi/libsignal/ecc"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/util/keys"
+)
+
+// IQHandler handles an info query sent by the client and returns the response node,
+// which can be created with IQResult or IQError.
+type IQHandler func(srv *Server, iq *waBinary.Node) waBinary.Node
+
+// IQResult creates a successful response to the given info query.
+func IQResult(iq *waBinary.Node, content ...waBinary.Node) waBinary.Node {
+	node := waBinary.Node{
+		Tag: "iq",
+		Attrs: waBinary.Attrs{
+			"id":   iq.AttrGetter().String("id"),
+			"type": "result",
+			"from": iq.AttrGetter().OptionalJIDOrEmpty("to"),
+		},
+	}
+	if len(content) > 0 {
+		node.Content = content
+	}
+	return node
+}
+
+// IQError creates an error response with the given status code to the given info query.
+func IQError(iq *waBinary.Node, code int, text string) waBinary.Node {
+	return waBinary.Node{
+		Tag: "iq",
+		Attrs: waBinary.Attrs{
+			"id":   iq.AttrGetter().String("id"),
+			"type": "error",
+			"from": iq.AttrGetter().OptionalJIDOrEmpty("to"),
+		},
+		Content: []waBinary.Node{{
+			Tag:   "error",
+			Attrs: waBinary.Attrs{"code": code, "text": text},
+		}},
+	}
+}
+
+func (srv *Server) handleIQ(conn *serverConn, iq *waBinary.Node) {
+	ag := iq.AttrGetter()
+	iqType := ag.String("type")
+	if iqType == "result" || iqType == "error" {
+		// Responses to pings and other queries from the server don't need to be handled
+		return
+	}
+	namespace := ag.OptionalString("xmlns")
+	srv.lock.Lock()
+	handler, ok := srv.iqHandlers[namespace]
+	srv.lock.Unlock()
+	var resp waBinary.Node
+	if ok {
+		resp = handler(srv, iq)
+	} else {
+		srv.log.Debugf("No handler for info query with namespace %q", namespace)
+		resp = IQError(iq, 501, "feature-not-implemented")
+	}
+	err := conn.sendNode(resp)
+	if err != nil {
+		srv.log.Warnf("Failed to send response to info query: %v", err)
+	}
+}
+
+func handleEmptyIQ(_ *Server, iq *waBinary.Node) waBinary.Node {
+	return IQResult(iq)
+}
+
+func handleEncryptIQ(srv *Server, iq *waBinary.Node) waBinary.Node {
+	children := iq.GetChildren()
+	if len(children) == 0 {
+		return IQError(iq, 400, "bad-request")
+	}
+	switch children[0].Tag {
+	case "count":
+		srv.lock.Lock()
+		count := 0
+		if srv.clientKeys != nil {
+			count = len(srv.clientKeys.preKeys)
+		}
+		srv.lock.Unlock()
+		return IQResult(iq, waBinary.Node{
+			Tag:   "count",
+			Attrs: waBinary.Attrs{"value": count},
+		})
+	case "registration":
+		ck, err := parseClientKeys(iq)
+		if err != nil {
+			srv.log.Warnf("Failed to parse uploaded prekeys: %v", err)
+			return IQError(iq, 400, "bad-request")
+		}
+		srv.lock.Lock()
+		srv.clientKeys = ck
+		srv.lock.Unlock()
+		return IQResult(iq)
+	case "key":
+		var users []waBinary.Node
+		for _, child := range children[0].GetChildren() {
+			jid, ok := child.Attrs["jid"].(types.JID)
+			if child.Tag != "user" || !ok {
+				continue
+			}
+			users = append(users, srv.userBundleNode(jid))
+		}
+		return IQResult(iq, waBinary.Node{Tag: "list", Content: users})
+	default:
+		return IQError(iq, 501, "feature-not-implemented")
+	}
+}
+
+func (srv *Server) userBundleNode(jid types.JID) waBinary.Node {
+	node := waBinary.Node{
+		Tag:   "user",
+		Attrs: waBinary.Attrs{"jid": jid},
+	}
+	user := srv.GetUser(jid)
+	if user == nil || jid.Device != 0 {
+		node.Content = []waBinary.Node{{
+			Tag:   "error",
+			Attrs: waBinary.Attrs{"code": 404, "text": "item-not-found"},
+		}}
+		return node
+	}
+	preKey, err := user.Device.PreKeys.GenOnePreKey()
+	if err != nil {
+		srv.log.Errorf("Failed to generate prekey for %s: %v", jid, err)
+		node.Content = []waBinary.Node{{
+			Tag:   "error",
+			Attrs: waBinary.Attrs{"code": 500, "text": "internal-server-error"},
+		}}
+		return node
+	}
+	var registrationID [4]byte
+	binary.BigEndian.PutUint32(registrationID[:], user.Device.RegistrationID)
+	node.Content = []waBinary.Node{
+		{Tag: "registration", Content: registrationID[:]},
+		{Tag: "type", Content: []byte{ecc.DjbType}},
+		{Tag: "identity", Content: user.Device.IdentityKey.Pub[:]},
+		preKeyNode(preKey),
+		preKeyNode(user.Device.SignedPreKey),
+	}
+	return node
+}
+
+func preKeyNode(key *keys.PreKey) waBinary.Node {
+	var keyID [4]byte
+	binary.BigEndian.PutUint32(keyID[:], key.KeyID)
+	node := waBinary.Node{
+		Tag: "key",
+		Content: []waBinary.Node{
+			{Tag: "id", Content: keyID[1:]},
+			{Tag: "value", Content: key.Pub[:]},
+		},
+	}
+	if key.Signature != nil {
+		node.Tag = "skey"
+		node.Content = append(node.GetChildren(), waBinary.Node{
+			Tag:     "signature",
+			Content: key.Signature[:],
+		})
+	}
+	return node
+}
+
+func handleUsyncIQ(srv *Server, iq *waBinary.Node) waBinary.Node {
+	usync, ok := iq.GetOptionalChildByTag("usync")
+	if !ok {
+		return IQError(iq, 400, "bad-request")
+	}
+	query := usync.GetChildByTag("query")
+	clientID := srv.ClientID()
+	list := usync.GetChildByTag("list")
+	var users []waBinary.Node
+	for _, child := range list.GetChildren() {
+		jid, ok := child.Attrs["jid"].(types.JID)
+		if !ok {
+			contact, _ := child.GetChildByTag("contact").Content.([]byte)
+			jid, _ = types.ParseJID(string(contact))
+		}
+		user := srv.GetUser(jid)
+		var deviceIDs []uint16
+		if user != nil {
+			deviceIDs = []uint16{0}
+		} else if jid.User == clientID.User {
+			deviceIDs = []uint16{clientID.Device}
+		}
+		var content []waBinary.Node
+		for _, queryChild := range query.GetChildren() {
+			switch queryChild.Tag {
+			case "devices":
+				devices := make([]waBinary.Node, len(deviceIDs))
+				for i, id := range deviceIDs {
+					devices[i] = waBinary.Node{
+						Tag:   "device",
+						Attrs: waBinary.Attrs{"id": int(id)},
+					}
+				}
+				content = append(content, waBinary.Node{
+					Tag:     "devices",
+					Content: []waBinary.Node{{Tag: "device-list", Content: devices}},
+				})
+			case "contact":
+				contactType := "out"
+				if user != nil {
+					contactType = "in"
+				}
+				content = append(content, waBinary.Node{
+					Tag:   "contact",
+					Attrs: waBinary.Attrs{"type": contactType},
+				})
+			}
+		}
+		users = append(users, waBinary.Node{
+			Tag:     "user",
+			Attrs:   waBinary.Attrs{"jid": jid.ToNonAD()},
+			Content: content,
+		})
+	}
+	return IQResult(iq, waBinary.Node{
+		Tag:   "usync",
+		Attrs: usync.Attrs,
+		Content: []waBinary.Node{{
+			Tag:     "list",
+			Content: users,
+		}},
+	})
+}
+
+func handleMediaConnIQ(srv *Server, iq *waBinary.Node) waBinary.Node {
+	return IQResult(iq, waBinary.Node{
+		Tag: "media_conn",
+		Attrs: waBinary.Attrs{
+			"auth":        "whatsmeowtest",
+			"ttl":         3600,
+			"auth_ttl":    3600,
+			"max_buckets": 12,
+		},
+		Content: []waBinary.Node{{
+			Tag:   "host",
+			Attrs: waBinary.Attrs{"hostname": srv.MediaHost},
+		}},
+	})
+}
+
+func handleGroupIQ(srv *Server, iq *waBinary.Node) waBinary.Node {
+	children := iq.GetChildren()
+	if len(children) == 0 || children[0].Tag != "query" {
+		return IQError(iq, 501, "feature-not-implemented")
+	}
+	group := srv.GetGroup(iq.AttrGetter().OptionalJIDOrEmpty("to"))
+	if group == nil {
+		return IQError(iq, 404, "item-not-found")
+	}
+	participants := make([]waBinary.Node, len(group.Participants))
+	for i, participant := range group.Participants {
+		participants[i] = waBinary.Node{
+			Tag:   "participant",
+			Attrs: waBinary.Attrs{"jid": participant.JID},
+		}
+		if participant.IsSuperAdmin {
+			participants[i].Attrs["type"] = "superadmin"
+		} else if participant.IsAdmin {
+			participants[i].Attrs["type"] = "admin"
+		}
+	}
+	attrs := waBinary.Attrs{
+		"id":       group.JID.User,
+		"subject":  group.Name,
+		"s_t":      strconv.FormatInt(group.NameSetAt.Unix(), 10),
+		"creation": strconv.FormatInt(group.GroupCreated.Unix(), 10),
+	}
+	if !group.NameSetBy.IsEmpty() {
+		attrs["s_o"] = group.NameSetBy
+	}
+	if !group.OwnerJID.IsEmpty() {
+		attrs["creator"] = group.OwnerJID
+	}
+	return IQResult(iq, waBinary.Node{
+		Tag:     "group",
+		Attrs:   attrs,
+		Content: participants,
+	})
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeowtest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"go.mau.fi/whatsmeow/whatsmeowtest"
+)
+
+type statusTest struct {
+	ctx      context.Context
+	t        *testing.T
+	srv      *whatsmeowtest.Server
+	cli      *whatsmeow.Client
+	statuses chan *events.MessageStatusChanged
+}
+
+func newStatusTest(ctx context.Context, t *testing.T) *statusTest {
+	t.Helper()
+	st := &statusTest{
+		ctx:      ctx,
+		t:        t,
+		srv:      whatsmeowtest.NewServer(nil),
+		statuses: make(chan *events.MessageStatusChanged, 20),
+	}
+	t.Cleanup(st.srv.Close)
+	st.cli = whatsmeow.NewClient(st.srv.NewClientDevice(types.NewADJID("2222", 0, 1)), nil)
+	st.cli.SetWebsocketURL(st.srv.URL())
+	st.cli.AddEventHandler(func(evt interface{}) {
+		if status, ok := evt.(*events.MessageStatusChanged); ok {
+			st.statuses <- status
+		}
+	})
+	err := st.cli.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(st.cli.Disconnect)
+	// Wait for the client to upload its prekeys, so that it has finished connecting
+	_, err = st.srv.WaitForNode(ctx, func(node *waBinary.Node) bool {
+		_, ok := node.GetOptionalChildByTag("registration")
+		return node.Tag == "iq" && ok
+	})
+	if err != nil {
+		t.Fatalf("Client didn't upload prekeys: %v", err)
+	}
+	return st
+}
+
+func (st *statusTest) send(to types.JID) types.MessageID {
+	st.t.Helper()
+	resp, err := st.cli.SendMessage(st.ctx, to, &waProto.Message{Conversation: proto.String("Hello")})
+	if err != nil {
+		st.t.Fatalf("Failed to send message: %v", err)
+	}
+	return resp.ID
+}
+
+// sendReceipt sends a receipt from the given user. The chat is only set for group receipts.
+func (st *statusTest) sendReceipt(chat, sender types.JID, receiptType events.ReceiptType, ids ...types.MessageID) {
+	st.t.Helper()
+	attrs := waBinary.Attrs{"from": sender, "id": ids[0], "t": time.Now().Unix()}
+	if !chat.IsEmpty() {
+		attrs["from"] = chat
+		attrs["participant"] = sender
+	}
+	if receiptType != events.ReceiptTypeDelivered {
+		attrs["type"] = string(receiptType)
+	}
+	node := waBinary.Node{Tag: "receipt", Attrs: attrs}
+	if len(ids) > 1 {
+		items := make([]waBinary.Node, len(ids)-1)
+		for i, id := range ids[1:] {
+			items[i] = waBinary.Node{Tag: "item", Attrs: waBinary.Attrs{"id": id}}
+		}
+		node.Content = []waBinary.Node{{Tag: "list", Content: items}}
+	}
+	if err := st.srv.SendNode(node); err != nil {
+		st.t.Fatalf("Failed to send receipt: %v", err)
+	}
+}
+
+// expectStatus checks that the next status event is for the given message and has the expected statuses.
+func (st *statusTest) expectStatus(id types.MessageID, recipient types.JID, previous, status types.MessageStatus) {
+	st.t.Helper()
+	select {
+	case evt := <-st.statuses:
+		if evt.ID != id || evt.Recipient != recipient || evt.PreviousStatus != previous || evt.Status != status {
+			st.t.Fatalf("Unexpected status event %s/%s: %s -> %s, expected %s/%s: %s -> %s",
+				evt.ID, evt.Recipient, evt.PreviousStatus, evt.Status, id, recipient, previous, status)
+		}
+	case <-st.ctx.Done():
+		st.t.Fatalf("Didn't get status event for %s (%s -> %s)", id, previous, status)
+	}
+}
+
+func (st *statusTest) expectSent(id types.MessageID) {
+	st.t.Helper()
+	st.expectStatus(id, types.EmptyJID, types.MessageStatusPending, types.MessageStatusSent)
+	st.expectStatus(id, types.EmptyJID, types.MessageStatusSent, types.MessageStatusServerAck)
+}
+
+func TestMessageStatus_DM(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	st := newStatusTest(ctx, t)
+	alice := st.srv.AddUser(types.NewJID("1111", types.DefaultUserServer), "Alice")
+
+	id := st.send(alice.JID)
+	st.expectSent(id)
+	st.sendReceipt(types.EmptyJID, alice.JID, events.ReceiptTypeDelivered, id)
+	st.expectStatus(id, alice.JID, types.MessageStatusServerAck, types.MessageStatusDelivered)
+	// Duplicate receipts and receipts for messages that aren't tracked don't change anything,
+	// so the next event must be the one for the read receipt.
+	st.sendReceipt(types.EmptyJID, alice.JID, events.ReceiptTypeDelivered, id)
+	st.sendReceipt(types.EmptyJID, alice.JID, events.ReceiptTypeRead, "UNTRACKED", id)
+	st.expectStatus(id, alice.JID, types.MessageStatusDelivered, types.MessageStatusRead)
+
+	if st.cli.GetMessageStatus(alice.JID, "UNTRACKED") != nil {
+		t.Errorf("Expected receipt not to start tracking an unknown message")
+	}
+	status := st.cli.GetMessageStatus(alice.JID, id)
+	if status == nil {
+		t.Fatalf("Expected sent message to be tracked")
+	} else if status.Status != types.MessageStatusRead || status.Recipients[alice.JID] != types.MessageStatusRead {
+		t.Errorf("Unexpected tracked status %s with recipients %v", status.Status, status.Recipients)
+	}
+}
+
+func TestMessageStatus_Group(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	st := newStatusTest(ctx, t)
+	alice := st.srv.AddUser(types.NewJID("1111", types.DefaultUserServer), "Alice")
+	bob := st.srv.AddUser(types.NewJID("3333", types.DefaultUserServer), "Bob")
+	group := types.NewJID("123456", types.GroupServer)
+	st.srv.AddGroup(types.GroupInfo{
+		JID:       group,
+		GroupName: types.GroupName{Name: "Group", NameSetAt: time.Now()},
+		Participants: []types.GroupParticipant{
+			{JID: types.NewJID("2222", types.DefaultUserServer), IsSuperAdmin: true},
+			{JID: alice.JID},
+			{JID: bob.JID},
+		},
+	})
+
+	id := st.send(group)
+	st.expectSent(id)
+	// The message is only delivered once every participant other than the sender has received it
+	st.sendReceipt(group, alice.JID, events.ReceiptTypeDelivered, id)
+	st.expectStatus(id, alice.JID, types.MessageStatusServerAck, types.MessageStatusServerAck)
+	st.sendReceipt(group, alice.JID, events.ReceiptTypeDelivered, id)
+	st.sendReceipt(group, alice.JID, events.ReceiptTypeRead, id)
+	st.expectStatus(id, alice.JID, types.MessageStatusServerAck, types.MessageStatusServerAck)
+	st.sendReceipt(group, bob.JID, events.ReceiptTypeDelivered, id)
+	st.expectStatus(id, bob.JID, types.MessageStatusServerAck, types.MessageStatusDelivered)
+	// Receipts from other devices of a user don't lower their status
+	st.sendReceipt(group, types.NewADJID(alice.JID.User, 0, 2), events.ReceiptTypeDelivered, id)
+	st.expectStatus(id, types.NewADJID(alice.JID.User, 0, 2), types.MessageStatusDelivered, types.MessageStatusDelivered)
+	st.sendReceipt(group, bob.JID, events.ReceiptTypeRead, id)
+	st.expectStatus(id, bob.JID, types.MessageStatusDelivered, types.MessageStatusRead)
+
+	status := st.cli.GetMessageStatus(group, id)
+	if status == nil {
+		t.Fatalf("Expected sent message to be tracked")
+	} else if status.Status != types.MessageStatusRead {
+		t.Errorf("Expected message to be read by everyone, got %s", status.Status)
+	}
+}
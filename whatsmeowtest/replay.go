@@ -0,0 +1,58 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeowtest
+
+import (
+	"context"
+	"fmt"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Replay sends the nodes that the original client received in the given capture to the connected client, in the
+// same order, without any delays. If a client isn't connected yet, it waits for one to connect. The nodes that the
+// original client sent and the nodes skipped by whatsmeow.IsReplayableNode are ignored. Nodes that can't be decoded
+// are sent as-is, which is useful for reproducing decoding errors.
+//
+// Unlike Client.ReplayCapture, which doesn't connect anywhere, this answers the queries the client sends while
+// handling the nodes like the mock server normally does.
+//
+// The client handles nodes one by one in the order they're received, so the events caused by the replayed nodes are
+// also dispatched in a deterministic order. Encrypted messages can only be decrypted if the client uses a copy of the
+// device store of the client that made the capture, taken before the capture was started.
+//
+//	nodes, err := whatsmeow.ReadCaptureFile("capture.jsonl")
+//	srv := whatsmeowtest.NewServer(nil)
+//	cli := whatsmeow.NewClient(deviceStoreCopy, log)
+//	cli.SetWebsocketURL(srv.URL())
+//	err = cli.Connect()
+//	err = srv.Replay(ctx, nodes)
+func (srv *Server) Replay(ctx context.Context, nodes []*whatsmeow.CapturedNode) error {
+	err := srv.WaitForClient(ctx)
+	if err != nil {
+		return err
+	}
+	for i, captured := range nodes {
+		if captured.Direction != whatsmeow.CaptureReceived {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		node, err := captured.Node()
+		if err != nil {
+			// Nodes that can't be decoded are sent as-is, so that the client runs into the same error
+			err = srv.sendPayload(append([]byte{0}, captured.Data...))
+		} else if whatsmeow.IsReplayableNode(node) {
+			err = srv.SendNode(*node)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to send node #%d: %w", i+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeowtest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"go.mau.fi/whatsmeow/whatsmeowtest"
+)
+
+var replayReceiptIDs = []types.MessageID{"MSG1", "MSG2", "MSG3"}
+
+// lockedBuffer is a capture file that can be read while the client may still be writing to it.
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *lockedBuffer) Bytes() []byte {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	return append([]byte{}, lb.buf.Bytes()...)
+}
+
+func readCapture(t *testing.T, data []byte) []*whatsmeow.CapturedNode {
+	t.Helper()
+	reader := whatsmeow.NewCaptureReader(bytes.NewReader(data))
+	var nodes []*whatsmeow.CapturedNode
+	for {
+		node, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nodes
+		} else if err != nil {
+			t.Fatalf("Failed to read node #%d in capture: %v", len(nodes)+1, err)
+		}
+		nodes = append(nodes, node)
+	}
+}
+
+func hasCapturedAck(t *testing.T, nodes []*whatsmeow.CapturedNode, id types.MessageID) bool {
+	t.Helper()
+	for _, captured := range nodes {
+		node, err := captured.Node()
+		if err != nil {
+			t.Fatalf("Failed to decode captured node: %v", err)
+		}
+		if captured.Direction == whatsmeow.CaptureSent && node.Tag == "ack" && node.Attrs["id"] == id {
+			return true
+		}
+	}
+	return false
+}
+
+func collectReceipts(cli *whatsmeow.Client) <-chan types.MessageID {
+	receipts := make(chan types.MessageID, 10)
+	cli.AddEventHandler(func(evt interface{}) {
+		if receipt, ok := evt.(*events.Receipt); ok {
+			receipts <- receipt.MessageIDs[0]
+		}
+	})
+	return receipts
+}
+
+// waitReceipts returns the IDs of the expected number of receipts, sorted, as they're dispatched in separate goroutines.
+func waitReceipts(ctx context.Context, t *testing.T, receipts <-chan types.MessageID) []types.MessageID {
+	t.Helper()
+	var ids []types.MessageID
+	for len(ids) < len(replayReceiptIDs) {
+		select {
+		case id := <-receipts:
+			ids = append(ids, id)
+		case <-ctx.Done():
+			t.Fatalf("Only got receipts for %v", ids)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// recordReceipts connects a client that records a capture to the mock server and sends it a few receipts.
+func recordReceipts(ctx context.Context, t *testing.T) []*whatsmeow.CapturedNode {
+	t.Helper()
+	srv := whatsmeowtest.NewServer(nil)
+	defer srv.Close()
+	cli := whatsmeow.NewClient(srv.NewClientDevice(types.NewADJID("2222", 0, 1)), nil)
+	cli.SetWebsocketURL(srv.URL())
+	var capture lockedBuffer
+	cli.SetFrameRecorder(whatsmeow.NewFrameRecorder(&capture))
+	receipts := collectReceipts(cli)
+	err := cli.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer cli.Disconnect()
+	if err = srv.WaitForClient(ctx); err != nil {
+		t.Fatalf("Client didn't connect: %v", err)
+	}
+	for _, id := range replayReceiptIDs {
+		err = srv.SendNode(waBinary.Node{
+			Tag:   "receipt",
+			Attrs: waBinary.Attrs{"from": types.NewJID("1111", types.DefaultUserServer), "id": id, "t": time.Now().Unix(), "type": "read"},
+		})
+		if err != nil {
+			t.Fatalf("Failed to send receipt: %v", err)
+		}
+	}
+	if ids := waitReceipts(ctx, t, receipts); !reflect.DeepEqual(ids, replayReceiptIDs) {
+		t.Fatalf("Got receipts for %v, expected %v", ids, replayReceiptIDs)
+	}
+	// Sent nodes are recorded after they've been sent, so the last ack may not be in the capture yet
+	for {
+		nodes := readCapture(t, capture.Bytes())
+		if hasCapturedAck(t, nodes, replayReceiptIDs[len(replayReceiptIDs)-1]) {
+			return nodes
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("Acks for the receipts weren't recorded")
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	nodes := recordReceipts(ctx, t)
+	for _, id := range replayReceiptIDs {
+		if !hasCapturedAck(t, nodes, id) {
+			t.Errorf("Capture doesn't contain the ack for %s", id)
+		}
+	}
+
+	t.Run("Server", func(t *testing.T) {
+		srv := whatsmeowtest.NewServer(nil)
+		defer srv.Close()
+		cli := whatsmeow.NewClient(srv.NewClientDevice(types.NewADJID("2222", 0, 1)), nil)
+		cli.SetWebsocketURL(srv.URL())
+		receipts := collectReceipts(cli)
+		err := cli.Connect()
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer cli.Disconnect()
+		if err = srv.Replay(ctx, nodes); err != nil {
+			t.Fatalf("Failed to replay capture: %v", err)
+		}
+		if ids := waitReceipts(ctx, t, receipts); !reflect.DeepEqual(ids, replayReceiptIDs) {
+			t.Errorf("Got receipts for %v after replay, expected %v", ids, replayReceiptIDs)
+		}
+	})
+
+	t.Run("Offline", func(t *testing.T) {
+		srv := whatsmeowtest.NewServer(nil)
+		defer srv.Close()
+		cli := whatsmeow.NewClient(srv.NewClientDevice(types.NewADJID("2222", 0, 1)), nil)
+		receipts := collectReceipts(cli)
+		acks := make(chan types.MessageID, 10)
+		err := cli.ReplayCapture(ctx, nodes, func(node *waBinary.Node) {
+			if node.Tag == "ack" {
+				acks <- node.Attrs["id"].(string)
+			}
+		})
+		if err != nil {
+			t.Fatalf("Failed to replay capture: %v", err)
+		}
+		defer cli.Disconnect()
+		if ids := waitReceipts(ctx, t, receipts); !reflect.DeepEqual(ids, replayReceiptIDs) {
+			t.Errorf("Got receipts for %v after replay, expected %v", ids, replayReceiptIDs)
+		}
+		if ids := waitReceipts(ctx, t, acks); !reflect.DeepEqual(ids, replayReceiptIDs) {
+			t.Errorf("Client sent acks for %v to the fake socket, expected %v", ids, replayReceiptIDs)
+		}
+		if len(srv.Nodes()) != 0 {
+			t.Errorf("Offline replay sent nodes to the mock server")
+		}
+	})
+}
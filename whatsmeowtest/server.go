@@ -0,0 +1,329 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package whatsmeowtest implements a local mock WhatsApp web server for end-to-end tests of whatsmeow clients.
+//
+// The server speaks the same Noise handshake and binary node protocol as the real servers, answers the
+// info queries that the client makes while connecting and sending messages with canned responses, and has
+// fake users with real Signal sessions, so end-to-end encrypted messages can be exchanged with the client.
+//
+//	srv := whatsmeowtest.NewServer(nil)
+//	defer srv.Close()
+//	alice := srv.AddUser(types.NewJID("1111", types.DefaultUserServer), "Alice")
+//	cli := whatsmeow.NewClient(srv.NewClientDevice(types.NewADJID("2222", 0, 1)), nil)
+//	cli.SetWebsocketURL(srv.URL())
+//	err := cli.Connect()
+//	...
+//	_, err = alice.SendMessage(&waProto.Message{Conversation: proto.String("Hello")})
+//	msg, err := srv.WaitForMessage(ctx)
+//
+// Pairing new devices isn't supported, so the client must use a device store that is already logged in,
+// such as the ones created by Server.NewClientDevice.
+package whatsmeowtest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/store/memstore"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/util/keys"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// ErrNotConnected is returned when trying to send something to the client while it's not connected.
+var ErrNotConnected = errors.New("client is not connected to the mock server")
+
+// Server is a mock WhatsApp web server. Only one client can be connected at a time,
+// a new connection replaces the previous one.
+type Server struct {
+	// MediaHost is the hostname returned in media_conn responses.
+	MediaHost string
+
+	log        waLog.Logger
+	httpServer *httptest.Server
+	upgrader   websocket.Upgrader
+	staticKey  *keys.KeyPair
+
+	lock       sync.Mutex
+	conn       *serverConn
+	connWait   chan struct{}
+	iqHandlers map[string]IQHandler
+	users      map[types.JID]*User
+	userStore  *memstore.Container
+	groups     map[types.JID]*types.GroupInfo
+	clientID   types.JID
+	clientKeys *clientKeys
+
+	receivedLock sync.Mutex
+	received     []*receivedNode
+	receivedWait chan struct{}
+}
+
+type receivedNode struct {
+	node    *waBinary.Node
+	message *ReceivedMessage
+	taken   bool
+}
+
+// NewServer starts a mock server listening on a random local port.
+//
+// The logger can be nil, it will default to a no-op logger.
+func NewServer(log waLog.Logger) *Server {
+	if log == nil {
+		log = waLog.Noop
+	}
+	srv := &Server{
+		MediaHost: "mmg.whatsapp.net",
+
+		log:       log,
+		staticKey: keys.NewKeyPair(),
+		users:     make(map[types.JID]*User),
+		userStore: memstore.New(log.Sub("Users")),
+		groups:    make(map[types.JID]*types.GroupInfo),
+		connWait:  make(chan struct{}),
+
+		receivedWait: make(chan struct{}),
+	}
+	// The client always sends the web.whatsapp.com origin
+	srv.upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	srv.iqHandlers = map[string]IQHandler{
+		"passive": handleEmptyIQ,
+		"w:p":     handleEmptyIQ,
+		"encrypt": handleEncryptIQ,
+		"usync":   handleUsyncIQ,
+		"w:m":     handleMediaConnIQ,
+		"w:g2":    handleGroupIQ,
+	}
+	srv.httpServer = httptest.NewServer(http.HandlerFunc(srv.serveWebsocket))
+	return srv
+}
+
+// URL returns the websocket URL of the server, which can be passed to Client.SetWebsocketURL.
+func (srv *Server) URL() string {
+	return "ws" + strings.TrimPrefix(srv.httpServer.URL, "http") + "/ws/chat"
+}
+
+// Close disconnects the client and stops the server.
+func (srv *Server) Close() {
+	srv.Disconnect()
+	srv.httpServer.Close()
+}
+
+// HandleIQ sets the handler for info queries with the given namespace, replacing the default canned responses.
+func (srv *Server) HandleIQ(namespace string, handler IQHandler) {
+	srv.lock.Lock()
+	srv.iqHandlers[namespace] = handler
+	srv.lock.Unlock()
+}
+
+// ClientID returns the JID of the currently or most recently connected client.
+func (srv *Server) ClientID() types.JID {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.clientID
+}
+
+// NewClientDevice creates an in-memory device store that is logged in as the given JID and can be used to connect to the server.
+func (srv *Server) NewClientDevice(jid types.JID) *store.Device {
+	device := memstore.New(srv.log.Sub("Client")).NewDevice()
+	device.ID = &jid
+	device.PushName = "whatsmeowtest"
+	device.Account = &waProto.ADVSignedDeviceIdentity{
+		Details:             []byte{},
+		AccountSignature:    make([]byte, 64),
+		AccountSignatureKey: make([]byte, 32),
+		DeviceSignature:     make([]byte, 64),
+	}
+	err := device.Save()
+	if err != nil {
+		// The memory store only fails if the ID isn't set
+		panic(err)
+	}
+	return device
+}
+
+func (srv *Server) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := srv.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		srv.log.Warnf("Failed to upgrade websocket connection: %v", err)
+		return
+	}
+	conn := &serverConn{srv: srv, ws: ws, log: srv.log.Sub("Conn")}
+	err = conn.handshake()
+	if err != nil {
+		srv.log.Warnf("Noise handshake with client failed: %v", err)
+		_ = ws.Close()
+		return
+	}
+	err = conn.sendNode(waBinary.Node{
+		Tag:   "success",
+		Attrs: waBinary.Attrs{"t": time.Now().Unix()},
+	})
+	if err != nil {
+		srv.log.Warnf("Failed to send success node: %v", err)
+	}
+	srv.lock.Lock()
+	prevConn := srv.conn
+	srv.conn = conn
+	srv.clientID = conn.clientID
+	if prevConn == nil {
+		close(srv.connWait)
+	}
+	srv.lock.Unlock()
+	if prevConn != nil {
+		prevConn.close()
+	}
+	conn.readLoop()
+	srv.clearConn(conn)
+}
+
+// clearConn forgets the given connection if it's the current one.
+func (srv *Server) clearConn(conn *serverConn) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.conn == conn && conn != nil {
+		srv.conn = nil
+		srv.connWait = make(chan struct{})
+	}
+}
+
+// WaitForClient waits until a client has connected and the server has sent the success node to it.
+func (srv *Server) WaitForClient(ctx context.Context) error {
+	srv.lock.Lock()
+	wait := srv.connWait
+	srv.lock.Unlock()
+	select {
+	case <-wait:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SendNode sends a node to the connected client, e.g. to push a notification.
+func (srv *Server) SendNode(node waBinary.Node) error {
+	srv.lock.Lock()
+	conn := srv.conn
+	srv.lock.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.sendNode(node)
+}
+
+func (srv *Server) sendPayload(payload []byte) error {
+	srv.lock.Lock()
+	conn := srv.conn
+	srv.lock.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.sendPayload(payload)
+}
+
+// Disconnect closes the connection to the client without stopping the server.
+func (srv *Server) Disconnect() {
+	srv.lock.Lock()
+	conn := srv.conn
+	srv.lock.Unlock()
+	if conn != nil {
+		srv.clearConn(conn)
+		conn.close()
+	}
+}
+
+func (srv *Server) handleNode(conn *serverConn, node *waBinary.Node) {
+	var msg *ReceivedMessage
+	switch node.Tag {
+	case "iq":
+		srv.handleIQ(conn, node)
+	case "message":
+		msg = srv.decryptMessage(conn.clientID, node)
+		ag := node.AttrGetter()
+		err := conn.sendNode(waBinary.Node{
+			Tag: "ack",
+			Attrs: waBinary.Attrs{
+				"class": "message",
+				"id":    ag.String("id"),
+				"from":  ag.JID("to"),
+				"t":     time.Now().Unix(),
+			},
+		})
+		if err != nil {
+			srv.log.Warnf("Failed to send ack for message: %v", err)
+		}
+	}
+	srv.receivedLock.Lock()
+	srv.received = append(srv.received, &receivedNode{node: node, message: msg})
+	close(srv.receivedWait)
+	srv.receivedWait = make(chan struct{})
+	srv.receivedLock.Unlock()
+}
+
+// Nodes returns all nodes that the server has received from clients.
+func (srv *Server) Nodes() []*waBinary.Node {
+	srv.receivedLock.Lock()
+	defer srv.receivedLock.Unlock()
+	nodes := make([]*waBinary.Node, len(srv.received))
+	for i, received := range srv.received {
+		nodes[i] = received.node
+	}
+	return nodes
+}
+
+func (srv *Server) waitForReceived(ctx context.Context, match func(*receivedNode) bool) (*receivedNode, error) {
+	for {
+		srv.receivedLock.Lock()
+		for _, received := range srv.received {
+			if !received.taken && match(received) {
+				received.taken = true
+				srv.receivedLock.Unlock()
+				return received, nil
+			}
+		}
+		wait := srv.receivedWait
+		srv.receivedLock.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// WaitForNode waits until the client has sent a node that matches the given function and returns it.
+// Each node is only returned once, so calling this repeatedly with the same function returns the matching nodes in order.
+func (srv *Server) WaitForNode(ctx context.Context, match func(*waBinary.Node) bool) (*waBinary.Node, error) {
+	received, err := srv.waitForReceived(ctx, func(received *receivedNode) bool {
+		return match(received.node)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return received.node, nil
+}
+
+// WaitForMessage waits for the next message stanza sent by the client and returns it along with its decrypted contents.
+func (srv *Server) WaitForMessage(ctx context.Context) (*ReceivedMessage, error) {
+	received, err := srv.waitForReceived(ctx, func(received *receivedNode) bool {
+		return received.message != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return received.message, nil
+}
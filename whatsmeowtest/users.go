@@ -0,0 +1,399 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeowtest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/libsignal/ecc"
+	"go.mau.fi/libsignal/groups"
+	"go.mau.fi/libsignal/keys/identity"
+	"go.mau.fi/libsignal/keys/prekey"
+	"go.mau.fi/libsignal/protocol"
+	"go.mau.fi/libsignal/session"
+	"go.mau.fi/libsignal/util/optional"
+	"google.golang.org/protobuf/proto"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/util/keys"
+)
+
+// ErrNoClientKeys is returned by User.SendMessage if the client hasn't uploaded prekeys and
+// the user doesn't have an existing session with the client.
+var ErrNoClientKeys = errors.New("client hasn't uploaded any prekeys")
+
+var pbSerializer = store.SignalProtobufSerializer
+
+// clientKeys contains the keys that the client has uploaded to the server.
+type clientKeys struct {
+	registrationID uint32
+	identityKey    [32]byte
+	signedPreKey   *keys.PreKey
+	preKeys        []*keys.PreKey
+}
+
+func parseClientKeys(iq *waBinary.Node) (*clientKeys, error) {
+	var ck clientKeys
+	registrationID, ok := iq.GetChildByTag("registration").Content.([]byte)
+	if !ok || len(registrationID) != 4 {
+		return nil, fmt.Errorf("invalid registration ID")
+	}
+	ck.registrationID = binary.BigEndian.Uint32(registrationID)
+	identityKey, ok := iq.GetChildByTag("identity").Content.([]byte)
+	if !ok || len(identityKey) != 32 {
+		return nil, fmt.Errorf("invalid identity key")
+	}
+	ck.identityKey = *(*[32]byte)(identityKey)
+	var err error
+	ck.signedPreKey, err = parsePreKeyNode(iq.GetChildByTag("skey"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signed prekey: %w", err)
+	} else if ck.signedPreKey.Signature == nil {
+		return nil, fmt.Errorf("signed prekey doesn't have a signature")
+	}
+	list := iq.GetChildByTag("list")
+	for _, child := range list.GetChildren() {
+		preKey, err := parsePreKeyNode(child)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prekey: %w", err)
+		}
+		ck.preKeys = append(ck.preKeys, preKey)
+	}
+	return &ck, nil
+}
+
+func parsePreKeyNode(node waBinary.Node) (*keys.PreKey, error) {
+	idBytes, ok := node.GetChildByTag("id").Content.([]byte)
+	if !ok || len(idBytes) != 3 {
+		return nil, fmt.Errorf("missing or invalid ID")
+	}
+	pub, ok := node.GetChildByTag("value").Content.([]byte)
+	if !ok || len(pub) != 32 {
+		return nil, fmt.Errorf("missing or invalid public key")
+	}
+	key := &keys.PreKey{
+		KeyPair: keys.KeyPair{Pub: (*[32]byte)(pub)},
+		KeyID:   binary.BigEndian.Uint32(append([]byte{0}, idBytes...)),
+	}
+	if node.Tag == "skey" {
+		sig, ok := node.GetChildByTag("signature").Content.([]byte)
+		if !ok || len(sig) != 64 {
+			return nil, fmt.Errorf("missing or invalid signature")
+		}
+		key.Signature = (*[64]byte)(sig)
+	}
+	return key, nil
+}
+
+// takeClientBundle returns a prekey bundle for starting a new session with the client.
+// Each uploaded one-time prekey is only handed out once, like on the real server.
+func (srv *Server) takeClientBundle() (*prekey.Bundle, error) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	ck := srv.clientKeys
+	if ck == nil {
+		return nil, ErrNoClientKeys
+	}
+	preKeyID := optional.NewEmptyUint32()
+	var preKeyPub ecc.ECPublicKeyable
+	if len(ck.preKeys) > 0 {
+		preKey := ck.preKeys[0]
+		ck.preKeys = ck.preKeys[1:]
+		preKeyID = optional.NewOptionalUint32(preKey.KeyID)
+		preKeyPub = ecc.NewDjbECPublicKey(*preKey.Pub)
+	}
+	return prekey.NewBundle(ck.registrationID, uint32(srv.clientID.Device),
+		preKeyID, ck.signedPreKey.KeyID,
+		preKeyPub, ecc.NewDjbECPublicKey(*ck.signedPreKey.Pub), *ck.signedPreKey.Signature,
+		identity.NewKey(ecc.NewDjbECPublicKey(ck.identityKey))), nil
+}
+
+// User is a fake WhatsApp user that can exchange end-to-end encrypted messages with the client.
+// Each user has a single device (the primary device with ID 0).
+type User struct {
+	JID      types.JID
+	PushName string
+	// Device contains the Signal keys and sessions of the user.
+	Device *store.Device
+
+	srv  *Server
+	lock sync.Mutex
+}
+
+// AddUser adds a fake user with the given JID. If the user already exists, the existing user is returned.
+func (srv *Server) AddUser(jid types.JID, pushName string) *User {
+	jid = jid.ToNonAD()
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if user, ok := srv.users[jid]; ok {
+		return user
+	}
+	deviceID := jid
+	device := srv.userStore.NewDevice()
+	device.ID = &deviceID
+	device.PushName = pushName
+	err := srv.userStore.PutDevice(device)
+	if err != nil {
+		// The memory store only fails if the ID isn't set
+		panic(err)
+	}
+	user := &User{
+		JID:      jid,
+		PushName: pushName,
+		Device:   device,
+		srv:      srv,
+	}
+	srv.users[jid] = user
+	return user
+}
+
+// GetUser returns the fake user with the given JID, or nil if there's no such user.
+func (srv *Server) GetUser(jid types.JID) *User {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.users[jid.ToNonAD()]
+}
+
+// AddGroup adds a group that the client can query and send messages to. The participants should be fake users
+// added with AddUser or the client itself, messages sent to the group are only decrypted for fake users.
+func (srv *Server) AddGroup(info types.GroupInfo) {
+	srv.lock.Lock()
+	srv.groups[info.JID] = &info
+	srv.lock.Unlock()
+}
+
+// GetGroup returns the info of the group with the given JID, or nil if there's no such group.
+func (srv *Server) GetGroup(jid types.JID) *types.GroupInfo {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.groups[jid]
+}
+
+func generateMessageID() types.MessageID {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return "3EB0" + strings.ToUpper(hex.EncodeToString(id))
+}
+
+func padMessage(plaintext []byte) []byte {
+	var pad [1]byte
+	_, _ = rand.Read(pad[:])
+	pad[0] &= 0xf
+	if pad[0] == 0 {
+		pad[0] = 0xf
+	}
+	return append(plaintext, bytes.Repeat(pad[:], int(pad[0]))...)
+}
+
+func unpadMessage(plaintext []byte) ([]byte, error) {
+	if len(plaintext) == 0 {
+		return nil, fmt.Errorf("plaintext is empty")
+	}
+	padding := int(plaintext[len(plaintext)-1])
+	if padding > len(plaintext) {
+		return nil, fmt.Errorf("plaintext doesn't have expected padding")
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// SendMessage encrypts the given message and sends it to the connected client from this user.
+func (user *User) SendMessage(message *waProto.Message) (types.MessageID, error) {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+	clientID := user.srv.ClientID()
+	if clientID.IsEmpty() {
+		return "", ErrNotConnected
+	}
+	plaintext, err := proto.Marshal(message)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal message: %w", err)
+	}
+	address := clientID.SignalAddress()
+	builder := session.NewBuilderFromSignal(user.Device, address, pbSerializer)
+	if !user.Device.ContainsSession(address) {
+		bundle, err := user.srv.takeClientBundle()
+		if err != nil {
+			return "", err
+		}
+		err = builder.ProcessBundle(bundle)
+		if err != nil {
+			return "", fmt.Errorf("failed to process client prekey bundle: %w", err)
+		}
+	}
+	ciphertext, err := session.NewCipher(builder, address).Encrypt(padMessage(plaintext))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt message: %w", err)
+	}
+	encType := "msg"
+	if ciphertext.Type() == protocol.PREKEY_TYPE {
+		encType = "pkmsg"
+	}
+	id := generateMessageID()
+	err = user.srv.SendNode(waBinary.Node{
+		Tag: "message",
+		Attrs: waBinary.Attrs{
+			"from":   user.JID,
+			"id":     id,
+			"t":      time.Now().Unix(),
+			"type":   "text",
+			"notify": user.PushName,
+		},
+		Content: []waBinary.Node{{
+			Tag:     "enc",
+			Attrs:   waBinary.Attrs{"v": "2", "type": encType},
+			Content: ciphertext.Serialize(),
+		}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// ReceivedMessage is a message stanza sent by the client, along with the contents decrypted by the fake users.
+type ReceivedMessage struct {
+	Node *waBinary.Node
+	ID   types.MessageID
+	To   types.JID
+	// Messages contains the decrypted message for each fake user that the message was encrypted for.
+	Messages map[types.JID]*waProto.Message
+	// Errors contains errors that happened when decrypting the message for fake users.
+	Errors map[types.JID]error
+}
+
+func (srv *Server) decryptMessage(sender types.JID, node *waBinary.Node) *ReceivedMessage {
+	ag := node.AttrGetter()
+	msg := &ReceivedMessage{
+		Node:     node,
+		ID:       types.MessageID(ag.String("id")),
+		To:       ag.JID("to"),
+		Messages: make(map[types.JID]*waProto.Message),
+		Errors:   make(map[types.JID]error),
+	}
+	var groupEnc *waBinary.Node
+	for _, child := range node.GetChildren() {
+		switch child.Tag {
+		case "participants":
+			for _, to := range child.GetChildren() {
+				jid, ok := to.Attrs["jid"].(types.JID)
+				if to.Tag != "to" || !ok {
+					continue
+				}
+				srv.decryptPairwise(msg, sender, jid, to.GetChildByTag("enc"))
+			}
+		case "enc":
+			child := child
+			if child.AttrGetter().String("type") == "skmsg" {
+				groupEnc = &child
+			} else {
+				srv.decryptPairwise(msg, sender, msg.To, child)
+			}
+		}
+	}
+	if groupEnc != nil {
+		group := srv.GetGroup(msg.To)
+		if group != nil {
+			for _, participant := range group.Participants {
+				if user := srv.GetUser(participant.JID); user != nil {
+					srv.decryptSenderKey(msg, sender, user, groupEnc)
+				}
+			}
+		}
+	}
+	return msg
+}
+
+func (srv *Server) decryptPairwise(msg *ReceivedMessage, sender, to types.JID, enc waBinary.Node) {
+	user := srv.GetUser(to)
+	if user == nil {
+		return
+	}
+	user.lock.Lock()
+	defer user.lock.Unlock()
+	content, _ := enc.Content.([]byte)
+	address := sender.SignalAddress()
+	cipher := session.NewCipher(session.NewBuilderFromSignal(user.Device, address, pbSerializer), address)
+	var plaintext []byte
+	var err error
+	switch enc.AttrGetter().String("type") {
+	case "pkmsg":
+		var preKeyMsg *protocol.PreKeySignalMessage
+		preKeyMsg, err = protocol.NewPreKeySignalMessageFromBytes(content, pbSerializer.PreKeySignalMessage, pbSerializer.SignalMessage)
+		if err == nil {
+			plaintext, _, err = cipher.DecryptMessageReturnKey(preKeyMsg)
+		}
+	case "msg":
+		var signalMsg *protocol.SignalMessage
+		signalMsg, err = protocol.NewSignalMessageFromBytes(content, pbSerializer.SignalMessage)
+		if err == nil {
+			plaintext, err = cipher.Decrypt(signalMsg)
+		}
+	default:
+		err = fmt.Errorf("unsupported enc type %q", enc.AttrGetter().String("type"))
+	}
+	if err == nil {
+		plaintext, err = unpadMessage(plaintext)
+	}
+	var decrypted waProto.Message
+	if err == nil {
+		err = proto.Unmarshal(plaintext, &decrypted)
+	}
+	if err != nil {
+		srv.log.Warnf("Failed to decrypt message %s for %s: %v", msg.ID, user.JID, err)
+		msg.Errors[user.JID] = err
+		return
+	}
+	if skdm := decrypted.GetSenderKeyDistributionMessage(); skdm != nil {
+		skdMsg, err := protocol.NewSenderKeyDistributionMessageFromBytes(skdm.GetAxolotlSenderKeyDistributionMessage(), pbSerializer.SenderKeyDistributionMessage)
+		if err != nil {
+			srv.log.Warnf("Failed to parse sender key distribution message in %s for %s: %v", msg.ID, user.JID, err)
+		} else {
+			builder := groups.NewGroupSessionBuilder(user.Device, pbSerializer)
+			builder.Process(protocol.NewSenderKeyName(skdm.GetGroupId(), sender.SignalAddress()), skdMsg)
+		}
+	}
+	msg.Messages[user.JID] = &decrypted
+}
+
+func (srv *Server) decryptSenderKey(msg *ReceivedMessage, sender types.JID, user *User, enc *waBinary.Node) {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+	content, _ := enc.Content.([]byte)
+	senderKeyName := protocol.NewSenderKeyName(msg.To.String(), sender.SignalAddress())
+	builder := groups.NewGroupSessionBuilder(user.Device, pbSerializer)
+	cipher := groups.NewGroupCipher(builder, senderKeyName, user.Device)
+	var plaintext []byte
+	senderKeyMsg, err := protocol.NewSenderKeyMessageFromBytes(content, pbSerializer.SenderKeyMessage)
+	if err == nil {
+		plaintext, err = cipher.Decrypt(senderKeyMsg)
+	}
+	if err == nil {
+		plaintext, err = unpadMessage(plaintext)
+	}
+	var decrypted waProto.Message
+	if err == nil {
+		err = proto.Unmarshal(plaintext, &decrypted)
+	}
+	if err != nil {
+		srv.log.Warnf("Failed to decrypt group message %s for %s: %v", msg.ID, user.JID, err)
+		msg.Errors[user.JID] = err
+		return
+	}
+	msg.Messages[user.JID] = &decrypted
+	delete(msg.Errors, user.JID)
+}